@@ -0,0 +1,278 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// addresses module for goimapsync, it extracts address book of
+// correspondents from local maildir: senders of received mails and
+// recipients of mails of sent folders (folders with "sent" in their names),
+// the latter ones are counted separately and rank first, i.e. people we
+// write to precede ones who only write to us. The address book is printed
+// in mutt alias, abook or CSV format.
+//
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Correspondent represents entry of address book
+type Correspondent struct {
+	Address   string    // email address in lower case
+	Name      string    // display name of the latest mail
+	FirstSeen time.Time // date of the first mail
+	LastSeen  time.Time // date of the latest mail
+	Sent      int       // number of mails sent to the address
+	Received  int       // number of mails received from the address
+}
+
+// addressParser decodes encoded words of display names in any charset
+var addressParser = &mail.AddressParser{WordDecoder: headerDecoder}
+
+// aliasPattern matches characters which are not allowed in mutt alias names
+var aliasPattern = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// helper function to check if given local folder keeps sent mails
+func isSentFolder(dir string) bool {
+	return strings.Contains(strings.ToLower(filepath.Base(dir)), "sent")
+}
+
+// helper function to parse list of addresses of given header value, the
+// raw 8-bit display names are decoded by decodeHeader
+func parseAddresses(value string) []*mail.Address {
+	if value == "" {
+		return nil
+	}
+	addrs, err := addressParser.ParseList(value)
+	if err != nil {
+		addrs, err = mail.ParseAddressList(decodeHeader(value))
+		if err != nil {
+			return nil
+		}
+	}
+	return addrs
+}
+
+// helper function to return local maildir folders to extract addresses
+// from, i.e. directories with cur area, limited by given IMAP server and
+// folder if they are set
+func addressFolders(imapName, folder string) ([]string, error) {
+	var out []string
+	dirs := conversationFolders(imapName, folder)
+	prefix := ""
+	if imapName != "" {
+		prefix = localPath(imapName, "", "")
+	}
+	err := filepath.Walk(Config.Maildir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		// skip backup snapshots, archive mode sidecars and attic of
+		// vanished folders
+		if info.Name() == ".snapshots" || info.Name() == sidecarDir || path == filepath.Join(Config.Maildir, atticDir) {
+			return filepath.SkipDir
+		}
+		if info.Name() != "cur" {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		switch {
+		case folder != "" && !dirs[dir]:
+		case folder == "" && prefix != "" && !strings.HasPrefix(dir+"/", prefix):
+		default:
+			out = append(out, dir)
+		}
+		return filepath.SkipDir
+	})
+	sort.Strings(out)
+	return out, err
+}
+
+// Addresses extracts correspondents of local maildir messages received
+// since and before given times (if they are set), own addresses of the
+// config are skipped
+func Addresses(imapName, folder string, since, before time.Time) ([]Correspondent, error) {
+	defer timing("Addresses", time.Now())
+	defer profiler("Addresses")()
+	var out []Correspondent
+	dirs, err := addressFolders(imapName, folder)
+	if err != nil {
+		return out, err
+	}
+	own := make(map[string]bool)
+	for _, s := range Config.Servers {
+		own[strings.ToLower(s.Username)] = true
+	}
+	own[strings.ToLower(Config.SmtpServer.From)] = true
+
+	cmap := make(map[string]*Correspondent)
+	// the same mail may be kept in several folders, count it only once
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		sent := isSentFolder(dir)
+		for _, area := range []string{"cur", "new"} {
+			files, err := filepath.Glob(filepath.Join(dir, area, "*"))
+			if err != nil {
+				return out, err
+			}
+			for _, fname := range files {
+				header, err := readMailHeader(fname)
+				if err != nil {
+					log.Printf("unable to read %s, error: %v\n", fname, err)
+					continue
+				}
+				key := fmt.Sprintf("%v:%s", sent, header.Get("Message-Id"))
+				if header.Get("Message-Id") != "" && seen[key] {
+					continue
+				}
+				seen[key] = true
+				date, err := header.Date()
+				if err != nil {
+					date = messageDate(fname, nil)
+				}
+				if date.Before(since) || (!before.IsZero() && !date.Before(before)) {
+					continue
+				}
+				var addrs []*mail.Address
+				if sent {
+					for _, h := range []string{"To", "Cc", "Bcc"} {
+						addrs = append(addrs, parseAddresses(header.Get(h))...)
+					}
+				} else {
+					addrs = parseAddresses(header.Get("From"))
+				}
+				for _, a := range addrs {
+					addr := strings.ToLower(a.Address)
+					if addr == "" || own[addr] {
+						continue
+					}
+					c, ok := cmap[addr]
+					if !ok {
+						c = &Correspondent{Address: addr, FirstSeen: date, LastSeen: date}
+						cmap[addr] = c
+					}
+					if date.Before(c.FirstSeen) {
+						c.FirstSeen = date
+					}
+					if !date.Before(c.LastSeen) {
+						c.LastSeen = date
+						if a.Name != "" {
+							c.Name = a.Name
+						}
+					} else if c.Name == "" {
+						c.Name = a.Name
+					}
+					if sent {
+						c.Sent += 1
+					} else {
+						c.Received += 1
+					}
+				}
+			}
+		}
+	}
+	for _, c := range cmap {
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Sent != out[j].Sent {
+			return out[i].Sent > out[j].Sent
+		}
+		if out[i].Received != out[j].Received {
+			return out[i].Received > out[j].Received
+		}
+		return out[i].Address < out[j].Address
+	})
+	return out, nil
+}
+
+// helper function to read header of given mail file
+func readMailHeader(fname string) (mail.Header, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	msg, err := mail.ReadMessage(file)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Header, nil
+}
+
+// helper function to make unique mutt alias names of given correspondents
+func aliasNames(cs []Correspondent) []string {
+	var out []string
+	names := make(map[string]bool)
+	for _, c := range cs {
+		name := c.Address
+		if idx := strings.Index(name, "@"); idx > 0 {
+			name = name[:idx]
+		}
+		name = strings.Trim(aliasPattern.ReplaceAllString(name, "_"), "_")
+		if name == "" {
+			name = "alias"
+		}
+		alias := name
+		for i := 2; names[alias]; i++ {
+			alias = fmt.Sprintf("%s%d", name, i)
+		}
+		names[alias] = true
+		out = append(out, alias)
+	}
+	return out
+}
+
+// helper function to format address of mutt alias, the display name is
+// kept in UTF-8 and quoted if it has special characters
+func aliasAddress(c Correspondent) string {
+	if c.Name == "" {
+		return fmt.Sprintf("<%s>", c.Address)
+	}
+	name := c.Name
+	if strings.ContainsAny(name, `,;:"()<>@[]\`) {
+		name = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+	}
+	return fmt.Sprintf("%s <%s>", name, c.Address)
+}
+
+// helper function to print correspondents in given format: alias (mutt
+// aliases), abook (abook addressbook file) or csv
+func printAddresses(w io.Writer, cs []Correspondent, format string) error {
+	switch format {
+	case "", "alias":
+		for i, alias := range aliasNames(cs) {
+			fmt.Fprintf(w, "alias %s %s\n", alias, aliasAddress(cs[i]))
+		}
+	case "abook":
+		fmt.Fprintf(w, "[format]\nprogram=abook\nversion=0.6.1\n")
+		for i, c := range cs {
+			name := c.Name
+			if name == "" {
+				name = c.Address
+			}
+			fmt.Fprintf(w, "\n[%d]\nname=%s\nemail=%s\n", i, name, c.Address)
+		}
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"address", "name", "first_seen", "last_seen", "sent", "received"})
+		for _, c := range cs {
+			cw.Write([]string{c.Address, c.Name, c.FirstSeen.UTC().Format(time.RFC3339), c.LastSeen.UTC().Format(time.RFC3339), fmt.Sprintf("%d", c.Sent), fmt.Sprintf("%d", c.Received)})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unsupported format '%s', please use alias, abook or csv", format)
+	}
+	return nil
+}
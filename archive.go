@@ -0,0 +1,517 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// archive module for goimapsync, it creates consistent backup of local
+// maildir and DB as (compressed) tar archive with manifest of its files
+// and restores it
+//
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// names of DB and manifest entries in backup archive
+const (
+	archiveDB       = "db/goimapsync.db"
+	archiveManifest = "manifest.json"
+	archiveMaildir  = "maildir"
+)
+
+// BackupFile represents maildir file recorded in backup manifest
+type BackupFile struct {
+	Size     int64  `json:"size"`     // file size
+	ModTime  int64  `json:"mtime"`    // file modification time
+	Sha256   string `json:"sha256"`   // file checksum
+	Included bool   `json:"included"` // file is included in this archive
+}
+
+// BackupManifest represents manifest of backup archive
+type BackupManifest struct {
+	Created     time.Time             `json:"created"`     // time of the backup
+	Maildir     string                `json:"maildir"`     // maildir of the backup
+	Previous    string                `json:"previous"`    // previous manifest of incremental backup
+	DBSha256    string                `json:"dbSha256"`    // checksum of DB snapshot
+	Files       map[string]BackupFile `json:"files"`       // maildir files, keys are relative paths
+	Count       int                   `json:"count"`       // number of maildir files
+	Included    int                   `json:"included"`    // number of maildir files in the archive
+	Size        int64                 `json:"size"`        // total size of maildir files
+	Checksum    string                `json:"checksum"`    // checksum of all file checksums
+	Incremental bool                  `json:"incremental"` // incremental backup
+}
+
+// helper function to compute overall checksum of manifest files
+func (m *BackupManifest) checksum() string {
+	var keys []string
+	for k := range m.Files {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	h.Write([]byte(m.DBSha256))
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s %s\n", k, m.Files[k].Sha256)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// helper function to read backup manifest from given file
+func readManifest(fname string) (BackupManifest, error) {
+	var m BackupManifest
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// helper function to wrap archive writer with compression based on file
+// extension, i.e. .zst, .gz/.tgz or plain tar otherwise
+func compressWriter(fname string, w io.Writer) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(fname, ".zst"):
+		return zstd.NewWriter(w)
+	case strings.HasSuffix(fname, ".gz"), strings.HasSuffix(fname, ".tgz"):
+		return gzip.NewWriter(w), nil
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// helper function to wrap archive reader with decompression based on file
+// extension, i.e. .zst, .gz/.tgz or plain tar otherwise
+func decompressReader(fname string, r io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(fname, ".zst"):
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case strings.HasSuffix(fname, ".gz"), strings.HasSuffix(fname, ".tgz"):
+		return gzip.NewReader(r)
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// nopWriteCloser adds no-op Close to io.Writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close implements io.Closer interface
+func (nopWriteCloser) Close() error { return nil }
+
+// helper function to add given file to tar archive and return its checksum
+func tarFile(tw *tar.Writer, name, fname string, info os.FileInfo) (string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return "", err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(tw, io.TeeReader(file, h)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// helper function to snapshot given DB into file via VACUUM INTO, the
+// snapshot is transactionally consistent even if DB is in use
+func snapshotDB(db *sql.DB, fname string) error {
+	os.Remove(fname)
+	return withBusyRetry(func() error {
+		_, err := db.Exec("VACUUM INTO ?", fname)
+		return err
+	})
+}
+
+// helper function to check if given maildir file should not be archived
+func skipArchive(rel string) bool {
+	base := filepath.Base(rel)
+	return base == ".goimapsync.lock" || strings.HasPrefix(base, ".goimapsync.db")
+}
+
+// BackupMaildir writes consistent snapshot of DB and local maildir into
+// given archive, with previous manifest only new or changed files are
+// included into the archive
+func BackupMaildir(out, previous string) error {
+	defer timing("BackupMaildir", time.Now())
+	defer profiler("BackupMaildir")()
+	if out == "" {
+		return errors.New("backup operation requires output archive")
+	}
+	if err := acquireRunLock(); err != nil {
+		return err
+	}
+	defer releaseRunLock()
+
+	var prev BackupManifest
+	manifest := BackupManifest{Created: time.Now(), Maildir: Config.Maildir, Files: make(map[string]BackupFile)}
+	if previous != "" {
+		var err error
+		if prev, err = readManifest(previous); err != nil {
+			return fmt.Errorf("unable to read previous manifest %s: %w", previous, err)
+		}
+		manifest.Previous = previous
+		manifest.Incremental = true
+	}
+
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	cw, err := compressWriter(out, file)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+
+	// DB snapshot
+	tmp, err := ioutil.TempDir("", "goimapsync")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	dbFile := filepath.Join(tmp, "goimapsync.db")
+	if err := snapshotDB(mdb, dbFile); err != nil {
+		return fmt.Errorf("unable to snapshot DB: %w", err)
+	}
+	info, err := os.Stat(dbFile)
+	if err != nil {
+		return err
+	}
+	if manifest.DBSha256, err = tarFile(tw, archiveDB, dbFile, info); err != nil {
+		return err
+	}
+
+	// maildir files
+	err = filepath.Walk(Config.Maildir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(Config.Maildir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if skipArchive(rel) {
+			return nil
+		}
+		entry := BackupFile{Size: info.Size(), ModTime: info.ModTime().Unix()}
+		if p, ok := prev.Files[rel]; ok && p.Size == entry.Size && p.ModTime == entry.ModTime {
+			entry.Sha256 = p.Sha256
+		} else {
+			if entry.Sha256, err = tarFile(tw, archiveMaildir+"/"+rel, path, info); err != nil {
+				return err
+			}
+			entry.Included = true
+			manifest.Included += 1
+		}
+		manifest.Files[rel] = entry
+		manifest.Count += 1
+		manifest.Size += entry.Size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	manifest.Checksum = manifest.checksum()
+
+	// manifest is written into archive and next to it for incremental backups
+	data, err := json.MarshalIndent(manifest, "", "   ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: archiveManifest, Mode: 0600, Size: int64(len(data)), ModTime: manifest.Created}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(out+".manifest.json", data, 0600); err != nil {
+		return err
+	}
+	log.Printf("backup %s: %d file(s), %d included, %d bytes, checksum %s\n", out, manifest.Count, manifest.Included, manifest.Size, manifest.Checksum)
+	return nil
+}
+
+// helper function to check that all messages recorded in given DB have
+// their files in local maildir, it returns number of missing files
+func checkDBPaths(db *sql.DB) (int, error) {
+	res, err := db.Query("SELECT hid, path FROM messages")
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+	var missing int
+	for res.Next() {
+		var hid, path string
+		if err := res.Scan(&hid, &path); err != nil {
+			return missing, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			log.Printf("message %s has no file %s\n", hid, path)
+			missing += 1
+		}
+	}
+	return missing, nil
+}
+
+// helper function to check if given directory is empty or does not exist
+func isEmptyDir(dir string) bool {
+	entries, err := ioutil.ReadDir(dir)
+	return err != nil || len(entries) == 0
+}
+
+// helper function to write content of tar entry into given file and
+// return its checksum
+func untarFile(r io.Reader, fname string, hdr *tar.Header) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(fname), os.ModePerm); err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(fname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode).Perm())
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(file, io.TeeReader(r, h)); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	os.Chtimes(fname, hdr.ModTime, hdr.ModTime)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// RestoreMaildir restores local maildir and DB from given backup archive
+// into target directory, the non-empty target is overwritten only if force
+// is set. With merge option the archive is restored into live maildir and
+// messages already present there (by hash id) are skipped.
+func RestoreMaildir(in, target string, force, merge bool) error {
+	defer timing("RestoreMaildir", time.Now())
+	defer profiler("RestoreMaildir")()
+	if in == "" {
+		return errors.New("restore operation requires input archive")
+	}
+	if merge {
+		target = Config.Maildir
+		if err := acquireRunLock(); err != nil {
+			return err
+		}
+		defer releaseRunLock()
+	}
+	if target == "" {
+		return errors.New("restore operation requires target directory")
+	}
+	if strings.HasPrefix(target, "~/") {
+		target = filepath.Join(os.Getenv("HOME"), target[2:])
+	}
+	if !merge && !force && !isEmptyDir(target) {
+		return fmt.Errorf("target %s is not empty, use -force to overwrite it", target)
+	}
+
+	file, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dr, err := decompressReader(in, file)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	tmp, err := ioutil.TempDir("", "goimapsync")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	// with merge option we need hash ids of live maildir folders
+	local := make(map[string]map[string]bool)
+	present := func(dir, hid string) bool {
+		if _, ok := local[dir]; !ok {
+			local[dir] = make(map[string]bool)
+			for _, d := range []string{"cur", "new"} {
+				entries, _ := ioutil.ReadDir(filepath.Join(filepath.Dir(dir), d))
+				for _, e := range entries {
+					if arr := strings.Split(e.Name(), "."); len(arr) > 1 {
+						local[dir][arr[1]] = true
+					}
+				}
+			}
+		}
+		return local[dir][hid]
+	}
+
+	var manifest BackupManifest
+	var dbSha string
+	checksums := make(map[string]string)
+	var restored []string
+	var skipped int
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case hdr.Name == archiveManifest:
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return err
+			}
+		case hdr.Name == archiveDB:
+			if dbSha, err = untarFile(tr, filepath.Join(tmp, "goimapsync.db"), hdr); err != nil {
+				return err
+			}
+		case strings.HasPrefix(hdr.Name, archiveMaildir+"/"):
+			rel := strings.TrimPrefix(hdr.Name, archiveMaildir+"/")
+			if strings.Contains(rel, "..") {
+				return fmt.Errorf("invalid archive entry %s", hdr.Name)
+			}
+			fname := filepath.Join(target, filepath.FromSlash(rel))
+			if merge {
+				arr := strings.Split(filepath.Base(rel), ".")
+				if len(arr) > 1 && present(filepath.Dir(fname), arr[1]) {
+					skipped += 1
+					continue
+				}
+			}
+			sum, err := untarFile(tr, fname, hdr)
+			if err != nil {
+				return err
+			}
+			checksums[rel] = sum
+			restored = append(restored, rel)
+		}
+	}
+
+	// verify checksums of restored files
+	if manifest.Files == nil {
+		return errors.New("backup archive has no manifest")
+	}
+	if dbSha != manifest.DBSha256 {
+		return errors.New("DB checksum mismatch")
+	}
+	var corrupted, notIncluded int
+	for rel, sum := range checksums {
+		if entry, ok := manifest.Files[rel]; !ok || entry.Sha256 != sum {
+			log.Printf("checksum mismatch of %s\n", rel)
+			corrupted += 1
+		}
+	}
+	for _, entry := range manifest.Files {
+		if !entry.Included {
+			notIncluded += 1
+		}
+	}
+	if corrupted > 0 {
+		return fmt.Errorf("%d file(s) have checksum mismatch", corrupted)
+	}
+	if notIncluded > 0 {
+		log.Printf("%d file(s) are not included in incremental backup, please restore %s first\n", notIncluded, manifest.Previous)
+	}
+
+	// restore DB and rewrite paths of messages to new maildir root
+	dbFile := filepath.Join(tmp, "goimapsync.db")
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	oldRoot := strings.TrimSuffix(manifest.Maildir, "/")
+	newRoot := strings.TrimSuffix(target, "/")
+	if !merge {
+		stmt := "UPDATE messages SET path = ? || substr(path, ?) WHERE substr(path, 1, ?) = ?"
+		if _, err := db.Exec(stmt, newRoot, len(oldRoot)+1, len(oldRoot), oldRoot); err != nil {
+			return err
+		}
+		db.Close()
+		dbTarget := filepath.Join(target, ".goimapsync.db")
+		data, err := ioutil.ReadFile(dbFile)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(dbTarget, data, 0600); err != nil {
+			return err
+		}
+		rdb, err := sql.Open("sqlite3", dbTarget)
+		if err != nil {
+			return err
+		}
+		defer rdb.Close()
+		missing, err := checkDBPaths(rdb)
+		if err != nil {
+			return err
+		}
+		log.Printf("restored %d file(s) and DB %s into %s, %d message(s) without files\n", len(restored), dbTarget, target, missing)
+		return nil
+	}
+
+	// with merge option we record restored messages in live DB
+	for _, rel := range restored {
+		arr := strings.Split(filepath.Base(rel), ".")
+		if len(arr) < 2 {
+			continue
+		}
+		var mid, imapName string
+		err := db.QueryRow("SELECT mid, imap FROM messages WHERE hid=?", arr[1]).Scan(&mid, &imapName)
+		if err != nil {
+			continue
+		}
+		m := Message{HashId: arr[1], MessageId: mid, Imap: imapName, Path: filepath.Join(target, filepath.FromSlash(rel))}
+		if err := insertMessage(m); err != nil {
+			log.Printf("unable to insert %s into DB, error: %v\n", m.Path, err)
+		}
+	}
+	missing, err := checkDBPaths(mdb)
+	if err != nil {
+		return err
+	}
+	log.Printf("merged %d file(s) into %s, skipped %d existing one(s), %d message(s) without files\n", len(restored), target, skipped, missing)
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"archive/tar"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helper function to write messages with given message ids into local
+// maildir and DB
+func archiveTestMaildir(t *testing.T, mids ...string) []Message {
+	t.Helper()
+	if err := createLocalFolder("a", "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []Message
+	for _, mid := range mids {
+		m := Message{MessageId: mid, HashId: md5hash(mid), Imap: "a"}
+		fname := fmt.Sprintf("%d.%s.%s:2,S", time.Now().Unix(), m.HashId, hostname)
+		m.Path = filepath.Join(localPath("a", "INBOX", "cur"), fname)
+		if err := ioutil.WriteFile(m.Path, testMessage{MessageId: mid}.body(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := insertMessage(m); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// helper function to copy tar archive and replace content of its entries
+// by given function
+func rewriteArchive(t *testing.T, in, out string, replace func(name string, data []byte) []byte) {
+	t.Helper()
+	src, err := os.Open(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := os.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	tr := tar.NewReader(src)
+	tw := tar.NewWriter(dst)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = replace(hdr.Name, data)
+		hdr.Size = int64(len(data))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	for _, name := range []string{"backup.tar", "backup.tar.gz", "backup.tar.zst"} {
+		t.Run(name, func(t *testing.T) {
+			setupTest(t)
+			msgs := archiveTestMaildir(t, "<archive-1@localhost>", "<archive-2@localhost>")
+			out := filepath.Join(t.TempDir(), name)
+			if err := BackupMaildir(out, ""); err != nil {
+				t.Fatal(err)
+			}
+			manifest, err := readManifest(out + ".manifest.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest.Count != len(msgs) || manifest.Included != len(msgs) || manifest.Incremental {
+				t.Errorf("manifest has %d file(s), %d included, incremental %v, expected %d full backup", manifest.Count, manifest.Included, manifest.Incremental, len(msgs))
+			}
+			target := filepath.Join(t.TempDir(), "restored")
+			if err := RestoreMaildir(out, target, false, false); err != nil {
+				t.Fatal(err)
+			}
+			// paths of restored DB point to files of new maildir root
+			db, err := sql.Open("sqlite3", filepath.Join(target, ".goimapsync.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for _, m := range msgs {
+				var path string
+				if err := db.QueryRow("SELECT path FROM messages WHERE hid=?", m.HashId).Scan(&path); err != nil {
+					t.Fatal(err)
+				}
+				rel, _ := filepath.Rel(Config.Maildir, m.Path)
+				if expect := filepath.Join(target, rel); path != expect {
+					t.Errorf("restored message %s has path %s, expected %s", m.MessageId, path, expect)
+				}
+				data, err := ioutil.ReadFile(path)
+				if err != nil || string(data) != string(testMessage{MessageId: m.MessageId}.body()) {
+					t.Errorf("restored message %s has content '%s', error: %v", m.MessageId, data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		nonEmpty bool
+		force    bool
+		fail     bool
+	}{
+		{name: "empty target"},
+		{name: "non-empty target", nonEmpty: true, fail: true},
+		{name: "forced non-empty target", nonEmpty: true, force: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			archiveTestMaildir(t, "<target@localhost>")
+			out := filepath.Join(t.TempDir(), "backup.tar")
+			if err := BackupMaildir(out, ""); err != nil {
+				t.Fatal(err)
+			}
+			target := t.TempDir()
+			keep := filepath.Join(target, "keep")
+			if tt.nonEmpty {
+				if err := ioutil.WriteFile(keep, []byte("keep"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := RestoreMaildir(out, target, tt.force, false)
+			if tt.fail {
+				if err == nil || !strings.Contains(err.Error(), "use -force to overwrite it") {
+					t.Errorf("restore into non-empty target has error: %v", err)
+				}
+				if _, err := os.Stat(filepath.Join(target, ".goimapsync.db")); !os.IsNotExist(err) {
+					t.Errorf("DB is restored into non-empty target, error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(target, ".goimapsync.db")); err != nil {
+				t.Errorf("DB is not restored: %v", err)
+			}
+		})
+	}
+}
+
+func TestRestoreChecksum(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string // prefix of corrupted archive entry
+		fail  string
+	}{
+		{name: "intact archive"},
+		{name: "corrupted mail file", entry: archiveMaildir + "/", fail: "1 file(s) have checksum mismatch"},
+		{name: "corrupted DB", entry: archiveDB, fail: "DB checksum mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			archiveTestMaildir(t, "<checksum@localhost>")
+			dir := t.TempDir()
+			out := filepath.Join(dir, "backup.tar")
+			if err := BackupMaildir(out, ""); err != nil {
+				t.Fatal(err)
+			}
+			corrupted := filepath.Join(dir, "corrupted.tar")
+			rewriteArchive(t, out, corrupted, func(name string, data []byte) []byte {
+				if tt.entry != "" && strings.HasPrefix(name, tt.entry) {
+					return append(data, '\n')
+				}
+				return data
+			})
+			err := RestoreMaildir(corrupted, filepath.Join(dir, "restored"), false, false)
+			if tt.fail == "" && err != nil {
+				t.Errorf("restore of intact archive fails: %v", err)
+			}
+			if tt.fail != "" && (err == nil || !strings.Contains(err.Error(), tt.fail)) {
+				t.Errorf("restore of corrupted archive has error %v, expected '%s'", err, tt.fail)
+			}
+		})
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	setupTest(t)
+	msgs := archiveTestMaildir(t, "<full-1@localhost>", "<full-2@localhost>")
+	dir := t.TempDir()
+	full := filepath.Join(dir, "full.tar")
+	if err := BackupMaildir(full, ""); err != nil {
+		t.Fatal(err)
+	}
+	// new message and changed file are included into incremental archive
+	msgs = append(msgs, archiveTestMaildir(t, "<incremental@localhost>")...)
+	changed := msgs[0].Path
+	if err := ioutil.WriteFile(changed, []byte("changed content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(changed, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	incr := filepath.Join(dir, "incremental.tar")
+	if err := BackupMaildir(incr, full+".manifest.json"); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := readManifest(incr + ".manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.Incremental || manifest.Previous != full+".manifest.json" {
+		t.Errorf("manifest is incremental %v with previous '%s'", manifest.Incremental, manifest.Previous)
+	}
+	if manifest.Count != len(msgs) || manifest.Included != 2 {
+		t.Errorf("incremental manifest has %d file(s), %d included, expected %d and 2", manifest.Count, manifest.Included, len(msgs))
+	}
+	for _, m := range msgs {
+		rel, _ := filepath.Rel(Config.Maildir, m.Path)
+		entry, ok := manifest.Files[filepath.ToSlash(rel)]
+		if expect := m.Path != msgs[1].Path; !ok || entry.Included != expect {
+			t.Errorf("file %s is included %v, expected %v", rel, entry.Included, expect)
+		}
+	}
+	// incremental archive is restored with files of its own
+	target := filepath.Join(dir, "restored")
+	if err := RestoreMaildir(incr, target, false, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range msgs {
+		rel, _ := filepath.Rel(Config.Maildir, m.Path)
+		_, err := os.Stat(filepath.Join(target, rel))
+		if expect := m.Path != msgs[1].Path; (err == nil) != expect {
+			t.Errorf("file %s is restored %v, expected %v", rel, err == nil, expect)
+		}
+	}
+}
+
+func TestRestoreMerge(t *testing.T) {
+	setupTest(t)
+	msgs := archiveTestMaildir(t, "<merge-1@localhost>", "<merge-2@localhost>")
+	out := filepath.Join(t.TempDir(), "backup.tar")
+	if err := BackupMaildir(out, ""); err != nil {
+		t.Fatal(err)
+	}
+	// live maildir has changed copy of the first message and lost the second
+	local := []byte("local copy")
+	if err := ioutil.WriteFile(msgs[0].Path, local, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(msgs[1].Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteMessage(msgs[1].HashId); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreMaildir(out, "", false, true); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(msgs[0].Path); err != nil || string(data) != string(local) {
+		t.Errorf("present message is overwritten by '%s', error: %v", data, err)
+	}
+	if _, err := os.Stat(msgs[1].Path); err != nil {
+		t.Errorf("lost message is not restored: %v", err)
+	}
+	if m, err := findMessage(msgs[1].HashId); err != nil || m.Path != msgs[1].Path {
+		t.Errorf("lost message is recorded as %+v in DB, error: %v", m, err)
+	}
+	if files := readMaildir("a", "INBOX"); len(files) != len(msgs) {
+		t.Errorf("merged maildir has %d file(s), expected %d", len(files), len(msgs))
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// backup module for goimapsync, it provides append-only fetch of IMAP
+// folders: new messages are written to local maildir, while local copies
+// of messages changed or removed on IMAP server are never touched
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// ManifestEntry represents message seen by backup run
+type ManifestEntry struct {
+	Imap   string `json:"imap"`   // name of imap server
+	Folder string `json:"folder"` // name of imap folder
+	Uid    uint32 `json:"uid"`    // message UID
+	Path   string `json:"path"`   // path of local copy of the message
+}
+
+// Backup fetches all folders of given IMAP server in append-only mode and
+// records UIDs present on the server, if manifest is set it writes JSON
+// listing of hid to local path of messages seen by this run into
+// Config.Maildir/.snapshots area
+func Backup(c *client.Client, imapName string, manifest bool) error {
+	defer timing("Backup", time.Now())
+	defer profiler("Backup")()
+
+	tstamp := time.Now().Unix()
+	entries := make(map[string]ManifestEntry)
+	// folders are fetched in parallel over connections of server pool
+	pool := connPool(imapName, c)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, folder := range imapFolders[imapName] {
+		if interrupted() {
+			break
+		}
+		conn, err := pool.Get()
+		if err != nil {
+			log.Printf("unable to backup '%s' on '%s', error: %v\n", folder, imapName, err)
+			continue
+		}
+		wg.Add(1)
+		go func(c *client.Client, folder string) {
+			defer wg.Done()
+			defer pool.Put(c)
+			log.Printf("### backup '%s' on %s\n", folder, imapName)
+			msgs, err := readImap(c, imapName, folder, false, FlagFilter{})
+			if err != nil {
+				log.Printf("unable to backup '%s' on '%s', error: %v\n", folder, imapName, err)
+				return
+			}
+			if err := recordPresence(tstamp, imapName, folder, msgs); err != nil {
+				log.Printf("unable to record presence of '%s' on '%s', error: %v\n", folder, imapName, err)
+			}
+			if !manifest {
+				return
+			}
+			mdict := readMaildir(imapName, folder)
+			mutex.Lock()
+			for _, m := range msgs {
+				entries[m.HashId] = ManifestEntry{Imap: imapName, Folder: folder, Uid: m.Uid, Path: mdict[m.HashId]}
+			}
+			mutex.Unlock()
+		}(conn, folder)
+	}
+	wg.Wait()
+	setOperation(imapName, "idle", "")
+	if !manifest {
+		return nil
+	}
+	sdir := filepath.Join(Config.Maildir, ".snapshots")
+	if err := os.MkdirAll(sdir, os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(entries, "", "   ")
+	if err != nil {
+		return err
+	}
+	fname := filepath.Join(sdir, fmt.Sprintf("%s-%d.json", imapName, tstamp))
+	log.Printf("write backup manifest %s\n", fname)
+	return ioutil.WriteFile(fname, data, 0600)
+}
@@ -0,0 +1,100 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// cat module for goimapsync, it writes raw RFC822 message to stdout
+//
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Cat writes raw content of given message to stdout, it prefers local copy
+// of the message and falls back to fetching it from IMAP server(s)
+func Cat(match string) error {
+	if match == "" {
+		return errors.New("Cat operation requires message id")
+	}
+	defer timing("Cat", time.Now())
+	defer profiler("Cat")()
+
+	// check if given match is existing file, if so we'll
+	// extract from it MatchedId
+	if _, err := os.Stat(match); err == nil {
+		match = getMessageId(match)
+	}
+
+	// look-up local copy of the message
+	entry, err := findMessageByMid(match)
+	if err == nil && entry.Path != "" {
+		if file, err := os.Open(entry.Path); err == nil {
+			defer file.Close()
+			_, err = io.Copy(os.Stdout, file)
+			return err
+		}
+		if Config.Verbose > 0 {
+			log.Printf("unable to open %s, fetch message from IMAP server(s)", entry.Path)
+		}
+	}
+
+	// fetch message from IMAP server(s)
+	cmap := connect()
+	defer logout(cmap)
+	for name, c := range cmap {
+		found, err := catImap(c, name, match, os.Stdout)
+		if err != nil {
+			log.Printf("unable to fetch '%s' from '%s', error: %v\n", match, name, err)
+			continue
+		}
+		if found {
+			return nil
+		}
+	}
+	return fmt.Errorf("message '%s' is not found", match)
+}
+
+// helper function to write raw content of given message from IMAP server
+func catImap(c *client.Client, imapName, mid string, w io.Writer) (bool, error) {
+	// use peek section to not mark the message as seen
+	section := &imap.BodySectionName{Peek: true}
+	return fetchSection(c, imapName, mid, section, w)
+}
+
+// helper function to write given body section of the message from IMAP server
+func fetchSection(c *client.Client, imapName, mid string, section *imap.BodySectionName, w io.Writer) (bool, error) {
+	if _, err := c.Select(imapFolder(imapName, "inbox"), true); err != nil {
+		return false, err
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", mid)
+	uids, err := c.UidSearch(criteria)
+	if err != nil || len(uids) == 0 {
+		return false, err
+	}
+	items := []imap.FetchItem{section.FetchItem(), imap.FetchUid}
+	messages := make(chan *imap.Message, 1)
+	done := fetchMessages(c, uidSet(uids[:1]), items, messages, true)
+	found := false
+	for msg := range messages {
+		if msg == nil || found {
+			continue
+		}
+		if r := msg.GetBody(section); r != nil {
+			if _, err := io.Copy(w, r); err != nil {
+				log.Println("unable to write message", err)
+			}
+			found = true
+		}
+	}
+	if err := <-done; err != nil {
+		return found, err
+	}
+	return found, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCatImap(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	m := testMessage{MessageId: "<cat-1@localhost>", Subject: "Message to cat"}
+	ts.add(t, "INBOX", m)
+	c := ts.connect(t)
+	tests := []struct {
+		mid   string
+		found bool
+	}{
+		{m.MessageId, true},
+		{"<cat-unknown@localhost>", false},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		found, err := catImap(c, testServerName, tt.mid, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != tt.found {
+			t.Errorf("%s: found %v, expected %v", tt.mid, found, tt.found)
+		}
+		if tt.found && !bytes.Contains(buf.Bytes(), []byte("Body of "+tt.mid)) {
+			t.Errorf("%s: written content %q", tt.mid, buf.String())
+		}
+		if !tt.found && buf.Len() > 0 {
+			t.Errorf("%s: unknown message wrote %q", tt.mid, buf.String())
+		}
+	}
+	// peek does not mark the message as seen
+	if flags := ts.flags(t, "INBOX")[m.MessageId]; len(flags) != 0 {
+		t.Errorf("cat changed flags of the message to %v", flags)
+	}
+}
+
+func TestCatLocal(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	m := testMessage{MessageId: "<cat-local@localhost>", Subject: "Local message to cat"}
+	ts.add(t, "INBOX", m)
+	c := ts.connect(t)
+	if _, err := Fetch(c, testServerName, "INBOX", false, FlagFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := findMessage(md5hash(m.MessageId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect, err := ioutil.ReadFile(entry.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// capture stdout where Cat writes local copy of the message
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = out
+	err = Cat(m.MessageId)
+	os.Stdout = stdout
+	out.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expect) {
+		t.Errorf("Cat wrote %q instead of local copy %q", data, expect)
+	}
+	if err := Cat(""); err == nil {
+		t.Error("Cat without message id succeeded")
+	}
+}
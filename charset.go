@@ -0,0 +1,164 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// charset module for goimapsync, it extracts text bodies of messages
+// and transcodes them and header values from their charset to UTF-8,
+// the transcoding is used only for metadata kept in DB while local mail
+// files always keep their original bytes
+//
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Part represents MIME part of the message, i.e. its header and body
+type Part struct {
+	Header textproto.MIMEHeader // part header
+	Body   io.Reader            // part body
+}
+
+// helper function to decode body of given MIME part into UTF-8 string,
+// the part charset is taken from its Content-Type header and falls back
+// to Config.DefaultCharset
+func decodeBody(part Part) (string, error) {
+	var r io.Reader = part.Body
+	switch strings.ToLower(part.Header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	charset := Config.DefaultCharset
+	if _, params, err := mime.ParseMediaType(part.Header.Get("Content-Type")); err == nil {
+		if v, ok := params["charset"]; ok {
+			charset = v
+		}
+	}
+	if charset != "" && !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "us-ascii") {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return "", fmt.Errorf("unsupported charset '%s'", charset)
+		}
+		r = enc.NewDecoder().Reader(r)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// helper function to extract text of given message, it walks over MIME
+// parts and joins decoded text/plain ones
+func messageText(msg *mail.Message) (string, error) {
+	part := Part{Header: textproto.MIMEHeader(msg.Header), Body: msg.Body}
+	var out []string
+	if err := walkParts(part, &out); err != nil {
+		return "", err
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+// helper function to walk over MIME parts and collect their text
+func walkParts(part Part, out *[]string) error {
+	ctype := part.Header.Get("Content-Type")
+	if ctype == "" {
+		ctype = "text/plain"
+	}
+	mtype, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(mtype, "multipart/") {
+		mr := multipart.NewReader(part.Body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			// read part fully since multipart reader invalidates it on next call
+			data, err := ioutil.ReadAll(p)
+			if err != nil {
+				return err
+			}
+			if err := walkParts(Part{Header: p.Header, Body: bytes.NewReader(data)}, out); err != nil {
+				return err
+			}
+		}
+	}
+	if mtype != "text/plain" {
+		return nil
+	}
+	text, err := decodeBody(part)
+	if err != nil {
+		return err
+	}
+	*out = append(*out, text)
+	return nil
+}
+
+// headerDecoder decodes RFC2047 encoded words of headers in any charset
+// known to htmlindex, e.g. KOI8-R or GB2312
+var headerDecoder = &mime.WordDecoder{CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset '%s'", charset)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}}
+
+// helper function to decode given header value into UTF-8 string, the
+// encoded words which can't be decoded are kept as is and raw 8-bit
+// bytes are transcoded from Config.DefaultCharset or ISO-8859-1
+func decodeHeader(value string) string {
+	out, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		// broken header, decode its words one by one
+		words := strings.Fields(value)
+		for i, w := range words {
+			if s, err := headerDecoder.Decode(w); err == nil {
+				words[i] = s
+			}
+		}
+		out = strings.Join(words, " ")
+	}
+	if utf8.ValidString(out) {
+		return out
+	}
+	charset := Config.DefaultCharset
+	if charset != "" && !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "us-ascii") {
+		if enc, err := htmlindex.Get(charset); err == nil {
+			if s, err := enc.NewDecoder().String(out); err == nil && utf8.ValidString(s) {
+				return s
+			}
+		}
+	}
+	// keep valid UTF-8 sequences, e.g. of decoded words, and treat other
+	// bytes as ISO-8859-1 ones
+	var buf strings.Builder
+	for len(out) > 0 {
+		r, size := utf8.DecodeRuneInString(out)
+		if r == utf8.RuneError && size == 1 {
+			r = rune(out[0])
+		}
+		buf.WriteRune(r)
+		out = out[size:]
+	}
+	return buf.String()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBody(t *testing.T) {
+	keepConfig(t)
+	tests := []struct {
+		name     string
+		ctype    string
+		encoding string
+		body     string
+		fallback string
+		expect   string
+		fail     bool
+	}{
+		{"utf-8", "text/plain; charset=utf-8", "", "Grüße", "", "Grüße", false},
+		{"windows-1252", "text/plain; charset=windows-1252", "", "\x93quoted\x94 \x80 caf\xe9", "", "“quoted” € café", false},
+		{"quoted-printable", "text/plain; charset=iso-8859-1", "quoted-printable", "caf=E9 cr=E8me", "", "café crème", false},
+		{"base64", "text/plain; charset=utf-8", "base64", "R3LDvMOfZQ==", "", "Grüße", false},
+		{"gb2312", "text/plain; charset=gb2312", "", "\xc4\xe3\xba\xc3", "", "你好", false},
+		{"no charset", "text/plain", "", "caf\xe9", "windows-1252", "café", false},
+		{"no content type", "", "", "caf\xe9", "iso-8859-1", "café", false},
+		{"unsupported", "text/plain; charset=x-unknown", "", "text", "", "", true},
+	}
+	for _, tt := range tests {
+		Config.DefaultCharset = tt.fallback
+		header := textproto.MIMEHeader{}
+		if tt.ctype != "" {
+			header.Set("Content-Type", tt.ctype)
+		}
+		if tt.encoding != "" {
+			header.Set("Content-Transfer-Encoding", tt.encoding)
+		}
+		text, err := decodeBody(Part{Header: header, Body: strings.NewReader(tt.body)})
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s: body with unsupported charset is decoded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if text != tt.expect {
+			t.Errorf("%s: decoded body %q, expected %q", tt.name, text, tt.expect)
+		}
+	}
+}
+
+func TestMessageText(t *testing.T) {
+	keepConfig(t)
+	Config.DefaultCharset = ""
+	raw := "Content-Type: multipart/alternative; boundary=b1\r\n\r\n" +
+		"--b1\r\nContent-Type: text/plain; charset=windows-1252\r\n\r\ncaf\xe9\r\n" +
+		"--b1\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<p>html</p>\r\n" +
+		"--b1\r\nContent-Type: multipart/mixed; boundary=b2\r\n\r\n" +
+		"--b2\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\nR3LDvMOfZQ==\r\n" +
+		"--b2--\r\n" +
+		"--b1--\r\n"
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := messageText(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := "café\nGrüße"; text != expect {
+		t.Errorf("message text %q, expected %q", text, expect)
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	keepConfig(t)
+	tests := []struct {
+		name     string
+		value    string
+		fallback string
+		expect   string
+	}{
+		{"ascii", "Hello world", "", "Hello world"},
+		{"utf-8 word", "=?utf-8?q?Gr=C3=BC=C3=9Fe?=", "", "Grüße"},
+		{"koi8-r word", "=?koi8-r?b?8NLJ18XU?=", "", "Привет"},
+		{"raw latin-1", "caf\xe9 cr\xe8me", "", "café crème"},
+		{"raw default charset", "\x93quoted\x94", "windows-1252", "“quoted”"},
+		{"raw utf-8", "Grüße", "windows-1252", "Grüße"},
+		{"word and raw bytes", "=?utf-8?q?Gr=C3=BC=C3=9Fe?= caf\xe9", "", "Grüße café"},
+		{"unknown charset word", "=?x-unknown?q?abc?= =?utf-8?q?caf=C3=A9?=", "", "=?x-unknown?q?abc?= café"},
+	}
+	for _, tt := range tests {
+		Config.DefaultCharset = tt.fallback
+		if got := decodeHeader(tt.value); got != tt.expect {
+			t.Errorf("%s: decodeHeader(%q)=%q, expected %q", tt.name, tt.value, got, tt.expect)
+		}
+	}
+}
+
+func TestThreadHeadersCharset(t *testing.T) {
+	keepConfig(t)
+	Config.DefaultCharset = ""
+	tests := []struct {
+		subject, from string
+		expectSubject string
+		expectFrom    string
+	}{
+		{"=?iso-8859-1?q?caf=E9?=", "Valentin <vk@example.org>", "café", "vk@example.org"},
+		{"caf\xe9", "Fran\xe7ois", "café", "François"},
+	}
+	for _, tt := range tests {
+		header := mail.Header{"Subject": {tt.subject}, "From": {tt.from}}
+		h := threadHeaders("hid", "<mid@localhost>", header)
+		if h.Subject != tt.expectSubject || h.From != tt.expectFrom {
+			t.Errorf("headers %q/%q are stored as %q/%q, expected %q/%q", tt.subject, tt.from, h.Subject, h.From, tt.expectSubject, tt.expectFrom)
+		}
+	}
+}
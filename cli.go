@@ -0,0 +1,182 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// cli module for goimapsync, it implements subcommand style command line
+//    goimapsync [global options] <command> [command options]
+// e.g. goimapsync -config config.json fetch -new -folder INBOX, where every
+// command accepts global options and its own ones only. The flags are
+// defined in main flag set and commands share their values, such that the
+// deprecated -op=<command> form keeps working.
+//
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// Command represents goimapsync subcommand
+type Command struct {
+	Name  string   // name of the command, i.e. its operation
+	Usage string   // description of the command
+	Flags []string // names of command options
+}
+
+// globalFlags lists options which apply to all commands and which may
+// precede command name
+var globalFlags = []string{"config", "set", "verbose", "dryRun", "server", "json", "db", "profiler", "safe", "events", "version", "format"}
+
+// cliCommands lists goimapsync commands, fetch command is shortcut for
+// fetch-all or fetch-new (with -new option) and move command accepts -to
+// option as alias of -folder
+var cliCommands = []Command{
+	{"sync", "to sync local maildir with IMAP server(s), use -index-only to defer download of message bodies", []string{"force-delete", "index-only"}},
+	{"daemon", "to periodically sync local maildir with IMAP server(s)", []string{"force-delete", "index-only"}},
+	{"fetch", "to fetch all messages of IMAP folder, use -new to fetch only new ones and -all-folders to mirror all folders", []string{"folder", "all-folders", "unseen", "with-flags", "without-flags"}},
+	{"fetch-new", "to get list of new messages from specified IMAP folder", []string{"folder", "all-folders", "unseen", "with-flags", "without-flags"}},
+	{"fetch-all", "to get list of all messages from specified IMAP folder", []string{"folder", "all-folders", "unseen", "with-flags", "without-flags"}},
+	{"fetch-bodies", "to fetch bodies of messages recorded by index-only sync, use -folder to limit it to given IMAP folder", []string{"folder"}},
+	{"fetch-query", "to fetch messages of specified IMAP folder matching -query, see remote-search", []string{"folder", "query"}},
+	{"move", "to move given message on IMAP server, e.g. send to Spam", []string{"mid", "folder", "uid", "folder-from", "force", "create-folder"}},
+	{"flag", "to add or remove flags of given message on IMAP server and in local maildir", []string{"mid", "add", "remove", "uid", "folder-from", "force"}},
+	{"cat", "to write raw content of given message to stdout", []string{"mid"}},
+	{"preview", "to write first -previewSize bytes of given message to stdout", []string{"mid", "previewSize"}},
+	{"list", "to list messages (envelopes only) of specified IMAP folder, use -ignored to list messages skipped by ignore rules", []string{"folder", "ignored"}},
+	{"remote-search", "to search messages of specified IMAP folder on server side by -query, use -uids-only to print UIDs for -uid option", []string{"folder", "query", "uids-only"}},
+	{"threads", "to show server-side thread structure of specified IMAP folder", []string{"folder", "threadAlgorithm"}},
+	{"addresses", "to list correspondents of local maildir in -format alias (mutt), abook or csv, recipients of sent folders rank first, use -folder, -since and -before", []string{"folder", "since", "before", "format"}},
+	{"list-threads", "to list conversations of local -folder messages, use -since, e.g. 7d, and -thread=<root message id> to list messages of conversation", []string{"folder", "since", "thread"}},
+	{"discover", "to discover IMAP and SMTP settings of -email address, use -write to append them to config", []string{"email", "write"}},
+	{"pin", "to show TLS certificate fingerprints of -server IMAP server, use -save to write it into config", []string{"save"}},
+	{"print-config", "to print merged configuration with redacted secrets", nil},
+	{"doctor", "to check maildir, DB (its effective location and schema) and logins to IMAP servers", nil},
+	{"refresh-folders", "to re-list folders of IMAP servers and refresh folders cache", nil},
+	{"migrate-db", "to migrate DB schema to latest version, use -dryRun to see pending migrations", nil},
+	{"stats", "to show statistics of IMAP servers and the last run recorded in DB, use -format text, json or prometheus", []string{"format"}},
+	{"history", "to show last runs of goimapsync, use -limit to specify number of runs", []string{"limit"}},
+	{"db-check", "to check consistency of DB records and local mail files after recovery of interrupted writes", nil},
+	{"vacuum", "to reclaim space of deleted rows in DB file", nil},
+	{"repair-flags", "to rename local mail files whose flags are not in canonical maildir form, use -dryRun to see renames", nil},
+	{"export-eml", "to export local maildir -folder messages as .eml files into -out location, use -since, -before and -zip", []string{"folder", "out", "since", "before", "zip"}},
+	{"verify-local", "to verify checksums of local mail files, use -full and -repair", []string{"full", "repair"}},
+	{"backup", "to backup local maildir and DB into -out archive, e.g. backup.tar.zst, use -incremental", []string{"out", "incremental"}},
+	{"restore", "to restore -in backup archive into -target directory, use -force or -merge", []string{"in", "target", "force", "merge"}},
+	{"backup-fetch", "to fetch all IMAP folders in append-only mode, use -manifest to write JSON manifest", []string{"manifest"}},
+	{"migrate", "to copy -folder messages from -from IMAP server to -to IMAP server", []string{"folder", "from", "to"}},
+	{"import-maildir", "to upload local maildir (-source) into IMAP server (-server)", []string{"source"}},
+}
+
+// setFlags keeps names of options given on command line
+var setFlags = make(map[string]bool)
+
+// helper function to check if given option is set on command line, e.g.
+// to distinguish default value of the option from explicit one
+func isFlagSet(name string) bool {
+	return setFlags[name]
+}
+
+// helper function to find command with given name
+func findCommand(name string) (Command, bool) {
+	for _, cmd := range cliCommands {
+		if cmd.Name == name {
+			return cmd, true
+		}
+	}
+	return Command{}, false
+}
+
+// helper function to add given options of main flag set to another one,
+// options which the flag set already has are skipped
+func copyFlags(fs *flag.FlagSet, names []string) {
+	for _, name := range names {
+		if fs.Lookup(name) != nil {
+			continue
+		}
+		if f := flag.Lookup(name); f != nil {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	}
+}
+
+// helper function to print list of commands
+func printCommands() {
+	fmt.Println("Commands:")
+	for _, cmd := range cliCommands {
+		fmt.Printf("   %-15s %s\n", cmd.Name, cmd.Usage)
+	}
+}
+
+// helper function to print usage of given command and its flag set
+func commandUsage(cmd Command, fs *flag.FlagSet) {
+	fmt.Printf("Usage: goimapsync [global options] %s [options]\n", cmd.Name)
+	fmt.Printf("   %s %s\n", cmd.Name, cmd.Usage)
+	fmt.Println("Options:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+}
+
+// helper function to parse subcommand style command line, e.g.
+// goimapsync -config config.json fetch -new -folder INBOX, it returns
+// operation of the command and false if command line has no command, i.e.
+// it uses deprecated -op option
+func parseCommand(args []string) (string, bool) {
+	global := flag.NewFlagSet("goimapsync", flag.ContinueOnError)
+	global.SetOutput(ioutil.Discard)
+	copyFlags(global, globalFlags)
+	if err := global.Parse(args); err != nil || global.NArg() == 0 {
+		return "", false
+	}
+	name := global.Arg(0)
+	if name == "help" {
+		if cmd, ok := findCommand(global.Arg(1)); ok {
+			fs := commandFlags(cmd, new(bool))
+			commandUsage(cmd, fs)
+		} else {
+			flag.Usage()
+		}
+		os.Exit(0)
+	}
+	cmd, ok := findCommand(name)
+	if !ok {
+		fmt.Printf("unknown command '%s'\n", name)
+		printCommands()
+		os.Exit(2)
+	}
+	var newOnly bool
+	fs := commandFlags(cmd, &newOnly)
+	fs.Parse(global.Args()[1:])
+	for _, s := range []*flag.FlagSet{global, fs} {
+		s.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	}
+	if fs.NArg() > 0 {
+		log.Fatalf("unexpected argument(s) of %s command: %s", cmd.Name, strings.Join(fs.Args(), " "))
+	}
+	if cmd.Name == "fetch" {
+		if newOnly {
+			return "fetch-new", true
+		}
+		return "fetch-all", true
+	}
+	return cmd.Name, true
+}
+
+// helper function to create flag set of given command, the global options
+// can follow command name as well
+func commandFlags(cmd Command, newOnly *bool) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.Name, flag.ExitOnError)
+	copyFlags(fs, globalFlags)
+	copyFlags(fs, cmd.Flags)
+	switch cmd.Name {
+	case "fetch":
+		fs.BoolVar(newOnly, "new", false, "fetch only new messages")
+	case "move":
+		if f := flag.Lookup("folder"); f != nil {
+			fs.Var(f.Value, "to", "target IMAP folder, alias of -folder")
+		}
+	}
+	fs.Usage = func() { commandUsage(cmd, fs) }
+	return fs
+}
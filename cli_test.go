@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helper function to define options of main flag set used by commands of
+// the test, the main function defines them in real run
+func cliTestFlags(t *testing.T) {
+	t.Helper()
+	if flag.Lookup("format") == nil {
+		flag.String("format", "", "output format")
+		flag.Int("verbose", 0, "verbose level")
+		flag.Bool("json", false, "json output")
+		flag.String("folder", "", "IMAP folder")
+	}
+	reset := func() {
+		for _, name := range []string{"format", "verbose", "json", "folder"} {
+			flag.Lookup(name).Value.Set(flag.Lookup(name).DefValue)
+		}
+		setFlags = make(map[string]bool)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		args   string
+		op     string
+		ok     bool
+		values map[string]string // values of options after parsing
+	}{
+		{"-format=json stats", "stats", true, map[string]string{"format": "json"}},
+		{"stats -format=prometheus", "stats", true, map[string]string{"format": "prometheus"}},
+		{"-format csv addresses -folder Sent", "addresses", true, map[string]string{"format": "csv", "folder": "Sent"}},
+		{"-verbose 2 -json fetch -new", "fetch-new", true, map[string]string{"verbose": "2", "json": "true"}},
+		{"fetch -folder Work -verbose 1", "fetch-all", true, map[string]string{"folder": "Work", "verbose": "1"}},
+		{"-format=json", "", false, nil},
+		{"-op=stats", "", false, nil},
+		{"", "", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			cliTestFlags(t)
+			op, ok := parseCommand(strings.Fields(tt.args))
+			if op != tt.op || ok != tt.ok {
+				t.Errorf("parseCommand(%q)=(%s, %v), expected (%s, %v)", tt.args, op, ok, tt.op, tt.ok)
+			}
+			for name, value := range tt.values {
+				if got := flag.Lookup(name).Value.String(); got != value || !isFlagSet(name) {
+					t.Errorf("option -%s is '%s' and set %v, expected '%s'", name, got, isFlagSet(name), value)
+				}
+			}
+		})
+	}
+}
+
+func TestInfo(t *testing.T) {
+	// date of version info is in year-month-day layout
+	out := info()
+	idx := strings.Index(out, "date=")
+	if idx < 0 {
+		t.Fatalf("version info '%s' has no date", out)
+	}
+	date, err := time.ParseInLocation("2006-01-02", out[idx+len("date="):], time.Local)
+	if now := time.Now(); err != nil || date.Year() != now.Year() || date.YearDay() != now.YearDay() {
+		t.Errorf("version info '%s' has date %v, expected %s, error: %v", out, date, now.Format("2006-01-02"), err)
+	}
+}
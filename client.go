@@ -9,20 +9,27 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/mail"
 	"net/smtp"
 	"os"
-	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -40,7 +47,7 @@ var gitVersion, gitTag string
 // Info function returns version string of the server
 func info() string {
 	goVersion := runtime.Version()
-	tstamp := time.Now().Format("2006-02-01")
+	tstamp := time.Now().Format("2006-01-02")
 	return fmt.Sprintf("gpm git=%s tag=%s go=%s date=%s", gitVersion, gitTag, goVersion, tstamp)
 }
 
@@ -48,6 +55,9 @@ func info() string {
 var imapFolders map[string][]string
 var hostname string
 
+// name of header which keeps source IMAP folder of local mails, see Config.FolderHeader
+const folderHeader = "X-GoImapSync-Folder"
+
 // Message structure holds all information about emails message
 type Message struct {
 	Path      string   // location of the message in local file dir
@@ -56,7 +66,10 @@ type Message struct {
 	Imap      string   // name of imap server it belongs to
 	Subject   string   // message subject
 	SeqNumber uint32   // message sequence number
+	Uid       uint32   // message UID
 	HashId    string   // message id md5 hash
+
+	InternalDate time.Time // internal date of the message on IMAP server, fetched in archive mode
 }
 
 // String function dumps Message info
@@ -73,11 +86,9 @@ type ServerClient struct {
 // helper function which extracts flags from given email file name
 func getFlags(fname string) []string {
 	// example of file name in our Inbox
-	// <tstamp.id.hostname:2,flags>
-	if strings.Contains(fname, ",") {
-		arr := strings.Split(fname, ",")
-		flags := arr[len(arr)-1]
-		return strings.Split(flags, "")
+	// <tstamp.id.hostname:2,flags>, mails of new area may have no flags part
+	if arr := strings.Split(fname, ":2,"); len(arr) > 1 && arr[len(arr)-1] != "" {
+		return strings.Split(arr[len(arr)-1], "")
 	}
 	return []string{}
 }
@@ -113,191 +124,370 @@ func connect() map[string]*client.Client {
 	defer close(ch)
 	for _, srv := range Config.Servers {
 		go func(s Server) {
-			var c *client.Client
-			var err error
-			if s.UseTls {
-				c, err = client.DialTLS(s.Uri, nil)
-			} else {
-				c, err = client.Dial(s.Uri)
-			}
+			c, err := dial(s)
 			if err != nil {
 				log.Fatal(err)
 			}
-			if err := c.Login(s.Username, s.Password); err != nil {
-				log.Fatal(err)
-			}
-			if Config.Verbose > 0 {
-				log.Println("Logged into", s.Uri)
-			}
 			ch <- ServerClient{Name: s.Name, Client: c}
 		}(srv)
 	}
 	for i := 0; i < len(Config.Servers); i++ {
 		s := <-ch
 		cmap[s.Name] = s.Client
+		registerClient(s.Name, s.Client)
 	}
 	return cmap
 }
 
 // helper function to logout from all IMAP clients
 func logout(cmap map[string]*client.Client) {
-	for _, c := range cmap {
-		c.Logout()
+	drainPools()
+	for name, c := range cmap {
+		currentClient(name, c).Logout()
+		releaseLogin(name)
+		setState(name, "logged out")
+	}
+}
+
+// size of channels of fetched messages, go-imap stops reading responses of
+// the server while the channel is full, i.e. the fetch is paced by the
+// consumer and fetched messages do not pile up in memory
+const fetchChannelSize = 16
+
+// number of mails written into local maildir at once, the fetch waits for
+// free writer and bodies of fetched messages are written promptly
+const mailWriters = 8
+
+// mailWriterSlots bounds number of concurrent writeMail calls
+var mailWriterSlots = make(chan struct{}, mailWriters)
+
+// helper function to fetch messages from IMAP server within fetch deadline,
+// it returns channel which will receive fetch error once messages channel
+// is drained by the caller, the caller should always drain the channel
+// since fetch goroutine blocks on full channel
+func fetchMessages(c *client.Client, seqset *imap.SeqSet, items []imap.FetchItem, messages chan *imap.Message, uid bool) chan error {
+	timeout := time.Duration(Config.FetchTimeout) * time.Second
+	if timeout == 0 {
+		timeout = 10 * time.Minute
+	}
+	// TODO: use goroutine until this issue will be solved
+	// https://github.com/emersion/go-imap/issues/382
+	done := make(chan error, 1)
+	go func() {
+		// the deadline of the whole fetch command closes the connection,
+		// the client itself is shared with the caller and is not modified
+		timer := time.AfterFunc(timeout, func() { c.Terminate() })
+		var err error
+		if uid {
+			err = c.UidFetch(seqset, items, messages)
+		} else {
+			err = c.Fetch(seqset, items, messages)
+		}
+		if !timer.Stop() && err != nil {
+			err = fmt.Errorf("fetch exceeded deadline of %v: %w", timeout, err)
+		}
+		done <- err
+	}()
+	return done
+}
+
+// FlagFilter represents flags which fetched messages should have or not have
+// and optional search query which they should match
+type FlagFilter struct {
+	With    []string             // flags which messages should have, e.g. \Flagged
+	Without []string             // flags which messages should not have, e.g. \Seen
+	Query   *imap.SearchCriteria // search criteria of the query, see parseQuery
+}
+
+// helper function to build search criteria of IMAP messages, the new
+// messages are always unseen ones while flag filter restricts search
+// to messages with or without given flags over the whole folder
+func searchCriteria(newMessages bool, filter FlagFilter) *imap.SearchCriteria {
+	criteria := imap.NewSearchCriteria()
+	if filter.Query != nil {
+		query := *filter.Query
+		query.WithFlags = append([]string{}, query.WithFlags...)
+		query.WithoutFlags = append([]string{}, query.WithoutFlags...)
+		criteria = &query
+	}
+	criteria.WithFlags = append(criteria.WithFlags, filter.With...)
+	criteria.WithoutFlags = append(criteria.WithoutFlags, filter.Without...)
+	if newMessages {
+		seen := false
+		for _, f := range criteria.WithoutFlags {
+			seen = seen || f == imap.SeenFlag
+		}
+		if !seen {
+			criteria.WithoutFlags = append(criteria.WithoutFlags, imap.SeenFlag)
+		}
 	}
+	return criteria
 }
 
 // helper function which takes a snapshot of remote IMAP servers
-// and return list of messages
-func readImap(c *client.Client, imapName, folder string, newMessages bool) []Message {
+// and return list of messages, with flag filter only matching messages
+// are read and the snapshot should not be used for merge
+func readImap(c *client.Client, imapName, folder string, newMessages bool, filter FlagFilter) ([]Message, error) {
+	msgs, err := readImapFolder(c, imapName, folder, newMessages, filter)
+	msgs = retryWrites(currentClient(imapName, c), imapName, folder, msgs)
+	fields := Event{"server": imapName, "folder": folder, "messages": len(msgs)}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	emitEvent("folder_done", fields)
+	return msgs, err
+}
+
+// helper function to read messages of given IMAP folder, see readImap
+func readImapFolder(c *client.Client, imapName, folder string, newMessages bool, filter FlagFilter) ([]Message, error) {
 	defer timing("readImap", time.Now())
 	defer profiler("readImap")()
 
-	if Config.Verbose > 1 {
+	if verboseLevel(imapName) > 1 {
 		log.Printf("call readImap name=%v folder=%v read new message %v", imapName, folder, newMessages)
 	}
+	setOperation(imapName, "fetch", folder)
+	RunSummary.Touch(imapName, folder)
 
-	// Select given imap folder
-	mbox, err := c.Select(folder, false)
+	// Select given imap folder and get UIDs of messages
+	var uids []uint32
+	var validity uint32
+	empty := false
+	c, err := withReconnect(c, imapName, "", func(c *client.Client) error {
+		mbox, err := c.Select(folder, false)
+		if err != nil {
+			return err
+		}
+		// removals of sync verify UIDs against UIDVALIDITY of this read
+		recordUidValidity(imapName, mbox.Name, mbox.UidValidity)
+		validity = mbox.UidValidity
+		// there is nothing to search in empty folder
+		empty = mbox.Messages == 0
+		uids = nil
+		if empty {
+			return nil
+		}
+		criteria := searchCriteria(newMessages, filter)
+		if verboseLevel(imapName) > 1 {
+			log.Println("IMAP search", criteria.Format())
+		}
+		uids, err = c.UidSearch(criteria)
+		return err
+	})
 	if err != nil {
 		log.Printf("Folder '%s' on '%s', error: %v\n", folder, imapName, err)
-		return []Message{}
-	}
-
-	// get messages
-	seqset := new(imap.SeqSet)
-	var nmsg uint32
+		return []Message{}, err
+	}
+	emitEvent("folder_start", Event{"server": imapName, "folder": folder, "total": len(uids)})
+	if empty {
+		// empty slice is a valid snapshot of the folder, e.g. Sync still
+		// merges local messages of empty remote folder
+		log.Printf("Folder '%s' on '%s' is empty\n", folder, imapName)
+		return []Message{}, nil
+	}
+	// messages recorded as ignored are neither fetched nor counted
+	uids = skipIgnored(imapName, folder, validity, uids)
+	nmsg := uint32(len(uids))
 	if newMessages {
-		// get only new messages
-		criteria := imap.NewSearchCriteria()
-		criteria.WithoutFlags = []string{imap.SeenFlag}
-		if Config.Verbose > 1 {
-			log.Println("IMAP", imap.SeenFlag)
-		}
-		ids, err := c.Search(criteria)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if len(ids) > 0 {
-			seqset.AddNum(ids...)
-			nmsg = uint32(len(ids))
-			log.Printf("Found %d new message(s) in folder '%s' on '%s'\n", nmsg, folder, imapName)
-		} else {
+		if nmsg == 0 {
 			log.Printf("No new messages in folder '%s' on '%s'\n", folder, imapName)
-			return []Message{}
+			return []Message{}, nil
 		}
-	} else {
-		// get all messages from mailbox
-		from := uint32(1)
-		to := mbox.Messages
-		seqset.AddRange(from, to)
-		nmsg = to
+		log.Printf("Found %d new message(s) in folder '%s' on '%s'\n", nmsg, folder, imapName)
+	} else if nmsg == 0 {
+		return []Message{}, nil
 	}
 	// section will be used only in writeContent
 	section := &imap.BodySectionName{}
-
-	messages := make(chan *imap.Message, nmsg)
-	items := []imap.FetchItem{section.FetchItem(), imap.FetchFlags, imap.FetchEnvelope}
-	if Config.Verbose > 1 {
+	items := []imap.FetchItem{section.FetchItem(), imap.FetchFlags, imap.FetchEnvelope, imap.FetchUid}
+	if Config.IndexOnly {
+		// bodies are fetched later by fetch-bodies operation
+		items = items[1:]
+	}
+	if Config.ArchiveMode {
+		items = append(items, imap.FetchInternalDate)
+	}
+	if verboseLevel(imapName) > 1 {
 		log.Println("IMAP", items)
 	}
-	// TODO: use goroutine until this issue will be solved
-	// https://github.com/emersion/go-imap/issues/382
-	done := make(chan error, 1)
-	go func() {
-		done <- c.Fetch(seqset, items, messages)
-	}()
-	//     err = c.Fetch(seqset, items, messages)
-	//     if err != nil {
-	//         log.Fatal(err)
-	//     }
 
-	seqNum := uint32(1)
+	// fetch messages in chunks of UIDs, if connection drops we'll resume
+	// from the chunk we did not complete
+	batch := Config.FetchBatchSize
+	if batch <= 0 {
+		batch = 500
+	}
 	var msgs []Message
 	var wg sync.WaitGroup
-	for msg := range messages {
-		var m Message
-		if msg == nil || msg.Envelope == nil {
-			continue
+	processed := make(map[uint32]bool)
+	// take snapshot of local maildir folder once, it is shared by all messages
+	mdict := readMaildir(imapName, folder)
+	// in pipelined mode bodies are fetched over second pooled connection
+	if Config.PipelinedFetch && !Config.IndexOnly {
+		pool := connPool(imapName, c)
+		if body := pool.TryGet(c); body != nil {
+			msgs, err := readImapPipelined(c, body, imapName, folder, uids, batch, section, newMessages, mdict, &wg)
+			pool.Put(body)
+			wg.Wait()
+			if err != nil {
+				log.Printf("unable to fetch folder '%s' on '%s', error: %v\n", folder, imapName, err)
+			}
+			return msgs, err
 		}
-		mid := msg.Envelope.MessageId
-		sub := msg.Envelope.Subject
-		hid := md5hash(mid)
-		flags := msg.Flags
-		m = Message{MessageId: mid, Flags: flags, Imap: imapName, Subject: sub, SeqNumber: seqNum, HashId: hid}
-		if mid == "" || hid == "" {
-			log.Printf("read empty mail %s %v out of %v from %s\n", m.String(), seqNum, nmsg, imapName)
-			continue
+	}
+	for start := 0; start < len(uids); start += batch {
+		if interrupted() {
+			log.Printf("fetch of folder '%s' on '%s' is interrupted\n", folder, imapName)
+			wg.Wait()
+			return msgs, errInterrupted
 		}
-		log.Printf("read %s %v out of %v from %s\n", m.String(), seqNum, nmsg, imapName)
-		r := msg.GetBody(section)
-		entry, e := findMessage(hid)
-		if Config.Verbose > 1 {
-			log.Println("hid", hid, "DB entry", entry.String(), e)
+		end := start + batch
+		if end > len(uids) {
+			end = len(uids)
 		}
-		if e == nil && entry.HashId == hid {
-			if Config.Verbose > 0 {
-				log.Println("Mail with hash", hid, "already exists")
-			}
-		} else {
-			if newMessages {
-				m.Flags = append(m.Flags, imap.RecentFlag)
-				if Config.Verbose > 1 {
-					log.Println("IMAP", imap.RecentFlag)
+		c, err = withReconnect(c, imapName, folder, func(c *client.Client) error {
+			// on retry after reconnect we resume with UIDs of the chunk
+			// which were not processed before connection dropped
+			var chunk []uint32
+			for _, uid := range uids[start:end] {
+				if !processed[uid] {
+					chunk = append(chunk, uid)
 				}
 			}
-			if !isMailWritten(m) {
-				wg.Add(1)
-				go writeMail(imapName, folder, m, r, &wg)
-			} else {
-				// check if mail is presented in our DB, if not we should insert its entry
-				msg, e := findMessage(m.HashId)
-				if e == nil && msg.HashId == "" {
-					m.Path = findPath(m.Imap, m.HashId)
-					insertMessage(m)
+			if len(chunk) == 0 {
+				return nil
+			}
+			messages := make(chan *imap.Message, fetchChannelSize)
+			done := fetchMessages(c, uidSet(chunk), items, messages, true)
+			// we always drain messages channel, otherwise go-imap will deadlock,
+			// and errors of individual messages are recorded in run summary
+			for msg := range messages {
+				if msg == nil || msg.Envelope == nil {
+					e := MessageError{Imap: imapName, Folder: folder, Error: errors.New("message without envelope")}
+					if msg != nil {
+						e.Uid = msg.Uid
+						processed[msg.Uid] = true
+					}
+					RunSummary.AddError(e)
+					continue
+				}
+				// interrupted fetch only drains remaining messages
+				if processed[msg.Uid] || interrupted() {
+					continue
+				}
+				processed[msg.Uid] = true
+				m, err := processMessage(imapName, folder, msg, section, msg.SeqNum, nmsg, newMessages, mdict, &wg)
+				if errors.Is(err, errIgnored) {
+					continue
 				}
+				if err != nil {
+					RunSummary.AddError(MessageError{Imap: imapName, Folder: folder, Uid: msg.Uid, MessageId: msg.Envelope.MessageId, Error: err})
+					continue
+				}
+				addProcessed(imapName, 1)
+				msgs = append(msgs, m)
 			}
+			return <-done
+		})
+		if err != nil {
+			// the fetch error means that we got only part of the folder
+			log.Printf("unable to fetch folder '%s' on '%s', error: %v\n", folder, imapName, err)
+			wg.Wait()
+			return msgs, err
 		}
-		msgs = append(msgs, m)
-		seqNum += 1
 	}
 	log.Println("read all messages, time to quit")
 	wg.Wait()
 	log.Println("quit readImap")
-	return msgs
+	return msgs, nil
 }
 
-// helper function to find message path in local maildir
-func findPath(imapName, hid string) string {
-	var mdict map[string]string
-	if Config.CommonInbox {
-		mdict = readMaildir("", "INBOX")
-	} else {
-		for k, v := range readMaildir(imapName, "INBOX") {
-			mdict[k] = v
+// errIgnored is returned by processMessage for messages matching ignore rules
+var errIgnored = errors.New("message is ignored")
+
+// helper function to process single IMAP message within readImap
+func processMessage(imapName, folder string, msg *imap.Message, section *imap.BodySectionName, seqNum, nmsg uint32, newMessages bool, mdict map[string]string, wg *sync.WaitGroup) (Message, error) {
+	mid := msg.Envelope.MessageId
+	sub := msg.Envelope.Subject
+	hid := md5hash(mid)
+	flags := msg.Flags
+	m := Message{MessageId: mid, Flags: flags, Imap: imapName, Subject: sub, SeqNumber: seqNum, Uid: msg.Uid, HashId: hid, InternalDate: msg.InternalDate}
+	if mid == "" || hid == "" {
+		log.Printf("read empty mail %s %v out of %v from %s\n", m.String(), seqNum, nmsg, imapName)
+		return m, errors.New("message without message id")
+	}
+	if rule := ignoredBy(msg.Envelope); rule != nil {
+		log.Printf("ignore %s of '%s' on %s, rule %s\n", m.String(), folder, imapName, rule)
+		recordIgnored(imapName, folder, msg, rule)
+		return m, errIgnored
+	}
+	log.Printf("read %s %v out of %v from %s\n", m.String(), seqNum, nmsg, imapName)
+	if err := addMessageAccount(hid, imapName); err != nil {
+		log.Printf("unable to associate %s with %s, error: %v\n", hid, imapName, err)
+	}
+	r := msg.GetBody(section)
+	entry, e := findMessage(hid)
+	if verboseLevel(imapName) > 1 {
+		log.Println("hid", hid, "DB entry", entry.String(), e)
+	}
+	if e == nil && entry.HashId == hid {
+		if verboseLevel(imapName) > 0 {
+			log.Println("Mail with hash", hid, "already exists")
+		}
+		return m, nil
+	}
+	if !isMailWritten(mdict, m) {
+		if Config.IndexOnly {
+			recordEnvelope(imapName, folder, msg)
+			return m, nil
+		}
+		if r == nil {
+			return m, errors.New("message without body")
+		}
+		// the consumer of fetched messages waits for free writer, such that
+		// fetch is paced by writes of mails
+		mailWriterSlots <- struct{}{}
+		wg.Add(1)
+		go func(m Message, r io.Reader) {
+			defer wg.Done()
+			defer func() { <-mailWriterSlots }()
+			// failed writes are retried once the folder is read, see retryWrites
+			if err := writeMail(imapName, folder, m, r); err != nil {
+				writeQueue.Add(imapName, folder, m, err)
+				return
+			}
+			RunSummary.AddFetched(1)
+			emitMessageEvent("message_fetched", imapName, folder, m)
+			if err := markBodyFetched(m.HashId); err != nil {
+				log.Printf("unable to mark body of %s as fetched, error: %v\n", m.HashId, err)
+			}
+			deleteFailedMessage(m.HashId)
+		}(m, r)
+		return m, nil
+	}
+	// check if mail is presented in our DB, if not we should insert its entry
+	if entry, e := findMessage(m.HashId); e == nil && entry.HashId == "" {
+		m.Path = findPath(mdict, m.HashId)
+		if err := insertMessage(m); err != nil {
+			return m, err
 		}
 	}
+	return m, nil
+}
+
+// helper function to find message path in local maildir snapshot, see readMaildir
+func findPath(mdict map[string]string, hid string) string {
 	if path, ok := mdict[hid]; ok {
 		return path
 	}
 	return ""
 }
 
-// helper function to check if mail was previously written in local maildir
-func isMailWritten(m Message) bool {
-	var mdict map[string]string
-	if Config.CommonInbox {
-		mdict = readMaildir("", "INBOX")
-	} else {
-		for k, v := range readMaildir(m.Imap, "INBOX") {
-			mdict[k] = v
-		}
-	}
-	for hid := range mdict {
-		if hid == m.HashId {
-			return true
-		}
-	}
-	return false
+// helper function to check if mail was previously written in local maildir,
+// the mdict is local maildir snapshot taken once per folder, see readMaildir
+func isMailWritten(mdict map[string]string, m Message) bool {
+	_, ok := mdict[m.HashId]
+	return ok
 }
 
 // helper function to create an md5 hash of given message Id
@@ -307,28 +497,32 @@ func md5hash(mid string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// helper function to create cur, new and tmp areas of local maildir folder
+func createLocalFolder(imapName, folder string) error {
+	for _, d := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(localPath(imapName, folder, d), os.ModePerm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // helper function to create maildir map of existing mails
 func readMaildir(imapName, folder string) map[string]string {
 
-	// when writing to local mail dir the folder name should not cotain slashes
-	// replace slash with dot
-	folder = strings.Replace(folder, "/", ".", -1)
 	// create proper dir structure in maildir area
-	var dirs = []string{"cur", "new", "tmp"}
-	fdir := localFolder(imapName, folder)
-	for _, d := range dirs {
-		fpath := fmt.Sprintf("%s/%s/%s", Config.Maildir, fdir, d)
-		os.MkdirAll(fpath, os.ModePerm)
-	}
-	if Config.Verbose > 0 {
-		log.Println("Read local mails from", fmt.Sprintf("%s/%s", Config.Maildir, fdir))
+	createLocalFolder(imapName, folder)
+	// files of tmp area are not yet committed, see commitMail
+	var dirs = []string{"cur", "new"}
+	if verboseLevel(imapName) > 0 {
+		log.Println("Read local mails from", localPath(imapName, folder, ""))
 	}
 
 	// create mail dict which we'll return upstream
 	mdict := make(map[string]string)
 	// each file in maildir has format: <tstamp.hid.hostname:2,flags>
 	for _, d := range dirs {
-		root := fmt.Sprintf("%s/%s/%s", Config.Maildir, fdir, d)
+		root := localPath(imapName, folder, d)
 		files, err := ioutil.ReadDir(root)
 		if err != nil {
 			log.Println("Error reading", root, err)
@@ -336,34 +530,77 @@ func readMaildir(imapName, folder string) map[string]string {
 		}
 		for _, f := range files {
 			fname := fmt.Sprintf("%s/%s", root, f.Name())
-			arr := strings.Split(fname, ".")
+			arr := strings.Split(f.Name(), ".")
+			if len(arr) < 2 {
+				continue
+			}
 			mdict[arr[1]] = fname
 		}
 	}
 	return mdict
 }
 
-// helper to get local maildir folder
+// helper function to find mail file with given hash id in new and cur
+// areas of local maildir folder
+func findLocalMail(imapName, folder, hid string) string {
+	for _, d := range []string{"cur", "new"} {
+		root := localPath(imapName, folder, d)
+		files, err := ioutil.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			arr := strings.Split(f.Name(), ".")
+			if len(arr) > 1 && arr[1] == hid {
+				return fmt.Sprintf("%s/%s", root, f.Name())
+			}
+		}
+	}
+	return ""
+}
+
+// helper to get local maildir folder, with nested layout (default) the
+// folder is placed into IMAP server directory, e.g. work/INBOX, while with
+// flat layout the folder name is prefixed with IMAP server name, e.g. work.INBOX
 func localFolder(imapName, folder string) string {
+	// when writing to local mail dir the folder name should not cotain slashes
+	// replace slash with dot
+	folder = strings.Replace(folder, "/", ".", -1)
 	if imapName == "" {
 		return folder
 	} else if strings.ToLower(folder) == "inbox" && Config.CommonInbox {
 		return folder
 	}
+	if Config.LocalLayout == "flat" {
+		return fmt.Sprintf("%s%s%s", imapName, Config.LocalSeparator, folder)
+	}
 	return fmt.Sprintf("%s/%s", imapName, folder)
 }
 
-// helper function to return short flag names
+// helper function to get path of given area (cur, new, tmp) of local
+// maildir folder, all consumers of local paths should use this function
+func localPath(imapName, folder, area string) string {
+	fpath := fmt.Sprintf("%s/%s", Config.Maildir, localFolder(imapName, folder))
+	if area != "" {
+		fpath = fmt.Sprintf("%s/%s", fpath, area)
+	}
+	return fpath
+}
+
+// helper function to return short flag names of given IMAP flags, the
+// \Recent flag is managed by IMAP server and has no maildir symbol
 func flagSymbols(flags []string) string {
 	var flag string
 	for _, f := range flags {
 		f = strings.ToLower(strings.Replace(f, "\\", "", -1))
 		if f == "seen" {
 			f = "S"
-		} else if f == "recent" {
-			f = "N"
 		} else if f == "answered" {
-			f = "A"
+			f = "R"
+		} else if f == "flagged" {
+			f = "F"
+		} else if f == "draft" {
+			f = "D"
 		} else if f == "junk" {
 			f = "J"
 		} else {
@@ -371,80 +608,254 @@ func flagSymbols(flags []string) string {
 		}
 		flag = fmt.Sprintf("%s%s", flag, f)
 	}
-	if flag == "" {
-		flag = "S"
+	// maildir flags should be in ASCII order
+	symbols := strings.Split(flag, "")
+	sort.Strings(symbols)
+	return strings.Join(symbols, "")
+}
+
+// helper function to return IMAP flags of given maildir flag symbols, e.g.
+// parsed from file name by getFlags, it is reverse of flagSymbols
+func symbolFlags(symbols []string) []string {
+	var flags []string
+	seen := make(map[string]bool)
+	for _, s := range symbols {
+		var f string
+		switch s {
+		case "S":
+			f = imap.SeenFlag
+		case "R", "A":
+			// old goimapsync versions used A symbol for answered mails
+			f = imap.AnsweredFlag
+		case "F":
+			f = imap.FlaggedFlag
+		case "D":
+			f = imap.DraftFlag
+		case "J":
+			f = "Junk"
+		default:
+			continue
+		}
+		if !seen[f] {
+			seen[f] = true
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
+
+// helper function to get hostname used in names of local mail files, it is
+// Config.MaildirHostname or OS hostname (e.g. random id within container),
+// the / and : characters are encoded as maildir spec requires
+func maildirHostname() (string, error) {
+	name := Config.MaildirHostname
+	if name == "" {
+		var err error
+		if name, err = os.Hostname(); err != nil {
+			return "", err
+		}
+	}
+	name = strings.ReplaceAll(name, "/", "\\057")
+	name = strings.ReplaceAll(name, ":", "\\072")
+	return name, nil
+}
+
+// helper function to read content of given message body, go-imap keeps
+// literals in memory and their bytes are used as is
+func readLiteral(r io.Reader) ([]byte, error) {
+	if b, ok := r.(interface{ Bytes() []byte }); ok {
+		return b.Bytes(), nil
 	}
-	return flag
+	return ioutil.ReadAll(r)
 }
 
 // helper function to write emails in imapName folder of local maildir
-func writeMail(imapName, folder string, m Message, r io.Reader, wg *sync.WaitGroup) {
+func writeMail(imapName, folder string, m Message, r io.Reader) error {
 	hid := m.HashId  // hash id of the message id
 	flags := m.Flags // message flags
 	defer timing("writeMail", time.Now())
 	defer profiler("writeMail")()
-	defer wg.Done()
 
 	// construct file name with the following format:
 	// tstamp.hid.hostname:2,flags
 	tstamp := time.Now().Unix()
 	flag := flagSymbols(flags)
-	if Config.Verbose > 0 {
+	if verboseLevel(imapName) > 0 {
 		log.Println("writeMail", tstamp, hid, flags, flag)
 	}
-	fdir := localFolder(imapName, folder)
+	// only unseen mails without any flags go to new area since by maildir
+	// rule its files have no info part, all other mails (e.g. unseen flagged
+	// ones) go to cur area where unseen mail has no S flag
 	fname := fmt.Sprintf("%d.%s.%s:2,%s", tstamp, hid, hostname, flag)
-	fpath := fmt.Sprintf("%s/%s/cur/%s", Config.Maildir, fdir, fname)
-	if strings.Contains(flag, "N") {
+	fpath := fmt.Sprintf("%s/%s", localPath(imapName, folder, "cur"), fname)
+	if flag == "" {
 		fname = fmt.Sprintf("%d.%s.%s", tstamp, hid, hostname)
-		fpath = fmt.Sprintf("%s/%s/new/%s", Config.Maildir, fdir, fname)
+		fpath = fmt.Sprintf("%s/%s", localPath(imapName, folder, "new"), fname)
 	}
-	// check if our file exist
-	if _, err := os.Stat(fpath); err == nil {
-		if Config.Verbose > 0 {
-			log.Println("File", fpath, "already exists")
+	// check if our mail exists in either new or cur area, the file name
+	// may differ by time stamp and flags
+	if fname := findLocalMail(imapName, folder, hid); fname != "" {
+		if verboseLevel(imapName) > 0 {
+			log.Println("File", fname, "already exists")
 		}
-		return
+		return nil
 	}
-	// proceed and create a file with our email
-	file, err := os.Create(fpath)
+	// keep raw source of the message for archive mode
+	raw, err := readLiteral(r)
 	if err != nil {
-		log.Println("unable to open", fpath, err)
-		return
+		return fmt.Errorf("unable to read a message: %w", err)
 	}
-	defer file.Close()
-	msg, err := mail.ReadMessage(r)
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
 	if err != nil {
-		log.Println("Unable to read a message", err)
-		return
+		return fmt.Errorf("unable to read a message: %w", err)
 	}
-	// write headers
-	for k, v := range msg.Header {
-		line := fmt.Sprintf("%s: %s\n", k, strings.Join(v, " "))
-		_, e := file.WriteString(line)
-		if e != nil {
-			log.Printf("unable to write '%s', error: %v\n", line, e)
-			return
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read a message body: %w", err)
+	}
+	// the file is written into tmp area first and committed by commitMail
+	tdir := localPath(imapName, folder, "tmp")
+	if err := os.MkdirAll(tdir, os.ModePerm); err != nil {
+		return err
+	}
+	tpath := fmt.Sprintf("%s/%s", tdir, fname)
+	file, err := os.Create(tpath)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", tpath, err)
+	}
+	// write headers and body, on failure remove partially written file,
+	// the checksum of the file is computed while we write it
+	h := sha256.New()
+	header := stripHeaders(msg.Header)
+	if Config.FolderHeader {
+		header = addFolderHeader(header, folder)
+	}
+	write := func(w io.Writer) error { return writeContent(w, header, body) }
+	if Config.ArchiveMode {
+		// the message is written as is, without stripped or added headers
+		write = func(w io.Writer) error {
+			_, err := w.Write(raw)
+			return err
 		}
 	}
-	// write body
-	body, err := ioutil.ReadAll(msg.Body)
-	if err == nil {
-		_, e := file.Write(body)
-		if e != nil {
-			log.Println("unable to write msg body, error", e)
-			return
+	if err := write(io.MultiWriter(file, h)); err != nil {
+		file.Close()
+		os.Remove(tpath)
+		return fmt.Errorf("unable to write %s: %w", tpath, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tpath)
+		return fmt.Errorf("unable to sync %s: %w", tpath, err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tpath)
+		return fmt.Errorf("unable to close %s: %w", tpath, err)
+	}
+
+	// write message info into DB and move the file into its place
+	m.Path = fpath
+	sha := hex.EncodeToString(h.Sum(nil))
+	size, err := commitMail(m, tpath, sha)
+	if err != nil {
+		return err
+	}
+	if Config.ArchiveMode {
+		if err := writeSidecar(imapName, folder, m, size, sha); err != nil {
+			log.Printf("unable to write metadata of %s, error: %v\n", fpath, err)
 		}
 	}
+	if err := updateMessageHeaders(threadHeaders(hid, m.MessageId, msg.Header)); err != nil {
+		log.Printf("unable to record headers of %s in DB, error: %v\n", fpath, err)
+	}
+
 	// run filters
 	filterMessage(msg, body)
+	return nil
+}
 
-	// write message info into DB
-	m.Path = fpath
-	err = insertMessage(m)
+// helper function to commit mail file of given message written into tmp
+// path: the message is recorded in DB as pending one (along with tmp path),
+// the file is moved into its place (m.Path) and the record is confirmed along
+// with checksum, size and modification time of the file. On failure the
+// record and the file are removed, and the commit interrupted by crash is
+// completed or rolled back at next start, see reindexPending. It returns
+// size of committed file.
+func commitMail(m Message, tpath, sha string) (int64, error) {
+	if err := insertPendingMessage(m, tpath); err != nil {
+		os.Remove(tpath)
+		return 0, fmt.Errorf("unable to write message into DB: %w", err)
+	}
+	if err := os.Rename(tpath, m.Path); err != nil {
+		os.Remove(tpath)
+		deleteMessage(m.HashId)
+		return 0, fmt.Errorf("unable to move %s: %w", tpath, err)
+	}
+	info, err := os.Stat(m.Path)
+	if err == nil {
+		err = confirmMessage(m.HashId, sha, info.Size(), info.ModTime().Unix())
+	}
 	if err != nil {
-		log.Fatal("message was written to file-system but not in DB, error: ", err)
+		os.Remove(m.Path)
+		deleteMessage(m.HashId)
+		return 0, fmt.Errorf("unable to confirm %s in DB: %w", m.Path, err)
+	}
+	return info.Size(), nil
+}
+
+// helper function to strip headers listed in Config.StripHeaders from given
+// message header, the match is case-insensitive and trailing * matches any suffix
+// e.g. X-Spam-*
+func stripHeaders(header mail.Header) mail.Header {
+	if len(Config.StripHeaders) == 0 {
+		return header
+	}
+	out := make(mail.Header)
+	for k, v := range header {
+		key := strings.ToLower(k)
+		strip := false
+		for _, h := range Config.StripHeaders {
+			h = strings.ToLower(h)
+			if strings.HasSuffix(h, "*") {
+				strip = strings.HasPrefix(key, strings.TrimSuffix(h, "*"))
+			} else {
+				strip = key == h
+			}
+			if strip {
+				break
+			}
+		}
+		if !strip {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// helper function to add folderHeader with given source IMAP folder to
+// copy of message header, the header of the same name set by anyone else
+// is replaced, non-ASCII folder names are MIME encoded
+func addFolderHeader(header mail.Header, folder string) mail.Header {
+	out := make(mail.Header)
+	for k, v := range header {
+		if !strings.EqualFold(k, folderHeader) {
+			out[k] = v
+		}
+	}
+	out[folderHeader] = []string{mime.QEncoding.Encode("utf-8", folder)}
+	return out
+}
+
+// helper function to write message headers and body to given writer
+func writeContent(w io.Writer, header mail.Header, body []byte) error {
+	for k, v := range header {
+		line := fmt.Sprintf("%s: %s\n", k, strings.Join(v, " "))
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
 	}
+	_, err := w.Write(body)
+	return err
 }
 
 // helper function to perform filter operation on a given message
@@ -456,11 +867,26 @@ func filterMessage(msg *mail.Message, body []byte) {
 	if from == "" || subject == "" {
 		return
 	}
+	// text of the message is extracted only if filter has body pattern
+	var text *string
+	bodyText := func() string {
+		if text == nil {
+			s, err := messageText(&mail.Message{Header: header, Body: bytes.NewReader(body)})
+			if err != nil {
+				log.Printf("unable to extract text of the message, error: %v", err)
+			}
+			text = &s
+		}
+		return *text
+	}
 	for _, f := range Config.Filters {
 		if f.From != "" && f.Subject != "" {
 			matched1, err1 := regexp.MatchString(f.From, from)
 			matched2, err2 := regexp.MatchString(f.Subject, subject)
 			log.Printf("### use filter %+v", f)
+			if matched1 && err1 == nil && matched2 && err2 == nil && f.Body != "" {
+				matched2, err2 = regexp.MatchString(f.Body, bodyText())
+			}
 			if matched1 && err1 == nil && matched2 && err2 == nil {
 				log.Printf("### match, send email to '%s' subject: '%s'", f.Forward, subject)
 				sendEmail(f.Forward, header, body)
@@ -470,6 +896,59 @@ func filterMessage(msg *mail.Message, body []byte) {
 	}
 }
 
+// helper function to send email via SMTP server, it is the same as
+// smtp.SendMail but applies TLS policy of SMTP server to STARTTLS
+func sendSmtp(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	srv := Config.SmtpServer
+	if srv.MinTLSVersion == "" && srv.MaxTLSVersion == "" && len(srv.CipherSuites) == 0 {
+		return smtp.SendMail(addr, auth, from, to, msg)
+	}
+	cfg, err := tlsPolicy(srv.MinTLSVersion, srv.MaxTLSVersion, srv.CipherSuites)
+	if err != nil {
+		return err
+	}
+	cfg.ServerName = srv.Host
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	// with TLS policy we never fall back to plain connection
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		return fmt.Errorf("SMTP server %s does not support STARTTLS", addr)
+	}
+	if err := c.StartTLS(cfg); err != nil {
+		return err
+	}
+	if state, ok := c.TLSConnectionState(); ok && Config.Verbose > 0 {
+		log.Printf("SMTP %s: %s, %s", addr, tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	}
+	if ok, _ := c.Extension("AUTH"); ok && auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
 // helper function to send email to recepient
 // https://www.loginradius.com/blog/async/sending-emails-with-golang/
 // https://zetcode.com/golang/email-smtp/
@@ -505,7 +984,7 @@ func sendEmail(recepient string, headers mail.Header, body []byte) {
 
 	// Sending email.
 	//     err = smtp.SendMail(smtpHost+":"+smtpPort, auth, from, to, message)
-	err := smtp.SendMail(smtpHost+":"+smtpPort, auth, from, to, []byte(message))
+	err := sendSmtp(smtpHost+":"+smtpPort, auth, from, to, []byte(message))
 	if err != nil {
 		log.Println(err)
 		return
@@ -514,23 +993,83 @@ func sendEmail(recepient string, headers mail.Header, body []byte) {
 }
 
 // helper function to get list of all imap folders
-func getImapFolders(c *client.Client, imapName string) []string {
+func getImapFolders(ctx context.Context, c *client.Client, imapName string) ([]string, error) {
+	mailboxes, err := listFolders(ctx, c, imapName)
+	if err != nil {
+		return nil, err
+	}
+	var folders []string
+	for _, m := range mailboxes {
+		folders = append(folders, m.Name)
+	}
+	return folders, nil
+}
+
+// helper function to list folders of given IMAP server along with their
+// attributes, the list is aborted when given context is done
+func listFolders(ctx context.Context, c *client.Client, imapName string) ([]*imap.MailboxInfo, error) {
 	// List mailboxes
 	mailboxes := make(chan *imap.MailboxInfo, 10)
 	done := make(chan error, 1)
 	go func() {
+		if utf8Enabled(imapName) {
+			done <- listUTF8(c, mailboxes)
+			return
+		}
 		done <- c.List("", "*", mailboxes)
 	}()
 
-	var folders []string
-	for m := range mailboxes {
-		folders = append(folders, m.Name)
+	// collect folders until list command closes mailboxes channel
+	var folders []*imap.MailboxInfo
+	collected := make(chan struct{})
+	go func() {
+		for m := range mailboxes {
+			folders = append(folders, m)
+		}
+		close(collected)
+	}()
+
+	select {
+	case err := <-done:
+		<-collected
+		if err != nil {
+			return nil, err
+		}
+		return folders, nil
+	case <-ctx.Done():
+		// the server stalled, terminate connection to unblock list command
+		c.Terminate()
+		return nil, fmt.Errorf("unable to list folders of %s: %w", imapName, ctx.Err())
 	}
+}
 
-	if err := <-done; err != nil {
-		log.Fatal(err)
+// helper function to find folder name in the list of given IMAP server folders
+func findImapFolder(imapName, folder string) (string, error) {
+	folders := imapFolders[imapName]
+	// exact name takes precedence over names which differ only by case
+	for _, f := range folders {
+		if f == folder {
+			return f, nil
+		}
+	}
+	for _, f := range folders {
+		if sameFolder(f, folder) {
+			return f, nil
+		}
+	}
+	// INBOX always exists on IMAP server
+	if strings.ToLower(folder) == "inbox" {
+		return "INBOX", nil
+	}
+	// user-friendly name of folder within personal namespace
+	if qfolder := qualifiedFolder(imapName, decodeFolderName(folder)); qfolder != decodeFolderName(folder) {
+		for _, f := range folders {
+			if sameFolder(f, qfolder) {
+				return f, nil
+			}
+		}
 	}
-	return folders
+	return "", fmt.Errorf("No folder '%s' found in imap '%s' folder list '%v'", folder, imapName, folders)
 }
 
 // helper function to get folder name for given IMAP server
@@ -539,40 +1078,60 @@ func imapFolder(imapName, folder string) string {
 	if folder == "" {
 		return folder
 	}
-	folders := imapFolders[imapName]
-	for _, f := range folders {
-		if strings.ToLower(f) == strings.ToLower(folder) {
-			return f
-		}
+	f, err := findImapFolder(imapName, folder)
+	if err == nil {
+		return f
 	}
 	// defaults
-	if strings.ToLower(folder) == "inbox" {
-		return "INBOX"
-	}
 	if strings.ToLower(folder) == "spam" {
 		return "Spam"
 	}
 	// at this point we should through an error
-	log.Fatalf("No folder '%s' found in imap '%s' folder list '%v'\n", folder, imapName, folders)
+	log.Fatal(err)
 	return ""
 }
 
-// MoveMessage moves message in given imap server into specifc folder
-func MoveMessage(c *client.Client, imapName string, msg Message, folderName string) {
-	defer timing("MoveMessage", time.Now())
-	defer profiler("MoveMessage")()
-	// inbox folder
-	inboxFolder := imapFolder(imapName, "inbox")
-	folder := imapFolder(imapName, folderName)
-
-	seqset := new(imap.SeqSet)
-	seqset.AddNum(msg.SeqNumber)
+// helper function to check that source and target folders exist on IMAP server
+// before we perform any destructive operation, if Config.CreateFolder is set
+// the missing target folder will be created
+func checkFolders(c *client.Client, imapName, source, target string) error {
+	if _, err := findImapFolder(imapName, source); err != nil {
+		return fmt.Errorf("source folder '%s' does not exist on '%s'", source, imapName)
+	}
+	if target == "" {
+		return nil
+	}
+	if _, err := findImapFolder(imapName, target); err == nil {
+		return nil
+	}
+	if !Config.CreateFolder {
+		return fmt.Errorf("target folder '%s' does not exist on '%s', use -create-folder to create it", target, imapName)
+	}
+	target = qualifiedFolder(imapName, target)
+	log.Printf("create folder '%s' on '%s'\n", target, imapName)
+	if err := c.Create(target); err != nil {
+		return fmt.Errorf("unable to create folder '%s' on '%s': %w", target, imapName, err)
+	}
+	imapFolders[imapName] = append(imapFolders[imapName], target)
+	if err := saveCachedFolders(imapName, imapFolders[imapName]); err != nil {
+		log.Printf("unable to cache folders of %s, error: %v\n", imapName, err)
+	}
+	return nil
+}
 
-	// connect to given Spam folder
-	_, err := c.Select(inboxFolder, false)
-	if err != nil {
-		log.Fatal(err)
+// MoveMessage moves message in given imap server into specifc folder, the
+// message is addressed by its UID such that concurrent expunge of other
+// messages can't shift it
+func MoveMessage(c *client.Client, imapName string, msg Message, folderName string) error {
+	defer timing("MoveMessage", time.Now())
+	defer profiler("MoveMessage")()
+	// inbox folder
+	inboxFolder := imapFolder(imapName, "inbox")
+	folder := imapFolder(imapName, folderName)
+	if msg.Uid == 0 {
+		return fmt.Errorf("message %s has no UID", msg.MessageId)
 	}
+	seqset := uidSet([]uint32{msg.Uid})
 
 	if folder == "" {
 		log.Printf("delete %v\n", msg.String())
@@ -580,44 +1139,72 @@ func MoveMessage(c *client.Client, imapName string, msg Message, folderName stri
 		log.Printf("move %v to '%s' on %s\n", msg.MessageId, folder, imapName)
 	}
 
-	// copy mail to folder
+	// record the move such that it is recovered if we crash in the middle
+	var oid int64
 	if folder != "" {
-		// mark mail as seen in our inbox
-		item := imap.FormatFlagsOp(imap.AddFlags, true)
-		flags := []interface{}{imap.SeenFlag}
-		if Config.Verbose > 1 {
-			log.Println("IMAP", imap.SeenFlag)
+		var err error
+		oid, err = recordMove(imapName, msg, inboxFolder, folder)
+		if err != nil {
+			return err
 		}
-		if err := c.Store(seqset, item, flags, nil); err != nil {
-			log.Fatal(err)
+	}
+
+	// the operation is idempotent by UID and it is replayed if connection drops
+	_, err := withReconnect(c, imapName, "", func(c *client.Client) error {
+		if _, err := c.Select(inboxFolder, false); err != nil {
+			return err
 		}
-		if err := c.Copy(seqset, folder); err != nil {
-			log.Fatal(err)
+		// copy mail to folder
+		if folder != "" {
+			// mark mail as seen in our inbox
+			item := imap.FormatFlagsOp(imap.AddFlags, true)
+			flags := []interface{}{imap.SeenFlag}
+			if verboseLevel(imapName) > 1 {
+				log.Println("IMAP", imap.SeenFlag)
+			}
+			if err := c.UidStore(seqset, item, flags, nil); err != nil {
+				return err
+			}
+			if err := c.UidCopy(seqset, folder); err != nil {
+				return err
+			}
 		}
+		// in safe mode the move degrades to copy and we never delete mail
+		if Config.SafeMode {
+			logSafeMode(imapName, fmt.Sprintf("removal of %s from '%s'", msg.MessageId, inboxFolder))
+			return nil
+		}
+		// mark mail as deleted on IMAP server and then delete it in inbox folder
+		item := imap.FormatFlagsOp(imap.AddFlags, true)
+		flags := []interface{}{imap.DeletedFlag}
+		if verboseLevel(imapName) > 1 {
+			log.Println("IMAP", imap.DeletedFlag)
+		}
+		if err := c.UidStore(seqset, item, flags, nil); err != nil {
+			return err
+		}
+		return expungeUids(c, []uint32{msg.Uid}, nil)
+	})
+	if err != nil {
+		return err
 	}
-	// mark mail as deleted on IMAP server
-	item := imap.FormatFlagsOp(imap.AddFlags, true)
-	flags := []interface{}{imap.DeletedFlag}
-	if Config.Verbose > 1 {
-		log.Println("IMAP", imap.DeletedFlag)
-	}
-	if err := c.Store(seqset, item, flags, nil); err != nil {
-		log.Fatal(err)
-	}
-	// then delete it in inbox folder
-	if err := c.Expunge(nil); err != nil {
-		log.Fatal(err)
-	}
+	completeOperation(oid)
+	return nil
 }
 
 // Move message on IMAP to a given folder, if folder name is not given the mail
 // will be deleted
-func Move(c *client.Client, imapName, match, folderName string) {
+func Move(c *client.Client, imapName, match, folderName string) error {
 	if folderName == "" || match == "" {
-		log.Fatal("Move operation requires both folder and message id")
+		return errors.New("Move operation requires both folder and message id")
 	}
 	defer timing("Move", time.Now())
 	defer profiler("Move")()
+	setOperation(imapName, "move", folderName)
+	// pre-flight check of folders before we'll touch anything
+	if err := checkFolders(c, imapName, "inbox", folderName); err != nil {
+		return err
+	}
 	// inbox folder
 	inboxFolder := imapFolder(imapName, "inbox")
 	folder := imapFolder(imapName, folderName)
@@ -631,7 +1218,11 @@ func Move(c *client.Client, imapName, match, folderName string) {
 	// Select INBOX
 	mbox, err := c.Select(inboxFolder, false)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if mbox.Messages == 0 {
+		log.Printf("Folder '%s' on '%s' is empty, nothing to move\n", inboxFolder, imapName)
+		return nil
 	}
 
 	// Get messages from INBOX
@@ -639,71 +1230,357 @@ func Move(c *client.Client, imapName, match, folderName string) {
 	to := mbox.Messages
 	seqset := new(imap.SeqSet)
 	seqset.AddRange(from, to)
-	if Config.Verbose > 0 {
+	if verboseLevel(imapName) > 0 {
 		log.Println("Fetch from IMAP", imapName, folderName, from, to)
 	}
 
-	messages := make(chan *imap.Message, to)
+	messages := make(chan *imap.Message, fetchChannelSize)
 	items := []imap.FetchItem{imap.FetchFlags, imap.FetchUid, imap.FetchEnvelope}
-	if Config.Verbose > 1 {
+	if verboseLevel(imapName) > 1 {
 		log.Println("IMAP", items)
 	}
-	// TODO: use goroutine until this issue will be solved
-	// https://github.com/emersion/go-imap/issues/382
-	done := make(chan error, 1)
-	go func() {
-		done <- c.Fetch(seqset, items, messages)
-	}()
-	//     err = c.Fetch(seqset, items, messages)
-	//     if err != nil {
-	//         log.Fatal(err)
-	//     }
+	done := fetchMessages(c, seqset, items, messages, false)
 
+	// we should drain all messages before issuing any other command
 	seqNum := uint32(1)
+	var found *Message
 	for msg := range messages {
-		if Config.Verbose > 1 {
+		if msg == nil || msg.Envelope == nil {
+			seqNum += 1
+			continue
+		}
+		if verboseLevel(imapName) > 1 {
 			log.Println("* "+msg.Envelope.Subject+" MessageId ", msg.Envelope.MessageId)
 		}
-		if msg.Envelope.MessageId == match {
-			if Config.Verbose > 0 {
+		if found == nil && msg.Envelope.MessageId == match {
+			if verboseLevel(imapName) > 0 {
 				log.Printf("Found match: seq:%v Envelope: %+v Flags: %+v\n", seqNum, msg.Envelope, msg.Flags)
 			}
 			mid := msg.Envelope.MessageId
 			hid := md5hash(mid)
 			sub := msg.Envelope.Subject
 			flags := msg.Flags
-			m := Message{HashId: hid, MessageId: mid, Flags: flags, Imap: imapName, Subject: sub, SeqNumber: seqNum}
-			MoveMessage(c, imapName, m, folder)
-			return
+			found = &Message{HashId: hid, MessageId: mid, Flags: flags, Imap: imapName, Subject: sub, SeqNumber: seqNum, Uid: msg.Uid}
+			// resolve local copy of the message if we have it
+			if entry, err := findMessageByMid(mid); err == nil && entry.Path != "" {
+				found.Path = entry.Path
+			}
 		}
 		seqNum += 1
 	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("unable to fetch folder '%s' on '%s': %w", inboxFolder, imapName, err)
+	}
+	if found != nil {
+		return MoveMessage(c, imapName, *found, folder)
+	}
+	return nil
+}
+
+// SetFlags adds and removes flags of given message on IMAP server and
+// updates flags of local copy of the message
+func SetFlags(c *client.Client, imapName, match string, add, remove []string) error {
+	if match == "" || (len(add) == 0 && len(remove) == 0) {
+		return errors.New("SetFlags operation requires message id and flags to add or remove")
+	}
+	defer timing("SetFlags", time.Now())
+	defer profiler("SetFlags")()
+	if Config.SafeMode {
+		for _, f := range add {
+			if strings.EqualFold(f, imap.DeletedFlag) {
+				logSafeMode(imapName, fmt.Sprintf("%s flag of %s", imap.DeletedFlag, match))
+				return errors.New("deleted flag is not allowed in safe mode")
+			}
+		}
+	}
+	setOperation(imapName, "flag", "INBOX")
+	inboxFolder := imapFolder(imapName, "inbox")
+
+	// check if given match is existing file, if so we'll
+	// extract from it MatchedId
+	if _, err := os.Stat(match); err == nil {
+		match = getMessageId(match)
+	}
+
+	// look-up message UID on IMAP server
+	if _, err := c.Select(inboxFolder, false); err != nil {
+		return err
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", match)
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return err
+	}
+	if len(uids) == 0 {
+		if verboseLevel(imapName) > 0 {
+			log.Printf("No message '%s' found in '%s' on %s\n", match, inboxFolder, imapName)
+		}
+		return nil
+	}
+	seqset := uidSet(uids)
+	log.Printf("set flags on %s on %s: add %v remove %v\n", match, imapName, add, remove)
+	if len(add) > 0 {
+		item := imap.FormatFlagsOp(imap.AddFlags, true)
+		if err := c.UidStore(seqset, item, stringsToInterfaces(add), nil); err != nil {
+			return err
+		}
+	}
+	if len(remove) > 0 {
+		item := imap.FormatFlagsOp(imap.RemoveFlags, true)
+		if err := c.UidStore(seqset, item, stringsToInterfaces(remove), nil); err != nil {
+			return err
+		}
+	}
+
+	// update flags of local copy of the message
+	entry, err := findMessageByMid(match)
+	if err != nil || entry.Path == "" {
+		return nil
+	}
+	return setLocalMessageFlags(entry, add, remove)
+}
+
+// helper function to add and remove flags of local copy of given message
+func setLocalMessageFlags(entry Message, add, remove []string) error {
+	symbols := localSyncFlags(entry.Path)
+	for _, f := range add {
+		if s, ok := syncFlagsMap[f]; ok && !strings.Contains(symbols, s) {
+			symbols += s
+		}
+	}
+	for _, f := range remove {
+		if s, ok := syncFlagsMap[f]; ok {
+			symbols = strings.Replace(symbols, s, "", -1)
+		}
+	}
+	fpath, err := setLocalFlags(entry.Path, symbols)
+	if err != nil {
+		return err
+	}
+	return updateMessagePath(entry.HashId, fpath)
+}
+
+// helper function to check that given UIDs of IMAP folder were seen by
+// goimapsync, i.e. recorded in DB, it returns hash ids of known UIDs. The
+// unknown UIDs are allowed with force only to guard against typos.
+func checkUids(imapName, folder string, uids []uint32, force bool) (map[uint32]string, error) {
+	known, err := presenceHashIds(imapName, folder, uids)
+	if err != nil {
+		return known, err
+	}
+	var unknown []string
+	for _, uid := range uids {
+		if _, ok := known[uid]; !ok {
+			unknown = append(unknown, fmt.Sprintf("%d", uid))
+		}
+	}
+	if len(unknown) > 0 && !force {
+		return known, fmt.Errorf("UID(s) %s of '%s' on %s were never seen in DB, use -force to proceed", strings.Join(unknown, ","), folder, imapName)
+	}
+	return known, nil
+}
+
+// MoveUids moves messages with given UIDs of given folder on IMAP server to
+// another folder, unlike Move it does not scan the folder for message id
+func MoveUids(c *client.Client, imapName, folderFrom string, uids []uint32, folderName string, force bool) error {
+	if folderName == "" || len(uids) == 0 {
+		return errors.New("Move operation requires both folder and message UIDs")
+	}
+	defer timing("MoveUids", time.Now())
+	defer profiler("MoveUids")()
+	setOperation(imapName, "move", folderName)
+	if err := checkFolders(c, imapName, folderFrom, folderName); err != nil {
+		return err
+	}
+	source := imapFolder(imapName, folderFrom)
+	folder := imapFolder(imapName, folderName)
+	if _, err := checkUids(imapName, source, uids, force); err != nil {
+		return err
+	}
+	seqset := uidSet(uids)
+	log.Printf("move UIDs %v of '%s' to '%s' on %s\n", seqset, source, folder, imapName)
+	// the operation is idempotent by UIDs and it is replayed if connection drops
+	_, err := withReconnect(c, imapName, "", func(c *client.Client) error {
+		if _, err := c.Select(source, false); err != nil {
+			return err
+		}
+		// mark mails as seen in source folder
+		item := imap.FormatFlagsOp(imap.AddFlags, true)
+		if err := c.UidStore(seqset, item, []interface{}{imap.SeenFlag}, nil); err != nil {
+			return err
+		}
+		if err := c.UidCopy(seqset, folder); err != nil {
+			return err
+		}
+		// in safe mode the move degrades to copy and we never delete mail
+		if Config.SafeMode {
+			logSafeMode(imapName, fmt.Sprintf("removal of UIDs %v from '%s'", seqset, source))
+			return nil
+		}
+		if err := c.UidStore(seqset, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+			return err
+		}
+		return expungeUids(c, uids, nil)
+	})
+	return err
+}
+
+// SetFlagsUids adds and removes flags of messages with given UIDs of given
+// folder on IMAP server and updates flags of their local copies
+func SetFlagsUids(c *client.Client, imapName, folderFrom string, uids []uint32, add, remove []string, force bool) error {
+	if len(uids) == 0 || (len(add) == 0 && len(remove) == 0) {
+		return errors.New("SetFlags operation requires message UIDs and flags to add or remove")
+	}
+	defer timing("SetFlagsUids", time.Now())
+	defer profiler("SetFlagsUids")()
+	if Config.SafeMode {
+		for _, f := range add {
+			if strings.EqualFold(f, imap.DeletedFlag) {
+				logSafeMode(imapName, fmt.Sprintf("%s flag of UIDs %v", imap.DeletedFlag, uids))
+				return errors.New("deleted flag is not allowed in safe mode")
+			}
+		}
+	}
+	setOperation(imapName, "flag", folderFrom)
+	if err := checkFolders(c, imapName, folderFrom, ""); err != nil {
+		return err
+	}
+	source := imapFolder(imapName, folderFrom)
+	known, err := checkUids(imapName, source, uids, force)
+	if err != nil {
+		return err
+	}
+	seqset := uidSet(uids)
+	log.Printf("set flags on UIDs %v of '%s' on %s: add %v remove %v\n", seqset, source, imapName, add, remove)
+	_, err = withReconnect(c, imapName, "", func(c *client.Client) error {
+		if _, err := c.Select(source, false); err != nil {
+			return err
+		}
+		if len(add) > 0 {
+			item := imap.FormatFlagsOp(imap.AddFlags, true)
+			if err := c.UidStore(seqset, item, stringsToInterfaces(add), nil); err != nil {
+				return err
+			}
+		}
+		if len(remove) > 0 {
+			item := imap.FormatFlagsOp(imap.RemoveFlags, true)
+			return c.UidStore(seqset, item, stringsToInterfaces(remove), nil)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// update flags of local copies of the messages
+	for _, hid := range known {
+		entry, err := findMessage(hid)
+		if err != nil || entry.Path == "" {
+			continue
+		}
+		if err := setLocalMessageFlags(entry, add, remove); err != nil {
+			log.Printf("unable to set flags on %s, error: %v\n", entry.Path, err)
+		}
+	}
+	return nil
 }
 
-// Fetch content of given folder from IMAP into local maildir
-func Fetch(c *client.Client, imapName, folder string, newMessages bool) {
+// helper function to parse comma separated list of UIDs and UID ranges,
+// e.g. 4521,4533,4600:4610
+func parseUids(value string) ([]uint32, error) {
+	var out []uint32
+	for _, v := range splitList(value) {
+		arr := strings.SplitN(v, ":", 2)
+		from, err := strconv.ParseUint(arr[0], 10, 32)
+		if err != nil || from == 0 {
+			return nil, fmt.Errorf("invalid UID '%s'", v)
+		}
+		to := from
+		if len(arr) == 2 {
+			if to, err = strconv.ParseUint(arr[1], 10, 32); err != nil || to < from || to-from >= 100000 {
+				return nil, fmt.Errorf("invalid UID range '%s'", v)
+			}
+		}
+		for uid := from; uid <= to; uid++ {
+			out = append(out, uint32(uid))
+		}
+	}
+	return out, nil
+}
+
+// helper function to convert list of strings to list of interfaces
+func stringsToInterfaces(list []string) []interface{} {
+	var out []interface{}
+	for _, v := range list {
+		out = append(out, v)
+	}
+	return out
+}
+
+// helper function to split comma separated list of values
+func splitList(value string) []string {
+	var out []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Fetch content of given folder from IMAP into local maildir, it returns
+// list of processed messages and fetch error if any
+func Fetch(c *client.Client, imapName, folder string, newMessages bool, filter FlagFilter) ([]Message, error) {
 	defer timing("Fetch", time.Now())
 	defer profiler("Fetch")()
 	log.Printf("Fetch %s from %s\n", folder, imapName)
-	for _, m := range readImap(c, imapName, folder, newMessages) {
-		if Config.Verbose > 0 {
+	c, state, unchanged := unchangedFolder(c, imapName, folder, filter)
+	if unchanged {
+		log.Printf("Folder '%s' on '%s' is unchanged since the last fetch\n", folder, imapName)
+		RunSummary.AddUnchanged(imapName, folder)
+		return []Message{}, nil
+	}
+	msgs, err := readImap(c, imapName, folder, newMessages, filter)
+	// the state of the folder is recorded only if all its messages are read,
+	// index-only fetch does not download their bodies
+	if err == nil && state != nil && !newMessages && !isFiltered(filter) && !Config.IndexOnly {
+		if err := setFolderState(imapName, folder, *state); err != nil {
+			log.Printf("unable to record state of '%s' on %s, error: %v\n", folder, imapName, err)
+		}
+	}
+	for _, m := range msgs {
+		if verboseLevel(imapName) > 0 {
 			log.Println("fetch", m.String())
 		}
 	}
+	if err != nil {
+		return msgs, fmt.Errorf("Fetch %s from %s: %w", folder, imapName, err)
+	}
+	return msgs, nil
 }
 
 // Sync provides sync between local maildir and IMAP servers
 func Sync(cmap map[string]*client.Client, dryRun bool) {
 	defer timing("Sync", time.Now())
 	defer profiler("Sync")()
+	if err := acquireRunLock(); err != nil {
+		log.Printf("skip sync, error: %v\n", err)
+		return
+	}
+	defer releaseRunLock()
 
-	var mlist []Message
+	mlist := make(map[string][]Message)
 	for imapName, c := range cmap {
 		// read new messages from IMAP
 		newMessages := true
 		log.Println("### read new messages on", imapName)
-		for _, m := range readImap(c, imapName, "INBOX", newMessages) {
-			if Config.Verbose > 0 {
+		msgs, err := readImap(c, imapName, "INBOX", newMessages, FlagFilter{})
+		if err != nil {
+			log.Printf("unable to read new messages on %s, error: %v\n", imapName, err)
+		}
+		for _, m := range msgs {
+			if verboseLevel(imapName) > 0 {
 				log.Println("Read new message", m.String())
 			}
 		}
@@ -712,46 +1589,137 @@ func Sync(cmap map[string]*client.Client, dryRun bool) {
 		// this step will ensure that we get local copies of non-new messages
 		log.Println("### read all messages on", imapName)
 		newMessages = false
-		for _, msg := range readImap(c, imapName, "INBOX", newMessages) {
-			mlist = append(mlist, msg)
+		msgs, err = readImap(currentClient(imapName, c), imapName, "INBOX", newMessages, FlagFilter{})
+		if err != nil {
+			// we can't merge partial snapshot of IMAP folder since missing
+			// messages would be treated as deleted ones
+			log.Printf("skip sync of %s, error: %v\n", imapName, err)
+			continue
 		}
+		mlist[imapName] = msgs
+	}
+	if interrupted() {
+		log.Println("### sync is interrupted, skip merge")
+		return
 	}
 
-	// get local maildir snapshot
-	log.Println("### read local maildir")
-	var mdict map[string]string
-	if Config.CommonInbox {
-		mdict = readMaildir("", "INBOX")
-	} else {
-		for name := range cmap {
-			for k, v := range readMaildir(name, "INBOX") {
-				mdict[k] = v
+	// now perform three-way merge of messages we got from IMAP, our local
+	// maildir snapshot and the state of the last sync, and collect
+	// messages for deletion on IMAP server(s)
+	var dlist []Message
+	var abort error
+	merged := make(map[string]*client.Client)
+	for imapName, c := range cmap {
+		if _, ok := mlist[imapName]; !ok {
+			continue
+		}
+		merged[imapName] = c
+		log.Println("### merge local maildir with", imapName)
+		name := imapName
+		if Config.CommonInbox {
+			name = ""
+		}
+		mdict := readMaildir(name, "INBOX")
+		c = currentClient(imapName, c)
+		setOperation(imapName, "merge", "INBOX")
+		mdel := mergeFolder(c, imapName, "INBOX", mlist[imapName], mdict, dryRun)
+		for _, msg := range mdel {
+			if dryRun {
+				log.Println("dry-run expunge", msg.String())
+			} else {
+				dlist = append(dlist, msg)
 			}
 		}
+		if !dryRun {
+			setPending(imapName, len(mdel))
+		}
+		if err := checkDeleteLimit(imapName, len(mdel), len(mlist[imapName])); err != nil {
+			abort = err
+		}
+	}
+	if abort != nil {
+		// do not issue any deletion if deletion set exceeds the limit,
+		// e.g. if local maildir failed to mount and looks empty
+		log.Printf("### abort sync deletions: %v\n", abort)
+		RunSummary.AddError(MessageError{Error: abort})
+		dlist = nil
 	}
+	if !dryRun && abort == nil {
+		removeImapMessages(merged, dlist)
+	}
+	for imapName := range mlist {
+		setPending(imapName, 0)
+		setOperation(imapName, "idle", "")
+		setLastSync(imapName)
+	}
+}
 
-	// now loop over messages we got from IMAP and compare with our local maildir
-	// then we collect message ids for deletion
-	var dlist []Message
-	for _, msg := range mlist {
-		// check if our message exists in DB
-		m, e := findMessage(msg.HashId)
-		if e == nil && m.HashId == msg.HashId {
-			// we found message in DB, check if it exists in local maildir
-			if _, ok := mdict[m.HashId]; !ok {
-				// message is not found in local maildir and we need to delete it
-				if dryRun {
-					log.Println("dry-run expunge", msg.String())
-				} else {
-					dlist = append(dlist, msg)
+// helper function to check that number of messages to delete on IMAP server
+// does not exceed Config.MaxDeleteCount and Config.MaxDeletePercent of the
+// folder size, the check is skipped if Config.ForceDelete is set
+func checkDeleteLimit(imapName string, ndel, total int) error {
+	if ndel == 0 || Config.ForceDelete {
+		return nil
+	}
+	if Config.MaxDeleteCount > 0 && ndel > Config.MaxDeleteCount {
+		return fmt.Errorf("%d message(s) to delete on %s exceeds maxDeleteCount %d, use -force-delete for deliberate mass-cleanup", ndel, imapName, Config.MaxDeleteCount)
+	}
+	if total > 0 && Config.MaxDeletePercent > 0 && 100*float64(ndel)/float64(total) > Config.MaxDeletePercent {
+		return fmt.Errorf("%d out of %d message(s) to delete on %s exceeds maxDeletePercent %v, use -force-delete for deliberate mass-cleanup", ndel, total, imapName, Config.MaxDeletePercent)
+	}
+	return nil
+}
+
+// helper function to log action suppressed in safe mode
+func logSafeMode(imapName, action string) {
+	log.Printf("### SAFE MODE: skip %s on %s\n", action, imapName)
+}
+
+// helper function to exclude messages larger than Config.ProtectSizeAbove
+// from given list of messages to delete, the sizes are fetched from IMAP
+// server and all messages of the server are protected if fetch fails
+func protectLargeMessages(cmap map[string]*client.Client, mlist []Message) []Message {
+	var out []Message
+	for imapName, c := range cmap {
+		var ulist []uint32
+		for _, m := range mlist {
+			if m.Imap == imapName {
+				ulist = append(ulist, m.Uid)
+			}
+		}
+		if len(ulist) == 0 {
+			continue
+		}
+		sizes := make(map[uint32]uint32)
+		_, err := withReconnect(c, imapName, "", func(c *client.Client) error {
+			if _, err := c.Select(imapFolder(imapName, "inbox"), false); err != nil {
+				return err
+			}
+			messages := make(chan *imap.Message, 10)
+			done := fetchMessages(c, uidSet(ulist), []imap.FetchItem{imap.FetchRFC822Size, imap.FetchUid}, messages, true)
+			for msg := range messages {
+				if msg != nil {
+					sizes[msg.Uid] = msg.Size
 				}
 			}
+			return <-done
+		})
+		if err != nil {
+			log.Printf("### protect all messages on %s, unable to fetch their sizes, error: %v\n", imapName, err)
+			continue
+		}
+		for _, m := range mlist {
+			if m.Imap != imapName {
+				continue
+			}
+			if size, ok := sizes[m.Uid]; ok && int64(size) > Config.ProtectSizeAbove {
+				log.Printf("### protected: skip removal of %s of %d bytes on %s\n", m.String(), size, imapName)
+				continue
+			}
+			out = append(out, m)
 		}
 	}
-	if !dryRun {
-		removeImapMessages(cmap, dlist)
-		removeLocalMessages(cmap, dlist)
-	}
+	return out
 }
 
 // helper function to remove messages in IMAP server(s)
@@ -763,101 +1731,133 @@ func removeImapMessages(cmap map[string]*client.Client, mlist []Message) {
 	if Config.Verbose > 0 {
 		log.Println("removeImapMessages", mlist)
 	}
-	for imapName, c := range cmap {
-		// select messages from IMAP inbox folder
-		inboxFolder := imapFolder(imapName, "inbox")
-		_, err := c.Select(inboxFolder, false)
-		if err != nil {
-			log.Fatal(err)
+	if Config.SafeMode {
+		for _, m := range mlist {
+			logSafeMode(m.Imap, fmt.Sprintf("removal of %s", m.String()))
 		}
-
-		// get list of message seq numbers for our IMAP server
-		var slist []uint32
-		var hlist []string
+		return
+	}
+	if Config.ProtectSizeAbove > 0 {
+		mlist = protectLargeMessages(cmap, mlist)
+	}
+	// servers are processed in parallel by bounded number of workers and
+	// failure of one server does not affect others
+	workers := Config.RemoveWorkers
+	if workers <= 0 {
+		workers = 4
+	}
+	sem := make(chan struct{}, workers)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(map[string]error)
+	for imapName, c := range cmap {
+		// get list of messages for our IMAP server
+		var msgs []Message
 		for _, m := range mlist {
 			if m.Imap == imapName {
-				slist = append(slist, m.SeqNumber)
-				hlist = append(hlist, m.HashId)
+				msgs = append(msgs, m)
 			}
 		}
-		seqset := new(imap.SeqSet)
-		seqset.AddNum(slist...)
-		if Config.Verbose > 0 {
-			log.Printf("%s, remove seqset: %v\n", imapName, seqset)
-		}
-		if seqset.Empty() {
-			continue
-		}
-		// now we mark messages for deletion in IMAP
-		item := imap.FormatFlagsOp(imap.AddFlags, true)
-		flags := []interface{}{imap.DeletedFlag}
-		if Config.Verbose > 1 {
-			log.Println("Move", imap.DeletedFlag)
-		}
-		if err := c.Store(seqset, item, flags, nil); err != nil {
-			log.Fatal(err)
-		}
-		// delete messages on IMAP server
-		if err := c.Expunge(nil); err != nil {
-			log.Fatal(err)
+		wg.Add(1)
+		go func(c *client.Client, imapName string, msgs []Message) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			var err error
+			if Config.DeleteGracePeriod > 0 {
+				err = deferImapMessages(c, imapName, msgs)
+			} else {
+				err = removeServerMessages(c, imapName, msgs)
+			}
+			if err != nil {
+				mutex.Lock()
+				errs[imapName] = err
+				mutex.Unlock()
+			}
+		}(c, imapName, msgs)
+	}
+	wg.Wait()
+	for imapName, err := range errs {
+		log.Printf("unable to remove messages on %s, error: %v\n", imapName, err)
+	}
+}
+
+// helper function to remove given inbox messages of IMAP server right away,
+// the messages are removed in batches of Config.DeleteBatchSize since some
+// servers fail on large UID sets
+func removeServerMessages(c *client.Client, imapName string, msgs []Message) error {
+	batch := Config.DeleteBatchSize
+	if batch <= 0 {
+		batch = len(msgs)
+	}
+	for start := 0; start < len(msgs); start += batch {
+		end := start + batch
+		if end > len(msgs) {
+			end = len(msgs)
 		}
-		// delete messages in local maildir DB
-		for _, hid := range hlist {
-			deleteMessage(hid)
+		if err := removeServerBatch(c, imapName, msgs[start:end]); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-// helper function to remove messages in local folder
-func removeLocalMessages(cmap map[string]*client.Client, mlist []Message) {
-	defer timing("removeLocalMessages", time.Now())
-	defer profiler("removeLocalMessages")()
-
-	if Config.Verbose > 0 {
-		log.Println("removeLocalMessages", mlist)
+// helper function to remove given batch of inbox messages of IMAP server,
+// see removeServerMessages
+func removeServerBatch(c *client.Client, imapName string, msgs []Message) error {
+	if len(msgs) == 0 {
+		return nil
 	}
-	for imapName, c := range cmap {
-		// select messages from IMAP inbox folder
-		inboxFolder := imapFolder(imapName, "inbox")
-		_, err := c.Select(inboxFolder, false)
+	// select messages from IMAP inbox folder
+	inboxFolder := imapFolder(imapName, "inbox")
+	// mark messages for deletion and expunge them, the operation is
+	// idempotent by UIDs and it is replayed if connection drops, the
+	// messages are verified within the same SELECT session since the
+	// folder could change after sync read it
+	var skipped []MessageError
+	_, err := withReconnect(c, imapName, "", func(c *client.Client) error {
+		mbox, err := c.Select(inboxFolder, false)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-
-		// get list of message ids for our IMAP server
-		var hlist []string
-		for _, m := range mlist {
-			if m.Imap == imapName {
-				log.Println("### hid number to delete", m.HashId)
-				hlist = append(hlist, m.HashId)
-			}
-		}
-		// delete messages in local maildir DB
-		for _, hid := range hlist {
-			// location of user inbox, either Maildir/Inbox/new or
-			// Maildir/<username>/INBOX/new
-			fpath := localFolder(imapName, inboxFolder)
-			fdir := fmt.Sprintf("%s/%s/new", Config.Maildir, fpath)
-			idir := fmt.Sprintf("%s/Inbox/new", Config.Maildir)
-			inboxDirs := []string{fdir, idir}
-			fpat := fmt.Sprintf("%s.%s", hid, hostname)
-			for _, dir := range inboxDirs {
-				if files, err := os.ReadDir(dir); err == nil {
-					for _, f := range files {
-						if strings.HasSuffix(f.Name(), fpat) {
-							fname := filepath.Join(fdir, f.Name())
-							if _, err := os.Stat("/path/to/whatever"); err == nil {
-								log.Printf("### DELETE local file %s", fname)
-								if err := os.Remove(fname); err != nil {
-									log.Printf("ERROR: unable to delete %s, error %v", fname, err)
-								}
-							}
-						}
-					}
-				}
-			}
+		var skip []MessageError
+		msgs, skip, err = verifyTargets(c, imapName, mbox, msgs)
+		if err != nil {
+			return err
+		}
+		skipped = append(skipped, skip...)
+		if len(msgs) == 0 {
+			return nil
+		}
+		seqset := uidSet(messageUids(msgs))
+		if verboseLevel(imapName) > 0 {
+			log.Printf("%s, remove uidset: %v\n", imapName, seqset)
 		}
+		item := imap.FormatFlagsOp(imap.AddFlags, true)
+		flags := []interface{}{imap.DeletedFlag}
+		if verboseLevel(imapName) > 1 {
+			log.Println("Move", imap.DeletedFlag)
+		}
+		if err := c.UidStore(seqset, item, flags, nil); err != nil {
+			return err
+		}
+		// delete messages on IMAP server
+		return expungeUids(c, messageUids(msgs), nil)
+	})
+	reportSkipped(skipped)
+	if err != nil {
+		return err
 	}
+	// delete messages in local maildir DB, sync state is removed only for
+	// expunged messages such that failed removal is merged again
+	for _, m := range msgs {
+		deleteMessage(m.HashId)
+		deleteMessageAccount(m.HashId, imapName)
+		deleteSyncState(m.HashId, imapName, "INBOX")
+		emitMessageEvent("message_deleted", imapName, inboxFolder, m)
+	}
+	RunSummary.AddDeleted(len(msgs))
+	return nil
 }
 
 // helper function to report timing of given function
@@ -894,8 +1894,10 @@ func sendEmailOld(host, port, from, password string, to []string, message []byte
 }
 
 func main() {
-	var config string
-	flag.StringVar(&config, "config", os.Getenv("HOME")+"/.goimapsyncrc", "config JSON file")
+	var config StringList
+	flag.Var(&config, "config", "config JSON file or HTTP(S) url, can be repeated to merge several configs (default $HOME/.goimapsyncrc)")
+	var overrides StringList
+	flag.Var(&overrides, "set", "override config value, e.g. -set servers.work.useTls=false, can be repeated")
 	var dryRun bool
 	flag.BoolVar(&dryRun, "dryRun", false, "perform dry-run")
 	var mid string
@@ -903,37 +1905,145 @@ func main() {
 	var folder string
 	flag.StringVar(&folder, "folder", "INBOX", "folder to use")
 	var op string
-	flag.StringVar(&op, "op", "sync", "perform given operation")
+	flag.StringVar(&op, "op", "sync", "perform given operation (deprecated, use command instead)")
 	var profiler string
 	flag.StringVar(&profiler, "profiler", "", "profiler file name")
 	var version bool
 	flag.BoolVar(&version, "version", false, "Show version")
 	var verbose int
 	flag.IntVar(&verbose, "verbose", 0, "verbosity level")
+	var threadAlgorithm string
+	flag.StringVar(&threadAlgorithm, "threadAlgorithm", "REFERENCES", "thread algorithm: REFERENCES or ORDEREDSUBJECT")
+	var addFlags string
+	flag.StringVar(&addFlags, "add", "", "comma separated list of flags to add, e.g. \\Seen")
+	var removeFlags string
+	flag.StringVar(&removeFlags, "remove", "", "comma separated list of flags to remove, e.g. \\Flagged")
+	var createFolder bool
+	flag.BoolVar(&createFolder, "create-folder", false, "create missing target folder on IMAP server")
+	var limit int
+	flag.IntVar(&limit, "limit", 10, "number of records to show, e.g. in history")
+	var dbUri string
+	flag.StringVar(&dbUri, "db", "", "DB uri to use instead of config one, e.g. sqlite3:///tmp/test.db")
+	var previewSize int
+	flag.IntVar(&previewSize, "previewSize", 4096, "number of bytes to fetch in preview")
+	var serverName string
+	flag.StringVar(&serverName, "server", "", "name of IMAP server to use, default all servers")
+	var source string
+	flag.StringVar(&source, "source", "", "local maildir to import, default maildir of the config")
+	var forceDelete bool
+	flag.BoolVar(&forceDelete, "force-delete", false, "allow deletions on IMAP server(s) beyond maxDeleteCount/maxDeletePercent limits")
+	var indexOnly bool
+	flag.BoolVar(&indexOnly, "index-only", false, "record envelopes of messages and defer download of their bodies to fetch-bodies operation")
+	var manifest bool
+	flag.BoolVar(&manifest, "manifest", false, "write JSON manifest of messages seen by backup-fetch")
+	var out string
+	flag.StringVar(&out, "out", "", "output directory or file, e.g. for export-eml")
+	var since string
+	flag.StringVar(&since, "since", "", "use messages since given date, e.g. 2024-06-01, 2024-06-01T10:00:00+02:00, 1-Jun-2024 or 90d, 12h, 3w before now")
+	var before string
+	flag.StringVar(&before, "before", "", "use messages before given date, see -since for accepted forms")
+	var threadRoot string
+	flag.StringVar(&threadRoot, "thread", "", "message id of conversation root to list its messages (list-threads operation)")
+	var zipOutput bool
+	flag.BoolVar(&zipOutput, "zip", false, "write export into single zip archive")
+	var unseen bool
+	flag.BoolVar(&unseen, "unseen", false, "fetch only unseen messages, e.g. with fetch-all")
+	var withFlags string
+	flag.StringVar(&withFlags, "with-flags", "", "comma separated list of flags fetched messages should have, e.g. \\Flagged")
+	var withoutFlags string
+	flag.StringVar(&withoutFlags, "without-flags", "", "comma separated list of flags fetched messages should not have, e.g. \\Seen")
+	var incremental string
+	flag.StringVar(&incremental, "incremental", "", "previous backup manifest to make incremental backup")
+	var in string
+	flag.StringVar(&in, "in", "", "input archive, e.g. for restore")
+	var target string
+	flag.StringVar(&target, "target", "", "target directory, e.g. for restore")
+	var savePinFlag bool
+	flag.BoolVar(&savePinFlag, "save", false, "write pinned certificate fingerprint into config file (pin operation)")
+	var email string
+	flag.StringVar(&email, "email", "", "email address to discover IMAP and SMTP settings of")
+	var writeConfig bool
+	flag.BoolVar(&writeConfig, "write", false, "append discovered settings to config file after confirmation (discover operation)")
+	var fromServer string
+	flag.StringVar(&fromServer, "from", "", "name of source IMAP server for migrate operation")
+	var toServer string
+	flag.StringVar(&toServer, "to", "", "name of destination IMAP server for migrate operation")
+	var force bool
+	flag.BoolVar(&force, "force", false, "overwrite non-empty target, e.g. in restore, or act on UIDs never seen in DB")
+	var uidList string
+	flag.StringVar(&uidList, "uid", "", "comma separated list of message UIDs or UID ranges, e.g. 4521,4600:4610, to use instead of -mid in move and flag")
+	var folderFrom string
+	flag.StringVar(&folderFrom, "folder-from", "INBOX", "source folder of messages given by -uid")
+	var query string
+	flag.StringVar(&query, "query", "", "search query of remote-search, e.g. 'FROM boss SINCE 1-Jun-2024 SUBJECT \"review\"'")
+	var uidsOnly bool
+	flag.BoolVar(&uidsOnly, "uids-only", false, "print comma separated UIDs of found messages in remote-search")
+	var merge bool
+	flag.BoolVar(&merge, "merge", false, "restore into live maildir skipping existing messages")
+	var full bool
+	flag.BoolVar(&full, "full", false, "verify all files, e.g. in verify-local")
+	var repair bool
+	flag.BoolVar(&repair, "repair", false, "re-fetch corrupted messages, e.g. in verify-local")
+	var safeMode bool
+	flag.BoolVar(&safeMode, "safe", false, "safe mode, never delete anything on IMAP server(s)")
+	var allFolders bool
+	flag.BoolVar(&allFolders, "all-folders", false, "fetch all folders of IMAP server(s) creating their local folders, see autoAddFolders and excludeFolders")
+	var format string
+	flag.StringVar(&format, "format", "", "output format of addresses operation: alias (mutt, default), abook or csv, and of stats operation: text (default), json or prometheus")
+	var ignored bool
+	flag.BoolVar(&ignored, "ignored", false, "list messages skipped by ignore rules of the config (list operation)")
+	var jsonOutput bool
+	flag.BoolVar(&jsonOutput, "json", false, "print output in JSON format")
+	var eventsFormat string
+	flag.StringVar(&eventsFormat, "events", "", "stream events of the operation on stdout in given format, e.g. ndjson")
 	flag.Usage = func() {
-		fmt.Println("Usage: goimapsync [options]")
-		flag.PrintDefaults()
-		fmt.Println("Supported operations:")
-		fmt.Println("   fetch-new: to get list of new messages from specified IMAP folder")
-		fmt.Println("   fetch-all: to get list of all messages from specified IMAP folder")
-		fmt.Println("   move     : to move givem message on IMAP server, e.g. send to Spam")
-		fmt.Println("   sync     : to sync local maildir with IMAP server(s)")
+		fmt.Println("Usage: goimapsync [global options] <command> [options]")
+		fmt.Println("   use goimapsync help <command> to see options of the command,")
+		fmt.Println("   the deprecated form goimapsync -op=<command> [options] accepts all options")
+		fmt.Println("Global options:")
+		global := flag.NewFlagSet("goimapsync", flag.ContinueOnError)
+		global.SetOutput(os.Stdout)
+		copyFlags(global, globalFlags)
+		global.PrintDefaults()
+		printCommands()
 		fmt.Println("Examples:")
 		fmt.Println("   # fetch new messages from given IMAP folder")
-		fmt.Println("   goimapsync -config config.json -op=fetch-new -folder=MyFolder")
+		fmt.Println("   goimapsync -config config.json fetch -new -folder MyFolder")
 		fmt.Println("   # fetch all messages from given IMAP folder")
-		fmt.Println("   goimapsync -config config.json -op=fetch-all -folder=MyFolder")
+		fmt.Println("   goimapsync -config config.json fetch -folder MyFolder")
 		fmt.Println("   # sync mails form local maildir to IMAP")
-		fmt.Println("   goimapsync -config config.json -op=sync")
+		fmt.Println("   goimapsync -config config.json sync")
 		fmt.Println("   # the same operation with encrypted (gpg) config")
-		fmt.Println("   gpg -d -o - $HOME/.goimapsync.gpg | goimapsync -op=sync -config -")
-		fmt.Println("   # sync mails form given IMAP folder into local maildir")
-		fmt.Println("   gpg -d -o - $HOME/.goimapsync.gpg | goimapsync -config config.json -op=fetch -folder=MyFolder")
+		fmt.Println("   gpg -d -o - $HOME/.goimapsync.gpg | goimapsync -config - sync")
 		fmt.Println("   # move given mail id in IMAP server to given folder")
-		fmt.Println("   goimapsync -config config.json -op=move -mid=123 -folder=MyFolder")
+		fmt.Println("   goimapsync -config config.json move -mid 123 -to MyFolder")
+		fmt.Println("   # write given mail id to stdout")
+		fmt.Println("   goimapsync -config config.json cat -mid 123 | less")
+		fmt.Println("   # mark given mail id as read and unflagged")
+		fmt.Println("   goimapsync -config config.json flag -mid 123 -add='\\Seen' -remove='\\Flagged'")
+		fmt.Println("   # list messages of given IMAP folder in JSON format")
+		fmt.Println("   goimapsync -config config.json -json list -folder INBOX")
+	}
+	// the command line is either subcommand style or deprecated -op one
+	legacy := false
+	if cmdOp, ok := parseCommand(os.Args[1:]); ok {
+		op = cmdOp
+	} else {
+		flag.Parse()
+		legacy = true
 	}
-	flag.Parse()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	if legacy {
+		if flag.NArg() > 0 {
+			log.Fatalf("unexpected argument(s): %s, command options should follow command name, see goimapsync -help", strings.Join(flag.Args(), " "))
+		}
+		flag.Visit(func(f *flag.Flag) {
+			setFlags[f.Name] = true
+			if f.Name == "op" {
+				log.Printf("-op option is deprecated, please use: goimapsync [global options] %s [options]\n", op)
+			}
+		})
+	}
 
 	if version {
 		fmt.Println(info())
@@ -941,64 +2051,574 @@ func main() {
 
 	}
 
-	ParseConfig(config)
+	// stream events, they are written until all deferred calls are done
+	if eventsFormat != "" {
+		if err := startEvents(eventsFormat, op); err != nil {
+			log.Fatal(err)
+		}
+		defer stopEvents()
+	}
+
+	if len(config) == 0 {
+		config = StringList{os.Getenv("HOME") + "/.goimapsyncrc"}
+	}
+
+	// discover operation finds settings of new account, there is no config yet
+	if op == "discover" {
+		var configFile string
+		if writeConfig {
+			if len(config) != 1 || config[0] == "-" || isConfigUrl(config[0]) {
+				log.Fatal("discover operation can write settings only into single local config file")
+			}
+			configFile = config[0]
+		}
+		if err := Discover(email, configFile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ParseConfig(config, overrides)
 	// overwrite verbose level in config
 	if verbose > 0 {
 		Config.Verbose = verbose
 		log.SetFlags(log.LstdFlags | log.Lshortfile)
 	}
+	if createFolder {
+		Config.CreateFolder = createFolder
+	}
+	if forceDelete {
+		Config.ForceDelete = forceDelete
+	}
+	if indexOnly {
+		Config.IndexOnly = indexOnly
+	}
+	// bodies are fetched regardless of index-only option of the config
+	if op == "fetch-bodies" {
+		Config.IndexOnly = false
+	}
+	// safe mode can be enabled but never disabled from command line
+	if safeMode {
+		Config.SafeMode = true
+	}
+	if Config.SafeMode {
+		log.Println("safe mode: no messages will be deleted on IMAP server(s)")
+	}
+	if op == "remote-search" && uidsOnly && serverName == "" {
+		log.Fatal("-uids-only option requires -server option")
+	}
+	// folder names copied from MUA config may be in modified UTF-7, e.g.
+	// Entw&APw-rfe, while go-imap expects UTF-8 names and encodes them itself
+	folder = decodeFolderName(folder)
+	folderFrom = decodeFolderName(folderFrom)
+	if allFolders && isFlagSet("folder") {
+		log.Fatal("-all-folders option fetches all folders, please do not use it with -folder option")
+	}
+	// UIDs are specific to IMAP server and its folder
+	var uids []uint32
+	if uidList != "" {
+		if serverName == "" {
+			log.Fatal("-uid option requires -server option")
+		}
+		var err error
+		if uids, err = parseUids(uidList); err != nil {
+			log.Fatalf("invalid -uid value '%s', error: %v", uidList, err)
+		}
+	}
+	if serverName != "" {
+		var servers []Server
+		for _, s := range Config.Servers {
+			if s.Name == serverName {
+				servers = append(servers, s)
+			}
+		}
+		if len(servers) == 0 {
+			log.Fatalf("no IMAP server '%s' found in configuration", serverName)
+		}
+		Config.Servers = servers
+	}
+	if dbUri != "" {
+		if _, _, err := parseDBUri(dbUri); err != nil {
+			log.Fatalf("invalid -db value '%s', error: %v", dbUri, err)
+		}
+		Config.DBUri = dbUri
+	}
+	// pin operation shows fingerprints of TLS certificate of given IMAP server
+	if op == "pin" {
+		if serverName == "" {
+			log.Fatal("pin operation requires -server option")
+		}
+		var configFile string
+		if savePinFlag {
+			if len(config) != 1 || config[0] == "-" || isConfigUrl(config[0]) {
+				log.Fatal("pin operation can save fingerprint only into single local config file")
+			}
+			configFile = config[0]
+		}
+		if err := Pin(Config.Servers[0], configFile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// print-config operation shows merged configuration
+	if op == "print-config" {
+		if err := printConfig(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// doctor operation checks setup and quits with non-zero code on failure
+	if op == "doctor" {
+		if printDoctor(os.Stdout, Doctor()) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 	if profiler != "" {
 		Config.Profiler = profiler
 		initProfiler(profiler)
 	}
+	// interrupted run quits with its exit code after clean shutdown
+	defer exitInterrupted()
 	// add timing profile
 	defer timing("main", time.Now())
+	defer RunSummary.Print()
+
+	// dump status of IMAP servers upon SIGUSR1 signal
+	initStatusSignal()
+	// stop long operations upon SIGINT or SIGTERM signal
+	initInterruptSignal()
 
 	// init imap folders map
 	var err error
 	imapFolders = make(map[string][]string)
-	hostname, err = os.Hostname()
+	hostname, err = maildirHostname()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// init our message db
-	mdb, err = InitDB()
+	// init our message db, read-only operations never take DB write locks
+	readOnly := false
+	switch op {
+	case "list", "threads", "list-threads", "cat", "history", "preview", "export-eml", "addresses", "stats":
+		readOnly = true
+	case "migrate-db", "repair-flags":
+		// dry-run only reports pending changes and never applies them
+		readOnly = dryRun
+	}
+	log.Println("use DB", Config.DBUri)
+	mdb, err = InitDB(readOnly)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer mdb.Close()
+	if op != "migrate-db" {
+		if err := checkLocalLayout(readOnly); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// migrate-db operation reports schema version and pending migrations
+	if op == "migrate-db" {
+		if err := MigrateDB(dryRun); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// history operation shows last runs of goimapsync
+	if op == "history" {
+		printHistory(limit)
+		return
+	}
+
+	// vacuum operation rebuilds DB file
+	if op == "vacuum" {
+		if err := VacuumDB(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// recover writes of mail files interrupted by crash of previous run
+	if !readOnly {
+		if err := reindexPending(); err != nil {
+			log.Println("unable to recover interrupted writes", err)
+		}
+	}
+
+	// db-check operation reports inconsistencies left after recovery
+	if op == "db-check" {
+		check, err := CheckDB()
+		if err != nil {
+			log.Fatal(err)
+		}
+		printDBCheck(os.Stdout, check)
+		if n := check.Count(); n > 0 {
+			log.Fatalf("DB check found %d inconsistencies", n)
+		}
+		return
+	}
+
+	// record the run in DB, read-only operations are not recorded
+	if !readOnly {
+		rid, err := startRun(op)
+		if err != nil {
+			log.Println("unable to record the run", err)
+		}
+		defer func() {
+			if err := finishRun(RunSummary.Run(rid), Config.HistoryRetention); err != nil {
+				log.Println("unable to record the run", err)
+			}
+			if vacuumDue(rid) {
+				if err := VacuumDB(); err != nil {
+					log.Println(err)
+				}
+			}
+		}()
+	}
+
+	// repair-flags operation works with local maildir and DB only
+	if op == "repair-flags" {
+		if err := RepairFlags(dryRun); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// export-eml operation works with local maildir only
+	if op == "export-eml" {
+		tsince, err := parseDate(since)
+		if err != nil {
+			log.Fatalf("invalid -since value, error: %v", err)
+		}
+		tbefore, err := parseDate(before)
+		if err != nil {
+			log.Fatalf("invalid -before value, error: %v", err)
+		}
+		if err := ExportEml(folder, out, tsince, tbefore, zipOutput); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// stats operation works with DB only, -json is shortcut for -format=json
+	if op == "stats" {
+		if jsonOutput && format == "" {
+			format = "json"
+		}
+		stats, err := CollectStats()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := printStats(os.Stdout, stats, format); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// addresses operation works with local maildir only, all its folders
+	// are used unless -folder is given
+	if op == "addresses" {
+		tsince, err := parseDate(since)
+		if err != nil {
+			log.Fatalf("invalid -since value, error: %v", err)
+		}
+		tbefore, err := parseDate(before)
+		if err != nil {
+			log.Fatalf("invalid -before value, error: %v", err)
+		}
+		afolder := ""
+		if isFlagSet("folder") {
+			afolder = folder
+		}
+		cs, err := Addresses(serverName, afolder, tsince, tbefore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := printAddresses(os.Stdout, cs, format); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// list-threads operation works with local maildir and DB only
+	if op == "list-threads" {
+		tsince, err := parseDate(since)
+		if err != nil {
+			log.Fatalf("invalid -since value, error: %v", err)
+		}
+		convs, err := Conversations(serverName, folder, tsince)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if threadRoot != "" {
+			if err := printConversation(convs, threadRoot); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		printConversations(convs)
+		return
+	}
+
+	// backup operation works with local maildir and DB only
+	if op == "backup" {
+		if err := BackupMaildir(out, incremental); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// restore operation works with backup archive only
+	if op == "restore" {
+		if err := RestoreMaildir(in, target, force, merge); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// verify-local operation requires connection only to repair messages
+	if op == "verify-local" && !repair {
+		if err := VerifyLocal(nil, full, repair); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// list of ignored messages is kept in DB
+	if op == "list" && ignored {
+		mlist, err := ListIgnored(folder)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printMessages(mlist, jsonOutput)
+		return
+	}
+
+	// cat operation does not require connection if message is available locally
+	if op == "cat" {
+		if err := Cat(mid); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	// connect to our IMAP servers
 	cmap := connect()
 	defer logout(cmap)
 
+	// use cached list of IMAP folders, the refresh-folders operation
+	// re-lists folders of all IMAP servers and overwrites the cache
 	for imapName, c := range cmap {
-		folders := getImapFolders(c, imapName)
+		folders, err := getCachedFolders(imapName)
+		if err != nil || len(folders) == 0 || op == "refresh-folders" {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(Config.ListTimeout)*time.Second)
+			folders, err = getImapFolders(ctx, c, imapName)
+			cancel()
+			if err != nil {
+				// skip server which fails to list its folders
+				log.Printf("unable to get folders of %s, error: %v\n", imapName, err)
+				c.Logout()
+				delete(cmap, imapName)
+				continue
+			}
+			if !readOnly {
+				if err := saveCachedFolders(imapName, folders); err != nil {
+					log.Printf("unable to cache folders of %s, error: %v\n", imapName, err)
+				}
+			}
+		}
 		imapFolders[imapName] = folders
-		if Config.Verbose > 0 {
+		if verboseLevel(imapName) > 0 {
 			log.Println("IMAP", imapName, folders)
 		}
 	}
+	if len(cmap) == 0 {
+		log.Fatal("no IMAP server is available")
+	}
+	// complete or roll back operations interrupted by crash of previous run
+	if !readOnly {
+		for name, c := range cmap {
+			if err := recoverOperations(c, name); err != nil {
+				log.Printf("unable to recover operations of %s, error: %v\n", name, err)
+			}
+		}
+	}
+	// flag filter of fetched messages, -unseen is shortcut for -without-flags=\Seen
+	filter := FlagFilter{With: splitList(withFlags), Without: splitList(withoutFlags)}
+	if unseen {
+		filter.Without = append(filter.Without, imap.SeenFlag)
+	}
 	switch op {
+	case "refresh-folders":
+		// folders cache is already refreshed above
+		for imapName, folders := range imapFolders {
+			log.Printf("refreshed %d folder(s) of %s\n", len(folders), imapName)
+		}
 	case "move":
 		// perform move action for given message id and IMAP folder
+		if uids != nil {
+			for name, c := range cmap {
+				if err := MoveUids(c, name, folderFrom, uids, folder, force); err != nil {
+					log.Printf("unable to move UIDs '%s' on '%s', error: %v\n", uidList, name, err)
+				}
+			}
+			break
+		}
+		for name, c := range cmap {
+			if err := Move(c, name, mid, folder); err != nil {
+				log.Printf("unable to move '%s' on '%s', error: %v\n", mid, name, err)
+			}
+		}
+	case "flag":
+		// add or remove flags of given message id
+		if uids != nil {
+			for name, c := range cmap {
+				if err := SetFlagsUids(c, name, folderFrom, uids, splitList(addFlags), splitList(removeFlags), force); err != nil {
+					log.Printf("unable to set flags of UIDs '%s' on '%s', error: %v\n", uidList, name, err)
+				}
+			}
+			break
+		}
 		for name, c := range cmap {
-			Move(c, name, mid, folder)
+			if err := SetFlags(c, name, mid, splitList(addFlags), splitList(removeFlags)); err != nil {
+				log.Printf("unable to set flags of '%s' on '%s', error: %v\n", mid, name, err)
+			}
 		}
 	case "fetch-new":
 		// fetch new messages for given IMAP folder
+		if allFolders {
+			mirrorFetch(cmap, true, filter)
+			break
+		}
 		for name, c := range cmap {
-			Fetch(c, name, folder, true)
+			msgs, err := Fetch(c, name, folder, true, filter)
+			if err != nil {
+				log.Println(err)
+			}
+			log.Printf("processed %d message(s) of '%s' on %s\n", len(msgs), folder, name)
+		}
+	case "fetch-query":
+		// fetch messages of given IMAP folder which match search query, the
+		// other messages are not recorded in DB and never seen by sync
+		criteria, err := parseQuery(query)
+		if err != nil {
+			log.Fatalf("invalid -query value '%s', error: %v", query, err)
+		}
+		filter.Query = criteria
+		for name, c := range cmap {
+			msgs, err := Fetch(c, name, folder, false, filter)
+			if err != nil {
+				log.Println(err)
+			}
+			log.Printf("processed %d message(s) of '%s' matching query on %s\n", len(msgs), folder, name)
 		}
 	case "fetch-all":
 		// fetch all messages (old and new) for given IMAP folder
+		if allFolders {
+			mirrorFetch(cmap, false, filter)
+			break
+		}
+		for name, c := range cmap {
+			msgs, err := Fetch(c, name, folder, false, filter)
+			if err != nil {
+				log.Println(err)
+			}
+			log.Printf("processed %d message(s) of '%s' on %s\n", len(msgs), folder, name)
+		}
+	case "list":
+		// list messages of given IMAP folder
+		var mlist []MessageInfo
+		for name, c := range cmap {
+			msgs, err := ListMessages(c, name, folder)
+			if err != nil {
+				log.Printf("unable to list folder '%s' on '%s', error: %v\n", folder, name, err)
+			}
+			mlist = append(mlist, msgs...)
+		}
+		printMessages(mlist, jsonOutput)
+	case "remote-search":
+		// search messages of given IMAP folder on server side
+		var mlist []MessageInfo
+		for name, c := range cmap {
+			msgs, err := RemoteSearch(c, name, folder, query)
+			if err != nil {
+				log.Printf("unable to search folder '%s' on '%s', error: %v\n", folder, name, err)
+			}
+			mlist = append(mlist, msgs...)
+		}
+		if uidsOnly {
+			printUids(mlist)
+		} else {
+			printMessages(mlist, jsonOutput)
+		}
+	case "verify-local":
+		// verify local mail files and repair corrupted ones
+		if err := VerifyLocal(cmap, full, repair); err != nil {
+			log.Println(err)
+		}
+	case "backup-fetch":
+		// append-only fetch of all IMAP folders, it never deletes local files
+		for name, c := range cmap {
+			if err := Backup(c, name, manifest); err != nil {
+				log.Printf("unable to backup '%s', error: %v\n", name, err)
+			}
+		}
+	case "import-maildir":
+		// upload existing local maildir to IMAP server, e.g. new account
+		if source == "" {
+			source = Config.Maildir
+		}
 		for name, c := range cmap {
-			Fetch(c, name, folder, false)
+			if err := ImportMaildir(c, name, source); err != nil {
+				log.Printf("unable to import %s into '%s', error: %v\n", source, name, err)
+			}
+		}
+	case "migrate":
+		// copy messages of given IMAP folder from one IMAP server to another
+		src, dst := cmap[fromServer], cmap[toServer]
+		if src == nil || dst == nil {
+			log.Fatalf("migrate operation requires connected -from and -to IMAP servers, got '%s' and '%s'", fromServer, toServer)
+		}
+		if err := Migrate(&ServerClient{Name: fromServer, Client: src}, &ServerClient{Name: toServer, Client: dst}, folder); err != nil {
+			log.Fatal(err)
+		}
+	case "preview":
+		// show first portion of given message
+		if err := Preview(cmap, mid, previewSize, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	case "threads":
+		// show thread structure of given IMAP folder
+		for name, c := range cmap {
+			threads, err := Threads(c, name, folder, threadAlgorithm)
+			if err != nil {
+				log.Printf("unable to get threads of '%s' on '%s', error: %v\n", folder, name, err)
+				continue
+			}
+			printThreads(currentClient(name, c), name, folder, threads)
+		}
+	case "fetch-bodies":
+		// fetch bodies of messages recorded by index-only sync
+		name := ""
+		if isFlagSet("folder") {
+			name = folder
+		}
+		for imapName, c := range cmap {
+			if err := FetchBodies(c, imapName, name); err != nil {
+				log.Printf("unable to fetch bodies on %s, error: %v\n", imapName, err)
+			}
 		}
 	case "sync":
 		// sync emails between local maildir and IMAP server
 		Sync(cmap, dryRun)
+	case "daemon":
+		// periodically sync emails between local maildir and IMAP servers
+		Daemon(cmap, dryRun)
 	default:
-		log.Fatalf("Given operation '%s' is not supported, please use sync, fetch-new, fetch-all\n", op)
+		log.Fatalf("Given operation '%s' is not supported, please see goimapsync -help\n", op)
 	}
 }
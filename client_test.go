@@ -0,0 +1,1215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+func TestWriteContent(t *testing.T) {
+	var buf bytes.Buffer
+	header := mail.Header{"Subject": {"Hello"}}
+	if err := writeContent(&buf, header, []byte("body\n")); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "Subject: Hello\nbody\n" {
+		t.Errorf("written content %q", buf.String())
+	}
+}
+
+func TestReadImapIsolatesMessageErrors(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	ts.add(t, "Errors", testMessage{MessageId: "<errors-1@localhost>", Subject: "Good message"})
+	ts.addRaw(t, "Errors", nil, []byte("From: selftest@example.org\r\nSubject: No message id\r\n\r\nbody\r\n"))
+	ts.add(t, "Errors", testMessage{MessageId: "<errors-2@localhost>", Subject: "Good message"})
+	c := ts.connect(t)
+
+	msgs, err := readImap(c, testServerName, "Errors", false, FlagFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("read %d message(s) instead of 2", len(msgs))
+	}
+	for _, mid := range []string{"<errors-1@localhost>", "<errors-2@localhost>"} {
+		if findLocalMail(testServerName, "Errors", md5hash(mid)) == "" {
+			t.Errorf("message %s is not written after failure of other message", mid)
+		}
+	}
+	if n := len(RunSummary.Errors); n != 1 {
+		t.Fatalf("run summary has %d error(s) instead of 1", n)
+	}
+	e := RunSummary.Errors[0]
+	if e.Imap != testServerName || e.Folder != "Errors" || e.Uid != 2 || !strings.Contains(e.Error.Error(), "message id") {
+		t.Errorf("unexpected error record %s", e.String())
+	}
+}
+
+func TestFindImapFolder(t *testing.T) {
+	imapFolders = map[string][]string{"a": {"INBOX", "Archive", "archive", "Sent Items", "Entwürfe", "[Gmail]/All Mail"}}
+	defer func() { imapFolders = make(map[string][]string) }()
+	tests := []struct {
+		imap, folder, expect string
+		fail                 bool
+	}{
+		{"a", "Archive", "Archive", false},
+		{"a", "archive", "archive", false},
+		{"a", "ARCHIVE", "Archive", false},
+		{"a", "sent items", "Sent Items", false},
+		{"a", "inbox", "INBOX", false},
+		{"b", "Inbox", "INBOX", false},
+		{"a", "Entw&APw-rfe", "Entwürfe", false},
+		{"a", "ENTW&ANw-RFE", "Entwürfe", false},
+		{"a", "entwürfe", "Entwürfe", false},
+		{"a", "[gmail]/all mail", "[Gmail]/All Mail", false},
+		{"a", "Trash", "", true},
+		{"b", "Archive", "", true},
+	}
+	for _, tt := range tests {
+		f, err := findImapFolder(tt.imap, tt.folder)
+		if tt.fail != (err != nil) || f != tt.expect {
+			t.Errorf("findImapFolder(%s, %s)=%q, %v, expected %q", tt.imap, tt.folder, f, err, tt.expect)
+		}
+	}
+}
+
+func TestCheckFolders(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		target string
+		create bool
+		fail   string
+	}{
+		{"no target", "INBOX", "", false, ""},
+		{"existing target", "INBOX", "Archive", false, ""},
+		{"missing source", "Drafts", "Archive", false, "source folder 'Drafts'"},
+		{"missing target", "INBOX", "Trash", false, "use -create-folder"},
+		{"created target", "INBOX", "Trash", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			ts.mailbox(t, "Archive")
+			c := ts.connect(t)
+			Config.CreateFolder = tt.create
+			err := checkFolders(c, testServerName, tt.source, tt.target)
+			if tt.fail != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.fail) {
+					t.Fatalf("expected error with %q, got %v", tt.fail, err)
+				}
+				if _, err := ts.User.GetMailbox(tt.target); tt.target == "Trash" && err == nil {
+					t.Errorf("missing target folder is created")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.target == "" {
+				return
+			}
+			if _, err := ts.User.GetMailbox(tt.target); err != nil {
+				t.Errorf("target folder does not exist on server: %v", err)
+			}
+			if _, err := findImapFolder(testServerName, tt.target); err != nil {
+				t.Errorf("target folder is not in folder list: %v", err)
+			}
+		})
+	}
+}
+
+func TestMove(t *testing.T) {
+	tests := []struct {
+		name   string
+		mid    string
+		folder string
+		moved  bool
+		fail   string
+	}{
+		{"move", "<move-1@localhost>", "Archive", true, ""},
+		{"unknown message", "<move-unknown@localhost>", "Archive", false, ""},
+		{"missing folder", "<move-1@localhost>", "Trash", false, "does not exist"},
+		{"no folder", "<move-1@localhost>", "", false, "requires both folder and message id"},
+		{"no message id", "", "Archive", false, "requires both folder and message id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			ts.mailbox(t, "Archive")
+			ts.add(t, "INBOX", testMessage{MessageId: "<move-1@localhost>", Subject: "Message to move"})
+			c := ts.connect(t)
+			inbox := ts.size(t, "INBOX")
+			err := Move(c, testServerName, tt.mid, tt.folder)
+			if tt.fail != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.fail) {
+					t.Fatalf("expected error with %q, got %v", tt.fail, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			expect := inbox
+			if tt.moved {
+				expect -= 1
+			}
+			if n := ts.size(t, "INBOX"); n != expect {
+				t.Errorf("INBOX has %d message(s) instead of %d", n, expect)
+			}
+			if n := ts.size(t, "Archive"); n != inbox-expect {
+				t.Errorf("Archive has %d message(s) instead of %d", n, inbox-expect)
+			}
+			if ops, err := getOperations(testServerName); err != nil || len(ops) != 0 {
+				t.Errorf("%d operation(s) are left in DB, error: %v", len(ops), err)
+			}
+		})
+	}
+}
+
+func TestMoveMessageWithoutUid(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	ts.mailbox(t, "Archive")
+	c := ts.connect(t)
+	if err := MoveMessage(c, testServerName, Message{MessageId: "<move-1@localhost>"}, "Archive"); err == nil {
+		t.Error("message without UID is moved")
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect []string
+	}{
+		{"", nil},
+		{"\\Seen", []string{"\\Seen"}},
+		{" \\Seen, \\Flagged ,", []string{"\\Seen", "\\Flagged"}},
+		{",,", nil},
+	}
+	for _, tt := range tests {
+		if got := splitList(tt.value); strings.Join(got, "|") != strings.Join(tt.expect, "|") {
+			t.Errorf("splitList(%q)=%v, expected %v", tt.value, got, tt.expect)
+		}
+	}
+}
+
+func TestSetFlags(t *testing.T) {
+	mid := "<flags-1@localhost>"
+	tests := []struct {
+		name   string
+		add    []string
+		remove []string
+		server string // expected flags on server
+		local  string // expected sync flags of local file
+		fail   bool
+	}{
+		{"mark read", []string{imap.SeenFlag}, nil, "\\Flagged \\Seen", "FS", false},
+		{"mark unread and unflagged", nil, []string{imap.FlaggedFlag}, "", "", false},
+		{"answered", []string{imap.AnsweredFlag}, []string{imap.FlaggedFlag}, "\\Answered", "R", false},
+		{"no flags", nil, nil, "\\Flagged", "F", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			ts.add(t, "INBOX", testMessage{MessageId: mid, Subject: "Message to flag", Flags: []string{imap.FlaggedFlag}})
+			c := ts.connect(t)
+			if _, err := Fetch(c, testServerName, "INBOX", false, FlagFilter{}); err != nil {
+				t.Fatal(err)
+			}
+			err := SetFlags(c, testServerName, mid, tt.add, tt.remove)
+			if tt.fail != (err != nil) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if flags := strings.Join(ts.flags(t, "INBOX")[mid], " "); flags != tt.server {
+				t.Errorf("server flags '%s' instead of '%s'", flags, tt.server)
+			}
+			entry, err := findMessage(md5hash(mid))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(entry.Path); err != nil {
+				t.Errorf("DB path of flagged message does not exist: %v", err)
+			}
+			if flags := localSyncFlags(entry.Path); flags != tt.local {
+				t.Errorf("local flags '%s' instead of '%s'", flags, tt.local)
+			}
+		})
+	}
+}
+
+func TestStripHeaders(t *testing.T) {
+	header := mail.Header{
+		"Subject":         {"Hello"},
+		"X-Spam-Status":   {"No"},
+		"X-Spam-Score":    {"0.1"},
+		"X-Mailer":        {"goimapsync"},
+		"Dkim-Signature":  {"v=1"},
+		"X-Spamassassin":  {"yes"},
+		"Received":        {"from a", "from b"},
+		"X-Original-From": {"a@b.org"},
+	}
+	tests := []struct {
+		strip  []string
+		expect []string
+	}{
+		{nil, []string{"Dkim-Signature", "Received", "Subject", "X-Mailer", "X-Original-From", "X-Spam-Score", "X-Spam-Status", "X-Spamassassin"}},
+		{[]string{"x-spam-*"}, []string{"Dkim-Signature", "Received", "Subject", "X-Mailer", "X-Original-From", "X-Spamassassin"}},
+		{[]string{"X-Spam*"}, []string{"Dkim-Signature", "Received", "Subject", "X-Mailer", "X-Original-From"}},
+		{[]string{"dkim-signature", "RECEIVED"}, []string{"Subject", "X-Mailer", "X-Original-From", "X-Spam-Score", "X-Spam-Status", "X-Spamassassin"}},
+		{[]string{"x-*"}, []string{"Dkim-Signature", "Received", "Subject"}},
+		{[]string{"X-Mail"}, []string{"Dkim-Signature", "Received", "Subject", "X-Mailer", "X-Original-From", "X-Spam-Score", "X-Spam-Status", "X-Spamassassin"}},
+	}
+	defer func() { Config.StripHeaders = nil }()
+	for _, tt := range tests {
+		Config.StripHeaders = tt.strip
+		var keys []string
+		for k := range stripHeaders(header) {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != strings.Join(tt.expect, ",") {
+			t.Errorf("strip %v: headers %v, expected %v", tt.strip, keys, tt.expect)
+		}
+	}
+}
+
+func TestWriteMailStripsHeaders(t *testing.T) {
+	setupTest(t)
+	Config.StripHeaders = []string{"X-Spam-*"}
+	raw := "Message-ID: <strip-1@localhost>\r\nSubject: Strip\r\nX-Spam-Status: Yes\r\nX-Spam-Score: 9\r\n\r\nbody\r\n"
+	mid := "<strip-1@localhost>"
+	m := Message{MessageId: mid, HashId: md5hash(mid), Imap: "a"}
+	createLocalFolder("a", "INBOX")
+	if err := writeMail("a", "INBOX", m, strings.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	fname := findLocalMail("a", "INBOX", m.HashId)
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "X-Spam") || !strings.Contains(string(data), "Subject: Strip") {
+		t.Errorf("local mail %q", data)
+	}
+}
+
+func TestFindLocalMail(t *testing.T) {
+	setupTest(t)
+	createLocalFolder("a", "INBOX")
+	files := map[string]string{
+		"new": "1700000000.hid1.host",
+		"cur": "1700000001.hid2.host:2,S",
+	}
+	for area, name := range files {
+		if err := ioutil.WriteFile(filepath.Join(localPath("a", "INBOX", area), name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		hid    string
+		expect string
+	}{
+		{"hid1", filepath.Join(localPath("a", "INBOX", "new"), files["new"])},
+		{"hid2", filepath.Join(localPath("a", "INBOX", "cur"), files["cur"])},
+		{"hid3", ""},
+		{"host", ""},
+	}
+	for _, tt := range tests {
+		if got := findLocalMail("a", "INBOX", tt.hid); filepath.Clean(got) != filepath.Clean(tt.expect) {
+			t.Errorf("findLocalMail(%s)=%q, expected %q", tt.hid, got, tt.expect)
+		}
+	}
+}
+
+func TestWriteMailKeepsExistingCopy(t *testing.T) {
+	mid := "<exists-1@localhost>"
+	raw := "Message-ID: " + mid + "\r\nSubject: Exists\r\n\r\nbody\r\n"
+	tests := []struct {
+		name     string
+		existing string   // area and name of existing local copy
+		flags    []string // flags of written message
+	}{
+		{"unseen copy in new area", "new/1700000000.%s.host", []string{imap.SeenFlag}},
+		{"seen copy in cur area", "cur/1700000000.%s.host:2,S", nil},
+		{"recent message", "cur/1700000000.%s.host:2,S", []string{imap.RecentFlag}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			createLocalFolder("a", "INBOX")
+			m := Message{MessageId: mid, HashId: md5hash(mid), Imap: "a", Flags: tt.flags}
+			existing := filepath.Join(localPath("a", "INBOX", ""), fmt.Sprintf(tt.existing, m.HashId))
+			if err := ioutil.WriteFile(existing, []byte(raw), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := writeMail("a", "INBOX", m, strings.NewReader(raw)); err != nil {
+				t.Fatal(err)
+			}
+			if files := readMaildir("a", "INBOX"); len(files) != 1 {
+				t.Errorf("%d local mail file(s) after write of existing mail", len(files))
+			}
+			if _, err := os.Stat(existing); err != nil {
+				t.Errorf("existing local copy is changed: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadMaildir(t *testing.T) {
+	setupTest(t)
+	createLocalFolder("a", "INBOX")
+	files := []string{
+		"new/1700000000.hid1.host",
+		"cur/1700000001.hid2.host:2,S",
+		"tmp/1700000002.hid3.host",
+		"cur/README",
+	}
+	for _, name := range files {
+		if err := ioutil.WriteFile(filepath.Join(localPath("a", "INBOX", ""), name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mdict := readMaildir("a", "INBOX")
+	tests := []struct {
+		hid     string
+		written bool
+		path    string
+	}{
+		{"hid1", true, files[0]},
+		{"hid2", true, files[1]},
+		// files of tmp area are not committed yet
+		{"hid3", false, ""},
+		{"hid4", false, ""},
+	}
+	for _, tt := range tests {
+		if got := isMailWritten(mdict, Message{HashId: tt.hid}); got != tt.written {
+			t.Errorf("isMailWritten(%s)=%v, expected %v", tt.hid, got, tt.written)
+		}
+		expect := ""
+		if tt.path != "" {
+			expect = filepath.Join(localPath("a", "INBOX", ""), tt.path)
+		}
+		if got := findPath(mdict, tt.hid); filepath.Clean(got) != filepath.Clean(expect) {
+			t.Errorf("findPath(%s)=%q, expected %q", tt.hid, got, expect)
+		}
+	}
+	if len(mdict) != 2 {
+		t.Errorf("maildir snapshot has %d entries instead of 2: %v", len(mdict), mdict)
+	}
+}
+
+// helper function to fill local maildir folder with given number of mails
+// for benchmarks, it returns hash ids of the mails
+func fillMaildir(b *testing.B, imapName, folder string, nmsg int) []string {
+	createLocalFolder(imapName, folder)
+	var hids []string
+	for i := 0; i < nmsg; i++ {
+		hid := md5hash(fmt.Sprintf("<bench-%d@localhost>", i))
+		fname := filepath.Join(localPath(imapName, folder, "cur"), fmt.Sprintf("1700000000.%s.%s:2,S", hid, hostname))
+		if err := ioutil.WriteFile(fname, nil, 0644); err != nil {
+			b.Fatal(err)
+		}
+		hids = append(hids, hid)
+	}
+	return hids
+}
+
+// BenchmarkMaildirLookup compares lookup of fetched messages in local
+// maildir snapshot taken once per folder with scan of the folder per message
+func BenchmarkMaildirLookup(b *testing.B) {
+	setupTest(b)
+	hids := fillMaildir(b, "a", "INBOX", 5000)
+	// every fetch chunk looks up its messages
+	chunk := hids[len(hids)-500:]
+	b.Run("snapshot", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			mdict := readMaildir("a", "INBOX")
+			for _, hid := range chunk {
+				if !isMailWritten(mdict, Message{HashId: hid}) {
+					b.Fatalf("mail %s is not found", hid)
+				}
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, hid := range chunk[:10] {
+				if findLocalMail("a", "INBOX", hid) == "" {
+					b.Fatalf("mail %s is not found", hid)
+				}
+			}
+		}
+	})
+}
+
+func TestSearchCriteriaUnseen(t *testing.T) {
+	unseen := FlagFilter{Without: []string{imap.SeenFlag}}
+	tests := []struct {
+		newMessages bool
+		filter      FlagFilter
+		expect      string
+	}{
+		{false, FlagFilter{}, "ALL"},
+		{true, FlagFilter{}, "UNSEEN"},
+		{false, unseen, "UNSEEN"},
+		// new messages are unseen already and \Seen is not repeated
+		{true, unseen, "UNSEEN"},
+	}
+	for _, tt := range tests {
+		var args []string
+		for _, f := range searchCriteria(tt.newMessages, tt.filter).Format() {
+			args = append(args, fmt.Sprintf("%v", f))
+		}
+		if got := strings.Join(args, " "); got != tt.expect {
+			t.Errorf("searchCriteria(%v, %+v)=%q, expected %q", tt.newMessages, tt.filter, got, tt.expect)
+		}
+	}
+}
+
+func TestFetchUnseen(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	ts.add(t, "Unseen",
+		testMessage{MessageId: "<unseen-1@localhost>", Subject: "Unseen"},
+		testMessage{MessageId: "<unseen-2@localhost>", Subject: "Seen", Flags: []string{imap.SeenFlag}},
+		testMessage{MessageId: "<unseen-3@localhost>", Subject: "Unseen flagged", Flags: []string{imap.FlaggedFlag}})
+	c := ts.connect(t)
+	msgs, err := Fetch(c, testServerName, "Unseen", false, FlagFilter{Without: []string{imap.SeenFlag}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mids []string
+	for _, m := range msgs {
+		mids = append(mids, m.MessageId)
+	}
+	sort.Strings(mids)
+	if expect := "<unseen-1@localhost> <unseen-3@localhost>"; strings.Join(mids, " ") != expect {
+		t.Errorf("fetched messages %v, expected %s", mids, expect)
+	}
+	if files := readMaildir(testServerName, "Unseen"); len(files) != 2 {
+		t.Errorf("fetch of unseen messages wrote %d local mail(s) instead of 2", len(files))
+	}
+}
+
+func TestFetchResult(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	ts.add(t, "Result", testMessages...)
+	c := ts.connect(t)
+	tests := []struct {
+		folder string
+		count  int
+		fail   bool
+	}{
+		{"Result", len(testMessages), false},
+		{"NoSuchFolder", 0, true},
+	}
+	for _, tt := range tests {
+		msgs, err := Fetch(c, testServerName, tt.folder, false, FlagFilter{})
+		if tt.fail {
+			if err == nil || !strings.Contains(err.Error(), "Fetch "+tt.folder+" from "+testServerName) {
+				t.Errorf("%s: fetch error %v", tt.folder, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.folder, err)
+		}
+		if len(msgs) != tt.count {
+			t.Fatalf("%s: fetch returned %d message(s) instead of %d", tt.folder, len(msgs), tt.count)
+		}
+		// returned messages are exactly written local mails
+		files := readMaildir(testServerName, tt.folder)
+		if len(files) != tt.count {
+			t.Errorf("%s: %d local mail(s) instead of %d", tt.folder, len(files), tt.count)
+		}
+		for _, m := range msgs {
+			if m.Imap != testServerName || m.Uid == 0 || m.HashId != md5hash(m.MessageId) {
+				t.Errorf("%s: wrong location of returned message %+v", tt.folder, m)
+			}
+			if !isMailWritten(files, m) {
+				t.Errorf("%s: returned message %s is not written", tt.folder, m.MessageId)
+			}
+		}
+	}
+}
+
+func TestReadImapResumesAfterDrop(t *testing.T) {
+	setupTest(t)
+	Config.FetchBatchSize = 2
+	ts := startTestServer(t)
+	var msgs []testMessage
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, testMessage{MessageId: fmt.Sprintf("<resume-%d@localhost>", i), Subject: "Resume"})
+	}
+	ts.add(t, "Resume", msgs...)
+	c := ts.connect(t)
+	// the connection drops in the middle of the second chunk
+	ts.Listener.DropAfter(3)
+	fetches := ts.Listener.FetchCount()
+	res, err := readImap(c, testServerName, "Resume", false, FlagFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != len(msgs) {
+		t.Errorf("read %d message(s) instead of %d", len(res), len(msgs))
+	}
+	if files := readMaildir(testServerName, "Resume"); len(files) != len(msgs) {
+		t.Errorf("%d local mail(s) instead of %d", len(files), len(msgs))
+	}
+	if currentClient(testServerName, c) == c {
+		t.Errorf("client is not reconnected")
+	}
+	// only the message which was in flight may be fetched again, the
+	// first chunk is never fetched twice
+	n := ts.Listener.FetchCount() - fetches
+	if n < len(msgs) || n > len(msgs)+1 {
+		t.Errorf("server sent %d FETCH response(s) for %d messages", n, len(msgs))
+	}
+}
+
+func TestGetImapFolders(t *testing.T) {
+	tests := []struct {
+		mode    string
+		timeout time.Duration
+		expect  []string
+		fail    string
+	}{
+		{"", time.Minute, []string{"INBOX", "Work"}, ""},
+		{"fail", time.Minute, nil, "list is not permitted"},
+		{"stall", 100 * time.Millisecond, nil, "context deadline exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("mode %q", tt.mode), func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			ts.mailbox(t, "Work")
+			c := ts.connect(t)
+			ts.List.Set(tt.mode)
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			folders, err := getImapFolders(ctx, c, testServerName)
+			cancel()
+			if tt.fail != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.fail) {
+					t.Errorf("%q: error %v, expected %q", tt.mode, err, tt.fail)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%q: %v", tt.mode, err)
+			}
+			sort.Strings(folders)
+			if strings.Join(folders, ",") != strings.Join(tt.expect, ",") {
+				t.Errorf("%q: folders %v, expected %v", tt.mode, folders, tt.expect)
+			}
+		})
+	}
+}
+
+func TestSearchCriteriaFlags(t *testing.T) {
+	tests := []struct {
+		newMessages bool
+		filter      FlagFilter
+		with        []string
+		without     []string
+	}{
+		{false, FlagFilter{With: []string{imap.FlaggedFlag}}, []string{imap.FlaggedFlag}, nil},
+		{false, FlagFilter{With: []string{imap.FlaggedFlag}, Without: []string{imap.SeenFlag}}, []string{imap.FlaggedFlag}, []string{imap.SeenFlag}},
+		{false, FlagFilter{With: []string{imap.FlaggedFlag, "$Work"}, Without: []string{imap.DeletedFlag, imap.DraftFlag}}, []string{imap.FlaggedFlag, "$Work"}, []string{imap.DeletedFlag, imap.DraftFlag}},
+		{true, FlagFilter{With: []string{imap.FlaggedFlag}, Without: []string{imap.DeletedFlag}}, []string{imap.FlaggedFlag}, []string{imap.DeletedFlag, imap.SeenFlag}},
+	}
+	for _, tt := range tests {
+		criteria := searchCriteria(tt.newMessages, tt.filter)
+		if strings.Join(criteria.WithFlags, " ") != strings.Join(tt.with, " ") {
+			t.Errorf("%+v: criteria with flags %v, expected %v", tt.filter, criteria.WithFlags, tt.with)
+		}
+		if strings.Join(criteria.WithoutFlags, " ") != strings.Join(tt.without, " ") {
+			t.Errorf("%+v: criteria without flags %v, expected %v", tt.filter, criteria.WithoutFlags, tt.without)
+		}
+	}
+}
+
+func TestFetchWithFlags(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	ts.add(t, "Flagged",
+		testMessage{MessageId: "<flagged-1@localhost>", Subject: "Flagged", Flags: []string{imap.FlaggedFlag}},
+		testMessage{MessageId: "<flagged-2@localhost>", Subject: "Flagged seen", Flags: []string{imap.FlaggedFlag, imap.SeenFlag}},
+		testMessage{MessageId: "<flagged-3@localhost>", Subject: "Plain"})
+	c := ts.connect(t)
+	tests := []struct {
+		filter FlagFilter
+		expect string
+	}{
+		{FlagFilter{With: []string{imap.FlaggedFlag}}, "<flagged-1@localhost> <flagged-2@localhost>"},
+		{FlagFilter{With: []string{imap.FlaggedFlag}, Without: []string{imap.SeenFlag}}, "<flagged-1@localhost>"},
+		{FlagFilter{Without: []string{imap.FlaggedFlag}}, "<flagged-3@localhost>"},
+	}
+	for _, tt := range tests {
+		msgs, err := readImap(c, testServerName, "Flagged", false, tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mids []string
+		for _, m := range msgs {
+			mids = append(mids, m.MessageId)
+		}
+		sort.Strings(mids)
+		if got := strings.Join(mids, " "); got != tt.expect {
+			t.Errorf("%+v: read messages %s, expected %s", tt.filter, got, tt.expect)
+		}
+	}
+}
+
+func TestProtectLargeMessages(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	small := testMessage{MessageId: "<small@localhost>", Subject: "Small"}
+	ts.add(t, "INBOX", small)
+	large := testMessage{MessageId: "<large@localhost>", Subject: "Large"}
+	ts.addRaw(t, "INBOX", nil, append(large.body(), bytes.Repeat([]byte("attachment\r\n"), 1000)...))
+	c := ts.connect(t)
+	mlist, err := readImap(c, testServerName, "INBOX", false, FlagFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deletions []Message
+	for _, m := range mlist {
+		if m.MessageId == small.MessageId || m.MessageId == large.MessageId {
+			deletions = append(deletions, m)
+		}
+	}
+	tests := []struct {
+		protect int64
+		expect  string
+	}{
+		{5000, "<small@localhost>"},
+		{100000, "<large@localhost> <small@localhost>"},
+	}
+	cmap := map[string]*client.Client{testServerName: c}
+	for _, tt := range tests {
+		Config.ProtectSizeAbove = tt.protect
+		var mids []string
+		for _, m := range protectLargeMessages(cmap, deletions) {
+			mids = append(mids, m.MessageId)
+		}
+		sort.Strings(mids)
+		if strings.Join(mids, " ") != tt.expect {
+			t.Errorf("protectSizeAbove %d: removals %v, expected %s", tt.protect, mids, tt.expect)
+		}
+	}
+	// oversized message is never expunged
+	Config.ProtectSizeAbove = 5000
+	removeImapMessages(cmap, deletions)
+	flags := ts.flags(t, "INBOX")
+	if _, ok := flags[large.MessageId]; !ok {
+		t.Errorf("protected message is removed")
+	}
+	if _, ok := flags[small.MessageId]; ok {
+		t.Errorf("message below protectSizeAbove is not removed")
+	}
+}
+
+func TestRemoveImapMessagesParallel(t *testing.T) {
+	setupTest(t)
+	var servers []*testServer
+	cmap := make(map[string]*client.Client)
+	var mlist []Message
+	for _, name := range []string{"a", "b", "broken"} {
+		ts := startTestServer(t)
+		ts.Server.Name = name
+		ts.add(t, "INBOX", testMessage{MessageId: fmt.Sprintf("<remove-%s@localhost>", name), Subject: "Remove"})
+		c := ts.connect(t)
+		msgs, err := readImap(c, name, "INBOX", false, FlagFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mlist = append(mlist, msgs...)
+		cmap[name] = c
+		servers = append(servers, ts)
+	}
+	// removals of a and b wait for each other, i.e. they can complete
+	// only if servers are processed concurrently
+	var mutex sync.Mutex
+	timeout := false
+	barrier := func(peer *testExpungeExtension) func() {
+		return func() {
+			deadline := time.Now().Add(5 * time.Second)
+			for peer.Get() == 0 {
+				if time.Now().After(deadline) {
+					mutex.Lock()
+					timeout = true
+					mutex.Unlock()
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+	servers[0].Expunge.SetWait(barrier(servers[1].Expunge))
+	servers[1].Expunge.SetWait(barrier(servers[0].Expunge))
+	// the broken server drops its connection and can't login again
+	cmap["broken"].Logout()
+	Config.Servers[2].Password = "wrong"
+
+	removeImapMessages(cmap, mlist)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if timeout {
+		t.Errorf("removals of IMAP servers are not concurrent")
+	}
+	tests := []struct {
+		server  *testServer
+		removed bool
+	}{
+		{servers[0], true},
+		{servers[1], true},
+		{servers[2], false},
+	}
+	for _, tt := range tests {
+		mid := fmt.Sprintf("<remove-%s@localhost>", tt.server.Server.Name)
+		if _, ok := tt.server.flags(t, "INBOX")[mid]; ok == tt.removed {
+			t.Errorf("%s: message is removed %v, expected %v", tt.server.Server.Name, !ok, tt.removed)
+		}
+	}
+}
+
+func TestReadImapEmptyFolder(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	ts.mailbox(t, "Empty")
+	c := ts.connect(t)
+	for _, newMessages := range []bool{false, true} {
+		fetches := ts.Listener.FetchCount()
+		msgs, err := readImap(c, testServerName, "Empty", newMessages, FlagFilter{})
+		if err != nil {
+			t.Fatalf("new messages %v: read of empty folder failed: %v", newMessages, err)
+		}
+		// empty slice is a valid snapshot of the folder, nil one is not
+		if msgs == nil || len(msgs) != 0 {
+			t.Errorf("new messages %v: read %v from empty folder", newMessages, msgs)
+		}
+		if ts.Listener.FetchCount() != fetches {
+			t.Errorf("new messages %v: empty folder is fetched", newMessages)
+		}
+	}
+	if msgs, err := Fetch(c, testServerName, "Empty", false, FlagFilter{}); err != nil || len(msgs) != 0 {
+		t.Errorf("fetch of empty folder returned %v, error %v", msgs, err)
+	}
+}
+
+func TestSyncEmptyInbox(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dry-run %v", dryRun), func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			ts.empty(t, "INBOX")
+			if err := createLocalFolder(testServerName, "INBOX"); err != nil {
+				t.Fatal(err)
+			}
+			nmsg := 2
+			for i := 0; i < nmsg; i++ {
+				mid := fmt.Sprintf("<local-only-%d@localhost>", i)
+				fname := fmt.Sprintf("%d.%s.%s:2,S", time.Now().Unix(), md5hash(mid), hostname)
+				if err := ioutil.WriteFile(filepath.Join(localPath(testServerName, "INBOX", "cur"), fname), testMessage{MessageId: mid}.body(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c := ts.connect(t)
+			Sync(map[string]*client.Client{testServerName: c}, dryRun)
+			// local-only messages are uploaded and none of them is deleted
+			expect := nmsg
+			if dryRun {
+				expect = 0
+			}
+			if RunSummary.Uploaded != expect {
+				t.Errorf("sync uploaded %d message(s), expected %d", RunSummary.Uploaded, expect)
+			}
+			if n := ts.size(t, "INBOX"); n != uint32(expect) {
+				t.Errorf("INBOX has %d message(s) after sync, expected %d", n, expect)
+			}
+			if files := readMaildir(testServerName, "INBOX"); len(files) != nmsg {
+				t.Errorf("local maildir has %d message(s) after sync, expected %d", len(files), nmsg)
+			}
+			if len(RunSummary.Errors) != 0 {
+				t.Errorf("sync of empty INBOX has errors %v", RunSummary.Errors)
+			}
+		})
+	}
+}
+
+func TestMoveEmptyFolder(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	ts.empty(t, "INBOX")
+	ts.mailbox(t, "Archive")
+	c := ts.connect(t)
+	fetches := ts.Listener.FetchCount()
+	if err := Move(c, testServerName, "<move-1@localhost>", "Archive"); err != nil {
+		t.Errorf("move from empty folder failed: %v", err)
+	}
+	if ts.Listener.FetchCount() != fetches {
+		t.Errorf("empty folder is fetched")
+	}
+	if n := ts.size(t, "Archive"); n != 0 {
+		t.Errorf("Archive has %d message(s) after move from empty folder", n)
+	}
+}
+
+func TestAddFolderHeader(t *testing.T) {
+	tests := []struct {
+		header mail.Header
+		folder string
+		expect string
+	}{
+		{mail.Header{"Subject": {"a"}}, "INBOX", "INBOX"},
+		{mail.Header{"Subject": {"a"}}, "Work/Projects", "Work/Projects"},
+		{mail.Header{"Subject": {"a"}}, "Entwürfe", "=?utf-8?q?Entw=C3=BCrfe?="},
+		// header set by sender is replaced
+		{mail.Header{"Subject": {"a"}, "X-Goimapsync-Folder": {"Spam"}}, "INBOX", "INBOX"},
+	}
+	for _, tt := range tests {
+		out := addFolderHeader(tt.header, tt.folder)
+		var values []string
+		for k, v := range out {
+			if strings.EqualFold(k, folderHeader) {
+				values = append(values, v...)
+			}
+		}
+		if strings.Join(values, ",") != tt.expect {
+			t.Errorf("%s: folder header %v, expected %s", tt.folder, values, tt.expect)
+		}
+		if out.Get("Subject") != "a" {
+			t.Errorf("%s: other headers are not kept: %v", tt.folder, out)
+		}
+		if _, ok := tt.header[folderHeader]; ok {
+			t.Errorf("%s: header of the message is modified", tt.folder)
+		}
+	}
+}
+
+func TestFetchFolderHeader(t *testing.T) {
+	tests := []struct {
+		enabled bool
+		folder  string
+	}{
+		{false, "INBOX"},
+		{true, "INBOX"},
+		{true, "Work"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v %s", tt.enabled, tt.folder), func(t *testing.T) {
+			setupTest(t)
+			Config.FolderHeader = tt.enabled
+			ts := startTestServer(t)
+			m := testMessage{MessageId: "<header-1@localhost>", Subject: "Folder header"}
+			ts.add(t, tt.folder, m)
+			c := ts.connect(t)
+			if _, err := Fetch(c, testServerName, tt.folder, false, FlagFilter{}); err != nil {
+				t.Fatal(err)
+			}
+			fname := findLocalMail(testServerName, tt.folder, md5hash(m.MessageId))
+			data, err := ioutil.ReadFile(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// local mail keeps headers as lines before its body
+			line := fmt.Sprintf("%s: %s\n", folderHeader, tt.folder)
+			if got := bytes.Contains(data, []byte(line)); got != tt.enabled {
+				t.Errorf("folderHeader %v: local mail of %s has header %v, expected %v", tt.enabled, tt.folder, got, tt.enabled)
+			}
+		})
+	}
+}
+
+func TestMaildirHostname(t *testing.T) {
+	keepConfig(t)
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, expect string
+	}{
+		{"", strings.ReplaceAll(strings.ReplaceAll(host, "/", "\\057"), ":", "\\072")},
+		{"mail.example.org", "mail.example.org"},
+		{"host/1:2", "host\\0571\\0722"},
+	}
+	for _, tt := range tests {
+		Config.MaildirHostname = tt.name
+		got, err := maildirHostname()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.expect {
+			t.Errorf("maildirHostname with '%s' is '%s', expected '%s'", tt.name, got, tt.expect)
+		}
+	}
+}
+
+func TestFetchMaildirHostname(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+	}{
+		{"backup.example.org", nil},
+		{"mail.localhost", []string{imap.SeenFlag}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			Config.MaildirHostname = tt.name
+			var err error
+			if hostname, err = maildirHostname(); err != nil {
+				t.Fatal(err)
+			}
+			ts := startTestServer(t)
+			m := testMessage{MessageId: "<hostname-1@localhost>", Subject: "Hostname", Flags: tt.flags}
+			ts.add(t, "Host", m)
+			c := ts.connect(t)
+			if _, err := Fetch(c, testServerName, "Host", false, FlagFilter{}); err != nil {
+				t.Fatal(err)
+			}
+			fname := findLocalMail(testServerName, "Host", md5hash(m.MessageId))
+			// flags part follows the hostname, messages without flags have none
+			if base := strings.Split(filepath.Base(fname), ":2,")[0]; !strings.HasSuffix(base, "."+tt.name) {
+				t.Errorf("local mail %s with flags %v has no %s hostname in its name", fname, tt.flags, tt.name)
+			}
+		})
+	}
+}
+
+func TestFetchUTF7Folder(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	m := testMessage{MessageId: "<utf7-1@localhost>", Subject: "Draft"}
+	ts.add(t, "Entwürfe", m)
+	c := ts.connect(t)
+	// folder with non-ASCII name is listed as Entw&APw-rfe in modified
+	// UTF-7 and matched by its encoded name regardless of case
+	folder := imapFolder(testServerName, "ENTW&ANw-RFE")
+	if folder != "Entwürfe" {
+		t.Fatalf("folder 'ENTW&ANw-RFE' is matched to '%s'", folder)
+	}
+	if _, err := Fetch(c, testServerName, folder, false, FlagFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	if fname := findLocalMail(testServerName, folder, md5hash(m.MessageId)); fname == "" {
+		t.Errorf("message of folder '%s' is not written into local maildir", folder)
+	}
+}
+
+func TestGetFlags(t *testing.T) {
+	tests := []struct {
+		fname  string
+		expect []string
+	}{
+		{"1700000000.hid.host", []string{}},
+		{"1700000000.hid.host:2,", []string{}},
+		{"1700000000.hid.host:2,S", []string{"S"}},
+		{"1700000000.hid.host:2,FRS", []string{"F", "R", "S"}},
+		{"1700000000.hid.host,1:2,S", []string{"S"}},
+	}
+	for _, tt := range tests {
+		if got := getFlags(tt.fname); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.expect) {
+			t.Errorf("getFlags(%s)=%q, expected %q", tt.fname, got, tt.expect)
+		}
+	}
+}
+
+func TestFlagSymbols(t *testing.T) {
+	tests := []struct {
+		flags  []string
+		expect string
+	}{
+		{nil, ""},
+		{[]string{imap.RecentFlag}, ""},
+		{[]string{imap.SeenFlag, imap.RecentFlag}, "S"},
+		{[]string{imap.SeenFlag, imap.FlaggedFlag, imap.AnsweredFlag}, "FRS"},
+		{[]string{imap.DraftFlag, "Junk"}, "DJ"},
+		{[]string{imap.DeletedFlag, "$Label1"}, ""},
+	}
+	for _, tt := range tests {
+		if got := flagSymbols(tt.flags); got != tt.expect {
+			t.Errorf("flagSymbols(%v)=%q, expected %q", tt.flags, got, tt.expect)
+		}
+	}
+}
+
+func TestFetchPlacement(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	tests := []struct {
+		flags []string // server flags of the message
+		area  string   // area of local maildir
+		info  string   // flags part of the file name
+	}{
+		{nil, "new", ""},
+		{[]string{imap.RecentFlag}, "new", ""},
+		{[]string{imap.SeenFlag}, "cur", ":2,S"},
+		{[]string{imap.SeenFlag, imap.RecentFlag}, "cur", ":2,S"},
+		{[]string{imap.FlaggedFlag}, "cur", ":2,F"},
+		{[]string{imap.AnsweredFlag, imap.RecentFlag}, "cur", ":2,R"},
+	}
+	for i, tt := range tests {
+		ts.add(t, "Placement", testMessage{MessageId: fmt.Sprintf("<placement-%d@localhost>", i), Subject: "Placement", Flags: tt.flags})
+	}
+	c := ts.connect(t)
+	if _, err := Fetch(c, testServerName, "Placement", false, FlagFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range tests {
+		mid := fmt.Sprintf("<placement-%d@localhost>", i)
+		fname := findLocalMail(testServerName, "Placement", md5hash(mid))
+		if fname == "" {
+			t.Errorf("message with flags %v is not fetched", tt.flags)
+			continue
+		}
+		if area := filepath.Base(filepath.Dir(fname)); area != tt.area {
+			t.Errorf("message with flags %v is placed in %s area, expected %s", tt.flags, area, tt.area)
+		}
+		if !strings.HasSuffix(filepath.Base(fname), "."+testHostname+tt.info) {
+			t.Errorf("message with flags %v has name %s, expected '%s' flags part", tt.flags, filepath.Base(fname), tt.info)
+		}
+	}
+}
+
+func TestSymbolFlags(t *testing.T) {
+	tests := []struct {
+		symbols []string
+		expect  []string
+	}{
+		{nil, nil},
+		{[]string{"S"}, []string{imap.SeenFlag}},
+		{[]string{"D", "F", "J", "R", "S"}, []string{imap.DraftFlag, imap.FlaggedFlag, "Junk", imap.AnsweredFlag, imap.SeenFlag}},
+		// old goimapsync versions used A symbol for answered mails
+		{[]string{"A", "R"}, []string{imap.AnsweredFlag}},
+		{[]string{"N", "T", "x"}, nil},
+	}
+	for _, tt := range tests {
+		if got := symbolFlags(tt.symbols); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.expect) {
+			t.Errorf("symbolFlags(%q)=%q, expected %q", tt.symbols, got, tt.expect)
+		}
+	}
+}
+
+func TestFlagSymbolsRoundTrip(t *testing.T) {
+	// flags part of file name is kept once parsed into IMAP flags
+	for _, info := range []string{"", "S", "FS", "DFJRS", "R"} {
+		fname := "1700000000.hid.host:2," + info
+		if got := flagSymbols(symbolFlags(getFlags(fname))); got != info {
+			t.Errorf("flags '%s' of file name are written back as '%s'", info, got)
+		}
+	}
+	// IMAP flags with maildir symbols are kept once written into file name
+	flags := []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DraftFlag, "Junk"}
+	got := symbolFlags(strings.Split(flagSymbols(append(flags, imap.RecentFlag, imap.DeletedFlag)), ""))
+	sort.Strings(got)
+	sort.Strings(flags)
+	if strings.Join(got, " ") != strings.Join(flags, " ") {
+		t.Errorf("IMAP flags %v are parsed back as %v", flags, got)
+	}
+}
+
+func TestCheckDeleteLimit(t *testing.T) {
+	keepConfig(t)
+	tests := []struct {
+		count   int
+		percent float64
+		force   bool
+		ndel    int
+		total   int
+		fail    string // part of expected error
+	}{
+		{0, -1, false, 100, 100, ""},
+		{-1, -1, false, 100, 100, ""},
+		{10, -1, false, 11, 100, "exceeds maxDeleteCount 10"},
+		{-1, 50, false, 51, 100, "exceeds maxDeletePercent 50"},
+		{10, 0, false, 10, 100, ""},
+		{10, 0, false, 11, 100, "exceeds maxDeleteCount 10"},
+		{10, 0, true, 11, 100, ""},
+		{0, 50, false, 50, 100, ""},
+		{0, 50, false, 51, 100, "51 out of 100 message(s) to delete on a exceeds maxDeletePercent 50"},
+		{0, 50, true, 100, 100, ""},
+		{0, 50, false, 3, 0, ""},
+		{10, 50, false, 0, 0, ""},
+		{100, 10, false, 20, 100, "exceeds maxDeletePercent 10"},
+	}
+	for _, tt := range tests {
+		Config.MaxDeleteCount, Config.MaxDeletePercent, Config.ForceDelete = tt.count, tt.percent, tt.force
+		err := checkDeleteLimit("a", tt.ndel, tt.total)
+		if tt.fail == "" && err != nil {
+			t.Errorf("deletion of %d out of %d message(s) with limits %d and %v%% fails: %v", tt.ndel, tt.total, tt.count, tt.percent, err)
+		}
+		if tt.fail != "" && (err == nil || !strings.Contains(err.Error(), tt.fail) || !strings.Contains(err.Error(), "-force-delete")) {
+			t.Errorf("deletion of %d out of %d message(s) with limits %d and %v%% has error %v, expected '%s'", tt.ndel, tt.total, tt.count, tt.percent, err, tt.fail)
+		}
+	}
+}
+
+func TestSyncDeleteLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		count   int
+		percent float64
+		force   bool
+		deleted bool // messages deleted locally are deleted on IMAP server
+	}{
+		{name: "no limits", percent: -1, deleted: true},
+		{name: "within count", count: 10, percent: -1, deleted: true},
+		{name: "count exceeded", count: 2, percent: -1},
+		{name: "percent exceeded", percent: 50},
+		{name: "forced", count: 2, percent: 50, force: true, deleted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			for i := 0; i < 3; i++ {
+				ts.add(t, "INBOX", testMessage{MessageId: fmt.Sprintf("<limit-%d@localhost>", i), Subject: "Delete limit"})
+			}
+			c := ts.connect(t)
+			cmap := map[string]*client.Client{testServerName: c}
+			Sync(cmap, false)
+			nmsg := ts.size(t, "INBOX")
+			files := readMaildir(testServerName, "INBOX")
+			if len(files) != int(nmsg) {
+				t.Fatalf("sync wrote %d local mail file(s) out of %d", len(files), nmsg)
+			}
+			// local maildir looks empty, e.g. it failed to mount
+			for _, fname := range files {
+				if err := os.Remove(fname); err != nil {
+					t.Fatal(err)
+				}
+			}
+			Config.MaxDeleteCount, Config.MaxDeletePercent, Config.ForceDelete = tt.count, tt.percent, tt.force
+			nerr := len(RunSummary.Errors)
+			Sync(cmap, false)
+			expect := nmsg
+			if tt.deleted {
+				expect = 0
+			}
+			if n := ts.size(t, "INBOX"); n != expect {
+				t.Errorf("INBOX has %d message(s) after sync, expected %d", n, expect)
+			}
+			if aborted := len(RunSummary.Errors) > nerr; aborted == tt.deleted {
+				t.Errorf("sync deletions are aborted %v, expected %v", aborted, !tt.deleted)
+			}
+		})
+	}
+}
@@ -6,11 +6,20 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zalando/go-keyring"
 )
 
 // Server structure keeps IMAP server's credentials
@@ -20,6 +29,32 @@ type Server struct {
 	Username string `json:"username"` // user name
 	Password string `json:"password"` // user password
 	UseTls   bool   `json:"useTls"`   // use TLS connection
+	Verbose  int    `json:"verbose"`  // verbosity level of this server, overrides global one
+
+	// authentication options
+	AuthMechanism string `json:"authMechanism"` // LOGIN (default), PLAIN or CRAM-MD5
+	Auth          string `json:"auth"`          // source of password: config (default) or keyring
+
+	// TLS certificate pinning options, fingerprints are sha256 hex strings
+	PinnedCertSHA256   string `json:"pinnedCertSHA256"`   // fingerprint of server certificate
+	PinnedPubKeySHA256 string `json:"pinnedPubKeySHA256"` // fingerprint of server public key
+
+	// TLS policy options, Go defaults are used if they are not set
+	MinTLSVersion string   `json:"minTLSVersion"` // minimal TLS version, e.g. 1.2
+	MaxTLSVersion string   `json:"maxTLSVersion"` // maximal TLS version, e.g. 1.3
+	CipherSuites  []string `json:"cipherSuites"`  // allowed cipher suites (TLS 1.0-1.2), e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+
+	// connection options, addresses are dialed in parallel staggered attempts
+	PreferIPv4     bool `json:"preferIPv4"`     // try IPv4 addresses before IPv6 ones
+	DialTimeout    int  `json:"dialTimeout"`    // timeout of single connection attempt in seconds (default 10)
+	MaxConnections int  `json:"maxConnections"` // number of connections to fetch folders in parallel, shared by servers of the same account (default 1)
+
+	// mirror options, see mirror.go
+	ExcludeFolders []string `json:"excludeFolders"` // folders skipped by fetch -all-folders, e.g. [Gmail]/* or Trash
+
+	// daemon mode options
+	SyncInterval int    `json:"syncInterval"` // sync interval in seconds (default 300)
+	Schedule     string `json:"schedule"`     // sync schedule, see daemon.go
 }
 
 // Filter structure provides Email filter to follow, e.g.
@@ -37,27 +72,225 @@ type SmtpServer struct {
 	Host     string `json:"host"`     // SMTP host
 	From     string `json:"from"`     // from (user's email address)
 	Password string `json:"password"` // user's password
+
+	// TLS policy options of STARTTLS, Go defaults are used if they are not set
+	MinTLSVersion string   `json:"minTLSVersion"` // minimal TLS version, e.g. 1.2
+	MaxTLSVersion string   `json:"maxTLSVersion"` // maximal TLS version, e.g. 1.3
+	CipherSuites  []string `json:"cipherSuites"`  // allowed cipher suites (TLS 1.0-1.2)
 }
 
 // Configuration stores DAS configuration parameters
 type Configuration struct {
-	Servers     []Server   `json:"servers"`     // list of IMAP server credentials
-	SmtpServer  SmtpServer `json:"smtp_server"` // SMTP server info
-	Maildir     string     `json:"maildir"`     // maildir directory
-	CommonInbox bool       `json:"commonInbox"` // use common inbox for all imap servers
-	DBUri       string     `json:"dbUri"`       // DB URI
-	Verbose     int        `json:"verbose"`     // verbosity level
-	Profiler    string     `json:"profiler"`    // profiler file name
-	Filters     []Filter   `json:"filters"`     // forward filters
+	Servers          []Server   `json:"servers"`          // list of IMAP server credentials
+	SmtpServer       SmtpServer `json:"smtp_server"`      // SMTP server info
+	Maildir          string     `json:"maildir"`          // maildir directory
+	CommonInbox      bool       `json:"commonInbox"`      // use common inbox for all imap servers
+	DBUri            string     `json:"dbUri"`            // DB URI
+	Verbose          int        `json:"verbose"`          // verbosity level
+	Profiler         string     `json:"profiler"`         // profiler file name
+	Filters          []Filter   `json:"filters"`          // forward filters
+	ConflictPolicy   string     `json:"conflictPolicy"`   // sync conflict policy: server (default) or local
+	FlagAuthority    string     `json:"flagAuthority"`    // direction of flags sync: local, server or newest (default three-way merge)
+	FetchTimeout     int        `json:"fetchTimeout"`     // deadline of IMAP fetch in seconds (default 600)
+	ListTimeout      int        `json:"listTimeout"`      // deadline of listing IMAP folders in seconds (default 60)
+	CreateFolder     bool       `json:"createFolder"`     // create missing target folders on IMAP server
+	AutoAddFolders   bool       `json:"autoAddFolders"`   // mirror remote folders created since the last fetch -all-folders run
+	VanishedFolders  string     `json:"vanishedFolders"`  // action on local folders of vanished mirrored ones: warn (default), attic or delete
+	FetchBatchSize   int        `json:"fetchBatchSize"`   // number of messages fetched at once (default 500)
+	PipelinedFetch   bool       `json:"pipelinedFetch"`   // fetch bodies over second pooled connection while envelopes of next chunk are fetched
+	ReconnectRetries int        `json:"reconnectRetries"` // number of reconnect attempts (default 3)
+	StripHeaders     []string   `json:"stripHeaders"`     // headers to strip when writing local mails, e.g. X-Spam-*
+	FolderHeader     bool       `json:"folderHeader"`     // add X-GoImapSync-Folder header with source IMAP folder to local mails
+	ArchiveMode      bool       `json:"archiveMode"`      // write raw source of mails as is along with JSON sidecar of their IMAP metadata
+	MaildirHostname  string     `json:"maildirHostname"`  // hostname used in names of local mail files (default OS hostname)
+	HistoryRetention int        `json:"historyRetention"` // number of runs to keep in DB history (default 100)
+	LocalLayout      string     `json:"localLayout"`      // local maildir layout: nested (default) or flat
+	LocalSeparator   string     `json:"localSeparator"`   // separator of server name prefix in flat layout (default .)
+	SafeMode         bool       `json:"safeMode"`         // never delete anything on IMAP server(s)
+	MaxDeleteCount   int        `json:"maxDeleteCount"`   // max number of messages to delete on IMAP server per sync (default no limit)
+	MaxDeletePercent float64    `json:"maxDeletePercent"` // max percent of folder messages to delete on IMAP server per sync (default 50, negative to disable)
+	ForceDelete      bool       `json:"-"`                // ignore deletion limits, set via -force-delete flag
+	DefaultCharset   string     `json:"defaultCharset"`   // charset of message text without explicit charset (default utf-8)
+	SecretsFile      string     `json:"secretsFile"`      // JSON file with passwords of servers, must have 0600 permissions
+
+	// deletion options
+	DeleteGracePeriod int   `json:"deleteGracePeriod"` // seconds between flagging sync deletions as \Deleted and their expunge (default 0, expunge right away)
+	ProtectSizeAbove  int64 `json:"protectSizeAbove"`  // messages larger than this size in bytes are never deleted by sync (default 0, no limit)
+	RemoveWorkers     int   `json:"removeWorkers"`     // number of IMAP servers whose sync deletions run in parallel (default 4)
+	DeleteBatchSize   int   `json:"deleteBatchSize"`   // number of messages flagged and expunged at once by sync deletions (default 0, all at once)
+
+	// identification options
+	ClientId map[string]string `json:"clientId"` // fields of IMAP ID command (default name and version of goimapsync), empty object sends ID NIL
+
+	// index options
+	IndexOnly bool `json:"indexOnly"` // record envelopes of messages during sync and defer download of their bodies to fetch-bodies operation
+
+	// ignore options
+	Ignore []IgnoreRule `json:"ignore"` // rules of messages which are never fetched, e.g. automated ones
+
+	// DB options
+	DBPragmas     map[string]string `json:"dbPragmas"`     // SQLite pragmas applied to every DB connection, e.g. {"synchronous": "OFF"}
+	VacuumEvery   int               `json:"vacuumEvery"`   // vacuum DB after every N recorded runs (default 0, never)
+	DBPingRetries int               `json:"dbPingRetries"` // number of retries of initial DB ping (default 5, negative value disables retries)
+	DBPingDelay   int               `json:"dbPingDelay"`   // delay before the first retry of DB ping in milliseconds, doubled on every retry (default 200)
 }
 
 // Config variable represents configuration object
 var Config Configuration
 
-// ParseConfig parse given config file
-func ParseConfig(configFile string) {
-	var data []byte
-	var err error
+// helper function to return verbosity level of given IMAP server, the
+// server verbose option overrides global one
+func verboseLevel(imapName string) int {
+	for _, s := range Config.Servers {
+		if s.Name == imapName && s.Verbose > 0 {
+			return s.Verbose
+		}
+	}
+	return Config.Verbose
+}
+
+// helper function to fetch config from given HTTP(S) url, the bearer token
+// is taken from GOIMAPSYNC_CONFIG_TOKEN environment variable if it is set
+func fetchConfig(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("GOIMAPSYNC_CONFIG_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// helper function to get password of given IMAP server, with keyring auth
+// the password is looked up in OS keyring (macOS Keychain, Secret Service,
+// Windows Credential Manager) under goimapsync service and server name
+func serverPassword(s Server) (string, error) {
+	switch s.Auth {
+	case "", "config":
+		if s.Password == "" && Config.SecretsFile != "" {
+			return "", fmt.Errorf("no password of '%s' in config or secrets file %s", s.Name, Config.SecretsFile)
+		}
+		return s.Password, nil
+	case "keyring":
+		password, err := keyring.Get("goimapsync", s.Name)
+		if err != nil {
+			return "", fmt.Errorf("unable to get password of '%s' from keyring: %w", s.Name, err)
+		}
+		return password, nil
+	}
+	return "", fmt.Errorf("unsupported auth '%s' of '%s', please use config or keyring", s.Auth, s.Name)
+}
+
+// Secret represents entry of secrets file
+type Secret struct {
+	Password string `json:"password"` // password
+}
+
+// secretNames keeps names of servers (and smtp) whose password was taken
+// from secrets file
+var secretNames = make(map[string]bool)
+
+// helper function to load secrets file, i.e. {serverName: {password: ...},
+// smtp: {password: ...}}, and fill in missing passwords of servers
+func loadSecrets(fname string) error {
+	if strings.HasPrefix(fname, "~/") {
+		fname = filepath.Join(os.Getenv("HOME"), fname[2:])
+	}
+	info, err := os.Stat(fname)
+	if err != nil {
+		return err
+	}
+	// the secrets should not be readable by anyone else
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("secrets file %s has %#o permissions, please use 0600", fname, info.Mode().Perm())
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	var secrets map[string]Secret
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return fmt.Errorf("unable to parse secrets file %s: %w", fname, err)
+	}
+	for i, s := range Config.Servers {
+		if s.Password == "" && secrets[s.Name].Password != "" {
+			Config.Servers[i].Password = secrets[s.Name].Password
+			secretNames[s.Name] = true
+		}
+	}
+	if Config.SmtpServer.Password == "" && secrets["smtp"].Password != "" {
+		Config.SmtpServer.Password = secrets["smtp"].Password
+		secretNames["smtp"] = true
+	}
+	return nil
+}
+
+// helper function to validate configuration, e.g. IMAP server names are
+// used as keys of connections and folders maps and should be unique
+func validateConfig() error {
+	names := make(map[string]bool)
+	for _, s := range Config.Servers {
+		if s.Name == "" {
+			return fmt.Errorf("IMAP server %s has no name", s.Uri)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("duplicate IMAP server name '%s'", s.Name)
+		}
+		names[s.Name] = true
+		if _, err := tlsPolicy(s.MinTLSVersion, s.MaxTLSVersion, s.CipherSuites); err != nil {
+			return fmt.Errorf("invalid TLS policy of '%s': %w", s.Name, err)
+		}
+	}
+	// primary connections of IMAP servers sharing the same account are
+	// always opened, warn if they alone exceed configured limit of account
+	accounts := make(map[string]int)
+	for _, s := range Config.Servers {
+		accounts[accountKey(s.Name)] += 1
+	}
+	for _, s := range Config.Servers {
+		key := accountKey(s.Name)
+		if n := accounts[key]; s.MaxConnections > 0 && n > accountLimit(s.Name) {
+			log.Printf("%d IMAP servers log into account %s which allows only %d connection(s)\n", n, key, accountLimit(s.Name))
+			accounts[key] = 0
+		}
+	}
+	if err := compileIgnoreRules(); err != nil {
+		return err
+	}
+	smtp := Config.SmtpServer
+	if _, err := tlsPolicy(smtp.MinTLSVersion, smtp.MaxTLSVersion, smtp.CipherSuites); err != nil {
+		return fmt.Errorf("invalid TLS policy of SMTP server: %w", err)
+	}
+	return nil
+}
+
+// StringList represents values of repeatable flag, e.g. -config or -set
+type StringList []string
+
+// String implements flag.Value interface
+func (c *StringList) String() string {
+	return strings.Join(*c, ",")
+}
+
+// Set implements flag.Value interface
+func (c *StringList) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+// helper function to read config data from stdin ("-"), HTTP(S) url or file
+func readConfig(configFile string) ([]byte, error) {
 	if configFile == "-" {
 		// read from stdin
 		scanner := bufio.NewScanner(os.Stdin)
@@ -65,19 +298,277 @@ func ParseConfig(configFile string) {
 		for scanner.Scan() {
 			content = fmt.Sprintf("%s%s", content, scanner.Text())
 		}
-		data = []byte(content)
 		if err := scanner.Err(); err != nil {
-			log.Fatal("unable to read from stdin", err)
+			return nil, fmt.Errorf("unable to read from stdin: %w", err)
 		}
-	} else {
-		data, err = ioutil.ReadFile(configFile)
+		return []byte(content), nil
+	}
+	if isConfigUrl(configFile) {
+		data, err := fetchConfig(configFile)
 		if err != nil {
-			log.Fatalf("Unable to read: file %s, error %v\n", configFile, err)
+			return nil, fmt.Errorf("unable to fetch %s: %w", configFile, err)
 		}
+		return data, nil
+	}
+	data, err := ioutil.ReadFile(configFile)
+	if err == nil && isEncryptedConfig(configFile, data) {
+		return decryptConfig(configFile, data)
 	}
-	err = json.Unmarshal(data, &Config)
+	return data, err
+}
+
+// helper function to check if given config file or its data is encrypted
+// with GPG, i.e. it has .gpg or .asc extension or ASCII armored PGP message
+func isEncryptedConfig(configFile string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".gpg", ".asc", ".pgp":
+		return true
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP MESSAGE-----"))
+}
+
+// helper function to check if given config location is HTTP(S) url
+func isConfigUrl(configFile string) bool {
+	return strings.HasPrefix(configFile, "http://") || strings.HasPrefix(configFile, "https://")
+}
+
+// helper function to load given config file into Config, the files listed
+// in its include key are loaded first, i.e. the including file overrides
+// them. Scalars of later files override earlier ones, servers are merged
+// by name and filters are appended.
+func loadConfig(configFile string, visited map[string]bool) error {
+	if visited[configFile] {
+		return fmt.Errorf("config include cycle at %s", configFile)
+	}
+	visited[configFile] = true
+	defer delete(visited, configFile)
+	data, err := readConfig(configFile)
+	if err != nil {
+		return err
+	}
+	var rec struct {
+		Include []string          `json:"include"`
+		Servers []json.RawMessage `json:"servers"`
+		Filters []Filter          `json:"filters"`
+		Ignore  []IgnoreRule      `json:"ignore"`
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return fmt.Errorf("unable to parse %s: %w", configFile, err)
+	}
+	for _, inc := range rec.Include {
+		// relative includes are resolved against including file location
+		if inc != "-" && !isConfigUrl(inc) && !filepath.IsAbs(inc) && configFile != "-" && !isConfigUrl(configFile) {
+			inc = filepath.Join(filepath.Dir(configFile), inc)
+		}
+		if err := loadConfig(inc, visited); err != nil {
+			return err
+		}
+	}
+	// detach lists from Config since unmarshal reuses their storage
+	servers, filters, ignore := Config.Servers, Config.Filters, Config.Ignore
+	Config.Servers, Config.Filters, Config.Ignore = nil, nil, nil
+	if err := json.Unmarshal(data, &Config); err != nil {
+		return fmt.Errorf("unable to parse %s: %w", configFile, err)
+	}
+	Config.Servers, Config.Filters = servers, append(filters, rec.Filters...)
+	Config.Ignore = append(ignore, rec.Ignore...)
+	for _, raw := range rec.Servers {
+		var srv struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(raw, &srv); err != nil {
+			return fmt.Errorf("unable to parse %s: %w", configFile, err)
+		}
+		idx := -1
+		for i, s := range Config.Servers {
+			if srv.Name != "" && s.Name == srv.Name {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			Config.Servers = append(Config.Servers, Server{})
+			idx = len(Config.Servers) - 1
+		}
+		// unmarshal on top of existing server to override only given keys
+		if err := json.Unmarshal(raw, &Config.Servers[idx]); err != nil {
+			return fmt.Errorf("unable to parse %s: %w", configFile, err)
+		}
+	}
+	return nil
+}
+
+// helper function to set config value given as dotted path, e.g.
+// servers.work.useTls=false, the keys are json names of the fields, the
+// elements of lists are addressed by their name or index
+func setConfig(expr string) error {
+	arr := strings.SplitN(expr, "=", 2)
+	if len(arr) != 2 {
+		return fmt.Errorf("invalid '%s', please use key=value", expr)
+	}
+	path, value := arr[0], arr[1]
+	v := reflect.ValueOf(&Config).Elem()
+	for _, key := range strings.Split(path, ".") {
+		switch v.Kind() {
+		case reflect.Struct:
+			field := -1
+			for i := 0; i < v.NumField(); i++ {
+				name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+				if name != "" && name != "-" && strings.EqualFold(name, key) {
+					field = i
+					break
+				}
+			}
+			if field < 0 {
+				return fmt.Errorf("unknown config key '%s' in '%s'", key, path)
+			}
+			v = v.Field(field)
+		case reflect.Slice:
+			idx := -1
+			for i := 0; i < v.Len(); i++ {
+				if e := v.Index(i); e.Kind() == reflect.Struct {
+					if f := e.FieldByName("Name"); f.IsValid() && f.String() == key {
+						idx = i
+						break
+					}
+				}
+			}
+			if idx < 0 {
+				if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < v.Len() {
+					idx = i
+				}
+			}
+			if idx < 0 {
+				return fmt.Errorf("unknown config element '%s' in '%s'", key, path)
+			}
+			v = v.Index(idx)
+		default:
+			return fmt.Errorf("config key '%s' in '%s' has no sub-keys", key, path)
+		}
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean value of '%s': %w", path, err)
+		}
+		// safe mode of the config can't be disabled from command line
+		if v.Addr().Interface() == &Config.SafeMode && v.Bool() && !b {
+			return fmt.Errorf("safe mode is enabled in config and '%s' can't disable it", path)
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer value of '%s': %w", path, err)
+		}
+		v.SetInt(int64(i))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid float value of '%s': %w", path, err)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("config key '%s' can't be set from command line", path)
+		}
+		// lists of strings are given as comma separated values
+		var list []string
+		if value != "" {
+			list = strings.Split(value, ",")
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("config key '%s' can't be set from command line", path)
+	}
+	return nil
+}
+
+// helper function to update given JSON config file via given function,
+// the file keeps its permissions but not the formatting
+func updateConfigFile(configFile string, update func(rec map[string]interface{}) error) error {
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		log.Fatalf("Unable to parse: file %s, error %v\n", configFile, err)
+		return err
+	}
+	var rec map[string]interface{}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	if err := update(rec); err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(rec, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configFile, append(data, '\n'), info.Mode().Perm())
+}
+
+// helper function to describe where password of given server comes from
+func credentialSource(name, auth, password string) string {
+	switch {
+	case auth == "keyring":
+		return "keyring"
+	case secretNames[name]:
+		return "secrets file " + Config.SecretsFile
+	case password != "":
+		return "literal"
+	}
+	return "none"
+}
+
+// helper function to print effective configuration as JSON with redacted
+// secrets, the sources of credentials are reported to stderr such that
+// stdout remains valid JSON
+func printConfig() error {
+	redacted := "<redacted>"
+	cfg := Config
+	cfg.Servers = make([]Server, len(Config.Servers))
+	for i, s := range Config.Servers {
+		fmt.Fprintf(os.Stderr, "# credentials of %s: %s\n", s.Name, credentialSource(s.Name, s.Auth, s.Password))
+		if s.Password != "" {
+			s.Password = redacted
+		}
+		cfg.Servers[i] = s
+	}
+	if cfg.SmtpServer.Host != "" || cfg.SmtpServer.Password != "" {
+		fmt.Fprintf(os.Stderr, "# credentials of smtp: %s\n", credentialSource("smtp", "", cfg.SmtpServer.Password))
+	}
+	if cfg.SmtpServer.Password != "" {
+		cfg.SmtpServer.Password = redacted
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "   ")
+	return enc.Encode(cfg)
+}
+
+// ParseConfig parse given config files and applies given key=value
+// overrides on top of them
+func ParseConfig(configFiles, overrides []string) {
+	for _, configFile := range configFiles {
+		if err := loadConfig(configFile, make(map[string]bool)); err != nil {
+			log.Fatalf("Unable to load config: file %s, error %v\n", configFile, err)
+		}
+	}
+	for _, expr := range overrides {
+		if err := setConfig(expr); err != nil {
+			log.Fatalf("Unable to set config value, error %v\n", err)
+		}
+	}
+	configFile := strings.Join(configFiles, ",")
+	if Config.SecretsFile != "" {
+		if err := loadSecrets(Config.SecretsFile); err != nil {
+			log.Fatalf("Unable to load secrets: file %s, error %v\n", Config.SecretsFile, err)
+		}
 	}
 	if Config.Maildir == "" {
 		log.Fatal("Please specify maildir in your configuration")
@@ -85,13 +576,53 @@ func ParseConfig(configFile string) {
 	// create if necessary Maildir
 	if Config.CommonInbox {
 		for _, d := range []string{"cur", "new", "tmp"} {
-			fpath := fmt.Sprintf("%s/INBOX/%s", Config.Maildir, d)
-			os.MkdirAll(fpath, os.ModePerm)
+			os.MkdirAll(localPath("", "INBOX", d), os.ModePerm)
 		}
 	}
+	switch Config.FlagAuthority {
+	case "", "local", "server", "newest":
+	default:
+		log.Fatalf("Unsupported flagAuthority '%s', please use local, server or newest", Config.FlagAuthority)
+	}
+	switch Config.VanishedFolders {
+	case "":
+		Config.VanishedFolders = "warn"
+	case "warn", "attic", "delete":
+	default:
+		log.Fatalf("Unsupported vanishedFolders '%s', please use warn, attic or delete", Config.VanishedFolders)
+	}
+	switch Config.LocalLayout {
+	case "":
+		Config.LocalLayout = "nested"
+	case "nested", "flat":
+	default:
+		log.Fatalf("Unsupported localLayout '%s', please use nested or flat", Config.LocalLayout)
+	}
+	if Config.LocalSeparator == "" {
+		Config.LocalSeparator = "."
+	}
+	// negative value disables the limit
+	if Config.MaxDeletePercent == 0 {
+		Config.MaxDeletePercent = 50
+	}
+	if Config.ListTimeout == 0 {
+		Config.ListTimeout = 60
+	}
+	if Config.HistoryRetention == 0 {
+		Config.HistoryRetention = 100
+	}
+	if Config.DBPingRetries == 0 {
+		Config.DBPingRetries = 5
+	}
+	if Config.DBPingDelay == 0 {
+		Config.DBPingDelay = 200
+	}
 	if Config.DBUri == "" {
 		Config.DBUri = fmt.Sprintf("sqlite3://%s/.goimapsync.db", Config.Maildir)
 	}
+	if err := validateConfig(); err != nil {
+		log.Fatalf("Invalid configuration: file %s, error %v\n", configFile, err)
+	}
 	if Config.CommonInbox {
 		log.Printf("maildir: %s, use common inbox for all IMAP servers\n", Config.Maildir)
 	} else {
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zalando/go-keyring"
+)
+
+// helper function to restore configuration once the test is done
+func keepConfig(t *testing.T) {
+	saved := Config
+	t.Cleanup(func() { Config = saved })
+}
+
+func TestVerboseLevel(t *testing.T) {
+	keepConfig(t)
+	tests := []struct {
+		global  int
+		servers []Server
+		imap    string
+		expect  int
+	}{
+		{0, nil, "a", 0},
+		{1, nil, "a", 1},
+		{1, []Server{{Name: "a", Verbose: 2}}, "a", 2},
+		{1, []Server{{Name: "a", Verbose: 2}}, "b", 1},
+		{2, []Server{{Name: "a"}}, "a", 2},
+		{0, []Server{{Name: "a", Verbose: 1}, {Name: "b", Verbose: 3}}, "b", 3},
+	}
+	for _, tt := range tests {
+		Config.Verbose, Config.Servers = tt.global, tt.servers
+		if got := verboseLevel(tt.imap); got != tt.expect {
+			t.Errorf("verboseLevel(%s) with global %d and servers %+v = %d, expected %d", tt.imap, tt.global, tt.servers, got, tt.expect)
+		}
+	}
+}
+
+func TestIsConfigUrl(t *testing.T) {
+	tests := []struct {
+		config string
+		url    bool
+	}{
+		{"config.json", false},
+		{"-", false},
+		{"/etc/goimapsync/config.json", false},
+		{"http://example.org/config.json", true},
+		{"https://example.org/config.json", true},
+		{"ftp://example.org/config.json", false},
+	}
+	for _, tt := range tests {
+		if got := isConfigUrl(tt.config); got != tt.url {
+			t.Errorf("isConfigUrl(%s)=%v, expected %v", tt.config, got, tt.url)
+		}
+	}
+}
+
+func TestFetchConfig(t *testing.T) {
+	config := `{"maildir": "/tmp/mail"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case r.URL.Path == "/private" && r.Header.Get("Authorization") != "Bearer secret":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.Write([]byte(config))
+		}
+	}))
+	defer srv.Close()
+	tests := []struct {
+		path  string
+		token string
+		fail  bool
+	}{
+		{"/config.json", "", false},
+		{"/missing", "", true},
+		{"/private", "", true},
+		{"/private", "wrong", true},
+		{"/private", "secret", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("GOIMAPSYNC_CONFIG_TOKEN", tt.token)
+		data, err := readConfig(srv.URL + tt.path)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s with token %q: fetch succeeded", tt.path, tt.token)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s with token %q: %v", tt.path, tt.token, err)
+		} else if string(data) != config {
+			t.Errorf("%s: fetched %q", tt.path, data)
+		}
+	}
+}
+
+func TestValidateConfigServerNames(t *testing.T) {
+	keepConfig(t)
+	tests := []struct {
+		servers []Server
+		fail    string
+	}{
+		{nil, ""},
+		{[]Server{{Name: "a"}, {Name: "b"}}, ""},
+		{[]Server{{Name: "a", Uri: "a.org:993"}, {Uri: "b.org:993"}}, "IMAP server b.org:993 has no name"},
+		{[]Server{{Name: "a"}, {Name: "b"}, {Name: "a"}}, "duplicate IMAP server name 'a'"},
+	}
+	for _, tt := range tests {
+		Config = Configuration{Servers: tt.servers}
+		err := validateConfig()
+		if tt.fail == "" && err != nil {
+			t.Errorf("servers %+v, error %v", tt.servers, err)
+		}
+		if tt.fail != "" && (err == nil || err.Error() != tt.fail) {
+			t.Errorf("servers %+v, error %v, expected %q", tt.servers, err, tt.fail)
+		}
+	}
+}
+
+func TestServerPassword(t *testing.T) {
+	keepConfig(t)
+	Config = Configuration{}
+	keyring.MockInit()
+	if err := keyring.Set("goimapsync", "stored", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		server Server
+		expect string
+		fail   string
+	}{
+		{Server{Name: "a", Password: "pass"}, "pass", ""},
+		{Server{Name: "a", Password: "pass", Auth: "config"}, "pass", ""},
+		{Server{Name: "stored", Password: "pass", Auth: "keyring"}, "secret", ""},
+		{Server{Name: "missing", Auth: "keyring"}, "", "unable to get password of 'missing' from keyring"},
+		{Server{Name: "a", Auth: "netrc"}, "", "unsupported auth 'netrc' of 'a'"},
+	}
+	for _, tt := range tests {
+		password, err := serverPassword(tt.server)
+		if tt.fail != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.fail) {
+				t.Errorf("%+v: error %v, expected %q", tt.server, err, tt.fail)
+			}
+			continue
+		}
+		if err != nil || password != tt.expect {
+			t.Errorf("%+v: password %q (error %v), expected %q", tt.server, password, err, tt.expect)
+		}
+	}
+}
+
+func TestDialKeyring(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	keyring.MockInit()
+	if err := keyring.Set("goimapsync", testServerName, "password"); err != nil {
+		t.Fatal(err)
+	}
+	s := ts.Server
+	s.Auth, s.Password = "keyring", ""
+	c, err := dial(s)
+	if err != nil {
+		t.Fatalf("unable to login with password from keyring: %v", err)
+	}
+	c.Logout()
+}
@@ -0,0 +1,316 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// conversation module for goimapsync, it groups messages of local maildir
+// folder into conversations using Message-Id, In-Reply-To and References
+// headers recorded in DB, similar to JWZ threading algorithm, see
+// https://www.jwz.org/doc/threading.html. Messages of clients which do not
+// set these headers are grouped by normalized subject.
+//
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// messageIdPattern matches message ids of In-Reply-To and References headers
+var messageIdPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+// replyPrefixPattern matches reply and forward prefixes of subjects,
+// e.g. Re:, RE[2]:, Fwd:, AW:
+var replyPrefixPattern = regexp.MustCompile(`(?i)^\s*(re|fw|fwd|aw|sv|wg)(\[\d+\])?\s*:\s*`)
+
+// ConversationMessage represents message of the conversation
+type ConversationMessage struct {
+	MessageHeaders
+	Parent string // message id of parent message within conversation
+	Depth  int    // depth of the message in conversation tree
+	Unread bool   // message is not seen
+}
+
+// Conversation represents group of messages replying to each other
+type Conversation struct {
+	Root         string                // message id of root message
+	Subject      string                // normalized subject of root message
+	Latest       time.Time             // date of latest message
+	Participants int                   // number of distinct senders
+	Unread       int                   // number of unread messages
+	Messages     []ConversationMessage // conversation messages sorted by date
+}
+
+// helper function to build threading headers of given message
+func threadHeaders(hid, mid string, header mail.Header) MessageHeaders {
+	h := MessageHeaders{HashId: hid, MessageId: mid}
+	// DB keeps UTF-8 metadata regardless of charset of the message
+	h.Subject = decodeHeader(header.Get("Subject"))
+	h.From = header.Get("From")
+	if addr, err := mail.ParseAddress(h.From); err == nil {
+		h.From = addr.Address
+	} else {
+		h.From = decodeHeader(h.From)
+	}
+	if date, err := header.Date(); err == nil {
+		h.Date = date.Unix()
+	}
+	h.InReplyTo = strings.Join(messageIdPattern.FindAllString(header.Get("In-Reply-To"), -1), " ")
+	h.References = strings.Join(messageIdPattern.FindAllString(header.Get("References"), -1), " ")
+	return h
+}
+
+// helper function to read threading headers of messages fetched by old
+// goimapsync versions from their local mail files
+func fileHeaders(h MessageHeaders) MessageHeaders {
+	file, err := os.Open(h.Path)
+	if err != nil {
+		return h
+	}
+	defer file.Close()
+	msg, err := mail.ReadMessage(file)
+	if err != nil {
+		return h
+	}
+	out := threadHeaders(h.HashId, h.MessageId, msg.Header)
+	out.Path = h.Path
+	if out.Date == 0 {
+		// use time stamp of the file name
+		out.Date = messageDate(h.Path, nil).Unix()
+	}
+	return out
+}
+
+// helper function to normalize message subject by removing reply and
+// forward prefixes and mailing list tags, e.g. "Re: [list] Fwd: Hi" -> "hi"
+func normalizeSubject(subject string) (string, bool) {
+	reply := false
+	s := strings.TrimSpace(subject)
+	for {
+		if loc := replyPrefixPattern.FindStringIndex(s); loc != nil {
+			s = s[loc[1]:]
+			reply = true
+			continue
+		}
+		if strings.HasPrefix(s, "[") {
+			if idx := strings.Index(s, "]"); idx > 0 {
+				s = strings.TrimSpace(s[idx+1:])
+				continue
+			}
+		}
+		break
+	}
+	return strings.ToLower(strings.Join(strings.Fields(s), " ")), reply
+}
+
+// helper function to return message id of given message in canonical form
+func canonicalId(mid string) string {
+	if ids := messageIdPattern.FindAllString(mid, -1); len(ids) > 0 {
+		return ids[0]
+	}
+	mid = strings.TrimSpace(mid)
+	if mid == "" {
+		return ""
+	}
+	return "<" + mid + ">"
+}
+
+// helper function to return local maildir folders of given IMAP folder for
+// all IMAP servers, or for given server only
+func conversationFolders(imapName, folder string) map[string]bool {
+	dirs := make(map[string]bool)
+	for _, s := range Config.Servers {
+		if imapName != "" && s.Name != imapName {
+			continue
+		}
+		dirs[filepath.Clean(localPath(s.Name, folder, ""))] = true
+	}
+	return dirs
+}
+
+// Conversations groups messages of given folder into conversations and
+// returns ones with activity since given time sorted by latest message
+func Conversations(imapName, folder string, since time.Time) ([]Conversation, error) {
+	defer timing("Conversations", time.Now())
+	defer profiler("Conversations")()
+	var out []Conversation
+	// read-only DB may not be migrated yet to have threading headers
+	if version, err := schemaVersion(mdb); err != nil {
+		return out, err
+	} else if version < 11 {
+		return out, fmt.Errorf("DB schema is at version %d, please run goimapsync -op=migrate-db", version)
+	}
+	headers, err := getMessageHeaders()
+	if err != nil {
+		return out, err
+	}
+	dirs := conversationFolders(imapName, folder)
+	var msgs []ConversationMessage
+	for _, h := range headers {
+		if !dirs[filepath.Dir(filepath.Dir(h.Path))] {
+			continue
+		}
+		if h.Date == 0 {
+			h = fileHeaders(h)
+		}
+		h.MessageId = canonicalId(h.MessageId)
+		if h.MessageId == "" {
+			continue
+		}
+		flags := localSyncFlags(h.Path)
+		msgs = append(msgs, ConversationMessage{MessageHeaders: h, Unread: !strings.Contains(flags, "S")})
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Date < msgs[j].Date })
+
+	// union messages with all messages they refer to, the parent of the
+	// message is the last entry of References or In-Reply-To header
+	roots := make(map[string]string)
+	var find func(id string) string
+	find = func(id string) string {
+		root, ok := roots[id]
+		if !ok || root == id {
+			roots[id] = id
+			return id
+		}
+		root = find(root)
+		roots[id] = root
+		return root
+	}
+	union := func(a, b string) {
+		ra, rb := find(a), find(b)
+		if ra != rb {
+			roots[rb] = ra
+		}
+	}
+	present := make(map[string]bool)
+	for _, m := range msgs {
+		present[m.MessageId] = true
+	}
+	subjects := make(map[string]string)
+	for i, m := range msgs {
+		find(m.MessageId)
+		refs := strings.Fields(m.References)
+		replies := strings.Fields(m.InReplyTo)
+		for _, id := range append(refs, replies...) {
+			union(id, m.MessageId)
+		}
+		if len(refs) > 0 {
+			msgs[i].Parent = refs[len(refs)-1]
+		} else if len(replies) > 0 {
+			msgs[i].Parent = replies[0]
+		}
+		// fall back to subject for replies without threading headers
+		subject, reply := normalizeSubject(m.Subject)
+		if subject == "" {
+			continue
+		}
+		if first, ok := subjects[subject]; ok && reply && len(refs) == 0 && len(replies) == 0 {
+			union(first, m.MessageId)
+			msgs[i].Parent = first
+		} else if !ok {
+			subjects[subject] = m.MessageId
+		}
+	}
+
+	groups := make(map[string][]ConversationMessage)
+	var order []string
+	for _, m := range msgs {
+		if m.Parent != "" && !present[m.Parent] {
+			m.Parent = ""
+		}
+		r := find(m.MessageId)
+		if _, ok := groups[r]; !ok {
+			order = append(order, r)
+		}
+		groups[r] = append(groups[r], m)
+	}
+	for _, r := range order {
+		conv := conversation(groups[r])
+		if conv.Latest.Before(since) {
+			continue
+		}
+		out = append(out, conv)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Latest.After(out[j].Latest) })
+	return out, nil
+}
+
+// helper function to build conversation from its messages sorted by date,
+// the earliest message without parent is the root of conversation and
+// other messages without parent are attached to it
+func conversation(msgs []ConversationMessage) Conversation {
+	var conv Conversation
+	for _, m := range msgs {
+		if m.Parent == "" {
+			conv.Root = m.MessageId
+			break
+		}
+	}
+	if conv.Root == "" {
+		// reference loop, use the earliest message
+		conv.Root = msgs[0].MessageId
+	}
+	parents := make(map[string]string)
+	senders := make(map[string]bool)
+	for i, m := range msgs {
+		if m.Parent == "" && m.MessageId != conv.Root {
+			msgs[i].Parent = conv.Root
+		}
+		if m.MessageId == conv.Root {
+			msgs[i].Parent = ""
+			conv.Subject, _ = normalizeSubject(m.Subject)
+		}
+		parents[m.MessageId] = msgs[i].Parent
+		senders[strings.ToLower(m.From)] = true
+		if m.Unread {
+			conv.Unread += 1
+		}
+		if date := time.Unix(m.Date, 0); date.After(conv.Latest) {
+			conv.Latest = date
+		}
+	}
+	for i, m := range msgs {
+		seen := map[string]bool{m.MessageId: true}
+		for p := parents[m.MessageId]; p != "" && !seen[p]; p = parents[p] {
+			seen[p] = true
+			msgs[i].Depth += 1
+		}
+	}
+	conv.Participants = len(senders)
+	conv.Messages = msgs
+	return conv
+}
+
+// helper function to print one line per conversation
+func printConversations(convs []Conversation) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LATEST\tPARTICIPANTS\tMESSAGES\tUNREAD\tSUBJECT\tROOT")
+	for _, c := range convs {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n", c.Latest.Format("2006-01-02 15:04"), c.Participants, len(c.Messages), c.Unread, c.Subject, c.Root)
+	}
+	w.Flush()
+}
+
+// helper function to print messages of conversation with given root
+// message id along with paths of their local mail files
+func printConversation(convs []Conversation, root string) error {
+	root = canonicalId(root)
+	for _, c := range convs {
+		if c.Root != root {
+			continue
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DATE\tFROM\tSUBJECT\tPATH")
+		for _, m := range c.Messages {
+			date := time.Unix(m.Date, 0).Format("2006-01-02 15:04")
+			fmt.Fprintf(w, "%s\t%s\t%s%s\t%s\n", date, m.From, strings.Repeat("  ", m.Depth), m.Subject, m.Path)
+		}
+		w.Flush()
+		return nil
+	}
+	return fmt.Errorf("no conversation with root message %s", root)
+}
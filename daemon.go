@@ -0,0 +1,203 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// daemon module for goimapsync, it periodically syncs IMAP servers
+// using per-server sync interval or schedule
+//
+// The schedule is a semicolon separated list of rules
+//    <days> <HH:MM-HH:MM> <interval>
+// where days is either "*", a range, e.g. "Mon-Fri", or list, e.g. "Sat,Sun",
+// and interval is Go duration, e.g. "2m". The first matching rule is used,
+// otherwise server syncInterval applies, e.g.
+//    "schedule": "Mon-Fri 09:00-18:00 2m; * 00:00-24:00 1h"
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// default sync interval in daemon mode
+const defaultSyncInterval = 5 * time.Minute
+
+// list of week days used in schedule rules
+var weekDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ScheduleRule represents single rule of the server schedule
+type ScheduleRule struct {
+	Days     map[time.Weekday]bool // week days of the rule
+	From     int                   // start of the rule in minutes since midnight
+	To       int                   // end of the rule in minutes since midnight
+	Interval time.Duration         // sync interval
+}
+
+// helper function to parse week day name
+func parseWeekDay(day string) (time.Weekday, error) {
+	day = strings.ToLower(strings.TrimSpace(day))
+	for i, d := range weekDays {
+		if strings.HasPrefix(day, d) {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid week day '%s'", day)
+}
+
+// helper function to parse days of the schedule rule
+func parseDays(days string) (map[time.Weekday]bool, error) {
+	out := make(map[time.Weekday]bool)
+	if days == "*" {
+		for i := range weekDays {
+			out[time.Weekday(i)] = true
+		}
+		return out, nil
+	}
+	for _, d := range strings.Split(days, ",") {
+		if arr := strings.Split(d, "-"); len(arr) == 2 {
+			from, err := parseWeekDay(arr[0])
+			if err != nil {
+				return out, err
+			}
+			to, err := parseWeekDay(arr[1])
+			if err != nil {
+				return out, err
+			}
+			for i := from; ; i = (i + 1) % 7 {
+				out[i] = true
+				if i == to {
+					break
+				}
+			}
+			continue
+		}
+		day, err := parseWeekDay(d)
+		if err != nil {
+			return out, err
+		}
+		out[day] = true
+	}
+	return out, nil
+}
+
+// helper function to parse HH:MM time into minutes since midnight
+func parseClock(clock string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(clock, "%d:%d", &h, &m); err != nil {
+		return 0, fmt.Errorf("invalid time '%s'", clock)
+	}
+	if h < 0 || h > 24 || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid time '%s'", clock)
+	}
+	return h*60 + m, nil
+}
+
+// helper function to parse server schedule
+func parseSchedule(schedule string) ([]ScheduleRule, error) {
+	var rules []ScheduleRule
+	for _, r := range strings.Split(schedule, ";") {
+		fields := strings.Fields(r)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return rules, fmt.Errorf("invalid schedule rule '%s'", r)
+		}
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return rules, err
+		}
+		arr := strings.Split(fields[1], "-")
+		if len(arr) != 2 {
+			return rules, fmt.Errorf("invalid time range '%s'", fields[1])
+		}
+		from, err := parseClock(arr[0])
+		if err != nil {
+			return rules, err
+		}
+		to, err := parseClock(arr[1])
+		if err != nil {
+			return rules, err
+		}
+		interval, err := time.ParseDuration(fields[2])
+		if err != nil {
+			return rules, err
+		}
+		rules = append(rules, ScheduleRule{Days: days, From: from, To: to, Interval: interval})
+	}
+	return rules, nil
+}
+
+// helper function to return sync interval of given server at given time
+func syncInterval(s Server, rules []ScheduleRule, t time.Time) time.Duration {
+	minutes := t.Hour()*60 + t.Minute()
+	for _, r := range rules {
+		if r.Days[t.Weekday()] && minutes >= r.From && minutes < r.To {
+			return r.Interval
+		}
+	}
+	if s.SyncInterval > 0 {
+		return time.Duration(s.SyncInterval) * time.Second
+	}
+	return defaultSyncInterval
+}
+
+// helper function to set next scheduled sync of given IMAP server
+func setNextRun(imapName string, t time.Time) {
+	updateStatus(imapName, func(s *ServerStatus) { s.NextRun = t })
+}
+
+// Daemon periodically syncs IMAP servers, every server has its own timer
+// and overlapping syncs of the same server are skipped
+func Daemon(cmap map[string]*client.Client, dryRun bool) {
+	var wg sync.WaitGroup
+	for _, srv := range Config.Servers {
+		c, ok := cmap[srv.Name]
+		if !ok {
+			continue
+		}
+		rules, err := parseSchedule(srv.Schedule)
+		if err != nil {
+			log.Fatalf("invalid schedule of '%s', error: %v\n", srv.Name, err)
+		}
+		wg.Add(1)
+		go func(s Server, c *client.Client) {
+			defer wg.Done()
+			var running sync.Mutex
+			for {
+				if !running.TryLock() {
+					log.Printf("skip sync of %s, previous sync is still running\n", s.Name)
+				} else {
+					go func() {
+						defer running.Unlock()
+						// the connection is kept across ticks and it is
+						// re-established only if it was found dead
+						var err error
+						if c, err = checkClient(s.Name, c); err != nil {
+							log.Printf("skip sync of %s, error: %v\n", s.Name, err)
+							return
+						}
+						Sync(map[string]*client.Client{s.Name: c}, dryRun)
+					}()
+				}
+				// next sync is scheduled since the start of current one
+				interval := syncInterval(s, rules, time.Now())
+				next := time.Now().Add(interval)
+				setNextRun(s.Name, next)
+				if verboseLevel(s.Name) > 0 {
+					log.Printf("next sync of %s at %v\n", s.Name, next)
+				}
+				select {
+				case <-time.After(interval):
+				case <-runContext.Done():
+					// wait for running sync before logout
+					running.Lock()
+					return
+				}
+			}
+		}(srv, c)
+	}
+	wg.Wait()
+}
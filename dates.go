@@ -0,0 +1,79 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// dates module for goimapsync, it parses dates of command line options and
+// search queries, e.g. -since, in one of the following forms
+//    2024-06-01                  ISO date, midnight UTC
+//    2024-06-01T10:00:00+02:00   ISO datetime with offset (RFC3339)
+//    2024-06-01T10:00:00         ISO datetime without offset, UTC
+//    1-Jun-2024                  IMAP date, midnight UTC
+//    90d, 12h, 3w                hours, days or weeks before now
+// All dates are returned in UTC, such that local comparisons never depend
+// on timezone of the host, and relative durations are exact multiples of
+// 24 hours regardless of DST changes.
+//
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+)
+
+// dateLayouts lists layouts of absolute dates accepted by parseDate
+var dateLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02", imap.DateLayout}
+
+// description of date forms accepted by parseDate used in error messages
+const dateForms = "2024-06-01, 2024-06-01T10:00:00+02:00, 1-Jun-2024 or relative 12h, 90d, 3w"
+
+// helper function to parse date given as absolute date or as duration
+// before now, empty value gives zero time
+func parseDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if n := len(value) - 1; n > 0 && strings.ContainsRune("hdw", rune(value[n])) {
+		if count, err := strconv.Atoi(value[:n]); err == nil {
+			if count < 0 {
+				return time.Time{}, fmt.Errorf("negative duration '%s', please use %s", value, dateForms)
+			}
+			unit := time.Hour
+			switch value[n] {
+			case 'd':
+				unit = 24 * time.Hour
+			case 'w':
+				unit = 7 * 24 * time.Hour
+			}
+			return time.Now().UTC().Add(-time.Duration(count) * unit), nil
+		}
+	}
+	for _, layout := range dateLayouts {
+		// layouts without offset are parsed as UTC
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date '%s', please use %s", value, dateForms)
+}
+
+// helper function to convert given time to date of IMAP SINCE search key,
+// IMAP dates have day granularity, hence the search includes whole UTC day
+// of given time
+func searchSince(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// helper function to convert given time to date of IMAP BEFORE search key,
+// time within the day moves the date to the next day, such that messages of
+// that day before given time are included
+func searchBefore(t time.Time) time.Time {
+	day := searchSince(t)
+	if day.Equal(t) {
+		return day
+	}
+	return day.AddDate(0, 0, 1)
+}
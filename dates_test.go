@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect time.Time
+		fail   bool
+	}{
+		{"", time.Time{}, false},
+		{"2024-06-01", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), false},
+		{" 2024-06-01 ", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), false},
+		{"1-Jun-2024", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2024-06-01T10:00:00", time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC), false},
+		{"2024-06-01T10:00", time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC), false},
+		{"2024-06-01T10:00:00+02:00", time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC), false},
+		{"2024-06-01T00:30:00+02:00", time.Date(2024, 5, 31, 22, 30, 0, 0, time.UTC), false},
+		{"01/06/2024", time.Time{}, true},
+		{"-3d", time.Time{}, true},
+		{"3m", time.Time{}, true},
+		{"d", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDate(tt.value)
+		if tt.fail {
+			if err == nil || !strings.Contains(err.Error(), dateForms) {
+				t.Errorf("parseDate(%q) error %v, expected one with accepted forms", tt.value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDate(%q): %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.expect) || got.Location() != time.UTC {
+			t.Errorf("parseDate(%q)=%v, expected %v", tt.value, got, tt.expect)
+		}
+	}
+}
+
+func TestParseDateRelative(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect time.Duration
+	}{
+		{"0d", 0},
+		{"12h", 12 * time.Hour},
+		{"90d", 90 * 24 * time.Hour},
+		{"3w", 21 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		now := time.Now()
+		got, err := parseDate(tt.value)
+		if err != nil {
+			t.Errorf("parseDate(%q): %v", tt.value, err)
+			continue
+		}
+		// durations are exact regardless of DST changes within them
+		if d := now.Sub(got) - tt.expect; d < -time.Second || d > time.Second {
+			t.Errorf("parseDate(%q) is %v before now, expected %v", tt.value, now.Sub(got), tt.expect)
+		}
+		if got.Location() != time.UTC {
+			t.Errorf("parseDate(%q) has location %v", tt.value, got.Location())
+		}
+	}
+}
+
+func TestSearchDates(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name   string
+		value  time.Time
+		since  time.Time
+		before time.Time
+	}{
+		{"midnight", day(2024, 6, 1), day(2024, 6, 1), day(2024, 6, 1)},
+		{"within day", time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC), day(2024, 6, 1), day(2024, 6, 2)},
+		{"local midnight", time.Date(2024, 6, 1, 0, 30, 0, 0, berlin), day(2024, 5, 31), day(2024, 6, 1)},
+		{"before DST change", time.Date(2024, 3, 31, 1, 30, 0, 0, berlin), day(2024, 3, 31), day(2024, 4, 1)},
+		{"after DST change", time.Date(2024, 3, 31, 3, 30, 0, 0, berlin), day(2024, 3, 31), day(2024, 4, 1)},
+		{"end of DST", time.Date(2024, 10, 27, 1, 30, 0, 0, berlin), day(2024, 10, 26), day(2024, 10, 27)},
+	}
+	for _, tt := range tests {
+		if got := searchSince(tt.value); !got.Equal(tt.since) {
+			t.Errorf("%s: searchSince(%v)=%v, expected %v", tt.name, tt.value, got, tt.since)
+		}
+		if got := searchBefore(tt.value); !got.Equal(tt.before) {
+			t.Errorf("%s: searchBefore(%v)=%v, expected %v", tt.name, tt.value, got, tt.before)
+		}
+	}
+}
+
+func TestParseQueryDates(t *testing.T) {
+	tests := []struct {
+		query  string
+		since  time.Time
+		before time.Time
+	}{
+		{"SINCE 1-Jun-2024", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), time.Time{}},
+		{"SINCE 2024-06-01T10:00:00+02:00 BEFORE 2024-06-03", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)},
+		{"BEFORE 2024-06-03T00:30:00+02:00", time.Time{}, time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		criteria, err := parseQuery(tt.query)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if !criteria.Since.Equal(tt.since) || !criteria.Before.Equal(tt.before) {
+			t.Errorf("%q: since %v and before %v, expected %v and %v", tt.query, criteria.Since, criteria.Before, tt.since, tt.before)
+		}
+	}
+	if _, err := parseQuery("SINCE yesterday"); err == nil {
+		t.Errorf("query with invalid date is accepted")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// dbcheck module for goimapsync, it reports inconsistencies between DB and
+// local maildir: messages of interrupted commits (pending DB records), DB
+// records whose files are gone from local maildir and tmp files written by
+// goimapsync without DB records. The interrupted commits are repaired at
+// start of every run, see reindexPending, hence db-check reports none of
+// them even after goimapsync was killed in the middle of fetch.
+//
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DBCheck represents inconsistencies between DB and local maildir
+type DBCheck struct {
+	Messages int      // number of checked DB records
+	Pending  []string // paths of messages with pending DB records
+	Missing  []string // paths of DB records whose files are gone
+	Orphans  []string // tmp files of goimapsync without DB records
+}
+
+// Count returns number of inconsistencies
+func (d DBCheck) Count() int {
+	return len(d.Pending) + len(d.Missing) + len(d.Orphans)
+}
+
+// CheckDB checks consistency of DB records and files of local maildir, the
+// DB record whose file was renamed, e.g. by MUA on flags change, is not
+// counted as missing one
+func CheckDB() (DBCheck, error) {
+	var check DBCheck
+	pending, err := getPendingMessages()
+	if err != nil {
+		return check, err
+	}
+	tmps := make(map[string]bool)
+	for _, p := range pending {
+		tmps[p.Tmp] = true
+		check.Pending = append(check.Pending, p.Path)
+	}
+	// collect hash ids of local mail files and orphan tmp files
+	hids := make(map[string]bool)
+	pattern := commitPattern()
+	err = filepath.Walk(Config.Maildir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == sidecarDir {
+			return filepath.SkipDir
+		}
+		area := info.Name()
+		if area != "cur" && area != "new" && area != "tmp" {
+			return nil
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			fname := filepath.Join(path, e.Name())
+			if area == "tmp" {
+				if pattern.MatchString(e.Name()) && !tmps[fname] {
+					check.Orphans = append(check.Orphans, fname)
+				}
+				continue
+			}
+			if arr := strings.Split(e.Name(), "."); len(arr) > 1 {
+				hids[arr[1]] = true
+			}
+		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return check, err
+	}
+	paths, err := getMessagePaths()
+	if err != nil {
+		return check, err
+	}
+	check.Messages = len(paths) + len(pending)
+	for hid, path := range paths {
+		if _, err := os.Stat(path); err != nil && !hids[hid] {
+			check.Missing = append(check.Missing, path)
+		}
+	}
+	sort.Strings(check.Missing)
+	sort.Strings(check.Orphans)
+	return check, nil
+}
+
+// helper function to print inconsistencies of DB check
+func printDBCheck(w io.Writer, check DBCheck) {
+	for _, p := range check.Pending {
+		fmt.Fprintf(w, "pending: %s\n", p)
+	}
+	for _, p := range check.Missing {
+		fmt.Fprintf(w, "missing: %s\n", p)
+	}
+	for _, p := range check.Orphans {
+		fmt.Fprintf(w, "orphan: %s\n", p)
+	}
+	fmt.Fprintf(w, "checked %d message(s): %d pending, %d missing, %d orphan tmp file(s)\n", check.Messages, len(check.Pending), len(check.Missing), len(check.Orphans))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckDB(t *testing.T) {
+	// mail file of commit step, i.e. written into tmp area with its DB
+	// record pointing to its place in cur area
+	commit := func(t *testing.T, step string) (Message, string) {
+		mid := fmt.Sprintf("<dbcheck-%s@localhost>", step)
+		m := Message{MessageId: mid, HashId: md5hash(mid), Imap: "a"}
+		fname := fmt.Sprintf("%d.%s.%s:2,", time.Now().Unix(), m.HashId, hostname)
+		m.Path = filepath.Join(localPath("a", "INBOX", "cur"), fname)
+		tmp := filepath.Join(localPath("a", "INBOX", "tmp"), fname)
+		if err := ioutil.WriteFile(tmp, testMessage{MessageId: mid}.body(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return m, tmp
+	}
+	tests := []struct {
+		name                      string
+		setup                     func(t *testing.T)
+		pending, missing, orphans int
+		recovered                 int // inconsistencies left after recovery of interrupted commits
+	}{
+		{name: "consistent", setup: func(t *testing.T) {
+			m, tmp := commit(t, "written")
+			if err := os.Rename(tmp, m.Path); err != nil {
+				t.Fatal(err)
+			}
+			if err := insertMessage(m); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "crash before DB record", setup: func(t *testing.T) {
+			commit(t, "record")
+		}, orphans: 1},
+		{name: "crash before rename", setup: func(t *testing.T) {
+			m, tmp := commit(t, "rename")
+			if err := insertPendingMessage(m, tmp); err != nil {
+				t.Fatal(err)
+			}
+		}, pending: 1},
+		{name: "crash before confirm", setup: func(t *testing.T) {
+			m, tmp := commit(t, "confirm")
+			if err := insertPendingMessage(m, tmp); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(tmp, m.Path); err != nil {
+				t.Fatal(err)
+			}
+		}, pending: 1},
+		{name: "renamed file", setup: func(t *testing.T) {
+			m, tmp := commit(t, "renamed")
+			if err := insertMessage(m); err != nil {
+				t.Fatal(err)
+			}
+			// MUA renames the file on flags change
+			if err := os.Rename(tmp, m.Path+"S"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "missing file", setup: func(t *testing.T) {
+			m, tmp := commit(t, "missing")
+			if err := insertMessage(m); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(tmp); err != nil {
+				t.Fatal(err)
+			}
+		}, missing: 1, recovered: 1},
+		{name: "foreign tmp file", setup: func(t *testing.T) {
+			fname := filepath.Join(localPath("a", "INBOX", "tmp"), "1700000000.M1P2.otherhost")
+			if err := ioutil.WriteFile(fname, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			if err := createLocalFolder("a", "INBOX"); err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(t)
+			check, err := CheckDB()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(check.Pending) != tt.pending || len(check.Missing) != tt.missing || len(check.Orphans) != tt.orphans {
+				t.Errorf("DB check reports %d pending, %d missing and %d orphan, expected %d, %d and %d",
+					len(check.Pending), len(check.Missing), len(check.Orphans), tt.pending, tt.missing, tt.orphans)
+			}
+			if err := reindexPending(); err != nil {
+				t.Fatal(err)
+			}
+			if check, err = CheckDB(); err != nil {
+				t.Fatal(err)
+			}
+			if n := check.Count(); n != tt.recovered {
+				var buf bytes.Buffer
+				printDBCheck(&buf, check)
+				t.Errorf("DB check reports %d inconsistencies after recovery, expected %d\n%s", n, tt.recovered, buf.String())
+			}
+		})
+	}
+}
+
+func TestPrintDBCheck(t *testing.T) {
+	check := DBCheck{Messages: 3, Pending: []string{"/m/cur/1"}, Missing: []string{"/m/cur/2"}, Orphans: []string{"/m/tmp/3"}}
+	var buf bytes.Buffer
+	printDBCheck(&buf, check)
+	expect := []string{
+		"pending: /m/cur/1",
+		"missing: /m/cur/2",
+		"orphan: /m/tmp/3",
+		"checked 3 message(s): 1 pending, 1 missing, 1 orphan tmp file(s)",
+	}
+	if got := strings.TrimSpace(buf.String()); got != strings.Join(expect, "\n") {
+		t.Errorf("DB check is printed as\n%s\nexpected\n%s", got, strings.Join(expect, "\n"))
+	}
+}
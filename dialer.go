@@ -0,0 +1,130 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// dialer module for goimapsync, it dials IMAP servers using staggered
+// parallel attempts over IPv6 and IPv4 addresses (happy eyeballs, see
+// https://tools.ietf.org/html/rfc8305) such that broken address family
+// does not hang connection for the whole OS timeout
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// delay between consecutive connection attempts
+const dialStagger = 250 * time.Millisecond
+
+// Dialer implements client.Dialer interface with staggered parallel dialing
+type Dialer struct {
+	Timeout    time.Duration // timeout of single connection attempt
+	PreferIPv4 bool          // try IPv4 addresses first
+	Addr       net.Addr      // remote address of established connection
+}
+
+// helper function to order addresses for dialing, the address families
+// are interleaved starting from preferred one
+func orderAddrs(addrs []net.IPAddr, preferIPv4 bool) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	first, second := v6, v4
+	if preferIPv4 {
+		first, second = v4, v6
+	}
+	var out []net.IPAddr
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// Dial implements client.Dialer interface
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rctx, rcancel := context.WithTimeout(ctx, timeout)
+	addrs, err := net.DefaultResolver.LookupIPAddr(rctx, host)
+	rcancel()
+	if err != nil {
+		return nil, err
+	}
+	addrs = orderAddrs(addrs, d.PreferIPv4)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses of %s", host)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	for i, a := range addrs {
+		go func(i int, a net.IPAddr) {
+			// stagger attempts, a failed attempt does not hurry the next one
+			select {
+			case <-time.After(time.Duration(i) * dialStagger):
+			case <-ctx.Done():
+				results <- result{err: ctx.Err()}
+				return
+			}
+			actx, acancel := context.WithTimeout(ctx, timeout)
+			defer acancel()
+			var nd net.Dialer
+			conn, err := nd.DialContext(actx, network, net.JoinHostPort(a.String(), port))
+			results <- result{conn: conn, err: err}
+		}(i, a)
+	}
+	var errs []error
+	for range addrs {
+		res := <-results
+		if res.err == nil {
+			d.Addr = res.conn.RemoteAddr()
+			// close connections of remaining attempts which may still succeed
+			cancel()
+			go func(n int) {
+				for i := 0; i < n; i++ {
+					if r := <-results; r.conn != nil {
+						r.conn.Close()
+					}
+				}
+			}(len(addrs) - len(errs) - 1)
+			return res.conn, nil
+		}
+		errs = append(errs, res.err)
+	}
+	return nil, fmt.Errorf("unable to connect to %s: %w", addr, errors.Join(errs...))
+}
+
+// helper function to describe address family and address of connection
+func (d *Dialer) String() string {
+	if d.Addr == nil {
+		return "not connected"
+	}
+	family := "IPv6"
+	if a, ok := d.Addr.(*net.TCPAddr); ok && a.IP.To4() != nil {
+		family = "IPv4"
+	}
+	return fmt.Sprintf("%s %s", family, d.Addr)
+}
@@ -0,0 +1,200 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// discover module for goimapsync, it discovers IMAP and SMTP settings of
+// mail provider from email address using (in order) RFC 6186 SRV records,
+// Mozilla autoconfig XML and common host names
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Discovery represents discovered settings of mail provider
+type Discovery struct {
+	Source string     // source of the settings, e.g. SRV records
+	Server Server     // IMAP server settings
+	Smtp   SmtpServer // SMTP server settings
+}
+
+// AutoconfigServer represents server of Mozilla autoconfig XML
+type AutoconfigServer struct {
+	Type       string `xml:"type,attr"`  // server type, e.g. imap or smtp
+	Hostname   string `xml:"hostname"`   // server host name
+	Port       int    `xml:"port"`       // server port
+	SocketType string `xml:"socketType"` // SSL, STARTTLS or plain
+	Username   string `xml:"username"`   // user name template, e.g. %EMAILADDRESS%
+}
+
+// Autoconfig represents Mozilla autoconfig XML, see
+// https://wiki.mozilla.org/Thunderbird:Autoconfiguration:ConfigFileFormat
+type Autoconfig struct {
+	Incoming []AutoconfigServer `xml:"emailProvider>incomingServer"` // incoming servers
+	Outgoing []AutoconfigServer `xml:"emailProvider>outgoingServer"` // outgoing servers
+}
+
+// helper function to discover settings via RFC 6186 SRV records
+func discoverSRV(email, domain string) (Discovery, bool) {
+	d := Discovery{Source: "SRV records"}
+	_, addrs, err := net.LookupSRV("imaps", "tcp", domain)
+	if err != nil || len(addrs) == 0 || addrs[0].Target == "." {
+		return d, false
+	}
+	host := strings.TrimSuffix(addrs[0].Target, ".")
+	d.Server = Server{Uri: net.JoinHostPort(host, strconv.Itoa(int(addrs[0].Port))), Username: email, UseTls: true}
+	if _, addrs, err := net.LookupSRV("submission", "tcp", domain); err == nil && len(addrs) > 0 && addrs[0].Target != "." {
+		d.Smtp = SmtpServer{Host: strings.TrimSuffix(addrs[0].Target, "."), Port: strconv.Itoa(int(addrs[0].Port)), From: email}
+	}
+	return d, true
+}
+
+// helper function to discover settings via Mozilla autoconfig XML
+func discoverAutoconfig(email, domain string) (Discovery, bool) {
+	urls := []string{
+		fmt.Sprintf("https://autoconfig.%s/mail/config-v1.1.xml?emailaddress=%s", domain, email),
+		fmt.Sprintf("https://%s/.well-known/autoconfig/mail/config-v1.1.xml", domain),
+		fmt.Sprintf("https://autoconfig.thunderbird.net/v1.1/%s", domain),
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, url := range urls {
+		resp, err := client.Get(url)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			continue
+		}
+		var cfg Autoconfig
+		if err := xml.Unmarshal(data, &cfg); err != nil {
+			continue
+		}
+		d := Discovery{Source: "autoconfig " + url}
+		username := func(tmpl string) string {
+			tmpl = strings.Replace(tmpl, "%EMAILADDRESS%", email, -1)
+			return strings.Replace(tmpl, "%EMAILLOCALPART%", strings.Split(email, "@")[0], -1)
+		}
+		for _, srv := range cfg.Incoming {
+			if srv.Type == "imap" {
+				d.Server = Server{
+					Uri:      net.JoinHostPort(srv.Hostname, strconv.Itoa(srv.Port)),
+					Username: username(srv.Username),
+					UseTls:   srv.SocketType == "SSL",
+				}
+				break
+			}
+		}
+		if d.Server.Uri == "" {
+			continue
+		}
+		for _, srv := range cfg.Outgoing {
+			if srv.Type == "smtp" {
+				d.Smtp = SmtpServer{Host: srv.Hostname, Port: strconv.Itoa(srv.Port), From: email}
+				break
+			}
+		}
+		return d, true
+	}
+	return Discovery{}, false
+}
+
+// helper function to discover settings by probing common host names
+func discoverGuess(email, domain string) (Discovery, bool) {
+	d := Discovery{Source: "common host names"}
+	for _, host := range []string{"imap." + domain, "mail." + domain} {
+		addr := net.JoinHostPort(host, "993")
+		if conn, err := net.DialTimeout("tcp", addr, 5*time.Second); err == nil {
+			conn.Close()
+			d.Server = Server{Uri: addr, Username: email, UseTls: true}
+			break
+		}
+	}
+	if d.Server.Uri == "" {
+		return d, false
+	}
+	for _, host := range []string{"smtp." + domain, "mail." + domain} {
+		addr := net.JoinHostPort(host, "587")
+		if conn, err := net.DialTimeout("tcp", addr, 5*time.Second); err == nil {
+			conn.Close()
+			d.Smtp = SmtpServer{Host: host, Port: "587", From: email}
+			break
+		}
+	}
+	return d, true
+}
+
+// Discover finds IMAP and SMTP settings of given email address, prints
+// them as config block and optionally appends them to given config file
+func Discover(email, configFile string) error {
+	arr := strings.Split(email, "@")
+	if len(arr) != 2 || arr[0] == "" || arr[1] == "" {
+		return fmt.Errorf("invalid email address '%s'", email)
+	}
+	domain := strings.ToLower(arr[1])
+	var d Discovery
+	found := false
+	for _, discover := range []func(string, string) (Discovery, bool){discoverSRV, discoverAutoconfig, discoverGuess} {
+		if d, found = discover(email, domain); found {
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("unable to discover settings of %s", domain)
+	}
+	// the name of the server is taken from the domain, e.g. example
+	d.Server.Name = strings.Split(domain, ".")[0]
+	rec := make(map[string]interface{})
+	rec["servers"] = []map[string]interface{}{{
+		"name":     d.Server.Name,
+		"uri":      d.Server.Uri,
+		"username": d.Server.Username,
+		"useTls":   d.Server.UseTls,
+	}}
+	if d.Smtp.Host != "" {
+		rec["smtp_server"] = map[string]interface{}{"host": d.Smtp.Host, "port": d.Smtp.Port, "from": d.Smtp.From}
+	}
+	data, err := json.MarshalIndent(rec, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# source: %s\n%s\n", d.Source, string(data))
+	if configFile == "" {
+		return nil
+	}
+	fmt.Printf("append server '%s' to %s? [y/N] ", d.Server.Name, configFile)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		return nil
+	}
+	return appendServer(configFile, rec)
+}
+
+// helper function to append discovered server to given config file, the
+// SMTP server is added only if config file does not have one
+func appendServer(configFile string, disc map[string]interface{}) error {
+	srv := disc["servers"].([]map[string]interface{})[0]
+	return updateConfigFile(configFile, func(rec map[string]interface{}) error {
+		servers, _ := rec["servers"].([]interface{})
+		for _, s := range servers {
+			if m, ok := s.(map[string]interface{}); ok && m["name"] == srv["name"] {
+				return fmt.Errorf("IMAP server '%s' is already defined in %s", srv["name"], configFile)
+			}
+		}
+		rec["servers"] = append(servers, srv)
+		if _, ok := rec["smtp_server"]; !ok && disc["smtp_server"] != nil {
+			rec["smtp_server"] = disc["smtp_server"]
+		}
+		return nil
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// doctor module for goimapsync, it checks configuration, local maildir, DB
+// and IMAP servers without touching any messages, and prints summary line
+// of every check. It never creates or migrates DB and logs out from every
+// IMAP server right after login.
+//
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+)
+
+// DoctorCheck represents result of single doctor check
+type DoctorCheck struct {
+	Name   string // name of the check
+	Status string // ok, warn or fail
+	Detail string // details of the check, e.g. effective DB uri
+}
+
+// helper function to make doctor check of given error
+func doctorCheck(name, detail string, err error) DoctorCheck {
+	if err != nil {
+		return DoctorCheck{Name: name, Status: "fail", Detail: fmt.Sprintf("%s: %v", detail, err)}
+	}
+	return DoctorCheck{Name: name, Status: "ok", Detail: detail}
+}
+
+// Doctor runs checks of goimapsync setup and returns their results
+func Doctor() []DoctorCheck {
+	var checks []DoctorCheck
+	checks = append(checks, DoctorCheck{Name: "config", Status: "ok", Detail: fmt.Sprintf("%d IMAP server(s)", len(Config.Servers))})
+
+	// local maildir should exist and be writable
+	err := func() error {
+		file, err := ioutil.TempFile(Config.Maildir, ".goimapsync-doctor")
+		if err != nil {
+			return err
+		}
+		file.Close()
+		return os.Remove(file.Name())
+	}()
+	checks = append(checks, doctorCheck("maildir", Config.Maildir, err))
+
+	// DB is opened read-only and it is never created by doctor
+	checks = append(checks, doctorDB()...)
+
+	// every IMAP server should accept our login
+	for _, s := range Config.Servers {
+		c, err := dial(s)
+		if err == nil {
+			c.Logout()
+		}
+		checks = append(checks, doctorCheck("server "+s.Name, s.Uri, err))
+	}
+	return checks
+}
+
+// helper function to check DB of the config, its schema version and
+// integrity
+func doctorDB() []DoctorCheck {
+	_, fname, err := parseDBUri(Config.DBUri)
+	if err != nil {
+		return []DoctorCheck{doctorCheck("db", Config.DBUri, err)}
+	}
+	if _, err := os.Stat(fname); os.IsNotExist(err) {
+		return []DoctorCheck{{Name: "db", Status: "warn", Detail: fmt.Sprintf("%s does not exist yet, it is created by the first run", Config.DBUri)}}
+	}
+	db, err := InitDB(true)
+	if err != nil {
+		return []DoctorCheck{doctorCheck("db", Config.DBUri, err)}
+	}
+	defer db.Close()
+	var check string
+	err = db.QueryRow("PRAGMA quick_check").Scan(&check)
+	if err == nil && check != "ok" {
+		err = fmt.Errorf("quick check reports '%s'", check)
+	}
+	checks := []DoctorCheck{doctorCheck("db", Config.DBUri, err)}
+	version, err := schemaVersion(db)
+	detail := fmt.Sprintf("version %d, latest %d", version, latestSchemaVersion())
+	if err == nil && version < latestSchemaVersion() {
+		checks = append(checks, DoctorCheck{Name: "schema", Status: "warn", Detail: detail + ", please run goimapsync migrate-db"})
+	} else {
+		checks = append(checks, doctorCheck("schema", detail, err))
+	}
+	return checks
+}
+
+// helper function to print summary line of every doctor check, it returns
+// number of failed checks
+func printDoctor(w io.Writer, checks []DoctorCheck) int {
+	failed := 0
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAIL")
+	for _, c := range checks {
+		if c.Status == "fail" {
+			failed += 1
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Name, c.Status, c.Detail)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d check(s), %d failed\n", len(checks), failed)
+	return failed
+}
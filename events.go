@@ -0,0 +1,94 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// events module for goimapsync, it streams events of long operations as
+// newline delimited JSON (-events=ndjson) on stdout, e.g.
+//    {"event":"folder_start","server":"work","folder":"INBOX","total":143}
+// such that other programs can render live progress without parsing logs.
+// The stream starts with {"event":"start","schema":1,...} record and ends
+// with done record, the records are written by single writer goroutine.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// version of events schema, it should be incremented on incompatible
+// changes of event records
+const eventsSchema = 1
+
+// Event represents single record of events stream
+type Event map[string]interface{}
+
+// events stream, emitters send events to channel read by writer goroutine
+var events = struct {
+	sync.RWMutex
+	ch   chan Event
+	done chan struct{}
+}{}
+
+// helper function to start events stream of given format and operation
+func startEvents(format, op string) error {
+	if format != "ndjson" {
+		return fmt.Errorf("unsupported events format '%s', please use ndjson", format)
+	}
+	events.Lock()
+	events.ch = make(chan Event, 1000)
+	events.done = make(chan struct{})
+	events.Unlock()
+	go func(ch chan Event, done chan struct{}) {
+		defer close(done)
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		for e := range ch {
+			// single Encode call writes the whole line
+			enc.Encode(e)
+		}
+	}(events.ch, events.done)
+	emitEvent("start", Event{"schema": eventsSchema, "op": op, "pid": os.Getpid(), "version": gitVersion})
+	return nil
+}
+
+// helper function to emit event with given name and fields, it does nothing
+// if events stream is not started
+func emitEvent(name string, fields Event) {
+	events.RLock()
+	defer events.RUnlock()
+	if events.ch == nil {
+		return
+	}
+	e := Event{"event": name, "time": time.Now().Format(time.RFC3339)}
+	for k, v := range fields {
+		if v != nil {
+			e[k] = v
+		}
+	}
+	events.ch <- e
+}
+
+// helper function to emit done event with run counters and wait until all
+// events are written
+func stopEvents() {
+	RunSummary.Lock()
+	fields := Event{"fetched": RunSummary.Fetched, "uploaded": RunSummary.Uploaded, "deleted": RunSummary.Deleted, "errors": len(RunSummary.Errors)}
+	RunSummary.Unlock()
+	emitEvent("done", fields)
+	events.Lock()
+	ch, done := events.ch, events.done
+	events.ch = nil
+	events.Unlock()
+	if ch == nil {
+		return
+	}
+	close(ch)
+	<-done
+}
+
+// helper function to emit event of given message
+func emitMessageEvent(name, imapName, folder string, m Message) {
+	emitEvent(name, Event{"server": imapName, "folder": folder, "uid": m.Uid, "message_id": m.MessageId})
+}
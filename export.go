@@ -0,0 +1,181 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// export module for goimapsync, it exports messages of local maildir folder
+// as individual RFC822 (.eml) files with normalized names along with
+// index.csv file of their metadata. The export never modifies maildir or DB.
+//
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maximum length of subject slug in exported file names
+const maxSlugLength = 60
+
+// ExportEntry represents exported message
+type ExportEntry struct {
+	Name      string    // name of exported file
+	Date      time.Time // message date
+	From      string    // message sender
+	Subject   string    // message subject
+	MessageId string    // message id
+	HashId    string    // message id md5 hash
+	Source    string    // path of the message in local maildir
+}
+
+// helper function to make filesystem safe slug of given string
+func slug(s string, size int) string {
+	var out []rune
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			out = append(out, r)
+			dash = false
+		} else if !dash && len(out) > 0 {
+			out = append(out, '-')
+			dash = true
+		}
+		if len(out) >= size {
+			break
+		}
+	}
+	res := strings.Trim(string(out), "-")
+	if res == "" {
+		return "none"
+	}
+	return res
+}
+
+// helper function to read export entry of given mail file
+func exportEntry(fname string) (ExportEntry, []byte, error) {
+	var e ExportEntry
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return e, nil, err
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return e, nil, err
+	}
+	e.Source = fname
+	e.Date = messageDate(fname, data)
+	e.Subject = decodeHeader(msg.Header.Get("Subject"))
+	e.From = msg.Header.Get("From")
+	domain := "unknown"
+	if addr, err := mail.ParseAddress(e.From); err == nil {
+		e.From = addr.Address
+		if arr := strings.Split(addr.Address, "@"); len(arr) == 2 {
+			domain = arr[1]
+		}
+	}
+	e.MessageId = msg.Header.Get("Message-Id")
+	if e.MessageId != "" {
+		e.HashId = md5hash(e.MessageId)
+	} else if arr := strings.Split(filepath.Base(fname), "."); len(arr) > 1 {
+		e.HashId = arr[1]
+	}
+	e.Name = fmt.Sprintf("%s_%s_%s_%s", e.Date.Format("2006-01-02"), slug(domain, 40), slug(e.Subject, maxSlugLength), e.HashId)
+	return e, data, nil
+}
+
+// ExportEml exports messages of given local maildir folder (relative to
+// Config.Maildir) received since given time and before another one (if it is
+// set) into output directory, or into zip archive if zipOutput is set
+func ExportEml(folder, out string, since, before time.Time, zipOutput bool) error {
+	defer timing("ExportEml", time.Now())
+	defer profiler("ExportEml")()
+	if out == "" {
+		return fmt.Errorf("export-eml operation requires output location")
+	}
+	root := filepath.Join(Config.Maildir, folder)
+	var files []string
+	for _, d := range []string{"cur", "new"} {
+		entries, err := ioutil.ReadDir(filepath.Join(root, d))
+		if err != nil {
+			return err
+		}
+		for _, f := range entries {
+			if !f.IsDir() {
+				files = append(files, filepath.Join(root, d, f.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+
+	var zw *zip.Writer
+	if zipOutput {
+		file, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		zw = zip.NewWriter(file)
+	} else if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	// helper function to write given file into output directory or archive
+	write := func(name string, data []byte) error {
+		if zw != nil {
+			w, err := zw.Create(name)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(data)
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(out, name), data, 0644)
+	}
+
+	var index bytes.Buffer
+	cw := csv.NewWriter(&index)
+	cw.Write([]string{"file", "date", "from", "subject", "message_id", "hid", "source"})
+	names := make(map[string]bool)
+	var nexp int
+	for _, fname := range files {
+		e, data, err := exportEntry(fname)
+		if err != nil {
+			log.Printf("unable to read %s, error: %v\n", fname, err)
+			continue
+		}
+		if e.Date.Before(since) || (!before.IsZero() && !e.Date.Before(before)) {
+			continue
+		}
+		// add suffix to the name in case of collisions
+		name := e.Name + ".eml"
+		for i := 1; names[name]; i++ {
+			name = fmt.Sprintf("%s_%d.eml", e.Name, i)
+		}
+		names[name] = true
+		if err := write(name, data); err != nil {
+			return err
+		}
+		cw.Write([]string{name, e.Date.Format(time.RFC3339), e.From, e.Subject, e.MessageId, e.HashId, e.Source})
+		nexp += 1
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	if err := write("index.csv", index.Bytes()); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	log.Printf("exported %d message(s) from %s into %s\n", nexp, root, out)
+	return nil
+}
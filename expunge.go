@@ -0,0 +1,259 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// expunge module for goimapsync, it defers expunge of sync deletions, i.e.
+// messages are flagged as \Deleted by one sync and they are expunged by
+// subsequent sync only after Config.DeleteGracePeriod passes. Within this
+// window the message can be recovered, e.g. by restoring its local file.
+// Every removal verifies its targets within the same SELECT session which
+// flags and expunges them, since sync deletions are computed from earlier
+// snapshot of the folder which could change in between.
+//
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+)
+
+// uidValidity keeps UIDVALIDITY of IMAP folders observed when their UIDs
+// were read, the keys are imap:folder strings
+var uidValidity = struct {
+	sync.Mutex
+	vmap map[string]uint32
+}{vmap: make(map[string]uint32)}
+
+// helper function to record UIDVALIDITY of given IMAP folder
+func recordUidValidity(imapName, folder string, validity uint32) {
+	uidValidity.Lock()
+	defer uidValidity.Unlock()
+	uidValidity.vmap[fmt.Sprintf("%s:%s", imapName, folder)] = validity
+}
+
+// helper function to get UIDVALIDITY of given IMAP folder observed when its
+// UIDs were read, it is zero if folder was not read yet
+func folderUidValidity(imapName, folder string) uint32 {
+	uidValidity.Lock()
+	defer uidValidity.Unlock()
+	return uidValidity.vmap[fmt.Sprintf("%s:%s", imapName, folder)]
+}
+
+// helper function to verify given messages in selected folder before they
+// are flagged or expunged, mbox is status of the SELECT which precedes the
+// removal. The UIDVALIDITY should match one observed when UIDs were read
+// and every UID should still point to message with expected message id,
+// it returns verified messages along with errors of skipped ones.
+func verifyTargets(c *client.Client, imapName string, mbox *imap.MailboxStatus, mlist []Message) ([]Message, []MessageError, error) {
+	var verified []Message
+	var skipped []MessageError
+	if len(mlist) == 0 {
+		return verified, skipped, nil
+	}
+	uidValidity.Lock()
+	validity, ok := uidValidity.vmap[fmt.Sprintf("%s:%s", imapName, mbox.Name)]
+	uidValidity.Unlock()
+	if ok && validity != mbox.UidValidity {
+		err := fmt.Errorf("UIDVALIDITY of '%s' changed from %d to %d", mbox.Name, validity, mbox.UidValidity)
+		for _, m := range mlist {
+			skipped = append(skipped, MessageError{Imap: imapName, Folder: mbox.Name, Uid: m.Uid, MessageId: m.MessageId, Error: err})
+		}
+		return verified, skipped, nil
+	}
+	var uids []uint32
+	for _, m := range mlist {
+		uids = append(uids, m.Uid)
+	}
+	mids := make(map[uint32]string)
+	messages := make(chan *imap.Message, fetchChannelSize)
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}
+	done := fetchMessages(c, uidSet(uids), items, messages, true)
+	for msg := range messages {
+		if msg != nil && msg.Envelope != nil {
+			mids[msg.Uid] = msg.Envelope.MessageId
+		}
+	}
+	if err := <-done; err != nil {
+		return verified, skipped, err
+	}
+	for _, m := range mlist {
+		mid, ok := mids[m.Uid]
+		if !ok {
+			skipped = append(skipped, MessageError{Imap: imapName, Folder: mbox.Name, Uid: m.Uid, MessageId: m.MessageId, Error: errors.New("message no longer exists on IMAP server")})
+		} else if md5hash(mid) != m.HashId {
+			err := fmt.Errorf("UID now points to different message %s", mid)
+			skipped = append(skipped, MessageError{Imap: imapName, Folder: mbox.Name, Uid: m.Uid, MessageId: m.MessageId, Error: err})
+		} else {
+			verified = append(verified, m)
+		}
+	}
+	return verified, skipped, nil
+}
+
+// helper function to report messages skipped by removal
+func reportSkipped(skipped []MessageError) {
+	for _, e := range skipped {
+		log.Printf("skip removal of UID %d (%s) in '%s' on %s: %v\n", e.Uid, e.MessageId, e.Folder, e.Imap, e.Error)
+		RunSummary.AddError(e)
+	}
+}
+
+// UidExpunge represents UID EXPUNGE command of UIDPLUS extension, see
+// https://tools.ietf.org/html/rfc4315, it should be wrapped into commands.Uid
+type UidExpunge struct {
+	SeqSet *imap.SeqSet // UIDs of messages to expunge
+}
+
+// Command implements imap.Commander interface
+func (cmd *UidExpunge) Command() *imap.Command {
+	return &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{cmd.SeqSet}}
+}
+
+// helper function to expunge messages with given UIDs in selected folder,
+// without UIDPLUS support the \Deleted flag is temporarily removed from
+// messages in keep list such that plain EXPUNGE does not remove them
+func expungeUids(c *client.Client, uids, keep []uint32) error {
+	if ok, err := c.Support("UIDPLUS"); err == nil && ok {
+		cmd := &commands.Uid{Cmd: &UidExpunge{SeqSet: uidSet(uids)}}
+		status, err := c.Execute(cmd, nil)
+		if err != nil {
+			return err
+		}
+		return status.Err()
+	}
+	flags := []interface{}{imap.DeletedFlag}
+	if len(keep) > 0 {
+		item := imap.FormatFlagsOp(imap.RemoveFlags, true)
+		if err := c.UidStore(uidSet(keep), item, flags, nil); err != nil {
+			return err
+		}
+	}
+	if err := c.Expunge(nil); err != nil {
+		return err
+	}
+	if len(keep) > 0 {
+		item := imap.FormatFlagsOp(imap.AddFlags, true)
+		return c.UidStore(uidSet(keep), item, flags, nil)
+	}
+	return nil
+}
+
+// helper function to defer removal of given inbox messages of IMAP server:
+// - new messages are flagged as \Deleted and recorded in DB
+// - messages flagged longer than Config.DeleteGracePeriod ago are expunged
+// - flagged messages which are no longer proposed for deletion (e.g. their
+// local file was restored) are unflagged
+// The mlist should contain all sync deletions of the server, otherwise
+// pending deletions of missing messages are cancelled
+func deferImapMessages(c *client.Client, imapName string, mlist []Message) error {
+	folder := "INBOX"
+	pending, err := getPendingDeletes(imapName, folder)
+	if err != nil {
+		return err
+	}
+	pmap := make(map[uint32]PendingDelete)
+	for _, p := range pending {
+		pmap[p.Uid] = p
+	}
+	grace := time.Duration(Config.DeleteGracePeriod) * time.Second
+	var flag, expunge, keep, cancel []uint32
+	var flagged, expired []Message
+	proposed := make(map[uint32]bool)
+	for _, m := range mlist {
+		proposed[m.Uid] = true
+		p, ok := pmap[m.Uid]
+		if !ok {
+			flag = append(flag, m.Uid)
+			flagged = append(flagged, m)
+		} else if time.Since(time.Unix(p.Timestamp, 0)) >= grace {
+			expunge = append(expunge, m.Uid)
+			expired = append(expired, m)
+		} else {
+			keep = append(keep, m.Uid)
+		}
+	}
+	for _, p := range pending {
+		if !proposed[p.Uid] {
+			cancel = append(cancel, p.Uid)
+		}
+	}
+	if len(flag)+len(expunge)+len(cancel) == 0 {
+		return nil
+	}
+
+	inboxFolder := imapFolder(imapName, "inbox")
+	var skipped []MessageError
+	_, err = withReconnect(c, imapName, "", func(c *client.Client) error {
+		mbox, err := c.Select(inboxFolder, false)
+		if err != nil {
+			return err
+		}
+		// verify messages to flag or expunge, the verification is repeated
+		// on retry after reconnect with lists of previous attempt
+		var fskip, eskip []MessageError
+		flagged, fskip, err = verifyTargets(c, imapName, mbox, flagged)
+		if err != nil {
+			return err
+		}
+		expired, eskip, err = verifyTargets(c, imapName, mbox, expired)
+		if err != nil {
+			return err
+		}
+		skipped = append(skipped, append(fskip, eskip...)...)
+		flag, expunge = messageUids(flagged), messageUids(expired)
+		// the messages flagged by this sync are kept until next one
+		wait := append(messageUids(nil), keep...)
+		wait = append(wait, flag...)
+		flags := []interface{}{imap.DeletedFlag}
+		if len(flag) > 0 {
+			item := imap.FormatFlagsOp(imap.AddFlags, true)
+			if err := c.UidStore(uidSet(flag), item, flags, nil); err != nil {
+				return err
+			}
+		}
+		if len(cancel) > 0 {
+			item := imap.FormatFlagsOp(imap.RemoveFlags, true)
+			if err := c.UidStore(uidSet(cancel), item, flags, nil); err != nil {
+				return err
+			}
+		}
+		if len(expunge) > 0 {
+			return expungeUids(c, expunge, wait)
+		}
+		return nil
+	})
+	reportSkipped(skipped)
+	if err != nil {
+		return err
+	}
+	for _, m := range flagged {
+		insertPendingDelete(imapName, folder, m.Uid, m.HashId)
+	}
+	for _, uid := range cancel {
+		deletePendingDelete(imapName, folder, uid)
+	}
+	for _, m := range expired {
+		deletePendingDelete(imapName, folder, m.Uid)
+		deleteMessage(m.HashId)
+		deleteMessageAccount(m.HashId, imapName)
+		deleteSyncState(m.HashId, imapName, folder)
+		emitMessageEvent("message_deleted", imapName, folder, m)
+	}
+	RunSummary.AddDeleted(len(expired))
+	log.Printf("%s: flagged %d message(s) as %s, expunged %d, restored %d, %d wait for grace period\n", imapName, len(flag), imap.DeletedFlag, len(expunge), len(cancel), len(keep))
+	return nil
+}
+
+// helper function to return UIDs of given messages
+func messageUids(mlist []Message) []uint32 {
+	var uids []uint32
+	for _, m := range mlist {
+		uids = append(uids, m.Uid)
+	}
+	return uids
+}
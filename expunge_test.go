@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+)
+
+// helper function to check if any of given flags is \Deleted
+func hasDeletedFlag(flags []string) bool {
+	for _, f := range flags {
+		if f == imap.DeletedFlag {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDeferImapMessages(t *testing.T) {
+	setupTest(t)
+	Config.DeleteGracePeriod = 3600
+	ts := startTestServer(t)
+	msgs := []testMessage{
+		{MessageId: "<defer-1@localhost>", Subject: "Delete"},
+		{MessageId: "<defer-2@localhost>", Subject: "Restore"},
+	}
+	ts.add(t, "INBOX", msgs...)
+	c := ts.connect(t)
+	mlist, err := readImap(c, testServerName, "INBOX", false, FlagFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletions := make(map[string]Message)
+	for _, m := range mlist {
+		deletions[m.MessageId] = m
+	}
+	del, restore := deletions[msgs[0].MessageId], deletions[msgs[1].MessageId]
+	size := ts.size(t, "INBOX")
+
+	tests := []struct {
+		name     string
+		mlist    []Message
+		expired  bool   // grace period of pending deletions is over
+		size     uint32 // number of messages in INBOX
+		deleted  string // messages flagged as \Deleted
+		pending  int    // number of pending deletions
+		expunges int    // number of EXPUNGE commands
+	}{
+		{"flag", []Message{del, restore}, false, size, "<defer-1@localhost> <defer-2@localhost>", 2, 0},
+		{"within grace period", []Message{del, restore}, false, size, "<defer-1@localhost> <defer-2@localhost>", 2, 0},
+		{"after grace period", []Message{del}, true, size - 1, "", 0, 1},
+	}
+	for _, tt := range tests {
+		if tt.expired {
+			if _, err := mdb.Exec("UPDATE pending_deletes SET timestamp=?", time.Now().Add(-2*time.Hour).Unix()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := deferImapMessages(c, testServerName, tt.mlist); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if n := ts.size(t, "INBOX"); n != tt.size {
+			t.Errorf("%s: INBOX has %d message(s) instead of %d", tt.name, n, tt.size)
+		}
+		var deleted []string
+		for _, mid := range []string{msgs[0].MessageId, msgs[1].MessageId} {
+			if flags, ok := ts.flags(t, "INBOX")[mid]; ok && hasDeletedFlag(flags) {
+				deleted = append(deleted, mid)
+			}
+		}
+		if got := strings.Join(deleted, " "); got != tt.deleted {
+			t.Errorf("%s: messages flagged as deleted %q, expected %q", tt.name, got, tt.deleted)
+		}
+		pending, err := getPendingDeletes(testServerName, "INBOX")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != tt.pending {
+			t.Errorf("%s: %d pending deletion(s) instead of %d", tt.name, len(pending), tt.pending)
+		}
+		if n := ts.Expunge.Get(); n != tt.expunges {
+			t.Errorf("%s: %d EXPUNGE command(s) instead of %d", tt.name, n, tt.expunges)
+		}
+	}
+	// the restored message is kept on IMAP server
+	if _, ok := ts.flags(t, "INBOX")[restore.MessageId]; !ok {
+		t.Errorf("restored message is expunged")
+	}
+}
+
+func TestRemoveServerMessages(t *testing.T) {
+	tests := []struct {
+		nmsg, batch int
+		expunges    int // ceil(nmsg/batch) EXPUNGE commands
+	}{
+		{5, 0, 1},
+		{5, 2, 3},
+		{4, 2, 2},
+		{5, 5, 1},
+		{3, 10, 1},
+		{0, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d in batches of %d", tt.nmsg, tt.batch), func(t *testing.T) {
+			setupTest(t)
+			Config.DeleteBatchSize = tt.batch
+			ts := startTestServer(t)
+			mids := make(map[string]bool)
+			for i := 0; i < tt.nmsg; i++ {
+				m := testMessage{MessageId: fmt.Sprintf("<remove-%d@localhost>", i), Subject: "Batch removal"}
+				ts.add(t, "INBOX", m)
+				mids[m.MessageId] = true
+			}
+			c := ts.connect(t)
+			mlist, err := readImap(c, testServerName, "INBOX", false, FlagFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var del []Message
+			for _, m := range mlist {
+				if mids[m.MessageId] {
+					del = append(del, m)
+				}
+			}
+			size := ts.size(t, "INBOX")
+			if err := removeServerMessages(currentClient(testServerName, c), testServerName, del); err != nil {
+				t.Fatal(err)
+			}
+			if n := ts.Expunge.Get(); n != tt.expunges {
+				t.Errorf("removal issued %d EXPUNGE command(s), expected %d", n, tt.expunges)
+			}
+			if n := ts.size(t, "INBOX"); n != size-uint32(tt.nmsg) {
+				t.Errorf("INBOX has %d message(s) after removal, expected %d", n, size-uint32(tt.nmsg))
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// failed module for goimapsync, it retries messages which were fetched but
+// could not be written into local maildir, e.g. on full disk. The failed
+// writes are queued per IMAP folder and retried once the folder is read,
+// with fresh fetch of their bodies by UID since the original ones are
+// already consumed. The messages which still fail are recorded in
+// failed_messages table, reported in run summary and excluded from the
+// messages read from the folder, such that they are fetched again by the
+// next run.
+//
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// WriteQueue represents messages whose write into local maildir failed,
+// keyed by IMAP server and folder
+type WriteQueue struct {
+	sync.Mutex
+	Messages map[string][]Message // failed messages
+}
+
+// writeQueue keeps failed writes of current run
+var writeQueue WriteQueue
+
+// helper function to return key of write queue for given IMAP folder
+func writeQueueKey(imapName, folder string) string {
+	return fmt.Sprintf("%s:%s", imapName, folder)
+}
+
+// Add queues given message of IMAP folder for retry
+func (q *WriteQueue) Add(imapName, folder string, m Message, err error) {
+	q.Lock()
+	defer q.Unlock()
+	log.Printf("unable to write %s, retry it later, error: %v\n", m.String(), err)
+	if q.Messages == nil {
+		q.Messages = make(map[string][]Message)
+	}
+	key := writeQueueKey(imapName, folder)
+	q.Messages[key] = append(q.Messages[key], m)
+}
+
+// Take returns and removes queued messages of given IMAP folder
+func (q *WriteQueue) Take(imapName, folder string) []Message {
+	q.Lock()
+	defer q.Unlock()
+	key := writeQueueKey(imapName, folder)
+	msgs := q.Messages[key]
+	delete(q.Messages, key)
+	return msgs
+}
+
+// helper function to retry queued writes of given IMAP folder, it returns
+// given messages of the folder without ones which could not be written
+func retryWrites(c *client.Client, imapName, folder string, msgs []Message) []Message {
+	queue := writeQueue.Take(imapName, folder)
+	if len(queue) == 0 {
+		return msgs
+	}
+	// interrupted run does not retry, the messages are fetched by next run
+	if interrupted() {
+		skip := make(map[uint32]bool)
+		for _, m := range queue {
+			skip[m.Uid] = true
+		}
+		return withoutUids(msgs, skip)
+	}
+	log.Printf("retry %d failed write(s) of '%s' on %s\n", len(queue), folder, imapName)
+	qmap := make(map[uint32]Message)
+	var uids []uint32
+	for _, m := range queue {
+		qmap[m.Uid] = m
+		uids = append(uids, m.Uid)
+	}
+	errs := make(map[uint32]error)
+	section := &imap.BodySectionName{}
+	items := []imap.FetchItem{section.FetchItem(), imap.FetchUid}
+	_, err := withReconnect(c, imapName, folder, func(c *client.Client) error {
+		// on retry after reconnect we fetch bodies of all queued messages
+		for _, uid := range uids {
+			errs[uid] = errors.New("message is not found on IMAP server")
+		}
+		messages := make(chan *imap.Message, fetchChannelSize)
+		done := fetchMessages(c, uidSet(uids), items, messages, true)
+		for msg := range messages {
+			m, ok := qmap[msg.Uid]
+			if !ok {
+				continue
+			}
+			r := msg.GetBody(section)
+			if r == nil {
+				errs[m.Uid] = errors.New("message without body")
+				continue
+			}
+			if err := writeMail(imapName, folder, m, r); err != nil {
+				errs[m.Uid] = err
+				continue
+			}
+			delete(errs, m.Uid)
+			RunSummary.AddFetched(1)
+			emitMessageEvent("message_fetched", imapName, folder, m)
+			if err := markBodyFetched(m.HashId); err != nil {
+				log.Printf("unable to mark body of %s as fetched, error: %v\n", m.HashId, err)
+			}
+			deleteFailedMessage(m.HashId)
+		}
+		return <-done
+	})
+	if err != nil {
+		log.Printf("unable to fetch failed messages of '%s' on %s, error: %v\n", folder, imapName, err)
+	}
+	validity := folderUidValidity(imapName, folder)
+	skip := make(map[uint32]bool)
+	for uid, e := range errs {
+		skip[uid] = true
+		m := qmap[uid]
+		f := FailedMessage{Imap: imapName, Folder: folder, Uid: uid, UidValidity: validity, HashId: m.HashId, MessageId: m.MessageId, Error: e.Error()}
+		if err := insertFailedMessage(f); err != nil {
+			log.Printf("unable to record failed message %s, error: %v\n", m.MessageId, err)
+		}
+		RunSummary.AddFailed(MessageError{Imap: imapName, Folder: folder, Uid: uid, MessageId: m.MessageId, Error: e})
+	}
+	return withoutUids(msgs, skip)
+}
+
+// helper function to drop messages with given UIDs from list of messages
+func withoutUids(msgs []Message, uids map[uint32]bool) []Message {
+	if len(uids) == 0 {
+		return msgs
+	}
+	var out []Message
+	for _, m := range msgs {
+		if !uids[m.Uid] {
+			out = append(out, m)
+		}
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteQueue(t *testing.T) {
+	var q WriteQueue
+	q.Add("a", "INBOX", Message{Uid: 1}, errors.New("disk full"))
+	q.Add("a", "INBOX", Message{Uid: 2}, errors.New("disk full"))
+	q.Add("a", "Work", Message{Uid: 3}, errors.New("disk full"))
+	q.Add("b", "INBOX", Message{Uid: 4}, errors.New("disk full"))
+	tests := []struct {
+		imap, folder string
+		expect       []uint32
+	}{
+		{"a", "INBOX", []uint32{1, 2}},
+		{"a", "INBOX", nil},
+		{"a", "Work", []uint32{3}},
+		{"b", "INBOX", []uint32{4}},
+		{"b", "Work", nil},
+	}
+	for _, tt := range tests {
+		var uids []uint32
+		for _, m := range q.Take(tt.imap, tt.folder) {
+			uids = append(uids, m.Uid)
+		}
+		if fmt.Sprintf("%v", uids) != fmt.Sprintf("%v", tt.expect) {
+			t.Errorf("queue of %s:%s has UIDs %v, expected %v", tt.imap, tt.folder, uids, tt.expect)
+		}
+	}
+}
+
+func TestWithoutUids(t *testing.T) {
+	msgs := []Message{{Uid: 1}, {Uid: 2}, {Uid: 3}}
+	tests := []struct {
+		uids   map[uint32]bool
+		expect []uint32
+	}{
+		{nil, []uint32{1, 2, 3}},
+		{map[uint32]bool{2: true}, []uint32{1, 3}},
+		{map[uint32]bool{1: true, 3: true, 4: true}, []uint32{2}},
+		{map[uint32]bool{1: true, 2: true, 3: true}, nil},
+	}
+	for _, tt := range tests {
+		var uids []uint32
+		for _, m := range withoutUids(msgs, tt.uids) {
+			uids = append(uids, m.Uid)
+		}
+		if fmt.Sprintf("%v", uids) != fmt.Sprintf("%v", tt.expect) {
+			t.Errorf("withoutUids(%v) has UIDs %v, expected %v", tt.uids, uids, tt.expect)
+		}
+	}
+}
+
+func TestFailedWrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		blocked  []bool // tmp area of local maildir is blocked on each fetch
+		failed   int    // failed writes counted in run summary
+		attempts int    // attempts of failed message recorded in DB
+		written  bool   // message is written into local maildir
+	}{
+		{name: "failed write", blocked: []bool{true}, failed: 1, attempts: 1},
+		{name: "failed twice", blocked: []bool{true, true}, failed: 2, attempts: 2},
+		{name: "fetched again", blocked: []bool{true, false}, failed: 1, written: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			m := testMessage{MessageId: "<failed-1@localhost>", Subject: "Failed write"}
+			ts.add(t, "Disk", m)
+			c := ts.connect(t)
+			// regular file in place of tmp area fails every write of the folder
+			tdir := strings.TrimSuffix(localPath(testServerName, "Disk", "tmp"), "/")
+			if err := os.MkdirAll(filepath.Dir(tdir), 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, blocked := range tt.blocked {
+				if blocked {
+					if err := ioutil.WriteFile(tdir, nil, 0644); err != nil {
+						t.Fatal(err)
+					}
+				} else if err := os.Remove(tdir); err != nil {
+					t.Fatal(err)
+				}
+				msgs, err := Fetch(currentClient(testServerName, c), testServerName, "Disk", false, FlagFilter{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				// failed message is not reported as read one
+				if n := len(msgs); blocked && n != 0 {
+					t.Errorf("fetch with failed write read %d message(s)", n)
+				}
+			}
+			if RunSummary.Failed != tt.failed {
+				t.Errorf("%d failed write(s) are counted, expected %d", RunSummary.Failed, tt.failed)
+			}
+			records, err := getFailedMessages(testServerName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.attempts == 0 && len(records) != 0 {
+				t.Errorf("%d failed message(s) are kept in DB", len(records))
+			}
+			if tt.attempts > 0 && (len(records) != 1 || records[0].MessageId != m.MessageId || records[0].Attempts != tt.attempts) {
+				t.Errorf("failed messages %+v, expected %s with %d attempt(s)", records, m.MessageId, tt.attempts)
+			}
+			if fname := findLocalMail(testServerName, "Disk", md5hash(m.MessageId)); (fname != "") != tt.written {
+				t.Errorf("message %s is written into '%s', expected written %v", m.MessageId, fname, tt.written)
+			}
+		})
+	}
+}
@@ -3,11 +3,22 @@ module github.com/vkuznet/goimapsync
 go 1.20
 
 require (
+	github.com/ProtonMail/go-crypto v1.1.6
 	github.com/emersion/go-imap v1.2.1
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
+	github.com/klauspost/compress v1.16.7
 	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/zalando/go-keyring v0.2.3
+	golang.org/x/text v0.14.0
 )
 
 require (
-	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
-	golang.org/x/text v0.3.8 // indirect
+	github.com/alessio/shellescape v1.4.1 // indirect
+	github.com/cloudflare/circl v1.3.7 // indirect
+	github.com/danieljoos/wincred v1.2.0 // indirect
+	github.com/emersion/go-message v0.15.0 // indirect
+	github.com/emersion/go-textwrapper v0.0.0-20200911093747-65d896831594 // indirect
+	github.com/godbus/dbus/v5 v5.1.0 // indirect
+	golang.org/x/crypto v0.17.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
 )
@@ -0,0 +1,226 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// gpg module for goimapsync, it decrypts symmetrically (gpg -c) encrypted
+// configuration in-process. The passphrase is taken from GOIMAPSYNC_PASSPHRASE
+// environment or it is asked via running gpg-agent (and its pinentry), such
+// that decrypted configuration never touches the disk.
+//
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+)
+
+// PassphraseEnv defines environment variable with passphrase of encrypted config
+const PassphraseEnv = "GOIMAPSYNC_PASSPHRASE"
+
+// helper function to decrypt GPG encrypted config data, data can be either
+// binary or ASCII armored PGP message
+func decryptConfig(configFile string, data []byte) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP MESSAGE-----")) {
+		block, err := armor.Decode(bytes.NewReader(bytes.TrimSpace(data)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode armored config %s: %w", configFile, err)
+		}
+		r = block.Body
+	}
+	agent := false
+	attempts := 0
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if !symmetric {
+			return nil, pgperrors.ErrKeyIncorrect
+		}
+		attempts += 1
+		if attempts > 1 {
+			// do not keep wrong passphrase in gpg-agent cache
+			if agent {
+				agentClearPassphrase(passphraseCacheId(configFile))
+			}
+			return nil, errors.New("wrong passphrase")
+		}
+		if pass, ok := os.LookupEnv(PassphraseEnv); ok {
+			return []byte(pass), nil
+		}
+		agent = true
+		return agentPassphrase(configFile)
+	}
+	// wrong passphrase may pass the check of its session key and fail
+	// decryption later, it is cleared from gpg-agent cache as well
+	clearAgent := func() {
+		if agent && attempts == 1 {
+			agentClearPassphrase(passphraseCacheId(configFile))
+		}
+	}
+	md, err := openpgp.ReadMessage(r, openpgp.EntityList{}, prompt, nil)
+	if errors.Is(err, pgperrors.ErrKeyIncorrect) {
+		return nil, fmt.Errorf("config %s is encrypted with public key, goimapsync decrypts only symmetrically encrypted (gpg -c) configs, please use gpg -d -o - %s | goimapsync -config - ...", configFile, configFile)
+	}
+	if err != nil {
+		clearAgent()
+		return nil, fmt.Errorf("unable to decrypt config %s: %w", configFile, err)
+	}
+	// integrity of the message is verified when its body is fully read
+	content, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		clearAgent()
+		return nil, fmt.Errorf("unable to decrypt config %s: %w", configFile, err)
+	}
+	return content, nil
+}
+
+// helper function to return cache id of passphrase in gpg-agent
+func passphraseCacheId(configFile string) string {
+	if path, err := filepath.Abs(configFile); err == nil {
+		configFile = path
+	}
+	return "goimapsync:" + configFile
+}
+
+// helper function to return candidates of gpg-agent socket, the standard
+// socket lives either in GNUPGHOME or in /run/user/<uid>/gnupg
+func agentSockets() []string {
+	var socks []string
+	home := os.Getenv("GNUPGHOME")
+	if home == "" {
+		if dir, err := os.UserHomeDir(); err == nil {
+			home = filepath.Join(dir, ".gnupg")
+		}
+	}
+	if home != "" {
+		socks = append(socks, filepath.Join(home, "S.gpg-agent"))
+	}
+	if uid := os.Getuid(); uid >= 0 {
+		socks = append(socks, fmt.Sprintf("/run/user/%d/gnupg/S.gpg-agent", uid))
+	}
+	return socks
+}
+
+// helper function to connect to gpg-agent, it follows socket redirection
+// files (%Assuan% followed by socket=<path>) used by gpg on some systems
+func agentDial() (net.Conn, error) {
+	var err error
+	for _, sock := range agentSockets() {
+		var conn net.Conn
+		if conn, err = net.Dial("unix", sock); err == nil {
+			return conn, nil
+		}
+		data, rerr := ioutil.ReadFile(sock)
+		if rerr != nil || !bytes.HasPrefix(data, []byte("%Assuan%")) {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "socket=") {
+				sock = strings.TrimSpace(strings.TrimPrefix(line, "socket="))
+				if conn, err = net.Dial("unix", sock); err == nil {
+					return conn, nil
+				}
+			}
+		}
+	}
+	if err == nil {
+		err = errors.New("no gpg-agent socket")
+	}
+	return nil, err
+}
+
+// helper function to escape argument of Assuan command
+func assuanEscape(s string) string {
+	r := strings.NewReplacer("%", "%25", "+", "%2B", "\r", "%0D", "\n", "%0A", " ", "+")
+	return r.Replace(s)
+}
+
+// helper function to send Assuan command to gpg-agent and read its data
+// lines until OK or ERR response
+func agentCommand(conn net.Conn, reader *bufio.Reader, cmd string) (string, error) {
+	if cmd != "" {
+		if _, err := fmt.Fprintf(conn, "%s\n", cmd); err != nil {
+			return "", err
+		}
+	}
+	var data string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data, nil
+		case strings.HasPrefix(line, "ERR"):
+			return "", fmt.Errorf("gpg-agent: %s", line)
+		case strings.HasPrefix(line, "D "):
+			val, err := url.PathUnescape(line[2:])
+			if err != nil {
+				return "", err
+			}
+			data += val
+		}
+		// status (S), comment (#) and other lines are ignored
+	}
+}
+
+// helper function to open session with gpg-agent, it passes our terminal
+// and display to pinentry of the agent
+func agentSession() (net.Conn, *bufio.Reader, error) {
+	conn, err := agentDial()
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	// read greeting of the agent
+	if _, err := agentCommand(conn, reader, ""); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		agentCommand(conn, reader, "OPTION ttyname="+tty)
+	}
+	if display := os.Getenv("DISPLAY"); display != "" {
+		agentCommand(conn, reader, "OPTION display="+display)
+	}
+	return conn, reader, nil
+}
+
+// helper function to ask gpg-agent for passphrase of given config file
+func agentPassphrase(configFile string) ([]byte, error) {
+	conn, reader, err := agentSession()
+	if err != nil {
+		return nil, fmt.Errorf("no passphrase, please set %s or start gpg-agent: %w", PassphraseEnv, err)
+	}
+	defer conn.Close()
+	cmd := fmt.Sprintf("GET_PASSPHRASE --data %s X %s %s",
+		assuanEscape(passphraseCacheId(configFile)),
+		assuanEscape("Passphrase:"),
+		assuanEscape("Please enter passphrase of goimapsync config "+configFile))
+	pass, err := agentCommand(conn, reader, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(pass), nil
+}
+
+// helper function to remove cached passphrase of given id from gpg-agent
+func agentClearPassphrase(cacheId string) {
+	conn, reader, err := agentSession()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	agentCommand(conn, reader, "CLEAR_PASSPHRASE "+assuanEscape(cacheId))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// helper function to symmetrically encrypt given data with passphrase
+func encryptTestConfig(t *testing.T, data, passphrase string, armored bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	var aw io.WriteCloser
+	if armored {
+		var err error
+		if aw, err = armor.Encode(&buf, "PGP MESSAGE", nil); err != nil {
+			t.Fatal(err)
+		}
+		out = aw
+	}
+	w, err := openpgp.SymmetricallyEncrypt(out, []byte(passphrase), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if aw != nil {
+		aw.Close()
+	}
+	return buf.Bytes()
+}
+
+// helper function to start fake gpg-agent which answers GET_PASSPHRASE
+// with given passphrase, it returns function to get received commands
+func fakeAgent(t *testing.T, passphrase string) func() []string {
+	t.Helper()
+	// unix socket path is limited in length, therefore we do not use t.TempDir
+	dir, err := ioutil.TempDir("", "gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ln, err := net.Listen("unix", filepath.Join(dir, "S.gpg-agent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	t.Setenv("GNUPGHOME", dir)
+	var mutex sync.Mutex
+	var cmds []string
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("OK Pleased to meet you\n"))
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				cmd := scanner.Text()
+				mutex.Lock()
+				cmds = append(cmds, cmd)
+				mutex.Unlock()
+				if strings.HasPrefix(cmd, "GET_PASSPHRASE") {
+					conn.Write([]byte("S PROGRESS\nD " + strings.ReplaceAll(passphrase, "%", "%25") + "\nOK\n"))
+				} else {
+					conn.Write([]byte("OK\n"))
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, cmds...)
+	}
+}
+
+func TestDecryptConfig(t *testing.T) {
+	config := `{"maildir": "/tmp/mail", "servers": []}`
+	tests := []struct {
+		name    string
+		pass    string
+		armored bool
+		env     *string
+		agent   string
+		fail    string
+	}{
+		{name: "armored env", armored: true, env: strPtr("secret")},
+		{name: "binary env", env: strPtr("secret")},
+		{name: "binary agent", agent: "secret"},
+		{name: "armored agent with percent", pass: "100%secret", armored: true, agent: "100%secret"},
+		{name: "wrong env passphrase", env: strPtr("wrong"), fail: "unable to decrypt"},
+		{name: "wrong agent passphrase", agent: "wrong", fail: "unable to decrypt"},
+		{name: "no passphrase", fail: "GOIMAPSYNC_PASSPHRASE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pass := tt.pass
+			if pass == "" {
+				pass = "secret"
+			}
+			data := encryptTestConfig(t, config, pass, tt.armored)
+			t.Setenv(PassphraseEnv, "")
+			os.Unsetenv(PassphraseEnv)
+			if tt.env != nil {
+				t.Setenv(PassphraseEnv, *tt.env)
+			}
+			var cmds func() []string
+			if tt.agent != "" {
+				cmds = fakeAgent(t, tt.agent)
+			} else {
+				// point to empty gnupg home and non existing runtime dir
+				t.Setenv("GNUPGHOME", t.TempDir())
+				t.Setenv("HOME", t.TempDir())
+			}
+			fname := filepath.Join(t.TempDir(), "config.gpg")
+			if err := ioutil.WriteFile(fname, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			content, err := readConfig(fname)
+			if tt.fail != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.fail) {
+					t.Fatalf("expected error with %q, got %v", tt.fail, err)
+				}
+				if tt.agent != "" && !hasPrefix(cmds(), "CLEAR_PASSPHRASE goimapsync:") {
+					t.Errorf("wrong passphrase is not cleared in agent, commands %v", cmds())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != config {
+				t.Errorf("decrypted config %q, expected %q", content, config)
+			}
+		})
+	}
+}
+
+func TestDecryptConfigPublicKey(t *testing.T) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := openpgp.Encrypt(&buf, []*openpgp.Entity{entity}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("{}"))
+	w.Close()
+	_, err = decryptConfig("config.gpg", buf.Bytes())
+	if err == nil || !strings.Contains(err.Error(), "gpg -c") {
+		t.Fatalf("expected public key error, got %v", err)
+	}
+}
+
+func TestAssuanEscape(t *testing.T) {
+	tests := []struct {
+		input, expect string
+	}{
+		{"Passphrase:", "Passphrase:"},
+		{"a b", "a+b"},
+		{"a+b", "a%2Bb"},
+		{"100%\n", "100%25%0A"},
+	}
+	for _, tt := range tests {
+		if got := assuanEscape(tt.input); got != tt.expect {
+			t.Errorf("assuanEscape(%q)=%q, expected %q", tt.input, got, tt.expect)
+		}
+	}
+}
+
+// helper function to return pointer of given string
+func strPtr(s string) *string {
+	return &s
+}
+
+// helper function to check if any of given strings has prefix
+func hasPrefix(list []string, prefix string) bool {
+	for _, s := range list {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// history module for goimapsync, it prints last runs recorded in DB
+//
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// helper function to print last runs of goimapsync
+func printHistory(limit int) {
+	runs, err := getRuns(limit)
+	if err != nil {
+		log.Println("unable to read history of runs", err)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTART\tDURATION\tOP\tSERVERS\tFOLDERS\tFETCHED\tUPLOADED\tDELETED\tERRORS\tSTATUS")
+	for _, r := range runs {
+		duration := "-"
+		if !r.End.IsZero() {
+			duration = r.End.Sub(r.Start).String()
+		}
+		start := r.Start.Format(time.RFC3339)
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\n", r.Id, start, duration, r.Op, r.Servers, r.Folders, r.Fetched, r.Uploaded, r.Deleted, r.Errors, r.Status)
+	}
+	w.Flush()
+}
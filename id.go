@@ -0,0 +1,127 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// id module for goimapsync, it identifies goimapsync to IMAP servers via ID
+// command, see https://tools.ietf.org/html/rfc2971, some providers log and
+// rate-limit clients by their identification. By default the name and
+// version of goimapsync are sent, the fields may be customized via clientId
+// config option, e.g.
+//    "clientId": {"name": "goimapsync", "vendor": "example.org"}
+// and empty object sends no identification (ID NIL).
+//
+
+import (
+	"errors"
+	"log"
+	"sort"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+)
+
+// IdCommand represents IMAP ID command
+type IdCommand struct {
+	Fields map[string]string // identification fields, nil sends NIL
+}
+
+// Command implements imap.Commander interface
+func (cmd *IdCommand) Command() *imap.Command {
+	return &imap.Command{Name: "ID", Arguments: []interface{}{idFields(cmd.Fields)}}
+}
+
+// IdResponse represents IMAP ID response
+type IdResponse struct {
+	Fields map[string]string // identification fields of the server
+}
+
+// Handle implements responses.Handler interface
+func (r *IdResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "ID" {
+		return responses.ErrUnhandled
+	}
+	if len(fields) < 1 {
+		return errors.New("ID response needs 1 field")
+	}
+	var err error
+	r.Fields, err = parseIdFields(fields[0])
+	return err
+}
+
+// helper function to convert identification fields into list of ID command,
+// keys are sorted to have stable command
+func idFields(fields map[string]string) interface{} {
+	if len(fields) == 0 {
+		return nil
+	}
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var list []interface{}
+	for _, k := range keys {
+		list = append(list, k, fields[k])
+	}
+	return list
+}
+
+// helper function to parse identification fields of ID command or response,
+// i.e. either NIL or list of key and value pairs
+func parseIdFields(field interface{}) (map[string]string, error) {
+	list, ok := field.([]interface{})
+	if !ok {
+		return nil, nil
+	}
+	if len(list)%2 != 0 {
+		return nil, errors.New("ID fields must be a list of key and value pairs")
+	}
+	fields := make(map[string]string)
+	for i := 0; i < len(list); i += 2 {
+		key, err := imap.ParseString(list[i])
+		if err != nil {
+			return nil, err
+		}
+		// NIL value is kept as empty one
+		value, _ := imap.ParseString(list[i+1])
+		fields[key] = value
+	}
+	return fields, nil
+}
+
+// helper function to return identification fields of goimapsync, see
+// Config.ClientId
+func clientId() map[string]string {
+	if Config.ClientId != nil {
+		return Config.ClientId
+	}
+	version := gitTag
+	if version == "" {
+		version = gitVersion
+	}
+	if version == "" {
+		version = "devel"
+	}
+	return map[string]string{"name": "goimapsync", "version": version}
+}
+
+// helper function to identify goimapsync to given IMAP server if it
+// advertises ID capability, it should be called after login
+func sendClientId(c *client.Client, imapName string) error {
+	if ok, err := c.Support("ID"); err != nil || !ok {
+		return err
+	}
+	res := &IdResponse{}
+	status, err := c.Execute(&IdCommand{Fields: clientId()}, res)
+	if err != nil {
+		return err
+	}
+	if err := status.Err(); err != nil {
+		return err
+	}
+	if verboseLevel(imapName) > 0 {
+		log.Printf("identified to %s, server identification: %v", imapName, res.Fields)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIdFields(t *testing.T) {
+	tests := []struct {
+		fields map[string]string
+		expect string
+	}{
+		{nil, "<nil>"},
+		{map[string]string{}, "<nil>"},
+		{map[string]string{"name": "goimapsync"}, "[name goimapsync]"},
+		{map[string]string{"version": "1.0", "name": "goimapsync", "vendor": "example.org"}, "[name goimapsync vendor example.org version 1.0]"},
+	}
+	for _, tt := range tests {
+		list := idFields(tt.fields)
+		if got := fmt.Sprintf("%v", list); got != tt.expect {
+			t.Errorf("idFields(%v)=%s, expected %s", tt.fields, got, tt.expect)
+		}
+		// fields are parsed back as sent, NIL has no fields
+		fields, err := parseIdFields(list)
+		if err != nil {
+			t.Errorf("parseIdFields(%v): %v", list, err)
+			continue
+		}
+		if len(tt.fields) == 0 && fields != nil {
+			t.Errorf("parseIdFields(%v)=%v, expected nil", list, fields)
+		} else if fmt.Sprintf("%v", fields) != fmt.Sprintf("%v", tt.fields) {
+			t.Errorf("parseIdFields(%v)=%v, expected %v", list, fields, tt.fields)
+		}
+	}
+	if _, err := parseIdFields([]interface{}{"name"}); err == nil {
+		t.Errorf("ID fields without value are accepted")
+	}
+}
+
+func TestClientId(t *testing.T) {
+	keepConfig(t)
+	tag, version := gitTag, gitVersion
+	t.Cleanup(func() { gitTag, gitVersion = tag, version })
+	tests := []struct {
+		clientId     map[string]string
+		tag, version string
+		expect       string
+	}{
+		{nil, "", "", "map[name:goimapsync version:devel]"},
+		{nil, "", "abc123", "map[name:goimapsync version:abc123]"},
+		{nil, "v1.2.0", "abc123", "map[name:goimapsync version:v1.2.0]"},
+		{map[string]string{"name": "custom"}, "v1.2.0", "", "map[name:custom]"},
+		{map[string]string{}, "v1.2.0", "", "map[]"},
+	}
+	for _, tt := range tests {
+		Config.ClientId = tt.clientId
+		gitTag, gitVersion = tt.tag, tt.version
+		if got := fmt.Sprintf("%v", clientId()); got != tt.expect {
+			t.Errorf("clientId with config %v and tag %q, version %q is %s, expected %s", tt.clientId, tt.tag, tt.version, got, tt.expect)
+		}
+	}
+}
+
+func TestSendClientId(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientId map[string]string
+		expect   map[string]string // fields received by the server
+	}{
+		{"configured", map[string]string{"name": "goimapsync-test", "version": "1.0"}, map[string]string{"name": "goimapsync-test", "version": "1.0"}},
+		{"empty", map[string]string{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			Config.ClientId = tt.clientId
+			ts.connect(t)
+			// connect identifies the client after login
+			if got := ts.Id.Get(); fmt.Sprintf("%v", got) != fmt.Sprintf("%v", tt.expect) {
+				t.Errorf("ID command carries %v, expected %v", got, tt.expect)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// ignore module for goimapsync, it skips fetch of messages matching ignore
+// rules of the config, e.g. automated calendar or monitoring messages,
+//    "ignore": [{"messageId": "*@calendar.example.com"}, {"from": "^bot@", "subject": "alert"}]
+// The ignored messages are recorded in DB with their UIDs, such that their
+// bodies are not fetched again by subsequent runs as long as the rule which
+// matched them is still in the config.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+)
+
+// IgnoreRule represents rule of messages which are never fetched, all
+// non-empty patterns of the rule should match the message
+type IgnoreRule struct {
+	MessageId string `json:"messageId"` // message id pattern, * matches any characters
+	From      string `json:"from"`      // from address regular expression
+	Subject   string `json:"subject"`   // subject regular expression
+}
+
+// String returns key of the rule recorded in DB along with ignored messages
+func (r IgnoreRule) String() string {
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+// ignoreMatcher represents compiled ignore rule
+type ignoreMatcher struct {
+	Rule      IgnoreRule     // ignore rule
+	MessageId *regexp.Regexp // compiled message id pattern
+	From      *regexp.Regexp // compiled from pattern
+	Subject   *regexp.Regexp // compiled subject pattern
+}
+
+// ignoreMatchers keeps compiled rules of Config.Ignore
+var ignoreMatchers []ignoreMatcher
+
+// helper function to compile ignore rules of the config
+func compileIgnoreRules() error {
+	ignoreMatchers = nil
+	for _, r := range Config.Ignore {
+		if r.MessageId == "" && r.From == "" && r.Subject == "" {
+			return fmt.Errorf("ignore rule without patterns")
+		}
+		m := ignoreMatcher{Rule: r}
+		var err error
+		if r.MessageId != "" {
+			// message id pattern matches id without angle brackets
+			pat := strings.Trim(r.MessageId, "<>")
+			pat = "^" + strings.ReplaceAll(regexp.QuoteMeta(pat), `\*`, ".*") + "$"
+			m.MessageId = regexp.MustCompile(pat)
+		}
+		if r.From != "" {
+			if m.From, err = regexp.Compile(r.From); err != nil {
+				return fmt.Errorf("invalid from pattern of ignore rule %s: %w", r, err)
+			}
+		}
+		if r.Subject != "" {
+			if m.Subject, err = regexp.Compile(r.Subject); err != nil {
+				return fmt.Errorf("invalid subject pattern of ignore rule %s: %w", r, err)
+			}
+		}
+		ignoreMatchers = append(ignoreMatchers, m)
+	}
+	return nil
+}
+
+// helper function to find ignore rule matching given envelope, it returns
+// nil if message should be fetched
+func ignoredBy(envelope *imap.Envelope) *IgnoreRule {
+	if envelope == nil {
+		return nil
+	}
+	mid := strings.Trim(envelope.MessageId, "<>")
+	from := formatAddresses(envelope.From)
+	for _, m := range ignoreMatchers {
+		if m.MessageId != nil && !m.MessageId.MatchString(mid) {
+			continue
+		}
+		if m.From != nil && !m.From.MatchString(from) {
+			continue
+		}
+		if m.Subject != nil && !m.Subject.MatchString(envelope.Subject) {
+			continue
+		}
+		rule := m.Rule
+		return &rule
+	}
+	return nil
+}
+
+// helper function to record message of given IMAP folder ignored by rule
+func recordIgnored(imapName, folder string, msg *imap.Message, rule *IgnoreRule) {
+	e := IgnoredMessage{
+		Imap:        imapName,
+		Folder:      folder,
+		Uid:         msg.Uid,
+		UidValidity: folderUidValidity(imapName, folder),
+		HashId:      md5hash(msg.Envelope.MessageId),
+		MessageId:   msg.Envelope.MessageId,
+		From:        formatAddresses(msg.Envelope.From),
+		Subject:     msg.Envelope.Subject,
+		Date:        msg.Envelope.Date.Unix(),
+		Rule:        rule.String(),
+	}
+	if err := insertIgnored(e); err != nil {
+		log.Printf("unable to record ignored message %s, error: %v\n", msg.Envelope.MessageId, err)
+	}
+}
+
+// helper function to drop UIDs of messages recorded as ignored from given
+// UIDs of IMAP folder, the records of rules removed from config or of
+// folder with changed UIDVALIDITY are deleted such that their messages are
+// fetched again
+func skipIgnored(imapName, folder string, validity uint32, uids []uint32) []uint32 {
+	records, err := getIgnored(imapName, folder)
+	if err != nil || len(records) == 0 {
+		return uids
+	}
+	rules := make(map[string]bool)
+	for _, m := range ignoreMatchers {
+		rules[m.Rule.String()] = true
+	}
+	skip := make(map[uint32]bool)
+	for _, e := range records {
+		if rules[e.Rule] && e.UidValidity == validity {
+			skip[e.Uid] = true
+			continue
+		}
+		if err := deleteIgnored(imapName, folder, e.Uid); err != nil {
+			log.Printf("unable to delete ignored message %s, error: %v\n", e.MessageId, err)
+		}
+	}
+	if len(skip) == 0 {
+		return uids
+	}
+	var out []uint32
+	for _, uid := range uids {
+		if !skip[uid] {
+			out = append(out, uid)
+		}
+	}
+	if verboseLevel(imapName) > 0 {
+		log.Printf("skip %d ignored message(s) of '%s' on '%s'\n", len(uids)-len(out), folder, imapName)
+	}
+	return out
+}
+
+// ListIgnored lists messages of given folder recorded as ignored on all
+// IMAP servers of the config
+func ListIgnored(folder string) ([]MessageInfo, error) {
+	var out []MessageInfo
+	// read-only DB may not be migrated yet to have ignored table
+	if version, err := schemaVersion(mdb); err != nil {
+		return out, err
+	} else if version < 13 {
+		return out, fmt.Errorf("DB schema is at version %d, please run goimapsync -op=migrate-db", version)
+	}
+	for _, s := range Config.Servers {
+		records, err := getIgnored(s.Name, folder)
+		if err != nil {
+			return out, err
+		}
+		for _, e := range records {
+			out = append(out, MessageInfo{
+				Imap:      e.Imap,
+				Folder:    e.Folder,
+				Uid:       e.Uid,
+				Date:      time.Unix(e.Date, 0),
+				From:      e.From,
+				Subject:   e.Subject,
+				MessageId: e.MessageId,
+			})
+		}
+	}
+	return out, nil
+}
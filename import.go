@@ -0,0 +1,222 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// import module for goimapsync, it uploads existing local maildir (e.g.
+// created by other tools) to IMAP server. The import is resumable, the
+// messages already present on IMAP server or recorded in DB are skipped.
+//
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// helper function to find maildir folders, i.e. directories with cur
+// and new sub-directories, of given root and map them to IMAP folder names
+func maildirFolders(root string) (map[string]string, error) {
+	fmap := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		for _, d := range []string{"cur", "new"} {
+			if fi, err := os.Stat(filepath.Join(path, d)); err != nil || !fi.IsDir() {
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		fmap[path] = maildirFolderName(rel)
+		return nil
+	})
+	return fmap, err
+}
+
+// helper function to convert relative maildir path to IMAP folder name,
+// e.g. work/Sent -> work/Sent and Maildir++ .Lists.go -> Lists/go
+func maildirFolderName(rel string) string {
+	if rel == "." {
+		return "INBOX"
+	}
+	var parts []string
+	for _, p := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(p, ".") {
+			p = strings.Replace(strings.TrimPrefix(p, "."), ".", "/", -1)
+		}
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		return "INBOX"
+	}
+	return strings.Join(parts, "/")
+}
+
+// helper function to get message ids of all messages in IMAP folder
+func imapMessageIds(c *client.Client, folder string) (map[string]bool, error) {
+	mids := make(map[string]bool)
+	mbox, err := c.Select(folder, false)
+	if err != nil {
+		return mids, err
+	}
+	if mbox.Messages == 0 {
+		return mids, nil
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+	messages := make(chan *imap.Message, 10)
+	done := fetchMessages(c, seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}, messages, true)
+	for msg := range messages {
+		if msg != nil && msg.Envelope != nil && msg.Envelope.MessageId != "" {
+			mids[msg.Envelope.MessageId] = true
+		}
+	}
+	return mids, <-done
+}
+
+// ImportMaildir uploads all messages of local maildir to given IMAP server
+func ImportMaildir(c *client.Client, imapName, root string) error {
+	defer timing("ImportMaildir", time.Now())
+	defer profiler("ImportMaildir")()
+
+	fmap, err := maildirFolders(root)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for p := range fmap {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := importFolder(c, imapName, path, fmap[path]); err != nil {
+			return fmt.Errorf("unable to import %s into '%s' on '%s': %w", path, fmap[path], imapName, err)
+		}
+	}
+	return nil
+}
+
+// helper function to create folder on IMAP server if it does not exist,
+// it returns name of the folder used by IMAP server
+func ensureImapFolder(c *client.Client, imapName, folder string) (string, error) {
+	if f, err := findImapFolder(imapName, folder); err == nil {
+		return f, nil
+	}
+	folder = qualifiedFolder(imapName, folder)
+	log.Printf("create folder '%s' on '%s'\n", folder, imapName)
+	_, err := withReconnect(c, imapName, "", func(c *client.Client) error {
+		return c.Create(folder)
+	})
+	if err != nil {
+		return folder, err
+	}
+	imapFolders[imapName] = append(imapFolders[imapName], folder)
+	if err := saveCachedFolders(imapName, imapFolders[imapName]); err != nil {
+		log.Printf("unable to cache folders of %s, error: %v\n", imapName, err)
+	}
+	return folder, nil
+}
+
+// helper function to upload messages of local maildir folder to IMAP folder
+func importFolder(c *client.Client, imapName, path, folder string) error {
+	setOperation(imapName, "import", folder)
+	RunSummary.Touch(imapName, folder)
+
+	// create remote folder if necessary
+	folder, err := ensureImapFolder(c, imapName, folder)
+	if err != nil {
+		return err
+	}
+
+	// the messages recorded in sync state were imported in previous run(s)
+	states, err := getSyncStates(imapName, folder)
+	if err != nil {
+		return err
+	}
+	var mids map[string]bool
+	c, err = withReconnect(c, imapName, "", func(c *client.Client) error {
+		var e error
+		mids, e = imapMessageIds(c, folder)
+		return e
+	})
+	if err != nil {
+		return err
+	}
+
+	var files []string
+	for _, d := range []string{"cur", "new"} {
+		entries, err := ioutil.ReadDir(filepath.Join(path, d))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				files = append(files, filepath.Join(path, d, e.Name()))
+			}
+		}
+	}
+	log.Printf("### import %d message(s) from %s into '%s' on '%s'\n", len(files), path, folder, imapName)
+
+	var uploaded, skipped int
+	for i, fname := range files {
+		mid := getMessageId(fname)
+		if mid == "" {
+			log.Printf("skip %s, message without message id\n", fname)
+			skipped += 1
+			continue
+		}
+		hid := md5hash(mid)
+		if _, ok := states[hid]; ok {
+			skipped += 1
+			continue
+		}
+		if !mids[mid] {
+			_, err := withReconnect(c, imapName, folder, func(c *client.Client) error {
+				return appendMessage(c, folder, fname)
+			})
+			if err != nil {
+				RunSummary.AddError(MessageError{Imap: imapName, Folder: folder, MessageId: mid, Error: err})
+				continue
+			}
+			mids[mid] = true
+			uploaded += 1
+			RunSummary.AddUploaded(1)
+		} else {
+			skipped += 1
+		}
+		// record the message in DB such that next sync treats it as reconciled
+		if entry, e := findMessage(hid); e != nil || entry.HashId != hid {
+			m := Message{MessageId: mid, HashId: hid, Path: fname, Imap: imapName}
+			if err := insertMessage(m); err != nil {
+				log.Printf("unable to insert %s into DB, error: %v\n", fname, err)
+			}
+		}
+		if err := addMessageAccount(hid, imapName); err != nil {
+			log.Printf("unable to associate %s with %s, error: %v\n", fname, imapName, err)
+		}
+		s := SyncState{HashId: hid, Imap: imapName, Folder: folder, Flags: localSyncFlags(fname), Remote: true, Local: true}
+		if err := updateSyncState(s); err != nil {
+			log.Printf("unable to update sync state of %s, error: %v\n", fname, err)
+		}
+		if (i+1)%100 == 0 {
+			log.Printf("import '%s' on '%s': %d out of %d message(s), uploaded %d, skipped %d\n", folder, imapName, i+1, len(files), uploaded, skipped)
+		}
+	}
+	log.Printf("imported '%s' on '%s': uploaded %d, skipped %d out of %d message(s)\n", folder, imapName, uploaded, skipped, len(files))
+	return nil
+}
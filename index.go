@@ -0,0 +1,182 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// index module for goimapsync, it defers download of message bodies. With
+// indexOnly option (or -index-only flag) the sync fetches only envelopes,
+// flags and UIDs of messages which are not yet stored locally and records
+// them in envelopes table with "body pending" marker, such that the first
+// sync of large mailbox over slow link is quick. The bodies are downloaded
+// later by fetch-bodies operation (or by any regular fetch of the folder)
+// which clears the marker. The indexed messages have neither local files nor
+// entries in messages table, i.e. the sync never treats them as locally
+// deleted ones.
+//
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// helper function to record envelope of given IMAP message whose body is
+// not fetched
+func recordEnvelope(imapName, folder string, msg *imap.Message) {
+	e := EnvelopeMessage{
+		Imap:        imapName,
+		Folder:      folder,
+		Uid:         msg.Uid,
+		UidValidity: folderUidValidity(imapName, folder),
+		HashId:      md5hash(msg.Envelope.MessageId),
+		MessageId:   msg.Envelope.MessageId,
+		From:        formatAddresses(msg.Envelope.From),
+		Subject:     msg.Envelope.Subject,
+		Date:        msg.Envelope.Date.Unix(),
+		Flags:       strings.Join(msg.Flags, " "),
+		BodyPending: true,
+	}
+	if err := insertEnvelope(e); err != nil {
+		log.Printf("unable to record envelope of %s, error: %v\n", e.MessageId, err)
+		return
+	}
+	RunSummary.AddIndexed(1)
+}
+
+// FetchBodies fetches bodies of messages recorded by index-only sync of
+// given IMAP folder, or of all folders with pending bodies if folder is empty
+func FetchBodies(c *client.Client, imapName, folder string) error {
+	defer timing("FetchBodies", time.Now())
+	defer profiler("FetchBodies")()
+	folders := []string{folder}
+	if folder == "" {
+		var err error
+		folders, err = getPendingFolders(imapName)
+		if err != nil {
+			return err
+		}
+	}
+	if len(folders) == 0 {
+		log.Printf("no pending bodies on %s\n", imapName)
+	}
+	var errs []error
+	for _, f := range folders {
+		var err error
+		c, err = fetchFolderBodies(c, imapName, f)
+		if err != nil {
+			log.Printf("unable to fetch bodies of '%s' on %s, error: %v\n", f, imapName, err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// helper function to fetch pending bodies of given IMAP folder, the records
+// of messages expunged on IMAP server or of folder with changed UIDVALIDITY
+// are dropped, the latter ones are indexed again by the next sync
+func fetchFolderBodies(c *client.Client, imapName, folder string) (*client.Client, error) {
+	envs, err := getEnvelopes(imapName, folder, true)
+	if err != nil || len(envs) == 0 {
+		return c, err
+	}
+	setOperation(imapName, "fetch", folder)
+	defer setOperation(imapName, "idle", "")
+	var validity uint32
+	c, err = withReconnect(c, imapName, "", func(c *client.Client) error {
+		mbox, err := c.Select(folder, false)
+		if err != nil {
+			return err
+		}
+		recordUidValidity(imapName, mbox.Name, mbox.UidValidity)
+		validity = mbox.UidValidity
+		return nil
+	})
+	if err != nil {
+		return c, err
+	}
+	var uids []uint32
+	var pending []EnvelopeMessage
+	for _, e := range envs {
+		if e.UidValidity != validity {
+			log.Printf("UIDVALIDITY of '%s' on %s changed, drop envelope of %s\n", folder, imapName, e.MessageId)
+			deleteEnvelope(imapName, folder, e.Uid)
+			continue
+		}
+		uids = append(uids, e.Uid)
+		pending = append(pending, e)
+	}
+	log.Printf("fetch %d pending bodies of '%s' on %s\n", len(uids), folder, imapName)
+
+	section := &imap.BodySectionName{}
+	items := []imap.FetchItem{section.FetchItem(), imap.FetchFlags, imap.FetchEnvelope, imap.FetchUid}
+	if Config.ArchiveMode {
+		items = append(items, imap.FetchInternalDate)
+	}
+	batch := Config.FetchBatchSize
+	if batch <= 0 {
+		batch = 500
+	}
+	nmsg := uint32(len(uids))
+	processed := make(map[uint32]bool)
+	mdict := readMaildir(imapName, folder)
+	var wg sync.WaitGroup
+	for start := 0; start < len(uids); start += batch {
+		if interrupted() {
+			wg.Wait()
+			return c, errInterrupted
+		}
+		end := start + batch
+		if end > len(uids) {
+			end = len(uids)
+		}
+		c, err = withReconnect(c, imapName, folder, func(c *client.Client) error {
+			var chunk []uint32
+			for _, uid := range uids[start:end] {
+				if !processed[uid] {
+					chunk = append(chunk, uid)
+				}
+			}
+			if len(chunk) == 0 {
+				return nil
+			}
+			messages := make(chan *imap.Message, fetchChannelSize)
+			done := fetchMessages(c, uidSet(chunk), items, messages, true)
+			for msg := range messages {
+				if msg == nil || msg.Envelope == nil || processed[msg.Uid] || interrupted() {
+					continue
+				}
+				processed[msg.Uid] = true
+				_, err := processMessage(imapName, folder, msg, section, msg.SeqNum, nmsg, false, mdict, &wg)
+				if err != nil && !errors.Is(err, errIgnored) {
+					RunSummary.AddError(MessageError{Imap: imapName, Folder: folder, Uid: msg.Uid, MessageId: msg.Envelope.MessageId, Error: err})
+				}
+			}
+			return <-done
+		})
+		if err != nil {
+			wg.Wait()
+			retryWrites(currentClient(imapName, c), imapName, folder, nil)
+			return c, err
+		}
+	}
+	wg.Wait()
+	retryWrites(currentClient(imapName, c), imapName, folder, nil)
+	for _, e := range pending {
+		if !processed[e.Uid] {
+			// the message was expunged on IMAP server since it was indexed
+			if verboseLevel(imapName) > 0 {
+				log.Printf("message %s is gone from '%s' on %s\n", e.MessageId, folder, imapName)
+			}
+			deleteEnvelope(imapName, folder, e.Uid)
+			continue
+		}
+		// the body of the message may already exist, e.g. in another folder
+		if entry, err := findMessage(e.HashId); err == nil && entry.HashId == e.HashId {
+			markBodyFetched(e.HashId)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+func TestIndexOnly(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	m := testMessage{MessageId: "<index-1@localhost>", Subject: "Indexed message"}
+	ts.add(t, "Index", m)
+	c := ts.connect(t)
+	Config.IndexOnly = true
+	if _, err := Fetch(c, testServerName, "Index", false, FlagFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	hid := md5hash(m.MessageId)
+	envs, err := getEnvelopes(testServerName, "Index", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envs) != 1 || envs[0].HashId != hid || envs[0].Subject != m.Subject {
+		t.Errorf("index-only fetch recorded pending envelopes %+v", envs)
+	}
+	if RunSummary.Indexed != 1 || RunSummary.Fetched != 0 {
+		t.Errorf("index-only fetch indexed %d and fetched %d message(s)", RunSummary.Indexed, RunSummary.Fetched)
+	}
+	// indexed messages have neither DB entries nor local files
+	if entry, err := findMessage(hid); err != nil || entry.HashId != "" {
+		t.Errorf("index-only fetch recorded message %s in DB, error: %v", m.MessageId, err)
+	}
+	if fname := findLocalMail(testServerName, "Index", hid); fname != "" {
+		t.Errorf("index-only fetch wrote body of %s into %s", m.MessageId, fname)
+	}
+	// the folder is fetched again since its bodies are not downloaded
+	if state, err := getFolderState(testServerName, "Index"); err != nil || state != nil {
+		t.Errorf("index-only fetch recorded state %+v of folder, error: %v", state, err)
+	}
+}
+
+func TestFetchBodies(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(t *testing.T, ts *testServer) // change of IMAP folder after indexing
+		backfill func(c *client.Client) error
+		envs     int  // envelopes left in DB
+		written  bool // body is written into local maildir
+	}{
+		{name: "all folders", backfill: func(c *client.Client) error {
+			return FetchBodies(c, testServerName, "")
+		}, envs: 1, written: true},
+		{name: "given folder", backfill: func(c *client.Client) error {
+			return FetchBodies(c, testServerName, "Index")
+		}, envs: 1, written: true},
+		{name: "other folder", backfill: func(c *client.Client) error {
+			return FetchBodies(c, testServerName, "INBOX")
+		}, envs: 1},
+		{name: "regular fetch", backfill: func(c *client.Client) error {
+			_, err := Fetch(c, testServerName, "Index", false, FlagFilter{})
+			return err
+		}, envs: 1, written: true},
+		{name: "expunged message", change: func(t *testing.T, ts *testServer) {
+			mbox := ts.mailbox(t, "Index")
+			seqset, _ := imap.ParseSeqSet("1")
+			if err := mbox.UpdateMessagesFlags(false, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+				t.Fatal(err)
+			}
+			if err := mbox.Expunge(); err != nil {
+				t.Fatal(err)
+			}
+		}, backfill: func(c *client.Client) error {
+			return FetchBodies(c, testServerName, "")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			m := testMessage{MessageId: "<index-2@localhost>", Subject: "Indexed message"}
+			ts.add(t, "Index", m)
+			c := ts.connect(t)
+			Config.IndexOnly = true
+			if _, err := Fetch(c, testServerName, "Index", false, FlagFilter{}); err != nil {
+				t.Fatal(err)
+			}
+			Config.IndexOnly = false
+			if tt.change != nil {
+				tt.change(t, ts)
+			}
+			if err := tt.backfill(currentClient(testServerName, c)); err != nil {
+				t.Fatal(err)
+			}
+			hid := md5hash(m.MessageId)
+			envs, err := getEnvelopes(testServerName, "Index", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(envs) != tt.envs {
+				t.Fatalf("%d envelope(s) are left in DB, expected %d", len(envs), tt.envs)
+			}
+			if len(envs) == 1 && envs[0].BodyPending == tt.written {
+				t.Errorf("envelope has pending body %v, expected %v", envs[0].BodyPending, !tt.written)
+			}
+			entry, err := findMessage(hid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written := entry.HashId == hid; written != tt.written {
+				t.Errorf("message %s is recorded in DB %v, expected %v", m.MessageId, written, tt.written)
+			}
+			if tt.written {
+				if _, err := os.Stat(entry.Path); err != nil {
+					t.Errorf("body of %s is not written, error: %v", m.MessageId, err)
+				}
+			}
+		})
+	}
+}
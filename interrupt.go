@@ -0,0 +1,62 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// interrupt module for goimapsync, it handles SIGINT (Ctrl-C) and SIGTERM
+// signals. The first signal cancels context of the run: long operations stop
+// at the next message or chunk of messages, mail files being written are
+// completed (they are written via tmp area of maildir), and main logs out
+// from IMAP servers, records the run and closes DB on its way out. The
+// second signal quits immediately, the interrupted writes are recovered by
+// the next run, see reindexPending.
+//
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// exit code of interrupted run, i.e. 128 + SIGINT
+const interruptedExitCode = 130
+
+// errInterrupted is returned by operations stopped by the signal
+var errInterrupted = errors.New("operation is interrupted")
+
+// runContext is canceled once the run is interrupted
+var runContext, cancelRun = context.WithCancel(context.Background())
+
+// interruptSignal guards installation of the signal handler
+var interruptSignal sync.Once
+
+// helper function to cancel run context upon SIGINT or SIGTERM signal
+func initInterruptSignal() {
+	interruptSignal.Do(func() {
+		ch := make(chan os.Signal, 2)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-ch
+			log.Printf("received %v signal, finish current messages and quit, send it again to quit immediately\n", sig)
+			cancelRun()
+			sig = <-ch
+			log.Printf("received %v signal again, quit immediately\n", sig)
+			os.Exit(interruptedExitCode)
+		}()
+	})
+}
+
+// helper function to check if the run is interrupted
+func interrupted() bool {
+	return runContext.Err() != nil
+}
+
+// helper function to exit with interrupted exit code, it should be deferred
+// first in main such that it runs after clean shutdown
+func exitInterrupted() {
+	if interrupted() {
+		os.Exit(interruptedExitCode)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// testInterruptSent guards interrupt signal sent to the test process, the
+// handler quits at the second signal, e.g. with -count flag of go test
+var testInterruptSent sync.Once
+
+// helper function to send interrupt signal to the test process, it cancels
+// run context directly if the signal was already sent or it can't be sent,
+// e.g. on windows
+func sendInterrupt(t *testing.T) {
+	sent := false
+	testInterruptSent.Do(func() {
+		proc, err := os.FindProcess(os.Getpid())
+		if err == nil {
+			err = proc.Signal(os.Interrupt)
+		}
+		if err != nil {
+			t.Logf("unable to send interrupt signal, error: %v", err)
+			return
+		}
+		sent = true
+	})
+	if !sent {
+		cancelRun()
+	}
+}
+
+func TestFetchInterrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		signal  bool // interrupt signal is sent in the middle of the fetch
+		written int  // messages written into local maildir
+	}{
+		// canceled run does not start fetch of the folder
+		{name: "canceled run", written: 0},
+		// the message being written is completed and the rest is not fetched
+		{name: "interrupt signal", signal: true, written: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			nmsg := 3
+			for i := 0; i < nmsg; i++ {
+				ts.add(t, "Interrupt", testMessage{MessageId: fmt.Sprintf("<interrupt-%d@localhost>", i), Subject: "Interrupted fetch"})
+			}
+			c := ts.connect(t)
+			// busy mail writers hold the fetch at its first message until the
+			// signal is handled, and every chunk has single message such that
+			// the rest of messages is not fetched
+			Config.FetchBatchSize = 1
+			for i := 0; i < mailWriters; i++ {
+				mailWriterSlots <- struct{}{}
+			}
+			if !tt.signal {
+				cancelRun()
+			}
+			initInterruptSignal()
+			done := make(chan error, 1)
+			go func() {
+				_, err := Fetch(currentClient(testServerName, c), testServerName, "Interrupt", false, FlagFilter{})
+				done <- err
+			}()
+			if tt.signal {
+				// the signal is sent once the first message waits for mail writer
+				hid := md5hash("<interrupt-0@localhost>")
+				for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+					if accounts, err := getMessageAccounts(hid); err == nil && len(accounts) > 0 {
+						break
+					}
+					if time.Since(start) > 10*time.Second {
+						t.Fatal("fetch of folder to interrupt does not start")
+					}
+				}
+				sendInterrupt(t)
+			}
+			select {
+			case <-runContext.Done():
+			case <-time.After(10 * time.Second):
+				t.Fatal("interrupt signal is not handled")
+			}
+			for i := 0; i < mailWriters; i++ {
+				<-mailWriterSlots
+			}
+			if err := <-done; !errors.Is(err, errInterrupted) {
+				t.Errorf("interrupted fetch returned error: %v", err)
+			}
+			if files := readMaildir(testServerName, "Interrupt"); len(files) != tt.written {
+				t.Errorf("interrupted fetch wrote %d message(s) out of %d, expected %d", len(files), nmsg, tt.written)
+			}
+			var partial []string
+			err := filepath.Walk(Config.Maildir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() && filepath.Base(filepath.Dir(path)) == "tmp" {
+					partial = append(partial, path)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(partial) > 0 {
+				t.Errorf("interrupted fetch left partial file(s) %v", partial)
+			}
+			// clean shutdown of main, i.e. logout and close of DB
+			logout(map[string]*client.Client{testServerName: c})
+			if err := mdb.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := mdb.Ping(); err == nil {
+				t.Error("DB is not closed")
+			}
+			if mdb, err = InitDB(false); err != nil {
+				t.Fatal(err)
+			}
+			var check string
+			if err := mdb.QueryRow("PRAGMA integrity_check").Scan(&check); err != nil || check != "ok" {
+				t.Errorf("DB integrity check '%s', error: %v", check, err)
+			}
+			if pending, err := getPendingMessages(); err != nil || len(pending) > 0 {
+				t.Errorf("interrupted fetch left %d pending message(s) in DB, error: %v", len(pending), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// list module for goimapsync, it lists messages of IMAP folder
+// using only envelope and flags information (no bodies are fetched)
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// MessageInfo represents envelope information of IMAP message
+type MessageInfo struct {
+	Imap      string    `json:"imap"`    // name of imap server
+	Folder    string    `json:"folder"`  // name of imap folder
+	SeqNumber uint32    `json:"seqnum"`  // message sequence number
+	Uid       uint32    `json:"uid"`     // message UID
+	Date      time.Time `json:"date"`    // message date
+	From      string    `json:"from"`    // message sender(s)
+	Subject   string    `json:"subject"` // message subject
+	Flags     []string  `json:"flags"`   // message flags
+	MessageId string    `json:"mid"`     // message id
+}
+
+// helper function to format list of envelope addresses
+func formatAddresses(addrs []*imap.Address) string {
+	var out []string
+	for _, a := range addrs {
+		if a == nil {
+			continue
+		}
+		addr := a.Address()
+		if a.PersonalName != "" {
+			addr = fmt.Sprintf("%s <%s>", a.PersonalName, addr)
+		}
+		out = append(out, addr)
+	}
+	return strings.Join(out, ", ")
+}
+
+// ListMessages lists messages of given IMAP folder
+func ListMessages(c *client.Client, imapName, folder string) ([]MessageInfo, error) {
+	defer timing("ListMessages", time.Now())
+	defer profiler("ListMessages")()
+	var out []MessageInfo
+
+	// select folder in read-only mode, we do not change anything
+	mbox, err := c.Select(imapFolder(imapName, folder), true)
+	if err != nil {
+		return out, err
+	}
+	if mbox.Messages == 0 {
+		return out, nil
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, mbox.Messages)
+
+	messages := make(chan *imap.Message, 10)
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags, imap.FetchUid}
+	if Config.Verbose > 1 {
+		log.Println("IMAP", items)
+	}
+	done := fetchMessages(c, seqset, items, messages, false)
+	for msg := range messages {
+		if msg == nil || msg.Envelope == nil {
+			continue
+		}
+		m := MessageInfo{
+			Imap:      imapName,
+			Folder:    folder,
+			SeqNumber: msg.SeqNum,
+			Uid:       msg.Uid,
+			Date:      msg.Envelope.Date,
+			From:      formatAddresses(msg.Envelope.From),
+			Subject:   msg.Envelope.Subject,
+			Flags:     msg.Flags,
+			MessageId: msg.Envelope.MessageId,
+		}
+		out = append(out, m)
+	}
+	if err := <-done; err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+// helper function to print list of messages either as a table or JSON
+func printMessages(mlist []MessageInfo, jsonOutput bool) {
+	if jsonOutput {
+		if mlist == nil {
+			mlist = []MessageInfo{}
+		}
+		data, err := json.MarshalIndent(mlist, "", "   ")
+		if err != nil {
+			log.Println("unable to marshal messages", err)
+			return
+		}
+		fmt.Println(string(data))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAP\tSEQ\tUID\tDATE\tFROM\tSUBJECT\tFLAGS")
+	for _, m := range mlist {
+		date := m.Date.Format("2006-01-02 15:04")
+		flags := strings.Join(m.Flags, " ")
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", m.Imap, m.SeqNumber, m.Uid, date, m.From, m.Subject, flags)
+	}
+	w.Flush()
+}
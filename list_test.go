@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	imap "github.com/emersion/go-imap"
+)
+
+func TestFormatAddresses(t *testing.T) {
+	tests := []struct {
+		name   string
+		addrs  []*imap.Address
+		expect string
+	}{
+		{"empty", nil, ""},
+		{"address", []*imap.Address{{MailboxName: "vk", HostName: "example.org"}}, "vk@example.org"},
+		{"personal name", []*imap.Address{{PersonalName: "Valentin", MailboxName: "vk", HostName: "example.org"}}, "Valentin <vk@example.org>"},
+		{"nil address", []*imap.Address{nil, {MailboxName: "a", HostName: "b.org"}}, "a@b.org"},
+		{"several", []*imap.Address{{MailboxName: "a", HostName: "b.org"}, {PersonalName: "C", MailboxName: "c", HostName: "d.org"}}, "a@b.org, C <c@d.org>"},
+	}
+	for _, tt := range tests {
+		if got := formatAddresses(tt.addrs); got != tt.expect {
+			t.Errorf("%s: formatAddresses=%q, expected %q", tt.name, got, tt.expect)
+		}
+	}
+}
+
+func TestListMessages(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	ts.mailbox(t, "Empty")
+	msgs := []testMessage{
+		{MessageId: "<list-1@localhost>", Subject: "First message"},
+		{MessageId: "<list-2@localhost>", Subject: "Second message", Flags: []string{imap.SeenFlag}},
+	}
+	ts.add(t, "List", msgs...)
+	c := ts.connect(t)
+
+	tests := []struct {
+		folder string
+		expect []testMessage
+	}{
+		{"Empty", nil},
+		{"List", msgs},
+	}
+	for _, tt := range tests {
+		mlist, err := ListMessages(c, testServerName, tt.folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mlist) != len(tt.expect) {
+			t.Fatalf("%s: listed %d message(s) instead of %d", tt.folder, len(mlist), len(tt.expect))
+		}
+		for i, m := range mlist {
+			e := tt.expect[i]
+			if m.Imap != testServerName || m.Folder != tt.folder || m.SeqNumber != uint32(i+1) || m.Uid == 0 {
+				t.Errorf("%s: wrong location of message %+v", tt.folder, m)
+			}
+			if m.MessageId != e.MessageId || m.Subject != e.Subject || m.From != "selftest@example.org" {
+				t.Errorf("%s: wrong envelope of message %+v", tt.folder, m)
+			}
+			if strings.Join(m.Flags, " ") != strings.Join(e.Flags, " ") {
+				t.Errorf("%s: message %s has flags %v instead of %v", tt.folder, m.MessageId, m.Flags, e.Flags)
+			}
+		}
+	}
+	// listing never writes local mails
+	if files := readMaildir(testServerName, "List"); len(files) != 0 {
+		t.Errorf("list wrote %d local mail file(s)", len(files))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// lock module for goimapsync, it provides run lock which prevents
+// concurrent goimapsync processes to change the same maildir and DB,
+// e.g. sync and backup. Within a process the lock is shared by goroutines.
+//
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// runLock keeps state of the run lock of current process
+var runLock struct {
+	sync.Mutex
+	count int
+}
+
+// helper function to return name of the run lock file
+func lockFile() string {
+	return filepath.Join(Config.Maildir, ".goimapsync.lock")
+}
+
+// helper function to check if the run lock of given content is stale, i.e.
+// its process is dead, it is current process (e.g. pid 1 of restarted
+// container) or its pid is reused by another process started later
+func staleRunLock(data string) bool {
+	fields := strings.Fields(data)
+	if len(fields) == 0 {
+		return true
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil || pid == os.Getpid() || !processAlive(pid) {
+		return true
+	}
+	// old goimapsync versions recorded pid only
+	if len(fields) > 1 {
+		if start := processStartTime(pid); start != "" && start != fields[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to acquire the run lock, the stale lock of dead
+// process is removed. The lock records pid and start time of the process
+// such that reuse of its pid can't hold the lock forever.
+func acquireRunLock() error {
+	runLock.Lock()
+	defer runLock.Unlock()
+	if runLock.count > 0 {
+		runLock.count += 1
+		return nil
+	}
+	fname := lockFile()
+	for i := 0; i < 2; i++ {
+		file, err := os.OpenFile(fname, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			pid := os.Getpid()
+			fmt.Fprintf(file, "%d %s", pid, processStartTime(pid))
+			file.Close()
+			runLock.count = 1
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		data, _ := ioutil.ReadFile(fname)
+		if !staleRunLock(string(data)) {
+			return fmt.Errorf("maildir %s is locked by goimapsync process %s, remove %s if the process is gone", Config.Maildir, strings.Fields(string(data))[0], fname)
+		}
+		// remove stale lock and try again
+		os.Remove(fname)
+	}
+	return fmt.Errorf("unable to acquire lock %s", fname)
+}
+
+// helper function to release the run lock
+func releaseRunLock() {
+	runLock.Lock()
+	defer runLock.Unlock()
+	if runLock.count == 0 {
+		return
+	}
+	runLock.count -= 1
+	if runLock.count == 0 {
+		os.Remove(lockFile())
+	}
+}
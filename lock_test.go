@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// helper function to return pid of process which is already gone
+func deadPid(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestStaleRunLock(t *testing.T) {
+	dead := deadPid(t)
+	// parent process of the test is alive and is not current one
+	ppid := os.Getppid()
+	start := processStartTime(ppid)
+	tests := []struct {
+		name  string
+		data  string
+		stale bool
+	}{
+		{"empty", "", true},
+		{"malformed", "goimapsync", true},
+		{"current process", fmt.Sprintf("%d %s", os.Getpid(), processStartTime(os.Getpid())), true},
+		{"dead process", fmt.Sprintf("%d 1", dead), true},
+		{"live process", fmt.Sprintf("%d %s", ppid, start), false},
+		{"live process of old version", fmt.Sprintf("%d", ppid), false},
+		// start time is not known without /proc, e.g. on windows
+		{"reused pid", fmt.Sprintf("%d %s0", ppid, start), start != ""},
+	}
+	for _, tt := range tests {
+		if got := staleRunLock(tt.data); got != tt.stale {
+			t.Errorf("%s: staleRunLock(%q)=%v, expected %v", tt.name, tt.data, got, tt.stale)
+		}
+	}
+}
+
+func TestAcquireRunLock(t *testing.T) {
+	dead := deadPid(t)
+	ppid := os.Getppid()
+	tests := []struct {
+		name string
+		data string // content of existing lock file
+		fail bool
+	}{
+		{name: "no lock"},
+		{name: "stale lock", data: fmt.Sprintf("%d 1", dead)},
+		{name: "empty lock", data: " "},
+		{name: "live lock", data: fmt.Sprintf("%d %s", ppid, processStartTime(ppid)), fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			if tt.data != "" {
+				if err := ioutil.WriteFile(lockFile(), []byte(tt.data), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := acquireRunLock()
+			if tt.fail {
+				expect := fmt.Sprintf("is locked by goimapsync process %d", ppid)
+				if err == nil || !strings.Contains(err.Error(), expect) {
+					t.Errorf("live lock is acquired with error: %v", err)
+				}
+				if data, _ := ioutil.ReadFile(lockFile()); string(data) != tt.data {
+					t.Errorf("live lock is replaced by '%s'", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the lock records current process and it is shared within it
+			data, _ := ioutil.ReadFile(lockFile())
+			if fields := strings.Fields(string(data)); len(fields) == 0 || fields[0] != fmt.Sprintf("%d", os.Getpid()) {
+				t.Errorf("lock file has '%s', expected pid %d", data, os.Getpid())
+			}
+			if err := acquireRunLock(); err != nil {
+				t.Errorf("lock of current process is not shared: %v", err)
+			}
+			releaseRunLock()
+			if _, err := os.Stat(lockFile()); err != nil {
+				t.Errorf("shared lock is removed before its last release")
+			}
+			releaseRunLock()
+			if _, err := os.Stat(lockFile()); !os.IsNotExist(err) {
+				t.Errorf("lock file is kept after release, error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// process helper of the run lock for unix systems
+//
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// helper function to check if process with given pid is alive
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return proc.Signal(syscall.Signal(0)) == nil
+}
+
+// helper function to return start time of process with given pid (in clock
+// ticks since boot), it is empty if it is not known, e.g. without /proc
+func processStartTime(pid int) string {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ""
+	}
+	// the command name may contain spaces, the fields follow its last paren
+	stat := string(data)
+	idx := strings.LastIndex(stat, ")")
+	if idx < 0 {
+		return ""
+	}
+	// start time is 22nd field of stat and the first one after paren is 3rd
+	fields := strings.Fields(stat[idx+1:])
+	if len(fields) < 20 {
+		return ""
+	}
+	return fields[19]
+}
@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// process helper of the run lock for windows
+//
+
+import "os"
+
+// helper function to check if process with given pid is alive, on windows
+// FindProcess opens process handle and fails for non-existing process
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	proc.Release()
+	return true
+}
+
+// helper function to return start time of process with given pid, it is
+// not known on windows and the lock relies on pid only
+func processStartTime(pid int) string {
+	return ""
+}
@@ -11,40 +11,205 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"math/rand"
 	"os"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
-// InitDB sets pointer to mdb
-func InitDB() (*sql.DB, error) {
-	dbAttrs := strings.Split(Config.DBUri, "://")
-	if len(dbAttrs) != 2 {
-		return nil, errors.New("Please provide proper mdb uri")
+// maximum time we retry DB write operation on busy or locked DB
+const dbBusyTimeout = 5 * time.Second
+
+// name of sqlite3 driver which applies Config.DBPragmas to every new connection
+const pragmaDriver = "sqlite3-pragmas"
+
+// pattern of allowed names and values of DB pragmas
+var pragmaPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func init() {
+	sql.Register(pragmaDriver, &sqlite3.SQLiteDriver{ConnectHook: applyPragmas})
+}
+
+// helper function to apply Config.DBPragmas to given SQLite connection, the
+// pragmas are per-connection settings (except journal_mode which is stored
+// in DB file) and should be applied to every connection of the pool
+func applyPragmas(conn *sqlite3.SQLiteConn) error {
+	var names []string
+	for name := range Config.DBPragmas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stmt := fmt.Sprintf("PRAGMA %s=%s", name, Config.DBPragmas[name])
+		if _, err := conn.Exec(stmt, nil); err != nil {
+			return fmt.Errorf("unable to apply '%s': %w", stmt, err)
+		}
+	}
+	return nil
+}
+
+// helper function to validate DB pragmas since they can't be passed as
+// statement parameters
+func validatePragmas(pragmas map[string]string) error {
+	for name, value := range pragmas {
+		if !pragmaPattern.MatchString(name) || !pragmaPattern.MatchString(value) {
+			return fmt.Errorf("invalid DB pragma %s=%s", name, value)
+		}
+	}
+	return nil
+}
+
+// helper function to parse DB uri, e.g. sqlite3:///path/file.db, into
+// DB driver and DB file name
+func parseDBUri(uri string) (string, string, error) {
+	dbAttrs := strings.Split(uri, "://")
+	if len(dbAttrs) != 2 || dbAttrs[0] == "" || dbAttrs[1] == "" {
+		return "", "", errors.New("Please provide proper mdb uri")
+	}
+	return dbAttrs[0], dbAttrs[1], nil
+}
+
+// InitDB sets pointer to mdb, the read-only DB never takes write locks
+func InitDB(readOnly bool) (*sql.DB, error) {
+	dbDriver, dbFileName, err := parseDBUri(Config.DBUri)
+	if err != nil {
+		return nil, err
 	}
-	dbDriver := dbAttrs[0]
-	dbFileName := dbAttrs[1]
 	newDB := false
 	// create DB if it does not exists
 	if _, err := os.Stat(dbFileName); os.IsNotExist(err) {
 		createDB(dbFileName)
 		newDB = true
+		readOnly = false
+	}
+	dsn := dbFileName
+	if readOnly && dbDriver == "sqlite3" {
+		dsn = fmt.Sprintf("file:%s?mode=ro", dbFileName)
+	}
+	// sqlite3 driver with connect hook applies pragmas to every connection
+	driver := dbDriver
+	if dbDriver == "sqlite3" && len(Config.DBPragmas) > 0 {
+		if err := validatePragmas(Config.DBPragmas); err != nil {
+			return nil, err
+		}
+		driver = pragmaDriver
 	}
-	db, err := sql.Open(dbDriver, dbFileName)
+	db, err := sql.Open(driver, dsn)
 	if err != nil {
 		return nil, err
 	}
-	err = db.Ping()
+	// DB file may not be ready yet, e.g. on network filesystem or during
+	// container startup
+	if err := pingDB(db, Config.DBPingRetries, time.Duration(Config.DBPingDelay)*time.Millisecond); err != nil {
+		db.Close()
+		return nil, err
+	}
 	db.SetMaxOpenConns(100)
 	db.SetMaxIdleConns(100)
-	if newDB {
-		createTable(db)
+	// check schema version of the DB and apply pending migrations
+	version, err := schemaVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	latest := latestSchemaVersion()
+	if version > latest {
+		db.Close()
+		return nil, fmt.Errorf("DB %s has schema version %d which is newer than supported version %d, please upgrade goimapsync", dbFileName, version, latest)
+	}
+	if version < latest {
+		if readOnly {
+			log.Printf("DB %s has schema version %d, latest version is %d, please run goimapsync -op=migrate-db", dbFileName, version, latest)
+			return db, nil
+		}
+		if !newDB && dbDriver == "sqlite3" {
+			if err := backupDB(db, dbFileName, version); err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+		if err := migrateDB(db, version); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// helper function to check if given error is SQLite busy or locked error
+func isBusyError(err error) bool {
+	var serr sqlite3.Error
+	if errors.As(err, &serr) {
+		return serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked
 	}
-	return db, err
+	return err != nil && strings.Contains(err.Error(), "database is locked")
+}
+
+// helper function to execute given function and retry it with jittered
+// backoff while DB is busy or locked
+func withBusyRetry(fn func() error) error {
+	deadline := time.Now().Add(dbBusyTimeout)
+	delay := 10 * time.Millisecond
+	for {
+		err := fn()
+		if !isBusyError(err) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(delay + time.Duration(rand.Int63n(int64(delay))))
+		if delay < 500*time.Millisecond {
+			delay *= 2
+		}
+	}
+}
+
+// dbPinger represents DB which can be pinged, e.g. *sql.DB
+type dbPinger interface {
+	Ping() error
+}
+
+// helper function to ping given DB, the ping is retried given number of
+// times with delay which is doubled on every retry
+func pingDB(db dbPinger, retries int, delay time.Duration) error {
+	err := db.Ping()
+	for i := 0; err != nil && i < retries; i++ {
+		log.Printf("unable to ping DB, retry %d out of %d in %v, error: %v\n", i+1, retries, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		err = db.Ping()
+	}
+	return err
+}
+
+// helper function to execute given write statement in a short transaction,
+// the transaction is retried if DB is busy
+func execTx(stmt string, args ...interface{}) error {
+	return withBusyRetry(func() error {
+		tx, err := mdb.Begin()
+		if err != nil {
+			log.Printf("unable to start transaction in DB: %v\n", err)
+			return err
+		}
+		defer tx.Rollback()
+		_, err = tx.Exec(stmt, args...)
+		if err != nil {
+			log.Printf("unable to execute statement '%s' in DB: %v\n", stmt, err)
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			log.Printf("unable to commit transaction in DB: %v\n", err)
+		}
+		return err
+	})
 }
 
 // helper function to create DB
@@ -57,76 +222,566 @@ func createDB(fname string) {
 	file.Close()
 }
 
-// helper function to create our table(s)
-func createTable(db *sql.DB) {
-	tableSQL := `CREATE TABLE messages (
-		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
-		"timestamp" int NOT NULL,
-		"hid" TEXT NOT NULL UNIQUE,
-		"mid" TEXT NOT NULL UNIQUE,
-		"path" TEXT NOT NULL,
-		"imap" TEXT NOT NULL
-	  );` // SQL Statement for Create Table
+// insertMessage inserts given message into DB or updates existing one
+func insertMessage(m Message) error {
+	tstmp := time.Now().Unix()
+	// use upsert to make insert idempotent, e.g. for re-fetched messages
+	stmt := "INSERT INTO messages (timestamp, hid, mid, path, imap) VALUES (?,?,?,?,?) ON CONFLICT(hid) DO UPDATE SET timestamp=excluded.timestamp, path=excluded.path, imap=excluded.imap"
+	return execTx(stmt, tstmp, m.HashId, m.MessageId, m.Path, m.Imap)
+}
 
-	statement, err := db.Prepare(tableSQL) // Prepare SQL Statement
+// updateMessagePath updates path of given message in DB
+func updateMessagePath(hid, path string) error {
+	stmt := "UPDATE messages SET path=? WHERE hid=?"
+	return execTx(stmt, path, hid)
+}
+
+// helper function to insert message whose file is not yet moved from
+// given tmp path into its place, see writeMail
+func insertPendingMessage(m Message, tmp string) error {
+	tstmp := time.Now().Unix()
+	stmt := "INSERT INTO messages (timestamp, hid, mid, path, imap, pending) VALUES (?,?,?,?,?,?) ON CONFLICT(hid) DO UPDATE SET timestamp=excluded.timestamp, path=excluded.path, imap=excluded.imap, pending=excluded.pending"
+	return execTx(stmt, tstmp, m.HashId, m.MessageId, m.Path, m.Imap, tmp)
+}
+
+// helper function to confirm pending message along with checksum, size
+// and modification time of its file
+func confirmMessage(hid, sha string, size, mtime int64) error {
+	stmt := "UPDATE messages SET pending='', sha256=?, size=?, mtime=? WHERE hid=?"
+	return execTx(stmt, sha, size, mtime, hid)
+}
+
+// MessageHeaders represents threading headers of message kept in DB
+type MessageHeaders struct {
+	HashId     string // message id md5 hash
+	MessageId  string // message id
+	Path       string // path of message file
+	Subject    string // decoded message subject
+	From       string // message sender address
+	Date       int64  // message date, zero for messages fetched by old versions
+	InReplyTo  string // In-Reply-To header
+	References string // References header
+}
+
+// helper function to record threading headers of given message
+func updateMessageHeaders(h MessageHeaders) error {
+	stmt := "UPDATE messages SET subject=?, sender=?, date=?, in_reply_to=?, refs=? WHERE hid=?"
+	return execTx(stmt, h.Subject, h.From, h.Date, h.InReplyTo, h.References, h.HashId)
+}
+
+// helper function to get threading headers of all stored messages
+func getMessageHeaders() ([]MessageHeaders, error) {
+	var out []MessageHeaders
+	stmt := "SELECT hid, mid, path, subject, sender, date, in_reply_to, refs FROM messages WHERE path != ''"
+	res, err := mdb.Query(stmt)
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Printf("unable to query DB: %v\n", err)
+		return out, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var h MessageHeaders
+		if err := res.Scan(&h.HashId, &h.MessageId, &h.Path, &h.Subject, &h.From, &h.Date, &h.InReplyTo, &h.References); err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return out, err
+		}
+		out = append(out, h)
 	}
-	statement.Exec() // Execute SQL Statements
-	// create hid index
-	tableSQL = `create unique index idx_hid on messages (hid);`
-	statement, err = db.Prepare(tableSQL) // Prepare SQL Statement
+	return out, res.Err()
+}
+
+// PendingMessage represents message whose write was not confirmed
+type PendingMessage struct {
+	HashId string // message id md5 hash
+	Path   string // final path of message file
+	Tmp    string // tmp path of message file
+}
+
+// helper function to get paths of confirmed messages keyed by their hash ids
+func getMessagePaths() (map[string]string, error) {
+	out := make(map[string]string)
+	stmt := "SELECT hid, path FROM messages WHERE path != '' AND pending = ''"
+	res, err := mdb.Query(stmt)
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Printf("unable to query DB: %v\n", err)
+		return out, err
 	}
-	statement.Exec() // Execute SQL Statements
+	defer res.Close()
+	for res.Next() {
+		var hid, path string
+		if err := res.Scan(&hid, &path); err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return out, err
+		}
+		out[hid] = path
+	}
+	return out, res.Err()
 }
 
-// insertMessage inserts given message into DB
-func insertMessage(m Message) error {
-	tx, err := mdb.Begin()
+// helper function to get pending messages of interrupted writes
+func getPendingMessages() ([]PendingMessage, error) {
+	var out []PendingMessage
+	stmt := "SELECT hid, path, pending FROM messages WHERE pending != ''"
+	res, err := mdb.Query(stmt)
 	if err != nil {
-		log.Printf("unable to start transaction in DB: %v\n", err)
+		log.Printf("unable to query DB: %v\n", err)
+		return out, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var p PendingMessage
+		if err := res.Scan(&p.HashId, &p.Path, &p.Tmp); err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return out, err
+		}
+		out = append(out, p)
+	}
+	return out, res.Err()
+}
+
+// PendingDelete represents message flagged as \Deleted on IMAP server
+// which waits for expunge until Config.DeleteGracePeriod passes
+type PendingDelete struct {
+	Imap      string // name of IMAP server
+	Folder    string // name of folder
+	Uid       uint32 // UID of message on IMAP server
+	HashId    string // hash id of message
+	Timestamp int64  // time when message was flagged as \Deleted
+}
+
+// helper function to record message flagged as \Deleted on IMAP server,
+// the time of first flagging is kept if message is recorded again
+func insertPendingDelete(imapName, folder string, uid uint32, hid string) error {
+	stmt := "INSERT OR IGNORE INTO pending_deletes (imap, folder, uid, hid, timestamp) VALUES (?,?,?,?,?)"
+	return execTx(stmt, imapName, folder, uid, hid, time.Now().Unix())
+}
+
+// helper function to remove record of message flagged as \Deleted
+func deletePendingDelete(imapName, folder string, uid uint32) error {
+	stmt := "DELETE FROM pending_deletes WHERE imap=? AND folder=? AND uid=?"
+	return execTx(stmt, imapName, folder, uid)
+}
+
+// helper function to get messages of given IMAP folder which wait for expunge
+func getPendingDeletes(imapName, folder string) ([]PendingDelete, error) {
+	var out []PendingDelete
+	stmt := "SELECT imap, folder, uid, hid, timestamp FROM pending_deletes WHERE imap=? AND folder=?"
+	res, err := mdb.Query(stmt, imapName, folder)
+	if err != nil {
+		log.Printf("unable to query DB: %v\n", err)
+		return out, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var p PendingDelete
+		if err := res.Scan(&p.Imap, &p.Folder, &p.Uid, &p.HashId, &p.Timestamp); err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return out, err
+		}
+		out = append(out, p)
+	}
+	return out, res.Err()
+}
+
+// Operation represents IMAP operation recorded in DB before its execution,
+// the record is removed once the operation is completed
+type Operation struct {
+	Id        int64  // id of the operation
+	Imap      string // name of IMAP server
+	Op        string // name of the operation, e.g. move
+	MessageId string // message id
+	Source    string // source folder
+	Target    string // target folder
+	Seen      bool   // message was seen before the operation
+	Timestamp int64  // time when operation was recorded
+}
+
+// helper function to record given operation, it returns id of the record
+func insertOperation(o Operation) (int64, error) {
+	var oid int64
+	err := withBusyRetry(func() error {
+		stmt := "INSERT INTO operations (imap, op, mid, source, target, seen, timestamp) VALUES (?,?,?,?,?,?,?)"
+		res, err := mdb.Exec(stmt, o.Imap, o.Op, o.MessageId, o.Source, o.Target, o.Seen, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		oid, err = res.LastInsertId()
 		return err
+	})
+	return oid, err
+}
+
+// helper function to remove record of completed operation
+func deleteOperation(oid int64) error {
+	stmt := "DELETE FROM operations WHERE id=?"
+	return execTx(stmt, oid)
+}
+
+// helper function to get operations of given IMAP server which were not
+// completed
+func getOperations(imapName string) ([]Operation, error) {
+	var out []Operation
+	stmt := "SELECT id, imap, op, mid, source, target, seen, timestamp FROM operations WHERE imap=? ORDER BY id"
+	res, err := mdb.Query(stmt, imapName)
+	if err != nil {
+		log.Printf("unable to query DB: %v\n", err)
+		return out, err
 	}
-	defer tx.Rollback()
-	var stmt string
-	tstmp := time.Now().Unix()
-	stmt = "INSERT INTO messages (timestamp, hid, mid, path, imap) VALUES (?,?,?,?,?)"
-	_, err = tx.Exec(stmt, tstmp, m.HashId, m.MessageId, m.Path, m.Imap)
+	defer res.Close()
+	for res.Next() {
+		var o Operation
+		if err := res.Scan(&o.Id, &o.Imap, &o.Op, &o.MessageId, &o.Source, &o.Target, &o.Seen, &o.Timestamp); err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return out, err
+		}
+		out = append(out, o)
+	}
+	return out, res.Err()
+}
+
+// IgnoredMessage represents message of IMAP folder skipped by ignore rule
+type IgnoredMessage struct {
+	Imap        string // name of IMAP server
+	Folder      string // name of IMAP folder
+	Uid         uint32 // UID of message on IMAP server
+	UidValidity uint32 // UIDVALIDITY of IMAP folder
+	HashId      string // hash id of message
+	MessageId   string // message id
+	From        string // message sender
+	Subject     string // message subject
+	Date        int64  // message date
+	Rule        string // ignore rule which matched the message
+}
+
+// helper function to record ignored message
+func insertIgnored(e IgnoredMessage) error {
+	stmt := "INSERT OR REPLACE INTO ignored (imap, folder, uid, uidvalidity, hid, mid, sender, subject, date, rule, timestamp) VALUES (?,?,?,?,?,?,?,?,?,?,?)"
+	return execTx(stmt, e.Imap, e.Folder, e.Uid, e.UidValidity, e.HashId, e.MessageId, e.From, e.Subject, e.Date, e.Rule, time.Now().Unix())
+}
+
+// helper function to remove record of ignored message
+func deleteIgnored(imapName, folder string, uid uint32) error {
+	stmt := "DELETE FROM ignored WHERE imap=? AND folder=? AND uid=?"
+	return execTx(stmt, imapName, folder, uid)
+}
+
+// helper function to get ignored messages of given IMAP folder
+func getIgnored(imapName, folder string) ([]IgnoredMessage, error) {
+	var out []IgnoredMessage
+	stmt := "SELECT imap, folder, uid, uidvalidity, hid, mid, sender, subject, date, rule FROM ignored WHERE imap=? AND folder=? ORDER BY uid"
+	res, err := mdb.Query(stmt, imapName, folder)
+	if err != nil {
+		log.Printf("unable to query DB: %v\n", err)
+		return out, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var e IgnoredMessage
+		if err := res.Scan(&e.Imap, &e.Folder, &e.Uid, &e.UidValidity, &e.HashId, &e.MessageId, &e.From, &e.Subject, &e.Date, &e.Rule); err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return out, err
+		}
+		out = append(out, e)
+	}
+	return out, res.Err()
+}
+
+// EnvelopeMessage represents message of IMAP folder indexed by its envelope
+type EnvelopeMessage struct {
+	Imap        string // name of IMAP server
+	Folder      string // name of IMAP folder
+	Uid         uint32 // UID of message on IMAP server
+	UidValidity uint32 // UIDVALIDITY of IMAP folder
+	HashId      string // hash id of message
+	MessageId   string // message id
+	From        string // message sender
+	Subject     string // message subject
+	Date        int64  // message date
+	Flags       string // message flags on IMAP server
+	BodyPending bool   // body of message is not yet fetched
+}
+
+// helper function to record indexed message
+func insertEnvelope(e EnvelopeMessage) error {
+	stmt := "INSERT OR REPLACE INTO envelopes (imap, folder, uid, uidvalidity, hid, mid, sender, subject, date, flags, body_pending, timestamp) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)"
+	return execTx(stmt, e.Imap, e.Folder, e.Uid, e.UidValidity, e.HashId, e.MessageId, e.From, e.Subject, e.Date, e.Flags, e.BodyPending, time.Now().Unix())
+}
+
+// helper function to mark body of indexed message as fetched
+func markBodyFetched(hid string) error {
+	stmt := "UPDATE envelopes SET body_pending=0 WHERE hid=? AND body_pending=1"
+	return execTx(stmt, hid)
+}
+
+// helper function to remove record of indexed message
+func deleteEnvelope(imapName, folder string, uid uint32) error {
+	stmt := "DELETE FROM envelopes WHERE imap=? AND folder=? AND uid=?"
+	return execTx(stmt, imapName, folder, uid)
+}
+
+// helper function to get indexed messages of given IMAP folder, only ones
+// with pending body if pending is set
+func getEnvelopes(imapName, folder string, pending bool) ([]EnvelopeMessage, error) {
+	var out []EnvelopeMessage
+	stmt := "SELECT imap, folder, uid, uidvalidity, hid, mid, sender, subject, date, flags, body_pending FROM envelopes WHERE imap=? AND folder=?"
+	if pending {
+		stmt += " AND body_pending=1"
+	}
+	res, err := mdb.Query(stmt+" ORDER BY uid", imapName, folder)
 	if err != nil {
-		log.Printf("unable to execute statement '%s' in DB: %v\n", stmt, err)
-		return tx.Rollback()
+		log.Printf("unable to query DB: %v\n", err)
+		return out, err
 	}
-	err = tx.Commit()
+	defer res.Close()
+	for res.Next() {
+		var e EnvelopeMessage
+		if err := res.Scan(&e.Imap, &e.Folder, &e.Uid, &e.UidValidity, &e.HashId, &e.MessageId, &e.From, &e.Subject, &e.Date, &e.Flags, &e.BodyPending); err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return out, err
+		}
+		out = append(out, e)
+	}
+	return out, res.Err()
+}
+
+// helper function to get folders of given IMAP server with indexed messages
+// whose bodies are pending
+func getPendingFolders(imapName string) ([]string, error) {
+	var out []string
+	stmt := "SELECT DISTINCT folder FROM envelopes WHERE imap=? AND body_pending=1 ORDER BY folder"
+	res, err := mdb.Query(stmt, imapName)
 	if err != nil {
-		log.Printf("unable to commit transaction in DB: %v\n", err)
-		return tx.Rollback()
+		log.Printf("unable to query DB: %v\n", err)
+		return out, err
 	}
-	return nil
+	defer res.Close()
+	for res.Next() {
+		var folder string
+		if err := res.Scan(&folder); err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return out, err
+		}
+		out = append(out, folder)
+	}
+	return out, res.Err()
 }
 
-// deleteMessage deletes given message in DB
-func deleteMessage(hid string) error {
-	tx, err := mdb.Begin()
+// FailedMessage represents message of IMAP folder which was fetched but
+// could not be written into local maildir
+type FailedMessage struct {
+	Imap        string // name of IMAP server
+	Folder      string // name of IMAP folder
+	Uid         uint32 // UID of message on IMAP server
+	UidValidity uint32 // UIDVALIDITY of IMAP folder
+	HashId      string // hash id of message
+	MessageId   string // message id
+	Error       string // error of the last write
+	Attempts    int    // number of runs which failed to write the message
+}
+
+// helper function to record message which could not be written, the number
+// of attempts is incremented if the message failed before
+func insertFailedMessage(f FailedMessage) error {
+	stmt := "INSERT INTO failed_messages (imap, folder, uid, uidvalidity, hid, mid, error, attempts, timestamp) VALUES (?,?,?,?,?,?,?,1,?) ON CONFLICT(imap, folder, uid) DO UPDATE SET uidvalidity=excluded.uidvalidity, hid=excluded.hid, mid=excluded.mid, error=excluded.error, attempts=attempts+1, timestamp=excluded.timestamp"
+	return execTx(stmt, f.Imap, f.Folder, f.Uid, f.UidValidity, f.HashId, f.MessageId, f.Error, time.Now().Unix())
+}
+
+// helper function to remove records of message once it is written
+func deleteFailedMessage(hid string) error {
+	stmt := "DELETE FROM failed_messages WHERE hid=?"
+	return execTx(stmt, hid)
+}
+
+// helper function to count messages of given IMAP folder which could not be
+// written
+func countFailedMessages(imapName, folder string) (int, error) {
+	var count int
+	stmt := "SELECT COUNT(*) FROM failed_messages WHERE imap=? AND folder=?"
+	err := mdb.QueryRow(stmt, imapName, folder).Scan(&count)
+	return count, err
+}
+
+// helper function to get messages of given IMAP server which could not be
+// written
+func getFailedMessages(imapName string) ([]FailedMessage, error) {
+	var out []FailedMessage
+	stmt := "SELECT imap, folder, uid, uidvalidity, hid, mid, error, attempts FROM failed_messages WHERE imap=? ORDER BY folder, uid"
+	res, err := mdb.Query(stmt, imapName)
 	if err != nil {
-		log.Printf("unable to start transaction in DB: %v\n", err)
-		return err
+		log.Printf("unable to query DB: %v\n", err)
+		return out, err
 	}
-	defer tx.Rollback()
-	var stmt string
-	stmt = "DELETE FROM messages WHERE hid=?"
-	_, err = tx.Exec(stmt, hid)
+	defer res.Close()
+	for res.Next() {
+		var f FailedMessage
+		if err := res.Scan(&f.Imap, &f.Folder, &f.Uid, &f.UidValidity, &f.HashId, &f.MessageId, &f.Error, &f.Attempts); err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return out, err
+		}
+		out = append(out, f)
+	}
+	return out, res.Err()
+}
+
+// MirroredFolder represents IMAP folder added to the mirror
+type MirroredFolder struct {
+	Folder      string            // name of IMAP folder
+	UidValidity uint32            // UIDVALIDITY of IMAP folder observed by the last fetch
+	Sample      map[uint32]string // sample of message ids of the folder by their UIDs
+}
+
+// helper function to record folder of IMAP server added to the mirror
+func insertMirrored(imapName string, m MirroredFolder) error {
+	sample := ""
+	if len(m.Sample) > 0 {
+		data, err := json.Marshal(m.Sample)
+		if err != nil {
+			return err
+		}
+		sample = string(data)
+	}
+	stmt := "INSERT OR REPLACE INTO mirrored (imap, folder, uidvalidity, sample, timestamp) VALUES (?,?,?,?,?)"
+	return execTx(stmt, imapName, m.Folder, m.UidValidity, sample, time.Now().Unix())
+}
+
+// helper function to get mirrored folders of given IMAP server
+func getMirrored(imapName string) ([]MirroredFolder, error) {
+	var out []MirroredFolder
+	stmt := "SELECT folder, uidvalidity, sample FROM mirrored WHERE imap=? ORDER BY folder"
+	res, err := mdb.Query(stmt, imapName)
 	if err != nil {
-		log.Printf("unable to execute statement '%s' in DB: %v\n", stmt, err)
-		return tx.Rollback()
+		log.Printf("unable to query DB: %v\n", err)
+		return out, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var m MirroredFolder
+		var sample string
+		if err := res.Scan(&m.Folder, &m.UidValidity, &sample); err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return out, err
+		}
+		if sample != "" {
+			if err := json.Unmarshal([]byte(sample), &m.Sample); err != nil {
+				log.Printf("unable to decode sample of mirrored folder '%s', error: %v\n", m.Folder, err)
+			}
+		}
+		out = append(out, m)
+	}
+	return out, res.Err()
+}
+
+// helper function to record state of IMAP folder after its complete fetch
+func setFolderState(imapName, folder string, st FolderState) error {
+	stmt := "INSERT OR REPLACE INTO folder_state (imap, folder, messages, uidnext, uidvalidity, unseen, rules, timestamp) VALUES (?,?,?,?,?,?,?,?)"
+	return execTx(stmt, imapName, folder, st.Messages, st.UidNext, st.UidValidity, st.Unseen, st.Rules, time.Now().Unix())
+}
+
+// helper function to get state of IMAP folder recorded by its last complete
+// fetch, it returns nil if folder state is not recorded
+func getFolderState(imapName, folder string) (*FolderState, error) {
+	var st FolderState
+	stmt := "SELECT messages, uidnext, uidvalidity, unseen, rules FROM folder_state WHERE imap=? AND folder=?"
+	err := mdb.QueryRow(stmt, imapName, folder).Scan(&st.Messages, &st.UidNext, &st.UidValidity, &st.Unseen, &st.Rules)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
 	}
-	err = tx.Commit()
 	if err != nil {
-		log.Printf("unable to commit transaction in DB: %v\n", err)
-		return tx.Rollback()
+		return nil, err
 	}
-	return nil
+	return &st, nil
+}
+
+// helper function to update DB records of given IMAP folder whose local
+// maildir folder at given path is moved to target path, the paths of its
+// messages are updated accordingly, or it is removed if target is empty
+// and then its messages are removed from DB as well. The other records of
+// the folder are moved to renamed folder if it is set or dropped otherwise
+func updateFolderRecords(imapName, folder, renamed, path, target string) error {
+	prefix := path + "/"
+	// SQLite substr counts characters rather than bytes
+	n := utf8.RuneCountInString(prefix)
+	return withBusyRetry(func() error {
+		tx, err := mdb.Begin()
+		if err != nil {
+			log.Printf("unable to start transaction in DB: %v\n", err)
+			return err
+		}
+		defer tx.Rollback()
+		if target == "" {
+			stmt := "DELETE FROM message_accounts WHERE hid IN (SELECT hid FROM messages WHERE substr(path, 1, ?)=?)"
+			if _, err := tx.Exec(stmt, n, prefix); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("DELETE FROM messages WHERE substr(path, 1, ?)=?", n, prefix); err != nil {
+				return err
+			}
+		} else {
+			stmt := "UPDATE messages SET path=? || substr(path, ?) WHERE substr(path, 1, ?)=?"
+			if _, err := tx.Exec(stmt, target+"/", n+1, n, prefix); err != nil {
+				return err
+			}
+		}
+		for _, table := range []string{"sync_state", "presence", "pending_deletes", "ignored", "mirrored", "folder_state", "envelopes", "failed_messages"} {
+			stmt := fmt.Sprintf("DELETE FROM %s WHERE imap=? AND folder=?", table)
+			args := []interface{}{imapName, folder}
+			if renamed != "" {
+				stmt = fmt.Sprintf("UPDATE OR REPLACE %s SET folder=? WHERE imap=? AND folder=?", table)
+				args = append([]interface{}{renamed}, args...)
+			}
+			if _, err := tx.Exec(stmt, args...); err != nil {
+				return err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			log.Printf("unable to commit transaction in DB: %v\n", err)
+		}
+		return err
+	})
+}
+
+// helper function to update checksum, size and modification time of
+// message file in DB
+func updateMessageChecksum(hid, sha string, size, mtime int64) error {
+	stmt := "UPDATE messages SET sha256=?, size=?, mtime=? WHERE hid=?"
+	return execTx(stmt, sha, size, mtime, hid)
+}
+
+// MessageFile represents message file recorded in DB along with its checksum
+type MessageFile struct {
+	Message        // message info
+	Sha256  string // file checksum
+	Size    int64  // file size
+	MTime   int64  // file modification time
+}
+
+// helper function to get all message files recorded in DB
+func getMessageFiles() ([]MessageFile, error) {
+	var out []MessageFile
+	stmt := "SELECT hid, mid, path, imap, sha256, size, mtime FROM messages"
+	res, err := mdb.Query(stmt)
+	if err != nil {
+		log.Printf("unable to query DB: %v\n", err)
+		return out, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var f MessageFile
+		err = res.Scan(&f.HashId, &f.MessageId, &f.Path, &f.Imap, &f.Sha256, &f.Size, &f.MTime)
+		if err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return out, err
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// deleteMessage deletes given message in DB
+func deleteMessage(hid string) error {
+	stmt := "DELETE FROM messages WHERE hid=?"
+	return execTx(stmt, hid)
 }
 
 // helper function to find message in DB
@@ -159,6 +814,21 @@ func findMessage(hid string) (Message, error) {
 	return m, nil
 }
 
+// helper function to find message in DB by its raw message id, the
+// empty message is returned if it is not found
+func findMessageByMid(mid string) (Message, error) {
+	var m Message
+	stmt := "SELECT hid, mid, path, imap FROM messages WHERE mid=?"
+	err := mdb.QueryRow(stmt, mid).Scan(&m.HashId, &m.MessageId, &m.Path, &m.Imap)
+	if err == sql.ErrNoRows {
+		return Message{}, nil
+	}
+	if err != nil {
+		log.Printf("unable to query DB: %v\n", err)
+	}
+	return m, err
+}
+
 // helper function to get all messages from local DB
 func getDBMessages() ([]Message, error) {
 	var mlist []Message
@@ -188,3 +858,339 @@ func getDBMessages() ([]Message, error) {
 	}
 	return mlist, nil
 }
+
+// SyncState represents state of the message at last sync
+type SyncState struct {
+	HashId string // message id md5 hash
+	Imap   string // name of imap server
+	Folder string // name of imap folder
+	Flags  string // sync flags symbols, see syncFlags
+	Remote bool   // message was present on IMAP server
+	Local  bool   // message was present in local maildir
+}
+
+// helper function to get sync states of given imap server and folder
+func getSyncStates(imapName, folder string) (map[string]SyncState, error) {
+	smap := make(map[string]SyncState)
+	// proceed with transaction operation
+	tx, err := mdb.Begin()
+	if err != nil {
+		log.Printf("unable to start transaction in DB: %v\n", err)
+		return smap, err
+	}
+	defer tx.Rollback()
+	stmt := "SELECT hid, flags, remote, local FROM sync_state WHERE imap=? AND folder=?"
+	res, err := tx.Query(stmt, imapName, folder)
+	if err != nil {
+		log.Printf("unable to query DB: %v\n", err)
+		return smap, err
+	}
+	for res.Next() {
+		var hid, flags string
+		var remote, local bool
+		err = res.Scan(&hid, &flags, &remote, &local)
+		if err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return smap, tx.Rollback()
+		}
+		smap[hid] = SyncState{HashId: hid, Imap: imapName, Folder: folder, Flags: flags, Remote: remote, Local: local}
+	}
+	return smap, nil
+}
+
+// helper function to insert or update sync state of the message
+func updateSyncState(s SyncState) error {
+	tstmp := time.Now().Unix()
+	stmt := "INSERT OR REPLACE INTO sync_state (hid, imap, folder, flags, remote, local, timestamp) VALUES (?,?,?,?,?,?,?)"
+	return execTx(stmt, s.HashId, s.Imap, s.Folder, s.Flags, s.Remote, s.Local, tstmp)
+}
+
+// helper function to delete sync state of the message
+func deleteSyncState(hid, imapName, folder string) error {
+	stmt := "DELETE FROM sync_state WHERE hid=? AND imap=? AND folder=?"
+	return execTx(stmt, hid, imapName, folder)
+}
+
+// helper function to associate message with IMAP server, with common inbox
+// the same message may be delivered to several IMAP servers
+func addMessageAccount(hid, imapName string) error {
+	stmt := "INSERT OR IGNORE INTO message_accounts (hid, imap) VALUES (?,?)"
+	return execTx(stmt, hid, imapName)
+}
+
+// helper function to remove association of message with IMAP server
+func deleteMessageAccount(hid, imapName string) error {
+	stmt := "DELETE FROM message_accounts WHERE hid=? AND imap=?"
+	return execTx(stmt, hid, imapName)
+}
+
+// helper function to get IMAP servers associated with given message
+func getMessageAccounts(hid string) ([]string, error) {
+	var accounts []string
+	res, err := mdb.Query("SELECT imap FROM message_accounts WHERE hid=? ORDER BY imap", hid)
+	if err != nil {
+		log.Printf("unable to query DB: %v\n", err)
+		return accounts, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var imapName string
+		if err := res.Scan(&imapName); err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return accounts, err
+		}
+		accounts = append(accounts, imapName)
+	}
+	return accounts, nil
+}
+
+// helper function to record messages present in IMAP folder at given time
+func recordPresence(tstamp int64, imapName, folder string, msgs []Message) error {
+	return withBusyRetry(func() error {
+		tx, err := mdb.Begin()
+		if err != nil {
+			log.Printf("unable to start transaction in DB: %v\n", err)
+			return err
+		}
+		defer tx.Rollback()
+		stmt := "INSERT INTO presence (timestamp, imap, folder, uid, hid) VALUES (?,?,?,?,?)"
+		for _, m := range msgs {
+			if _, err := tx.Exec(stmt, tstamp, imapName, folder, m.Uid, m.HashId); err != nil {
+				return err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			log.Printf("unable to commit transaction in DB: %v\n", err)
+		}
+		return err
+	})
+}
+
+// helper function to get hash ids of given UIDs of IMAP folder which were
+// ever recorded in presence table, the unknown UIDs are not in the map
+func presenceHashIds(imapName, folder string, uids []uint32) (map[uint32]string, error) {
+	out := make(map[uint32]string)
+	stmt := "SELECT hid FROM presence WHERE imap=? AND folder=? AND uid=? ORDER BY timestamp DESC LIMIT 1"
+	for _, uid := range uids {
+		var hid string
+		err := mdb.QueryRow(stmt, imapName, folder, uid).Scan(&hid)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Printf("unable to query DB: %v\n", err)
+			return out, err
+		}
+		out[uid] = hid
+	}
+	return out, nil
+}
+
+// Run represents record of goimapsync run
+type Run struct {
+	Id       int64     // id of the run
+	Start    time.Time // start time of the run
+	End      time.Time // end time of the run
+	Op       string    // operation
+	Servers  string    // comma separated list of touched IMAP servers
+	Folders  string    // comma separated list of touched folders
+	Fetched  int       // number of fetched messages
+	Uploaded int       // number of uploaded messages
+	Deleted  int       // number of deleted messages
+	Errors   int       // number of errors
+	Status   string    // exit status of the run
+}
+
+// helper function to record start of the run, it returns id of the run
+func startRun(op string) (int64, error) {
+	var rid int64
+	err := withBusyRetry(func() error {
+		stmt := "INSERT INTO runs (start, end, op, servers, folders, fetched, uploaded, deleted, errors, status) VALUES (?,0,?,'','',0,0,0,0,'running')"
+		res, err := mdb.Exec(stmt, time.Now().Unix(), op)
+		if err != nil {
+			return err
+		}
+		rid, err = res.LastInsertId()
+		return err
+	})
+	return rid, err
+}
+
+// helper function to record end of the run and prune old runs
+func finishRun(r Run, retention int) error {
+	stmt := "UPDATE runs SET end=?, servers=?, folders=?, fetched=?, uploaded=?, deleted=?, errors=?, status=? WHERE id=?"
+	err := execTx(stmt, time.Now().Unix(), r.Servers, r.Folders, r.Fetched, r.Uploaded, r.Deleted, r.Errors, r.Status, r.Id)
+	if err != nil {
+		return err
+	}
+	if retention > 0 {
+		stmt = "DELETE FROM runs WHERE id NOT IN (SELECT id FROM runs ORDER BY id DESC LIMIT ?)"
+		err = execTx(stmt, retention)
+	}
+	return err
+}
+
+// VacuumDB rebuilds the DB file to reclaim space of deleted rows, SQLite
+// never shrinks its file on its own
+func VacuumDB() error {
+	defer timing("VacuumDB", time.Now())
+	if err := acquireRunLock(); err != nil {
+		return err
+	}
+	defer releaseRunLock()
+	_, dbFileName, err := parseDBUri(Config.DBUri)
+	if err != nil {
+		return err
+	}
+	before, err := os.Stat(dbFileName)
+	if err != nil {
+		return err
+	}
+	err = withBusyRetry(func() error {
+		_, err := mdb.Exec("VACUUM")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to vacuum DB: %w", err)
+	}
+	after, err := os.Stat(dbFileName)
+	if err != nil {
+		return err
+	}
+	log.Printf("vacuum DB %s: %d -> %d bytes\n", dbFileName, before.Size(), after.Size())
+	return nil
+}
+
+// helper function to check if DB should be vacuumed after run with given
+// id, it is done after every Config.VacuumEvery recorded runs
+func vacuumDue(rid int64) bool {
+	return Config.VacuumEvery > 0 && rid > 0 && rid%int64(Config.VacuumEvery) == 0
+}
+
+// helper function to get last runs from DB
+func getRuns(limit int) ([]Run, error) {
+	var runs []Run
+	stmt := "SELECT id, start, end, op, servers, folders, fetched, uploaded, deleted, errors, status FROM runs ORDER BY id DESC LIMIT ?"
+	res, err := mdb.Query(stmt, limit)
+	if err != nil {
+		log.Printf("unable to query DB: %v\n", err)
+		return runs, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var r Run
+		var start, end int64
+		err = res.Scan(&r.Id, &start, &end, &r.Op, &r.Servers, &r.Folders, &r.Fetched, &r.Uploaded, &r.Deleted, &r.Errors, &r.Status)
+		if err != nil {
+			log.Printf("unable to scan in DB: %v\n", err)
+			return runs, err
+		}
+		r.Start = time.Unix(start, 0)
+		if end > 0 {
+			r.End = time.Unix(end, 0)
+		}
+		runs = append(runs, r)
+	}
+	return runs, nil
+}
+
+// helper function to get cached list of folders of given IMAP server
+func getCachedFolders(imapName string) ([]string, error) {
+	var folders []string
+	stmt := "SELECT folder FROM folders WHERE imap=? ORDER BY folder"
+	res, err := mdb.Query(stmt, imapName)
+	if err != nil {
+		return folders, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var folder string
+		if err := res.Scan(&folder); err != nil {
+			return folders, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, nil
+}
+
+// helper function to overwrite cached list of folders of given IMAP server
+func saveCachedFolders(imapName string, folders []string) error {
+	tstmp := time.Now().Unix()
+	return withBusyRetry(func() error {
+		tx, err := mdb.Begin()
+		if err != nil {
+			log.Printf("unable to start transaction in DB: %v\n", err)
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec("DELETE FROM folders WHERE imap=?", imapName); err != nil {
+			return err
+		}
+		for _, f := range folders {
+			stmt := "INSERT OR REPLACE INTO folders (imap, folder, timestamp) VALUES (?,?,?)"
+			if _, err := tx.Exec(stmt, imapName, f, tstmp); err != nil {
+				return err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			log.Printf("unable to commit transaction in DB: %v\n", err)
+		}
+		return err
+	})
+}
+
+// helper function to get value of given setting from DB
+func getSetting(name string) (string, error) {
+	var value string
+	err := mdb.QueryRow("SELECT value FROM settings WHERE name=?", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// helper function to set value of given setting in DB
+func setSetting(name, value string) error {
+	stmt := "INSERT OR REPLACE INTO settings (name, value) VALUES (?,?)"
+	return execTx(stmt, name, value)
+}
+
+// helper function to check that local maildir layout was not changed since
+// DB was created, switching layouts would cause full re-download of mails
+func checkLocalLayout(readOnly bool) error {
+	layout := fmt.Sprintf("%s:%s", Config.LocalLayout, Config.LocalSeparator)
+	if Config.LocalLayout == "nested" {
+		layout = Config.LocalLayout
+	}
+	// read-only DB may not be migrated yet to have settings table
+	if version, err := schemaVersion(mdb); err != nil || version < 5 {
+		return err
+	}
+	stored, err := getSetting("localLayout")
+	if err != nil {
+		return err
+	}
+	if stored == "" {
+		// DBs created before layout option existed use nested layout
+		var count int
+		if err := mdb.QueryRow("SELECT count(*) FROM messages").Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			stored = "nested"
+		} else {
+			stored = layout
+		}
+		if !readOnly {
+			if err := setSetting("localLayout", stored); err != nil {
+				return err
+			}
+		}
+	}
+	if stored != layout {
+		return fmt.Errorf("local maildir uses '%s' layout while configuration requests '%s' one, switching layouts of existing maildir is not supported", stored, layout)
+	}
+	return nil
+}
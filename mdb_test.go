@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+func TestInsertMessageIdempotent(t *testing.T) {
+	setupTest(t)
+	mid := "<insert-1@localhost>"
+	m := Message{MessageId: mid, HashId: md5hash(mid), Imap: "a", Path: "/mail/a/INBOX/cur/1"}
+	tests := []struct {
+		imap, path string
+	}{
+		{"a", "/mail/a/INBOX/cur/1"},
+		{"a", "/mail/a/INBOX/cur/1"},
+		{"b", "/mail/b/INBOX/cur/2"},
+	}
+	for _, tt := range tests {
+		m.Imap, m.Path = tt.imap, tt.path
+		if err := insertMessage(m); err != nil {
+			t.Fatalf("insert of %+v: %v", tt, err)
+		}
+		entry, err := findMessage(m.HashId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Path != tt.path || entry.Imap != tt.imap {
+			t.Errorf("DB record %+v, expected imap %s path %s", entry, tt.imap, tt.path)
+		}
+	}
+	var count int
+	if err := mdb.QueryRow("SELECT COUNT(*) FROM messages WHERE hid=?", m.HashId).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d DB record(s) of the message instead of 1", count)
+	}
+}
+
+func TestIsBusyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		busy bool
+	}{
+		{nil, false},
+		{errors.New("no such table"), false},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{sqlite3.Error{Code: sqlite3.ErrLocked}, true},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint}, false},
+		{fmt.Errorf("insert: %w", sqlite3.Error{Code: sqlite3.ErrBusy}), true},
+		{errors.New("database is locked"), true},
+	}
+	for _, tt := range tests {
+		if got := isBusyError(tt.err); got != tt.busy {
+			t.Errorf("isBusyError(%v)=%v, expected %v", tt.err, got, tt.busy)
+		}
+	}
+}
+
+func TestWithBusyRetry(t *testing.T) {
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+	other := errors.New("no such table")
+	tests := []struct {
+		name   string
+		errs   []error // errors returned by consecutive calls
+		calls  int
+		expect error
+	}{
+		{"success", []error{nil}, 1, nil},
+		{"busy then success", []error{busy, busy, nil}, 3, nil},
+		{"other error", []error{other, nil}, 1, other},
+		{"busy then other error", []error{busy, other}, 2, other},
+	}
+	for _, tt := range tests {
+		calls := 0
+		err := withBusyRetry(func() error {
+			err := tt.errs[calls]
+			calls += 1
+			return err
+		})
+		if err != tt.expect || calls != tt.calls {
+			t.Errorf("%s: %d call(s) with error %v, expected %d call(s) with error %v", tt.name, calls, err, tt.calls, tt.expect)
+		}
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	setupTest(t)
+	// second DB handle represents ad-hoc CLI run next to the daemon
+	db, err := InitDB(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO messages (timestamp, hid, mid, path, imap) VALUES (0, 'lock', 'lock', '', 'b')"); err != nil {
+		t.Fatal(err)
+	}
+	// release the write lock while the other writer retries
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tx.Commit()
+	}()
+	mid := "<busy-1@localhost>"
+	if err := insertMessage(Message{MessageId: mid, HashId: md5hash(mid), Imap: "a"}); err != nil {
+		t.Fatalf("insert into busy DB is not retried: %v", err)
+	}
+	if entry, err := findMessage(md5hash(mid)); err != nil || entry.Imap != "a" {
+		t.Errorf("message is not inserted, error: %v", err)
+	}
+}
+
+func TestInitDBReadOnly(t *testing.T) {
+	setupTest(t)
+	db, err := InitDB(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("DELETE FROM messages"); err == nil {
+		t.Error("read-only DB accepts writes")
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count); err != nil {
+		t.Errorf("read-only DB can't be read: %v", err)
+	}
+}
+
+func TestCachedFolders(t *testing.T) {
+	setupTest(t)
+	tests := []struct {
+		imap    string
+		folders []string
+		expect  map[string]string // expected cached folders per server
+	}{
+		{"a", []string{"INBOX", "Archive"}, map[string]string{"a": "Archive,INBOX", "b": ""}},
+		{"b", []string{"INBOX"}, map[string]string{"a": "Archive,INBOX", "b": "INBOX"}},
+		{"a", []string{"INBOX", "Sent", "Archive/2024"}, map[string]string{"a": "Archive/2024,INBOX,Sent", "b": "INBOX"}},
+		{"a", nil, map[string]string{"a": "", "b": "INBOX"}},
+	}
+	for i, tt := range tests {
+		if err := saveCachedFolders(tt.imap, tt.folders); err != nil {
+			t.Fatal(err)
+		}
+		for imapName, expect := range tt.expect {
+			folders, err := getCachedFolders(imapName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(folders, ","); got != expect {
+				t.Errorf("step %d: cached folders of %s are %q instead of %q", i, imapName, got, expect)
+			}
+		}
+	}
+}
+
+func TestCreatedFolderIsCached(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	c := ts.connect(t)
+	Config.CreateFolder = true
+	if err := checkFolders(c, testServerName, "INBOX", "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	folders, err := getCachedFolders(testServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(folders, ","); got != "Archive,INBOX" {
+		t.Errorf("cached folders %q after create of Archive", got)
+	}
+}
+
+func TestDBPragmas(t *testing.T) {
+	setupTest(t)
+	mdb.Close()
+	Config.DBPragmas = map[string]string{"synchronous": "OFF", "cache_size": "-4000", "journal_mode": "WAL"}
+	db, err := InitDB(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdb = db
+	// pragmas are applied to every connection of the pool
+	var conns []*sql.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	tests := []struct {
+		pragma string
+		expect string
+	}{
+		{"synchronous", "0"},
+		{"cache_size", "-4000"},
+		{"journal_mode", "wal"},
+	}
+	for i, conn := range conns {
+		for _, tt := range tests {
+			var value string
+			if err := conn.QueryRowContext(context.Background(), "PRAGMA "+tt.pragma).Scan(&value); err != nil {
+				t.Fatal(err)
+			}
+			if value != tt.expect {
+				t.Errorf("connection %d: pragma %s=%s, expected %s", i, tt.pragma, value, tt.expect)
+			}
+		}
+	}
+}
+
+func TestValidatePragmas(t *testing.T) {
+	tests := []struct {
+		pragmas map[string]string
+		fail    bool
+	}{
+		{nil, false},
+		{map[string]string{"synchronous": "NORMAL", "cache_size": "-2000"}, false},
+		{map[string]string{"synchronous": "OFF; DROP TABLE messages"}, true},
+		{map[string]string{"journal mode": "WAL"}, true},
+		{map[string]string{"mmap_size": ""}, true},
+	}
+	for _, tt := range tests {
+		if err := validatePragmas(tt.pragmas); (err != nil) != tt.fail {
+			t.Errorf("validatePragmas(%v) error %v, expected failure %v", tt.pragmas, err, tt.fail)
+		}
+	}
+	setupTest(t)
+	mdb.Close()
+	Config.DBPragmas = map[string]string{"synchronous": "OFF;"}
+	if db, err := InitDB(false); err == nil {
+		db.Close()
+		t.Errorf("DB is opened with invalid pragma")
+	}
+}
+
+func TestDBPragmasKeepMigrationBackup(t *testing.T) {
+	setupTest(t)
+	mdb.Close()
+	_, fname, err := parseDBUri(Config.DBUri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// DB of the previous version is backed up before migration
+	db, err := sql.Open("sqlite3", fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := latestSchemaVersion() - 1
+	if _, err := db.Exec("DELETE FROM schema_version WHERE version > ?", version); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	Config.DBPragmas = map[string]string{"synchronous": "OFF"}
+	if mdb, err = InitDB(false); err != nil {
+		t.Fatal(err)
+	}
+	backups, _ := filepath.Glob(fmt.Sprintf("%s.v%d.*.bak", fname, version))
+	if len(backups) != 1 {
+		t.Errorf("DB with pragmas is migrated with backups %v", backups)
+	}
+}
+
+func TestFindMessageByMid(t *testing.T) {
+	setupTest(t)
+	msgs := []Message{
+		{MessageId: "<mid-1@localhost>", Imap: "a", Path: "/mail/a/INBOX/cur/1"},
+		{MessageId: "<mid-2@localhost>", Imap: "b", Path: "/mail/b/Work/cur/2"},
+	}
+	for _, m := range msgs {
+		m.HashId = md5hash(m.MessageId)
+		if err := insertMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		mid    string
+		expect Message
+	}{
+		{"<mid-1@localhost>", msgs[0]},
+		{"<mid-2@localhost>", msgs[1]},
+		{"<MID-2@localhost>", Message{}},
+		{md5hash("<mid-1@localhost>"), Message{}},
+		{"", Message{}},
+	}
+	for _, tt := range tests {
+		m, err := findMessageByMid(tt.mid)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.mid, err)
+		}
+		if tt.expect.MessageId != "" {
+			tt.expect.HashId = md5hash(tt.expect.MessageId)
+		}
+		if m.HashId != tt.expect.HashId || m.MessageId != tt.expect.MessageId || m.Path != tt.expect.Path || m.Imap != tt.expect.Imap {
+			t.Errorf("findMessageByMid(%q)=%+v, expected %+v", tt.mid, m, tt.expect)
+		}
+	}
+}
+
+func TestVacuumDB(t *testing.T) {
+	setupTest(t)
+	_, fname, err := parseDBUri(Config.DBUri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := mdb.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := strings.Repeat("x", 512)
+	for i := 0; i < 2000; i++ {
+		mid := fmt.Sprintf("<vacuum-%d@localhost>", i)
+		if _, err := tx.Exec("INSERT INTO messages (timestamp, hid, mid, path, imap) VALUES (?,?,?,?,?)", 0, md5hash(mid), mid, path, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mdb.Exec("DELETE FROM messages"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VacuumDB(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("DB file size %d is not decreased by vacuum, before %d", after.Size(), before.Size())
+	}
+}
+
+func TestVacuumDue(t *testing.T) {
+	keepConfig(t)
+	tests := []struct {
+		every  int
+		rid    int64
+		expect bool
+	}{
+		{0, 10, false},
+		{10, 0, false},
+		{10, 5, false},
+		{10, 10, true},
+		{10, 20, true},
+		{1, 7, true},
+	}
+	for _, tt := range tests {
+		Config.VacuumEvery = tt.every
+		if got := vacuumDue(tt.rid); got != tt.expect {
+			t.Errorf("vacuumDue(%d) with vacuumEvery %d = %v, expected %v", tt.rid, tt.every, got, tt.expect)
+		}
+	}
+}
+
+// testPinger represents DB whose first pings fail
+type testPinger struct {
+	Failures int // number of failing pings
+	Pings    int // number of pings
+}
+
+// Ping implements dbPinger interface
+func (p *testPinger) Ping() error {
+	p.Pings += 1
+	if p.Pings <= p.Failures {
+		return errors.New("database is not ready")
+	}
+	return nil
+}
+
+func TestPingDB(t *testing.T) {
+	tests := []struct {
+		failures int
+		retries  int
+		pings    int
+		fail     bool
+	}{
+		{0, 3, 1, false},
+		{2, 3, 3, false},
+		{3, 3, 4, false},
+		{5, 2, 3, true},
+		{1, -1, 1, true},
+	}
+	for _, tt := range tests {
+		p := &testPinger{Failures: tt.failures}
+		err := pingDB(p, tt.retries, time.Millisecond)
+		if tt.fail != (err != nil) {
+			t.Errorf("ping with %d failure(s) and %d retries, error %v", tt.failures, tt.retries, err)
+		}
+		if p.Pings != tt.pings {
+			t.Errorf("ping with %d failure(s) and %d retries pinged DB %d time(s), expected %d", tt.failures, tt.retries, p.Pings, tt.pings)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// three-way merge module for goimapsync
+//
+// The sync compares state of messages on IMAP server, in local maildir and
+// the state recorded at last sync (see sync_state table). The change on
+// exactly one side is propagated to another side, the change on both sides
+// is resolved using Config.ConflictPolicy, and no change does nothing.
+// The direction of flags sync can be changed via Config.FlagAuthority.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// syncFlagsMap defines IMAP flags we sync and their maildir symbols
+var syncFlagsMap = map[string]string{
+	imap.SeenFlag:     "S",
+	imap.AnsweredFlag: "R",
+	imap.FlaggedFlag:  "F",
+}
+
+// helper function to return sorted sync symbols of given IMAP flags
+func syncFlags(flags []string) string {
+	var symbols []string
+	for _, f := range flags {
+		if s, ok := syncFlagsMap[f]; ok {
+			symbols = append(symbols, s)
+		}
+	}
+	sort.Strings(symbols)
+	return strings.Join(symbols, "")
+}
+
+// helper function to return sorted sync symbols of given local mail file
+func localSyncFlags(fname string) string {
+	// mails in new area are not seen and do not carry any flags
+	if filepath.Base(filepath.Dir(fname)) == "new" {
+		return ""
+	}
+	var symbols []string
+	for _, f := range getFlags(filepath.Base(fname)) {
+		// old goimapsync versions used A symbol for answered mails
+		if f == "A" {
+			f = "R"
+		}
+		if f == "S" || f == "R" || f == "F" {
+			symbols = append(symbols, f)
+		}
+	}
+	sort.Strings(symbols)
+	return strings.Join(symbols, "")
+}
+
+// helper function to set sync flags on local mail file, it returns new path of the file
+func setLocalFlags(fname, flags string) (string, error) {
+	dir := filepath.Dir(fname)
+	base := filepath.Base(fname)
+	// keep non-sync symbols of the file and replace sync ones
+	var symbols []string
+	if arr := strings.Split(base, ":2,"); len(arr) == 2 {
+		base = arr[0]
+		for _, f := range strings.Split(arr[1], "") {
+			if f != "" && f != "A" && !strings.Contains("SRF", f) {
+				symbols = append(symbols, f)
+			}
+		}
+	}
+	symbols = append(symbols, strings.Split(flags, "")...)
+	sort.Strings(symbols)
+	// mail with flags should reside in cur area of maildir
+	if filepath.Base(dir) == "new" {
+		dir = filepath.Join(filepath.Dir(dir), "cur")
+	}
+	fpath := filepath.Join(dir, fmt.Sprintf("%s:2,%s", base, strings.Join(symbols, "")))
+	if fpath == fname {
+		return fname, nil
+	}
+	err := os.Rename(fname, fpath)
+	return fpath, err
+}
+
+// helper function to set sync flags of given message on IMAP server,
+// the folder should be already selected
+func setImapFlags(c *client.Client, m Message, flags string) error {
+	var add, remove []interface{}
+	for f, s := range syncFlagsMap {
+		if strings.Contains(flags, s) {
+			add = append(add, f)
+		} else {
+			remove = append(remove, f)
+		}
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(m.Uid)
+	if len(add) > 0 {
+		item := imap.FormatFlagsOp(imap.AddFlags, true)
+		if err := c.UidStore(seqset, item, add, nil); err != nil {
+			return err
+		}
+	}
+	if len(remove) > 0 {
+		item := imap.FormatFlagsOp(imap.RemoveFlags, true)
+		if err := c.UidStore(seqset, item, remove, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// helper function to append local mail file to given IMAP folder, the
+// message is appended with flags of its file name
+func appendMessage(c *client.Client, folder, fname string) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	flags := symbolFlags(getFlags(filepath.Base(fname)))
+	return c.Append(folder, flags, messageDate(fname, data), bytes.NewBuffer(data))
+}
+
+// helper function to get date of local mail file, we use its Date header,
+// then time stamp of maildir file name and finally file modification time
+func messageDate(fname string, data []byte) time.Time {
+	if msg, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		if date, err := msg.Header.Date(); err == nil {
+			return date
+		}
+	}
+	arr := strings.Split(filepath.Base(fname), ".")
+	if tstamp, err := strconv.ParseInt(arr[0], 10, 64); err == nil && tstamp > 0 {
+		return time.Unix(tstamp, 0)
+	}
+	if info, err := os.Stat(fname); err == nil {
+		return info.ModTime()
+	}
+	return time.Now()
+}
+
+// helper function to check if given message is associated with IMAP server
+func hasMessageAccount(hid, imapName string) bool {
+	accounts, err := getMessageAccounts(hid)
+	if err != nil {
+		return false
+	}
+	for _, a := range accounts {
+		if a == imapName {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to remove local mail file and its DB records
+func removeLocalMessage(imapName, folder, hid, fname string) {
+	log.Printf("### DELETE local file %s", fname)
+	if err := os.Remove(fname); err != nil {
+		log.Printf("ERROR: unable to delete %s, error %v", fname, err)
+		return
+	}
+	removeSidecar(imapName, folder, hid)
+	deleteMessage(hid)
+	deleteSyncState(hid, imapName, folder)
+	deleteMessageAccount(hid, imapName)
+	RunSummary.AddDeleted(1)
+	emitEvent("message_deleted", Event{"server": imapName, "folder": folder, "path": fname, "local": true})
+}
+
+// helper function to resolve conflict between server and local flags
+func resolveFlags(serverFlags, localFlags string) string {
+	if Config.ConflictPolicy == "local" {
+		return localFlags
+	}
+	return serverFlags
+}
+
+// helper function to merge server and local flags of the message along
+// with flags of last sync according to Config.FlagAuthority:
+// - local: server mirrors local flags unconditionally
+// - server: local maildir mirrors server flags unconditionally
+// - newest: every flag takes value of the side which changed it since last
+// sync, i.e. the newest change wins
+// - otherwise the change on one side is propagated and conflicts are
+// resolved via Config.ConflictPolicy
+// The messages without sync state are resolved via Config.ConflictPolicy.
+func reconcileFlags(serverFlags, localFlags, stateFlags string, hasState bool) string {
+	switch Config.FlagAuthority {
+	case "local":
+		return localFlags
+	case "server":
+		return serverFlags
+	}
+	if serverFlags == localFlags {
+		return serverFlags
+	}
+	if !hasState {
+		return resolveFlags(serverFlags, localFlags)
+	}
+	if serverFlags != stateFlags && localFlags == stateFlags {
+		return serverFlags
+	}
+	if localFlags != stateFlags && serverFlags == stateFlags {
+		return localFlags
+	}
+	if Config.FlagAuthority != "newest" {
+		return resolveFlags(serverFlags, localFlags)
+	}
+	var symbols []string
+	for _, s := range syncFlagsMap {
+		inServer := strings.Contains(serverFlags, s)
+		set := strings.Contains(localFlags, s)
+		if inServer != strings.Contains(stateFlags, s) {
+			set = inServer
+		}
+		if set {
+			symbols = append(symbols, s)
+		}
+	}
+	sort.Strings(symbols)
+	return strings.Join(symbols, "")
+}
+
+// helper function to perform three-way merge of given IMAP folder with local maildir,
+// it takes list of messages on IMAP server and map of local mails (hid:path)
+// and returns list of messages which should be deleted on IMAP server
+func mergeFolder(c *client.Client, imapName, folder string, remote []Message, local map[string]string, dryRun bool) []Message {
+	defer timing("mergeFolder", time.Now())
+	defer profiler("mergeFolder")()
+
+	states, err := getSyncStates(imapName, folder)
+	if err != nil {
+		log.Printf("unable to read sync state of '%s' on '%s', error: %v\n", folder, imapName, err)
+		return []Message{}
+	}
+	rmap := make(map[string]Message)
+	for _, m := range remote {
+		rmap[m.HashId] = m
+	}
+
+	// collect all hash ids known to any side
+	hids := make(map[string]bool)
+	for hid := range rmap {
+		hids[hid] = true
+	}
+	for hid := range states {
+		hids[hid] = true
+	}
+	for hid := range local {
+		hids[hid] = true
+	}
+
+	var dlist []Message
+	for hid := range hids {
+		rmsg, onServer := rmap[hid]
+		fname, onLocal := local[hid]
+		state, hasState := states[hid]
+		entry, e := findMessage(hid)
+		inDB := e == nil && entry.HashId == hid
+
+		// with common inbox local mails belong to different IMAP servers
+		if !onServer && !hasState && Config.CommonInbox {
+			if !inDB || !hasMessageAccount(hid, imapName) {
+				continue
+			}
+		}
+
+		switch {
+		case onServer && onLocal:
+			sflags := syncFlags(rmsg.Flags)
+			lflags := localSyncFlags(fname)
+			flags := reconcileFlags(sflags, lflags, state.Flags, hasState)
+			if dryRun {
+				if flags != sflags || flags != lflags {
+					log.Printf("dry-run set flags '%s' on %s", flags, rmsg.String())
+				}
+				continue
+			}
+			if flags != lflags {
+				if verboseLevel(imapName) > 0 {
+					log.Printf("set local flags '%s' on %s", flags, fname)
+				}
+				fpath, err := setLocalFlags(fname, flags)
+				if err != nil {
+					log.Printf("unable to set flags on %s, error %v", fname, err)
+					continue
+				}
+				if inDB {
+					updateMessagePath(hid, fpath)
+				}
+			}
+			if flags != sflags {
+				if verboseLevel(imapName) > 0 {
+					log.Printf("set IMAP flags '%s' on %s", flags, rmsg.String())
+				}
+				if err := setImapFlags(c, rmsg, flags); err != nil {
+					log.Printf("unable to set flags on %s, error %v", rmsg.String(), err)
+					continue
+				}
+			}
+			updateSyncState(SyncState{HashId: hid, Imap: imapName, Folder: folder, Flags: flags, Remote: true, Local: true})
+		case onServer && !onLocal:
+			if hasState && state.Local {
+				// message was deleted locally
+				if syncFlags(rmsg.Flags) != state.Flags && Config.ConflictPolicy != "local" {
+					// message was changed on server, we'll fetch it again
+					log.Printf("conflict: %s was deleted locally and changed on server, keep it", rmsg.String())
+					if !dryRun {
+						deleteMessage(hid)
+						deleteSyncState(hid, imapName, folder)
+					}
+					continue
+				}
+				dlist = append(dlist, rmsg)
+			} else if !hasState && inDB {
+				// message was fetched by goimapsync before sync state was introduced
+				dlist = append(dlist, rmsg)
+			}
+			// otherwise it is a new message on server which is handled by readImap
+		case !onServer && onLocal:
+			if hasState && state.Remote {
+				// message was deleted on server
+				if localSyncFlags(fname) != state.Flags && Config.ConflictPolicy == "local" {
+					// message was changed locally, we'll upload it again
+					log.Printf("conflict: %s was deleted on server and changed locally, keep it", fname)
+					if !dryRun {
+						deleteSyncState(hid, imapName, folder)
+					}
+					continue
+				}
+				if dryRun {
+					log.Println("dry-run delete local file", fname)
+					continue
+				}
+				// with common inbox we keep local file until every
+				// associated IMAP server deleted its copy
+				if Config.CommonInbox {
+					deleteMessageAccount(hid, imapName)
+					deleteSyncState(hid, imapName, folder)
+					if accounts, err := getMessageAccounts(hid); err == nil && len(accounts) > 0 {
+						log.Printf("keep local file %s, it still exists on %v", fname, accounts)
+						continue
+					}
+				}
+				removeLocalMessage(imapName, folder, hid, fname)
+			} else if !hasState && !inDB {
+				// new local message, make sure it is managed by goimapsync
+				if md5hash(getMessageId(fname)) != hid {
+					if verboseLevel(imapName) > 0 {
+						log.Printf("skip local file %s, it does not belong to goimapsync", fname)
+					}
+					continue
+				}
+				if Config.CommonInbox {
+					log.Printf("skip local file %s, unable to identify its IMAP server in common inbox", fname)
+					continue
+				}
+				if dryRun {
+					log.Printf("dry-run append %s to '%s' on %s", fname, folder, imapName)
+					continue
+				}
+				log.Printf("append %s to '%s' on %s", fname, folder, imapName)
+				if err := appendMessage(c, folder, fname); err != nil {
+					log.Printf("unable to append %s, error %v", fname, err)
+				} else {
+					RunSummary.AddUploaded(1)
+				}
+			} else if !hasState && verboseLevel(imapName) > 0 {
+				log.Printf("skip local file %s, it has no sync state", fname)
+			}
+		case !onServer && !onLocal:
+			// message is gone on both sides
+			if !dryRun {
+				deleteMessageAccount(hid, imapName)
+				deleteSyncState(hid, imapName, folder)
+				if accounts, err := getMessageAccounts(hid); err == nil && len(accounts) == 0 {
+					deleteMessage(hid)
+				}
+			}
+		}
+	}
+	return dlist
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+func TestReconcileFlags(t *testing.T) {
+	keepConfig(t)
+	tests := []struct {
+		authority string
+		policy    string
+		server    string
+		local     string
+		state     string
+		hasState  bool
+		expect    string
+	}{
+		// local maildir is authoritative
+		{"local", "", "FS", "R", "S", true, "R"},
+		{"local", "", "S", "", "", false, ""},
+		// IMAP server is authoritative
+		{"server", "local", "FS", "R", "S", true, "FS"},
+		{"server", "", "", "S", "", false, ""},
+		// newest change of every flag wins: server flagged and local answered
+		{"newest", "", "FS", "RS", "S", true, "FRS"},
+		// server unseen and local flagged
+		{"newest", "", "", "FS", "S", true, "F"},
+		{"newest", "", "S", "S", "", true, "S"},
+		{"newest", "local", "F", "R", "", false, "R"},
+		// three-way merge propagates change of one side
+		{"", "", "FS", "S", "S", true, "FS"},
+		{"", "", "S", "RS", "S", true, "RS"},
+		// and resolves conflicts via conflict policy
+		{"", "", "FS", "RS", "S", true, "FS"},
+		{"", "local", "FS", "RS", "S", true, "RS"},
+		{"", "", "F", "R", "", false, "F"},
+		{"", "local", "F", "R", "", false, "R"},
+	}
+	for _, tt := range tests {
+		Config.FlagAuthority, Config.ConflictPolicy = tt.authority, tt.policy
+		if got := reconcileFlags(tt.server, tt.local, tt.state, tt.hasState); got != tt.expect {
+			t.Errorf("flagAuthority %q conflictPolicy %q: reconcileFlags(%q, %q, %q, %v)=%q, expected %q", tt.authority, tt.policy, tt.server, tt.local, tt.state, tt.hasState, got, tt.expect)
+		}
+	}
+}
+
+func TestAppendMessageFlags(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	ts.mailbox(t, "Append")
+	c := ts.connect(t)
+	dir := localPath(testServerName, "Append", "cur")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		info   string // flags part of local mail file name
+		expect string // flags of appended message
+	}{
+		{"", ""},
+		{":2,", ""},
+		{":2,S", imap.SeenFlag},
+		{":2,FRS", strings.Join([]string{imap.AnsweredFlag, imap.FlaggedFlag, imap.SeenFlag}, " ")},
+		{":2,A", imap.AnsweredFlag},
+	}
+	for i, tt := range tests {
+		mid := fmt.Sprintf("<append-%d@localhost>", i)
+		fname := filepath.Join(dir, fmt.Sprintf("%d.%s.%s%s", time.Now().Unix(), md5hash(mid), hostname, tt.info))
+		if err := ioutil.WriteFile(fname, testMessage{MessageId: mid, Subject: "Append"}.body(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := appendMessage(c, "Append", fname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flags := ts.flags(t, "Append")
+	if len(flags) != len(tests) {
+		t.Fatalf("Append folder has %d message(s) after append, expected %d", len(flags), len(tests))
+	}
+	for i, tt := range tests {
+		mid := fmt.Sprintf("<append-%d@localhost>", i)
+		if got := strings.Join(flags[mid], " "); got != tt.expect {
+			t.Errorf("file with '%s' flags is appended with flags '%s', expected '%s'", tt.info, got, tt.expect)
+		}
+	}
+}
+
+func TestMergeFolder(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string // conflict policy
+		dryRun   bool
+		server   bool   // message is on IMAP server
+		sflags   string // sync flags on IMAP server
+		local    bool   // message is in local maildir
+		lflags   string // sync flags of local mail file, none places it in new area
+		state    bool   // message has sync state, i.e. it was on both sides
+		stflags  string // sync flags of the last sync
+		inDB     bool   // message is recorded in DB
+		deleted  bool   // message should be deleted on IMAP server
+		uploaded bool   // local message is appended to IMAP server
+		kept     bool   // local mail file is kept
+		lout     string // sync flags of local mail file after merge
+		sout     string // sync flags on IMAP server after merge
+		synced   bool   // sync state is kept
+		stout    string // sync flags of sync state after merge
+		dbout    bool   // DB record is kept
+	}{
+		// change on one side propagates
+		{name: "new on server", server: true, sflags: "S", sout: "S"},
+		{name: "deleted locally", server: true, sflags: "S", state: true, stflags: "S", inDB: true,
+			deleted: true, sout: "S", synced: true, stout: "S", dbout: true},
+		{name: "fetched before sync state", server: true, sflags: "S", inDB: true, deleted: true, sout: "S", dbout: true},
+		{name: "deleted on server", local: true, lflags: "S", state: true, stflags: "S", inDB: true},
+		{name: "new local file", local: true, lflags: "S", uploaded: true, kept: true, lout: "S", sout: "S"},
+		{name: "gone on both sides", state: true, stflags: "S", inDB: true},
+		{name: "flagged on server", server: true, sflags: "FS", local: true, lflags: "S", state: true, stflags: "S", inDB: true,
+			kept: true, lout: "FS", sout: "FS", synced: true, stout: "FS", dbout: true},
+		{name: "flagged locally", server: true, sflags: "S", local: true, lflags: "FS", state: true, stflags: "S", inDB: true,
+			kept: true, lout: "FS", sout: "FS", synced: true, stout: "FS", dbout: true},
+		{name: "seen on server", server: true, sflags: "S", local: true, state: true, inDB: true,
+			kept: true, lout: "S", sout: "S", synced: true, stout: "S", dbout: true},
+		// no change does nothing
+		{name: "unchanged", server: true, sflags: "S", local: true, lflags: "S", state: true, stflags: "S", inDB: true,
+			kept: true, lout: "S", sout: "S", synced: true, stout: "S", dbout: true},
+		{name: "first sync", server: true, sflags: "S", local: true, lflags: "S", inDB: true,
+			kept: true, lout: "S", sout: "S", synced: true, stout: "S", dbout: true},
+		// change on both sides goes to conflict policy
+		{name: "deleted locally and changed on server", server: true, sflags: "FS", state: true, stflags: "S", inDB: true, sout: "FS"},
+		{name: "deleted locally and changed on server, local policy", policy: "local", server: true, sflags: "FS", state: true, stflags: "S", inDB: true,
+			deleted: true, sout: "FS", synced: true, stout: "S", dbout: true},
+		{name: "deleted on server and changed locally", local: true, lflags: "FS", state: true, stflags: "S", inDB: true},
+		{name: "deleted on server and changed locally, local policy", policy: "local", local: true, lflags: "FS", state: true, stflags: "S", inDB: true,
+			kept: true, lout: "FS", dbout: true},
+		// dry run changes nothing
+		{name: "dry run", dryRun: true, local: true, lflags: "S", state: true, stflags: "S", inDB: true,
+			kept: true, lout: "S", synced: true, stout: "S", dbout: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			Config.ConflictPolicy = tt.policy
+			ts := startTestServer(t)
+			m := testMessage{MessageId: "<merge-1@localhost>", Subject: "Merge", Flags: symbolFlags(strings.Split(tt.sflags, ""))}
+			hid := md5hash(m.MessageId)
+			ts.mailbox(t, "Work")
+			if tt.server {
+				ts.add(t, "Work", m)
+			}
+			c := ts.connect(t)
+			if _, err := c.Select("Work", false); err != nil {
+				t.Fatal(err)
+			}
+			var remote []Message
+			if tt.server {
+				remote = append(remote, Message{MessageId: m.MessageId, HashId: hid, Imap: testServerName, Uid: 1, Flags: m.Flags})
+			}
+			local := make(map[string]string)
+			fname := fmt.Sprintf("%d.%s.%s", time.Now().Unix(), hid, hostname)
+			fpath := filepath.Join(localPath(testServerName, "Work", "new"), fname)
+			if tt.lflags != "" {
+				fpath = filepath.Join(localPath(testServerName, "Work", "cur"), fname+":2,"+tt.lflags)
+			}
+			if err := createLocalFolder(testServerName, "Work"); err != nil {
+				t.Fatal(err)
+			}
+			if tt.local {
+				if err := ioutil.WriteFile(fpath, m.body(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				local[hid] = fpath
+			}
+			if tt.inDB {
+				if err := insertMessage(Message{MessageId: m.MessageId, HashId: hid, Imap: testServerName, Path: fpath}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.state {
+				if err := updateSyncState(SyncState{HashId: hid, Imap: testServerName, Folder: "Work", Flags: tt.stflags, Remote: true, Local: true}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dlist := mergeFolder(c, testServerName, "Work", remote, local, tt.dryRun)
+			if deleted := len(dlist) == 1 && dlist[0].HashId == hid; deleted != tt.deleted || len(dlist) > 1 {
+				t.Errorf("message should be deleted on IMAP server %v, expected %v", deleted, tt.deleted)
+			}
+			if uploaded := RunSummary.Uploaded == 1; uploaded != tt.uploaded {
+				t.Errorf("local message is uploaded %v, expected %v", uploaded, tt.uploaded)
+			}
+			lname := findLocalMail(testServerName, "Work", hid)
+			if kept := lname != ""; kept != tt.kept {
+				t.Errorf("local mail file is kept %v, expected %v", kept, tt.kept)
+			} else if kept && localSyncFlags(lname) != tt.lout {
+				t.Errorf("local mail file %s has flags '%s', expected '%s'", lname, localSyncFlags(lname), tt.lout)
+			}
+			if flags, ok := ts.flags(t, "Work")[m.MessageId]; ok != (tt.server || tt.uploaded) {
+				t.Errorf("message is on IMAP server %v, expected %v", ok, tt.server || tt.uploaded)
+			} else if ok && syncFlags(flags) != tt.sout {
+				t.Errorf("message has flags '%s' on IMAP server, expected '%s'", syncFlags(flags), tt.sout)
+			}
+			states, err := getSyncStates(testServerName, "Work")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state, ok := states[hid]; ok != tt.synced {
+				t.Errorf("sync state is kept %v, expected %v", ok, tt.synced)
+			} else if ok && state.Flags != tt.stout {
+				t.Errorf("sync state has flags '%s', expected '%s'", state.Flags, tt.stout)
+			}
+			entry, err := findMessage(hid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inDB := entry.HashId == hid; inDB != tt.dbout {
+				t.Errorf("DB record is kept %v, expected %v", inDB, tt.dbout)
+			}
+		})
+	}
+}
+
+func TestSyncFailedRemoval(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	var hids []string
+	for i := 0; i < 2; i++ {
+		mid := fmt.Sprintf("<removal-%d@localhost>", i)
+		ts.add(t, "INBOX", testMessage{MessageId: mid, Subject: "Failed removal"})
+		hids = append(hids, md5hash(mid))
+	}
+	c := ts.connect(t)
+	cmap := map[string]*client.Client{testServerName: c}
+	Sync(cmap, false)
+	nmsg := ts.size(t, "INBOX")
+	// messages are deleted in local maildir and their removal on IMAP
+	// server fails
+	for _, hid := range hids {
+		fname := findLocalMail(testServerName, "INBOX", hid)
+		if fname == "" {
+			t.Fatalf("sync did not write message %s", hid)
+		}
+		if err := os.Remove(fname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Config.ReconnectRetries, Config.MaxDeletePercent = 0, -1
+	ts.Expunge.SetError(errors.New("expunge is not permitted"))
+	Sync(cmap, false)
+	if n := ts.size(t, "INBOX"); n != nmsg {
+		t.Errorf("INBOX has %d message(s) after failed removal, expected %d", n, nmsg)
+	}
+	states, err := getSyncStates(testServerName, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hid := range hids {
+		if _, ok := states[hid]; !ok {
+			t.Errorf("sync state of message %s is removed after failed removal", hid)
+		}
+	}
+	// next sync merges kept sync state and removes the messages
+	ts.Expunge.SetError(nil)
+	Sync(cmap, false)
+	if n := ts.size(t, "INBOX"); n != nmsg-uint32(len(hids)) {
+		t.Errorf("INBOX has %d message(s) after next sync, expected %d", n, nmsg-uint32(len(hids)))
+	}
+	for _, hid := range hids {
+		if fname := findLocalMail(testServerName, "INBOX", hid); fname != "" {
+			t.Errorf("removed message %s is fetched again into '%s'", hid, fname)
+		}
+	}
+	if states, err = getSyncStates(testServerName, "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	for _, hid := range hids {
+		if _, ok := states[hid]; ok {
+			t.Errorf("sync state of expunged message %s is kept", hid)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// migrate module for goimapsync, it keeps versioned migrations of DB schema
+//
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Migration represents single step of DB schema migration
+type Migration struct {
+	Version     int      // schema version after the migration
+	Description string   // description of the migration
+	Statements  []string // SQL statements of the migration
+}
+
+// migrations keeps ordered list of DB schema migrations, new migration
+// should be appended to the list with next version number. The first
+// migrations use IF NOT EXISTS since they are applied to DBs created
+// before schema versioning was introduced
+var migrations = []Migration{
+	{1, "create messages table", []string{
+		`CREATE TABLE IF NOT EXISTS messages (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"timestamp" int NOT NULL,
+		"hid" TEXT NOT NULL UNIQUE,
+		"mid" TEXT NOT NULL UNIQUE,
+		"path" TEXT NOT NULL,
+		"imap" TEXT NOT NULL
+	  );`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_hid ON messages (hid);`,
+	}},
+	{2, "create sync_state table", []string{
+		`CREATE TABLE IF NOT EXISTS sync_state (
+		"hid" TEXT NOT NULL,
+		"imap" TEXT NOT NULL,
+		"folder" TEXT NOT NULL,
+		"flags" TEXT NOT NULL,
+		"remote" INTEGER NOT NULL,
+		"local" INTEGER NOT NULL,
+		"timestamp" int NOT NULL,
+		PRIMARY KEY (hid, imap, folder)
+	  );`,
+	}},
+	{3, "create runs table", []string{
+		`CREATE TABLE IF NOT EXISTS runs (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"start" int NOT NULL,
+		"end" int NOT NULL,
+		"op" TEXT NOT NULL,
+		"servers" TEXT NOT NULL,
+		"folders" TEXT NOT NULL,
+		"fetched" INTEGER NOT NULL,
+		"uploaded" INTEGER NOT NULL,
+		"deleted" INTEGER NOT NULL,
+		"errors" INTEGER NOT NULL,
+		"status" TEXT NOT NULL
+	  );`,
+	}},
+	{4, "create folders table", []string{
+		`CREATE TABLE IF NOT EXISTS folders (
+		"imap" TEXT NOT NULL,
+		"folder" TEXT NOT NULL,
+		"timestamp" int NOT NULL,
+		PRIMARY KEY (imap, folder)
+	  );`,
+	}},
+	{5, "create settings table", []string{
+		`CREATE TABLE IF NOT EXISTS settings (
+		"name" TEXT NOT NULL PRIMARY KEY,
+		"value" TEXT NOT NULL
+	  );`,
+	}},
+	{6, "create message_accounts table", []string{
+		`CREATE TABLE IF NOT EXISTS message_accounts (
+		"hid" TEXT NOT NULL,
+		"imap" TEXT NOT NULL,
+		PRIMARY KEY (hid, imap)
+	  );`,
+		`INSERT OR IGNORE INTO message_accounts (hid, imap) SELECT hid, imap FROM messages;`,
+	}},
+	{7, "create presence table", []string{
+		`CREATE TABLE IF NOT EXISTS presence (
+		"timestamp" int NOT NULL,
+		"imap" TEXT NOT NULL,
+		"folder" TEXT NOT NULL,
+		"uid" INTEGER NOT NULL,
+		"hid" TEXT NOT NULL
+	  );`,
+		`CREATE INDEX IF NOT EXISTS idx_presence_hid ON presence (hid);`,
+	}},
+	{8, "add checksum columns to messages table", []string{
+		`ALTER TABLE messages ADD COLUMN "sha256" TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE messages ADD COLUMN "size" INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE messages ADD COLUMN "mtime" INTEGER NOT NULL DEFAULT 0;`,
+	}},
+	{9, "add pending column to messages table", []string{
+		`ALTER TABLE messages ADD COLUMN "pending" TEXT NOT NULL DEFAULT '';`,
+	}},
+	{10, "create pending_deletes table", []string{
+		`CREATE TABLE IF NOT EXISTS pending_deletes (
+		"imap" TEXT NOT NULL,
+		"folder" TEXT NOT NULL,
+		"uid" INTEGER NOT NULL,
+		"hid" TEXT NOT NULL,
+		"timestamp" int NOT NULL,
+		PRIMARY KEY (imap, folder, uid)
+	  );`,
+	}},
+	{11, "add threading headers to messages table", []string{
+		`ALTER TABLE messages ADD COLUMN "subject" TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE messages ADD COLUMN "sender" TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE messages ADD COLUMN "date" INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE messages ADD COLUMN "in_reply_to" TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE messages ADD COLUMN "refs" TEXT NOT NULL DEFAULT '';`,
+	}},
+	{12, "create operations table", []string{
+		`CREATE TABLE IF NOT EXISTS operations (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"imap" TEXT NOT NULL,
+		"op" TEXT NOT NULL,
+		"mid" TEXT NOT NULL,
+		"source" TEXT NOT NULL,
+		"target" TEXT NOT NULL,
+		"seen" INTEGER NOT NULL,
+		"timestamp" int NOT NULL
+	  );`,
+	}},
+	{13, "create ignored table", []string{
+		`CREATE TABLE IF NOT EXISTS ignored (
+		"imap" TEXT NOT NULL,
+		"folder" TEXT NOT NULL,
+		"uid" INTEGER NOT NULL,
+		"uidvalidity" INTEGER NOT NULL,
+		"hid" TEXT NOT NULL,
+		"mid" TEXT NOT NULL,
+		"sender" TEXT NOT NULL,
+		"subject" TEXT NOT NULL,
+		"date" INTEGER NOT NULL,
+		"rule" TEXT NOT NULL,
+		"timestamp" int NOT NULL,
+		PRIMARY KEY (imap, folder, uid)
+	  );`,
+	}},
+	{14, "create mirrored table", []string{
+		`CREATE TABLE IF NOT EXISTS mirrored (
+		"imap" TEXT NOT NULL,
+		"folder" TEXT NOT NULL,
+		"timestamp" int NOT NULL,
+		PRIMARY KEY (imap, folder)
+	  );`,
+	}},
+	{15, "add uidvalidity column to mirrored table", []string{
+		`ALTER TABLE mirrored ADD COLUMN "uidvalidity" INTEGER NOT NULL DEFAULT 0;`,
+	}},
+	{16, "add sample column to mirrored table", []string{
+		`ALTER TABLE mirrored ADD COLUMN "sample" TEXT NOT NULL DEFAULT '';`,
+	}},
+	{17, "create folder_state table", []string{
+		`CREATE TABLE IF NOT EXISTS folder_state (
+		"imap" TEXT NOT NULL,
+		"folder" TEXT NOT NULL,
+		"messages" INTEGER NOT NULL,
+		"uidnext" INTEGER NOT NULL,
+		"uidvalidity" INTEGER NOT NULL,
+		"unseen" INTEGER NOT NULL,
+		"rules" TEXT NOT NULL,
+		"timestamp" int NOT NULL,
+		PRIMARY KEY (imap, folder)
+	  );`,
+	}},
+	{18, "create envelopes table", []string{
+		`CREATE TABLE IF NOT EXISTS envelopes (
+		"imap" TEXT NOT NULL,
+		"folder" TEXT NOT NULL,
+		"uid" INTEGER NOT NULL,
+		"uidvalidity" INTEGER NOT NULL,
+		"hid" TEXT NOT NULL,
+		"mid" TEXT NOT NULL,
+		"sender" TEXT NOT NULL,
+		"subject" TEXT NOT NULL,
+		"date" INTEGER NOT NULL,
+		"flags" TEXT NOT NULL,
+		"body_pending" INTEGER NOT NULL,
+		"timestamp" int NOT NULL,
+		PRIMARY KEY (imap, folder, uid)
+	  );`,
+		`CREATE INDEX IF NOT EXISTS idx_envelopes_hid ON envelopes (hid);`,
+	}},
+	{19, "create failed_messages table", []string{
+		`CREATE TABLE IF NOT EXISTS failed_messages (
+		"imap" TEXT NOT NULL,
+		"folder" TEXT NOT NULL,
+		"uid" INTEGER NOT NULL,
+		"uidvalidity" INTEGER NOT NULL,
+		"hid" TEXT NOT NULL,
+		"mid" TEXT NOT NULL,
+		"error" TEXT NOT NULL,
+		"attempts" INTEGER NOT NULL,
+		"timestamp" int NOT NULL,
+		PRIMARY KEY (imap, folder, uid)
+	  );`,
+	}},
+}
+
+// helper function to return latest schema version supported by goimapsync
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// helper function to get schema version of given DB, DB without
+// schema_version table has version 0
+func schemaVersion(db *sql.DB) (int, error) {
+	var count int
+	stmt := "SELECT count(*) FROM sqlite_master WHERE type='table' AND name='schema_version'"
+	if err := db.QueryRow(stmt).Scan(&count); err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// helper function to return migrations pending for given schema version
+func pendingMigrations(version int) []Migration {
+	var out []Migration
+	for _, m := range migrations {
+		if m.Version > version {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// helper function to make backup copy of DB file before migration, the
+// copy is snapshot of given DB such that it includes changes kept in WAL
+func backupDB(db *sql.DB, fname string, version int) error {
+	bname := fmt.Sprintf("%s.v%d.%d.bak", fname, version, time.Now().Unix())
+	log.Printf("backup DB %s to %s", fname, bname)
+	return snapshotDB(db, bname)
+}
+
+// helper function to apply pending migrations to given DB, every migration
+// is applied within its own transaction along with schema version update
+func migrateDB(db *sql.DB, version int) error {
+	for _, m := range pendingMigrations(version) {
+		log.Printf("migrate DB to version %d: %s", m.Version, m.Description)
+		err := withBusyRetry(func() error {
+			tx, err := db.Begin()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			stmt := `CREATE TABLE IF NOT EXISTS schema_version (
+				"version" INTEGER NOT NULL,
+				"timestamp" int NOT NULL
+			  );`
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+			for _, stmt := range m.Statements {
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			stmt = "INSERT INTO schema_version (version, timestamp) VALUES (?,?)"
+			if _, err := tx.Exec(stmt, m.Version, time.Now().Unix()); err != nil {
+				return err
+			}
+			return tx.Commit()
+		})
+		if err != nil {
+			return fmt.Errorf("unable to migrate DB to version %d: %w", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// MigrateDB reports schema version of the DB and pending migrations, the
+// migrations themselves are applied by InitDB when DB is opened for writing
+func MigrateDB(dryRun bool) error {
+	version, err := schemaVersion(mdb)
+	if err != nil {
+		return err
+	}
+	pending := pendingMigrations(version)
+	if len(pending) == 0 {
+		fmt.Printf("DB schema is at version %d, no pending migrations\n", version)
+		return nil
+	}
+	if !dryRun {
+		return fmt.Errorf("DB schema is at version %d, but %d migration(s) are still pending", version, len(pending))
+	}
+	fmt.Printf("DB schema is at version %d, pending migrations:\n", version)
+	for _, m := range pending {
+		fmt.Printf("   %d: %s\n", m.Version, m.Description)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// helper function to create DB file of given schema version, DB of version
+// 0 has messages table created before schema versioning was introduced
+func schemaTestDB(t *testing.T, fname string, version int) {
+	t.Helper()
+	if err := os.Remove(fname); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if version == 0 {
+		for _, stmt := range migrations[0].Statements {
+			if _, err := db.Exec(stmt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	} else {
+		all := migrations
+		migrations = migrations[:version]
+		err := migrateDB(db, 0)
+		migrations = all
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stmt := "INSERT INTO messages (timestamp, hid, mid, path, imap) VALUES (?,?,?,?,?)"
+	if _, err := db.Exec(stmt, 1700000000, md5hash("<schema@localhost>"), "<schema@localhost>", "/mail/a/INBOX/cur/1", "a"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// helper function to describe tables and their columns of given DB
+func schemaTables(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	var out []string
+	for _, table := range tables {
+		var cols []string
+		rows, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			cols = append(cols, name)
+		}
+		rows.Close()
+		sort.Strings(cols)
+		out = append(out, fmt.Sprintf("%s(%s)", table, strings.Join(cols, ",")))
+	}
+	return strings.Join(out, "\n")
+}
+
+func TestPendingMigrations(t *testing.T) {
+	latest := latestSchemaVersion()
+	tests := []struct {
+		version int
+		first   int // version of the first pending migration
+		count   int
+	}{
+		{0, 1, latest},
+		{1, 2, latest - 1},
+		{latest - 1, latest, 1},
+		{latest, 0, 0},
+		{latest + 1, 0, 0},
+	}
+	for _, tt := range tests {
+		pending := pendingMigrations(tt.version)
+		if len(pending) != tt.count || (len(pending) > 0 && pending[0].Version != tt.first) {
+			t.Errorf("version %d has %d pending migration(s), expected %d starting with %d", tt.version, len(pending), tt.count, tt.first)
+		}
+	}
+	// migrations are ordered by their consecutive versions
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %q has version %d, expected %d", m.Description, m.Version, i+1)
+		}
+	}
+}
+
+func TestInitDBMigrations(t *testing.T) {
+	setupTest(t)
+	fresh := schemaTables(t, mdb)
+	latest := latestSchemaVersion()
+	for version := 0; version <= latest; version++ {
+		t.Run(fmt.Sprintf("version %d", version), func(t *testing.T) {
+			setupTest(t)
+			mdb.Close()
+			_, fname, err := parseDBUri(Config.DBUri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			schemaTestDB(t, fname, version)
+			if mdb, err = InitDB(false); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := schemaVersion(mdb); err != nil || v != latest {
+				t.Errorf("DB is migrated to version %d, expected %d, error: %v", v, latest, err)
+			}
+			// migrated DB has the same schema as new one
+			if got := schemaTables(t, mdb); got != fresh {
+				t.Errorf("migrated DB has schema\n%s\nexpected\n%s", got, fresh)
+			}
+			// messages of previous version are kept
+			hid := md5hash("<schema@localhost>")
+			if entry, err := findMessage(hid); err != nil || entry.HashId != hid || entry.Path != "/mail/a/INBOX/cur/1" {
+				t.Errorf("message of version %d is %+v after migration, error: %v", version, entry, err)
+			}
+			// DB is backed up before migration
+			backups, _ := filepath.Glob(fmt.Sprintf("%s.v%d.*.bak", fname, version))
+			if expect := version < latest; (len(backups) == 1) != expect {
+				t.Errorf("DB of version %d has backups %v, expected backup %v", version, backups, expect)
+			}
+			// the backup is snapshot of DB before migration
+			for _, bname := range backups {
+				db, err := sql.Open("sqlite3", bname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var count int
+				err = db.QueryRow("SELECT COUNT(*) FROM messages WHERE hid=?", hid).Scan(&count)
+				v, verr := schemaVersion(db)
+				db.Close()
+				if err != nil || count != 1 || verr != nil || v != version {
+					t.Errorf("backup %s has %d message(s) and version %d, error: %v %v", bname, count, v, err, verr)
+				}
+			}
+		})
+	}
+}
+
+func TestInitDBNewerVersion(t *testing.T) {
+	setupTest(t)
+	latest := latestSchemaVersion()
+	if _, err := mdb.Exec("INSERT INTO schema_version (version, timestamp) VALUES (?,?)", latest+1, 1700000000); err != nil {
+		t.Fatal(err)
+	}
+	mdb.Close()
+	for _, readOnly := range []bool{false, true} {
+		db, err := InitDB(readOnly)
+		if err == nil {
+			db.Close()
+			t.Errorf("DB of newer version is opened with read-only %v", readOnly)
+		} else if !strings.Contains(err.Error(), fmt.Sprintf("schema version %d which is newer than supported version %d", latest+1, latest)) {
+			t.Errorf("DB of newer version fails with error: %v", err)
+		}
+	}
+}
+
+func TestMigrateDB(t *testing.T) {
+	setupTest(t)
+	if err := MigrateDB(false); err != nil {
+		t.Errorf("DB of latest version has pending migrations, error: %v", err)
+	}
+	mdb.Close()
+	_, fname, err := parseDBUri(Config.DBUri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// read-only DB of previous version is not migrated
+	schemaTestDB(t, fname, latestSchemaVersion()-1)
+	if mdb, err = InitDB(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateDB(true); err != nil {
+		t.Errorf("dry-run of pending migrations fails: %v", err)
+	}
+	if err := MigrateDB(false); err == nil || !strings.Contains(err.Error(), "1 migration(s) are still pending") {
+		t.Errorf("pending migrations are reported with error: %v", err)
+	}
+}
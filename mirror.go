@@ -0,0 +1,381 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// mirror module for goimapsync, it fetches all folders of IMAP server, e.g.
+//    goimapsync fetch -all-folders -server=newwork
+// The first run lists selectable folders of the server, creates local
+// maildir folders for them and fetches them. The mirrored folders are
+// recorded in DB and the subsequent runs fetch the recorded folders, the
+// remote folders created since the last run are added to the mirror only
+// with autoAddFolders config option. Folders matching excludeFolders server
+// option are skipped, and \Noselect folders have no local maildir folder
+// since names of their children already carry the hierarchy, e.g.
+// Projects/2024 is kept as Projects.2024 local folder.
+// The mirrored folders which vanished from the server are handled according
+// to vanishedFolders config option: warn (default) only reports them, attic
+// moves their local folders into Deleted-Folders directory of the maildir
+// and delete removes them, in both cases their DB records are dropped and
+// paths of their messages are updated or removed. The vanished folder is
+// treated as renamed one if single new folder of the server has the same
+// UIDVALIDITY and its messages match sample of UIDs and message ids of the
+// vanished folder recorded by the last fetch, then its local folder is
+// moved to local folder of new name and its DB records follow the rename,
+// i.e. its messages are not fetched again. All vanished folders are listed
+// in the run summary.
+//
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// helper function to check if given folder matches excludeFolders patterns
+// of given IMAP server, patterns are case-insensitive shell globs which may
+// be given in modified UTF-7
+func isExcludedFolder(imapName, folder string) bool {
+	for _, s := range Config.Servers {
+		if s.Name != imapName {
+			continue
+		}
+		for _, pat := range s.ExcludeFolders {
+			if ok, err := path.Match(strings.ToLower(decodeFolderName(pat)), strings.ToLower(folder)); err == nil && ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// helper function to check if given folder can't be selected, i.e. it only
+// holds other folders
+func isNoselect(info *imap.MailboxInfo) bool {
+	for _, attr := range info.Attributes {
+		if strings.EqualFold(attr, imap.NoSelectAttr) || strings.EqualFold(attr, "\\NonExistent") {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to return folders of given IMAP server to mirror, it
+// lists folders of the server, refreshes folders cache, records folders
+// added to the mirror and creates their local maildir folders
+func mirrorFolders(c *client.Client, imapName string) ([]MirroredFolder, error) {
+	var out []MirroredFolder
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(Config.ListTimeout)*time.Second)
+	mailboxes, err := listFolders(ctx, c, imapName)
+	cancel()
+	if err != nil {
+		return out, err
+	}
+	var folders []string
+	for _, m := range mailboxes {
+		folders = append(folders, m.Name)
+	}
+	imapFolders[imapName] = folders
+	if err := saveCachedFolders(imapName, folders); err != nil {
+		log.Printf("unable to cache folders of %s, error: %v\n", imapName, err)
+	}
+	records, err := getMirrored(imapName)
+	if err != nil {
+		return out, err
+	}
+	if records, err = pruneVanished(c, imapName, mailboxes, records); err != nil {
+		return out, err
+	}
+	mirrored := make(map[string]MirroredFolder)
+	for _, m := range records {
+		mirrored[m.Folder] = m
+	}
+	// on the first run all folders are added to the mirror
+	first := len(records) == 0
+	for _, m := range mailboxes {
+		folder := m.Name
+		if isNoselect(m) {
+			continue
+		}
+		if isExcludedFolder(imapName, folder) {
+			if verboseLevel(imapName) > 0 {
+				log.Printf("skip excluded folder '%s' on %s\n", folder, imapName)
+			}
+			continue
+		}
+		record, ok := mirrored[folder]
+		if !ok {
+			if !first && !Config.AutoAddFolders {
+				log.Printf("skip new folder '%s' on %s, use autoAddFolders option to mirror it\n", folder, imapName)
+				continue
+			}
+			record = MirroredFolder{Folder: folder}
+			if err := insertMirrored(imapName, record); err != nil {
+				return out, err
+			}
+			log.Printf("mirror folder '%s' of %s into %s\n", folder, imapName, localPath(imapName, folder, ""))
+		}
+		if err := createLocalFolder(imapName, folder); err != nil {
+			return out, err
+		}
+		out = append(out, record)
+	}
+	return out, nil
+}
+
+// helper function to fetch mirrored folders of given IMAP servers
+func mirrorFetch(cmap map[string]*client.Client, newMessages bool, filter FlagFilter) {
+	for name, c := range cmap {
+		total, err := MirrorFetch(c, name, newMessages, filter)
+		if err != nil {
+			log.Println(err)
+		}
+		log.Printf("processed %d message(s) of all folders on %s\n", total, name)
+	}
+}
+
+// MirrorFetch fetches all mirrored folders of given IMAP server, see
+// mirrorFolders, it returns number of processed messages
+func MirrorFetch(c *client.Client, imapName string, newMessages bool, filter FlagFilter) (int, error) {
+	defer timing("MirrorFetch", time.Now())
+	defer profiler("MirrorFetch")()
+	records, err := mirrorFolders(c, imapName)
+	if err != nil {
+		return 0, fmt.Errorf("unable to mirror folders of %s: %w", imapName, err)
+	}
+	total := 0
+	for _, m := range records {
+		if interrupted() {
+			return total, errInterrupted
+		}
+		msgs, err := Fetch(currentClient(imapName, c), imapName, m.Folder, newMessages, filter)
+		if err != nil {
+			log.Println(err)
+		}
+		log.Printf("processed %d message(s) of '%s' on %s\n", len(msgs), m.Folder, imapName)
+		total += len(msgs)
+		// UIDVALIDITY and sample of messages of the folder are used to
+		// detect its rename, the previous sample is kept if no messages
+		// are fetched from the folder with the same UIDVALIDITY
+		validity := folderUidValidity(imapName, m.Folder)
+		if validity == 0 {
+			continue
+		}
+		if validity != m.UidValidity || len(msgs) > 0 {
+			m.Sample = folderSample(msgs)
+		}
+		m.UidValidity = validity
+		if err := insertMirrored(imapName, m); err != nil {
+			log.Printf("unable to record UIDVALIDITY of '%s' on %s, error: %v\n", m.Folder, imapName, err)
+		}
+	}
+	return total, nil
+}
+
+// number of messages in sample of mirrored folder
+const sampleSize = 8
+
+// helper function to pick sample of message ids of given messages by their
+// UIDs, the messages are picked evenly across the folder
+func folderSample(msgs []Message) map[uint32]string {
+	sample := make(map[uint32]string)
+	step := (len(msgs) + sampleSize - 1) / sampleSize
+	for i := 0; i < len(msgs); i += step {
+		if msgs[i].Uid != 0 && msgs[i].MessageId != "" {
+			sample[msgs[i].Uid] = msgs[i].MessageId
+		}
+	}
+	return sample
+}
+
+// name of directory of local folders whose mirrored folders vanished
+const atticDir = "Deleted-Folders"
+
+// helper function to handle mirrored folders of given IMAP server absent in
+// given list of its folders, see Config.VanishedFolders, it returns records
+// of mirrored folders which are kept
+func pruneVanished(c *client.Client, imapName string, mailboxes []*imap.MailboxInfo, records []MirroredFolder) ([]MirroredFolder, error) {
+	remote := make(map[string]bool)
+	for _, m := range mailboxes {
+		remote[m.Name] = true
+	}
+	mirrored := make(map[string]bool)
+	for _, m := range records {
+		mirrored[m.Folder] = true
+	}
+	var out []MirroredFolder
+	validities := make(map[string]uint32)
+	for _, m := range records {
+		if remote[m.Folder] {
+			out = append(out, m)
+			continue
+		}
+		if renamed := renamedFolder(c, imapName, m, mailboxes, mirrored, validities); renamed != "" {
+			if err := renameLocalFolder(imapName, m.Folder, renamed); err != nil {
+				RunSummary.AddVanished(imapName, m.Folder, fmt.Sprintf("renamed to '%s', unable to move its local folder: %v", renamed, err))
+				out = append(out, m)
+				continue
+			}
+			RunSummary.AddVanished(imapName, m.Folder, fmt.Sprintf("renamed to '%s', local folder is moved to %s", renamed, localPath(imapName, renamed, "")))
+			mirrored[renamed] = true
+			m.Folder = renamed
+			out = append(out, m)
+			continue
+		}
+		lpath := localPath(imapName, m.Folder, "")
+		switch Config.VanishedFolders {
+		case "attic":
+			target, err := atticPath(imapName, m.Folder)
+			if err == nil {
+				err = moveLocalFolder(imapName, m.Folder, "", lpath, target)
+			}
+			if err != nil {
+				return out, err
+			}
+			RunSummary.AddVanished(imapName, m.Folder, fmt.Sprintf("local folder is moved to %s", target))
+		case "delete":
+			if err := updateFolderRecords(imapName, m.Folder, "", lpath, ""); err != nil {
+				return out, err
+			}
+			if err := os.RemoveAll(lpath); err != nil {
+				return out, err
+			}
+			RunSummary.AddVanished(imapName, m.Folder, fmt.Sprintf("local folder %s is deleted", lpath))
+		default:
+			RunSummary.AddVanished(imapName, m.Folder, fmt.Sprintf("local folder %s is kept, use vanishedFolders option to move it to attic or delete it", lpath))
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+// helper function to find single new folder of IMAP server which given
+// vanished folder was renamed to, i.e. the folder with the same UIDVALIDITY
+// whose messages match the sample of vanished folder. The UIDVALIDITY of new
+// folders is kept in given map. It returns empty name and logs the reason if
+// rename can't be inferred
+func renamedFolder(c *client.Client, imapName string, m MirroredFolder, mailboxes []*imap.MailboxInfo, mirrored map[string]bool, validities map[string]uint32) string {
+	if m.UidValidity == 0 || len(m.Sample) == 0 {
+		log.Printf("no rename of vanished folder '%s' on %s is inferred, it has no recorded UIDVALIDITY or sample of messages\n", m.Folder, imapName)
+		return ""
+	}
+	var candidates, renamed []string
+	for _, mbox := range mailboxes {
+		name := mbox.Name
+		if mirrored[name] || isNoselect(mbox) || isExcludedFolder(imapName, name) {
+			continue
+		}
+		validity, ok := validities[name]
+		if !ok {
+			status, err := c.Status(name, []imap.StatusItem{imap.StatusUidValidity})
+			if err != nil {
+				log.Printf("unable to get status of '%s' on %s, error: %v\n", name, imapName, err)
+				continue
+			}
+			validity = status.UidValidity
+			validities[name] = validity
+		}
+		if validity != m.UidValidity {
+			continue
+		}
+		candidates = append(candidates, name)
+		if matchSample(c, imapName, name, m.Sample) {
+			renamed = append(renamed, name)
+		}
+	}
+	switch {
+	case len(candidates) == 0:
+		log.Printf("no rename of vanished folder '%s' on %s is inferred, no new folder has its UIDVALIDITY %d\n", m.Folder, imapName, m.UidValidity)
+	case len(renamed) == 0:
+		log.Printf("no rename of vanished folder '%s' on %s is inferred, messages of new folder(s) %v with its UIDVALIDITY do not match its sample\n", m.Folder, imapName, candidates)
+	case len(renamed) > 1:
+		log.Printf("no rename of vanished folder '%s' on %s is inferred, messages of several new folders %v match its sample\n", m.Folder, imapName, renamed)
+	default:
+		return renamed[0]
+	}
+	return ""
+}
+
+// helper function to check if messages of given IMAP folder match given
+// sample of message ids by UIDs, i.e. no UID of the sample refers to another
+// message and at least half of the sample is found in the folder
+func matchSample(c *client.Client, imapName, folder string, sample map[uint32]string) bool {
+	var uids []uint32
+	for uid := range sample {
+		uids = append(uids, uid)
+	}
+	found := make(map[uint32]string)
+	if _, err := c.Select(folder, true); err != nil {
+		log.Printf("unable to select '%s' on %s, error: %v\n", folder, imapName, err)
+		return false
+	}
+	messages := make(chan *imap.Message, fetchChannelSize)
+	done := fetchMessages(c, uidSet(uids), []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}, messages, true)
+	for msg := range messages {
+		if msg != nil && msg.Envelope != nil {
+			found[msg.Uid] = msg.Envelope.MessageId
+		}
+	}
+	if err := <-done; err != nil {
+		log.Printf("unable to fetch sample of '%s' on %s, error: %v\n", folder, imapName, err)
+		return false
+	}
+	matched := 0
+	for uid, mid := range found {
+		if sample[uid] != mid {
+			return false
+		}
+		matched += 1
+	}
+	return matched > 0 && 2*matched >= len(sample)
+}
+
+// helper function to return attic path of local folder of given vanished
+// folder, the time suffix is added if the path is already taken
+func atticPath(imapName, folder string) (string, error) {
+	target := filepath.Join(Config.Maildir, atticDir, localFolder(imapName, folder))
+	if _, err := os.Stat(target); err == nil {
+		target = fmt.Sprintf("%s.%d", target, time.Now().Unix())
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	return target, nil
+}
+
+// helper function to move local folder of renamed IMAP folder to local
+// folder of its new name, the existing local folder is never overwritten
+func renameLocalFolder(imapName, folder, renamed string) error {
+	target := localPath(imapName, renamed, "")
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("local folder %s already exists", target)
+	}
+	return moveLocalFolder(imapName, folder, renamed, localPath(imapName, folder, ""), target)
+}
+
+// helper function to move local folder of given IMAP folder to target path,
+// the paths of its messages are updated and other DB records of the folder
+// are moved to renamed folder if it is set or dropped otherwise
+func moveLocalFolder(imapName, folder, renamed, lpath, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	if _, err := os.Stat(lpath); err == nil {
+		if err := os.Rename(lpath, target); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := updateFolderRecords(imapName, folder, renamed, lpath, target); err != nil {
+		// keep local folder and its DB records consistent
+		os.Rename(target, lpath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// helper function to fetch all folders of test server and verify that
+// exactly given folders are mirrored and have local maildir folders
+func verifyMirror(c *client.Client, folders []string) error {
+	if _, err := MirrorFetch(currentClient(testServerName, c), testServerName, false, FlagFilter{}); err != nil {
+		return err
+	}
+	records, err := getMirrored(testServerName)
+	if err != nil {
+		return err
+	}
+	var mirrored []string
+	for _, m := range records {
+		mirrored = append(mirrored, m.Folder)
+	}
+	if strings.Join(mirrored, ",") != strings.Join(folders, ",") {
+		return fmt.Errorf("mirrored folders are %v instead of %v", mirrored, folders)
+	}
+	for _, folder := range folders {
+		if _, err := os.Stat(localPath(testServerName, folder, "cur")); err != nil {
+			return fmt.Errorf("mirrored folder '%s' has no local maildir folder: %w", folder, err)
+		}
+	}
+	return nil
+}
+
+func TestIsExcludedFolder(t *testing.T) {
+	keepConfig(t)
+	Config = Configuration{Servers: []Server{{Name: "a", ExcludeFolders: []string{"Spam", "archive/*", "Entw&APw-rfe"}}, {Name: "b"}}}
+	tests := []struct {
+		imap, folder string
+		expect       bool
+	}{
+		{"a", "Spam", true},
+		{"a", "SPAM", true},
+		{"a", "Archive/2024", true},
+		{"a", "Archive", false},
+		{"a", "Entwürfe", true},
+		{"a", "INBOX", false},
+		{"b", "Spam", false},
+		{"c", "Spam", false},
+	}
+	for _, tt := range tests {
+		if got := isExcludedFolder(tt.imap, tt.folder); got != tt.expect {
+			t.Errorf("isExcludedFolder(%s, %s)=%v, expected %v", tt.imap, tt.folder, got, tt.expect)
+		}
+	}
+}
+
+func TestIsNoselect(t *testing.T) {
+	tests := []struct {
+		attrs  []string
+		expect bool
+	}{
+		{nil, false},
+		{[]string{imap.NoInferiorsAttr}, false},
+		{[]string{imap.NoSelectAttr}, true},
+		{[]string{"\\noselect"}, true},
+		{[]string{"\\HasChildren", "\\NonExistent"}, true},
+	}
+	for _, tt := range tests {
+		if got := isNoselect(&imap.MailboxInfo{Attributes: tt.attrs}); got != tt.expect {
+			t.Errorf("isNoselect(%v)=%v, expected %v", tt.attrs, got, tt.expect)
+		}
+	}
+}
+
+func TestFolderSample(t *testing.T) {
+	var msgs []Message
+	for i := 1; i <= 20; i++ {
+		msgs = append(msgs, Message{Uid: uint32(i), MessageId: fmt.Sprintf("<%d@localhost>", i)})
+	}
+	tests := []struct {
+		msgs   []Message
+		expect []uint32
+	}{
+		{nil, nil},
+		{msgs[:3], []uint32{1, 2, 3}},
+		{msgs, []uint32{1, 4, 7, 10, 13, 16, 19}},
+		{[]Message{{Uid: 1}, {Uid: 0, MessageId: "<x@localhost>"}, {Uid: 3, MessageId: "<3@localhost>"}}, []uint32{3}},
+	}
+	for _, tt := range tests {
+		sample := folderSample(tt.msgs)
+		if len(sample) != len(tt.expect) {
+			t.Errorf("sample of %d message(s) is %v, expected UIDs %v", len(tt.msgs), sample, tt.expect)
+			continue
+		}
+		for _, uid := range tt.expect {
+			if sample[uid] != fmt.Sprintf("<%d@localhost>", uid) {
+				t.Errorf("sample of %d message(s) is %v, expected UIDs %v", len(tt.msgs), sample, tt.expect)
+			}
+		}
+	}
+}
+
+func TestMirrorFetch(t *testing.T) {
+	tests := []struct {
+		name     string
+		autoAdd  bool
+		exclude  []string
+		first    []string // folders mirrored by the first run
+		expect   []string // folders mirrored once New folder is created
+		newFiles int      // local mail files of New folder
+	}{
+		{"skip new folder", false, nil, []string{"Archive", "INBOX", "Raw"}, []string{"Archive", "INBOX", "Raw"}, 0},
+		{"auto add folders", true, nil, []string{"Archive", "INBOX", "Raw"}, []string{"Archive", "INBOX", "New", "Raw"}, 1},
+		{"excluded folders", true, []string{"raw", "n*"}, []string{"Archive", "INBOX"}, []string{"Archive", "INBOX"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			ts.Server.ExcludeFolders = tt.exclude
+			ts.mailbox(t, "Archive")
+			ts.add(t, "Raw", testMessage{MessageId: "<mirror-raw@localhost>", Subject: "Mirror"})
+			c := ts.connect(t)
+			// fetch of all folders mirrors every folder except excluded
+			// ones, the folder created afterwards is mirrored only with
+			// autoAddFolders
+			if err := verifyMirror(c, tt.first); err != nil {
+				t.Fatal(err)
+			}
+			ts.add(t, "New", testMessage{MessageId: "<mirror-new@localhost>", Subject: "Mirror"})
+			Config.AutoAddFolders = tt.autoAdd
+			if err := verifyMirror(c, tt.expect); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(readMaildir(testServerName, "New")); n != tt.newFiles {
+				t.Errorf("New folder has %d local mail file(s), expected %d", n, tt.newFiles)
+			}
+			if _, err := os.Stat(localPath(testServerName, "Raw", "cur")); len(tt.exclude) > 0 && !os.IsNotExist(err) {
+				t.Errorf("excluded folder has local maildir folder, error: %v", err)
+			}
+		})
+	}
+}
+
+func TestPruneVanished(t *testing.T) {
+	tests := []struct {
+		action   string
+		mirrored []string // folders mirrored once New folder vanished
+		kept     bool     // local folder of New folder is kept
+		attic    bool     // local folder of New folder is moved to attic
+	}{
+		{"", []string{"INBOX", "New"}, true, false},
+		{"warn", []string{"INBOX", "New"}, true, false},
+		{"attic", []string{"INBOX"}, false, true},
+		{"delete", []string{"INBOX"}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("action %q", tt.action), func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			m := testMessage{MessageId: "<vanished-1@localhost>", Subject: "Message of vanished folder"}
+			ts.add(t, "New", m)
+			c := ts.connect(t)
+			if err := verifyMirror(c, []string{"INBOX", "New"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := ts.User.DeleteMailbox("New"); err != nil {
+				t.Fatal(err)
+			}
+			// vanished folder is never lost silently
+			Config.VanishedFolders = tt.action
+			if err := verifyMirror(c, tt.mirrored); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(RunSummary.Vanished); n != 1 || !strings.Contains(RunSummary.Vanished[0], "'New' on "+testServerName) {
+				t.Errorf("run summary lists vanished folders %v", RunSummary.Vanished)
+			}
+			if _, err := os.Stat(localPath(testServerName, "New", "")); (err == nil) != tt.kept {
+				t.Errorf("local folder of vanished folder is kept %v, expected %v", err == nil, tt.kept)
+			}
+			attic := filepath.Join(Config.Maildir, atticDir, localFolder(testServerName, "New"))
+			if _, err := os.Stat(attic); (err == nil) != tt.attic {
+				t.Errorf("local folder of vanished folder is in attic %v, expected %v", err == nil, tt.attic)
+			}
+			// DB records follow the local folder, i.e. db-check stays clean
+			entry, err := findMessage(md5hash(m.MessageId))
+			switch {
+			case tt.kept && (err != nil || !strings.HasPrefix(entry.Path, localPath(testServerName, "New", "")+"/")):
+				t.Errorf("DB path %s, error %v, expected path in kept local folder", entry.Path, err)
+			case tt.attic && (err != nil || !strings.HasPrefix(entry.Path, attic+"/")):
+				t.Errorf("DB path %s, error %v, expected path in attic %s", entry.Path, err, attic)
+			case !tt.kept && !tt.attic && err == nil && entry.HashId != "":
+				t.Errorf("DB record %s of deleted local folder is kept", entry.Path)
+			}
+			check, err := CheckDB()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := check.Count(); n > 0 {
+				t.Errorf("DB check reports %d inconsistencies: %+v", n, check)
+			}
+			if err := VerifyLocal(nil, true, false); err != nil {
+				t.Errorf("verify-local after %q action: %v", tt.action, err)
+			}
+		})
+	}
+}
+
+func TestAtticPath(t *testing.T) {
+	setupTest(t)
+	attic := filepath.Join(Config.Maildir, atticDir, localFolder(testServerName, "New"))
+	target, err := atticPath(testServerName, "New")
+	if err != nil || target != attic {
+		t.Errorf("attic path %s, error %v, expected %s", target, err, attic)
+	}
+	// the path already taken by previously vanished folder gets time suffix
+	if err := os.MkdirAll(attic, 0755); err != nil {
+		t.Fatal(err)
+	}
+	target, err = atticPath(testServerName, "New")
+	if err != nil || !strings.HasPrefix(target, attic+".") {
+		t.Errorf("attic path %s, error %v, expected %s with time suffix", target, err, attic)
+	}
+}
+
+func TestFollowRename(t *testing.T) {
+	reports := testMessage{MessageId: "<renamed-1@localhost>", Subject: "Message of renamed folder"}
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, ts *testServer)
+		mirrored []string // folders mirrored after the change
+		renamed  string   // local folder of messages of Reports folder
+		action   string   // action of Reports folder in run summary
+	}{
+		{"rename", func(t *testing.T, ts *testServer) {
+			if err := ts.User.RenameMailbox("Reports", "Reports-2024"); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"INBOX", "Reports-2024"}, "Reports-2024", "renamed to 'Reports-2024'"},
+		{"ambiguous", func(t *testing.T, ts *testServer) {
+			// both new folders have the same UIDVALIDITY and messages
+			ts.add(t, "Copy", reports)
+			if err := ts.User.RenameMailbox("Reports", "Reports-2024"); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"Copy", "INBOX", "Reports", "Reports-2024"}, "Reports", "local folder"},
+		{"sample mismatch", func(t *testing.T, ts *testServer) {
+			if err := ts.User.DeleteMailbox("Reports"); err != nil {
+				t.Fatal(err)
+			}
+			ts.add(t, "Other", testMessage{MessageId: "<other-1@localhost>", Subject: "Other message"})
+		}, []string{"INBOX", "Other", "Reports"}, "Reports", "local folder"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			ts.add(t, "Reports", reports)
+			c := ts.connect(t)
+			if err := verifyMirror(c, []string{"INBOX", "Reports"}); err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(t, ts)
+			Config.AutoAddFolders = true
+			fetched := RunSummary.Fetched
+			if err := verifyMirror(c, tt.mirrored); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(RunSummary.Vanished); n != 1 || !strings.Contains(RunSummary.Vanished[0], tt.action) {
+				t.Errorf("run summary lists vanished folders %v, expected one with %q", RunSummary.Vanished, tt.action)
+			}
+			entry, err := findMessage(md5hash(reports.MessageId))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lpath := localPath(testServerName, tt.renamed, ""); !strings.HasPrefix(entry.Path, lpath+"/") {
+				t.Errorf("DB path %s of message of Reports folder is not in %s", entry.Path, lpath)
+			}
+			if tt.renamed != "Reports" {
+				// local folder follows the rename and its messages are not
+				// fetched again
+				if _, err := os.Stat(localPath(testServerName, "Reports", "")); !os.IsNotExist(err) {
+					t.Errorf("local folder of renamed folder is not moved")
+				}
+				if n := RunSummary.Fetched - fetched; n != 0 {
+					t.Errorf("%d message(s) of renamed folder are fetched again", n)
+				}
+			}
+			if err := VerifyLocal(nil, true, false); err != nil {
+				t.Errorf("verify-local after %s: %v", tt.name, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// namespace module for goimapsync, it queries personal namespace of IMAP
+// servers, see https://tools.ietf.org/html/rfc2342, e.g. Dovecot servers
+// often keep all folders under INBOX. prefix, and the prefix is used to
+// resolve user-friendly folder names, e.g. Archive -> INBOX.Archive
+//
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+)
+
+// Namespace represents personal namespace of IMAP server
+type Namespace struct {
+	Prefix    string // prefix of folder names, e.g. INBOX.
+	Delimiter string // hierarchy delimiter, e.g. .
+}
+
+// namespaces keeps personal namespaces of IMAP servers
+var namespaces = struct {
+	sync.Mutex
+	nmap map[string]Namespace
+}{nmap: make(map[string]Namespace)}
+
+// NamespaceCommand represents IMAP NAMESPACE command
+type NamespaceCommand struct{}
+
+// Command implements imap.Commander interface
+func (cmd *NamespaceCommand) Command() *imap.Command {
+	return &imap.Command{Name: "NAMESPACE"}
+}
+
+// NamespaceResponse represents IMAP NAMESPACE response, only the first
+// personal namespace is kept
+type NamespaceResponse struct {
+	Personal *Namespace // personal namespace, nil if server has none
+}
+
+// Handle implements responses.Handler interface
+func (r *NamespaceResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "NAMESPACE" {
+		return responses.ErrUnhandled
+	}
+	if len(fields) < 1 {
+		return errors.New("namespace response needs at least 1 field")
+	}
+	// personal namespaces are either NIL or list of (prefix delimiter) lists
+	list, ok := fields[0].([]interface{})
+	if !ok || len(list) == 0 {
+		return nil
+	}
+	ns, ok := list[0].([]interface{})
+	if !ok || len(ns) < 2 {
+		return errors.New("namespace must be a list of prefix and delimiter")
+	}
+	prefix, err := imap.ParseString(ns[0])
+	if err != nil {
+		return err
+	}
+	delim, _ := imap.ParseString(ns[1])
+	r.Personal = &Namespace{Prefix: prefix, Delimiter: delim}
+	return nil
+}
+
+// helper function to query personal namespace of given IMAP server if it
+// advertises NAMESPACE capability, it should be called after login
+func queryNamespace(c *client.Client, imapName string) error {
+	if ok, err := c.Support("NAMESPACE"); err != nil || !ok {
+		return err
+	}
+	res := &NamespaceResponse{}
+	status, err := c.Execute(&NamespaceCommand{}, res)
+	if err != nil {
+		return err
+	}
+	if err := status.Err(); err != nil {
+		return err
+	}
+	if res.Personal == nil {
+		return nil
+	}
+	namespaces.Lock()
+	namespaces.nmap[imapName] = *res.Personal
+	namespaces.Unlock()
+	if res.Personal.Prefix != "" && verboseLevel(imapName) > 0 {
+		log.Printf("personal namespace of %s: prefix '%s', delimiter '%s'", imapName, res.Personal.Prefix, res.Personal.Delimiter)
+	}
+	return nil
+}
+
+// helper function to return personal namespace prefix of given IMAP server
+func namespacePrefix(imapName string) string {
+	namespaces.Lock()
+	defer namespaces.Unlock()
+	return namespaces.nmap[imapName].Prefix
+}
+
+// helper function to qualify given folder name with personal namespace
+// prefix of IMAP server, e.g. Archive -> INBOX.Archive, INBOX is never
+// qualified
+func qualifiedFolder(imapName, folder string) string {
+	prefix := namespacePrefix(imapName)
+	if prefix == "" || strings.EqualFold(folder, "inbox") || strings.HasPrefix(strings.ToLower(folder), strings.ToLower(prefix)) {
+		return folder
+	}
+	return prefix + folder
+}
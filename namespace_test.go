@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	imap "github.com/emersion/go-imap"
+)
+
+func TestNamespaceResponse(t *testing.T) {
+	tests := []struct {
+		line   string
+		expect *Namespace
+		fail   bool
+	}{
+		{"* NAMESPACE ((\"INBOX.\" \".\")) NIL NIL\r\n", &Namespace{Prefix: "INBOX.", Delimiter: "."}, false},
+		{"* NAMESPACE ((\"\" \"/\")) ((\"#shared/\" \"/\")) NIL\r\n", &Namespace{Prefix: "", Delimiter: "/"}, false},
+		{"* NAMESPACE NIL NIL NIL\r\n", nil, false},
+		{"* NAMESPACE ((\"INBOX.\")) NIL NIL\r\n", nil, true},
+	}
+	for _, tt := range tests {
+		r := imap.NewReader(bufio.NewReader(strings.NewReader(tt.line)))
+		resp, err := imap.ReadResp(r)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.line, err)
+		}
+		res := &NamespaceResponse{}
+		err = res.Handle(resp)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%q: invalid namespace response is accepted", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if (res.Personal == nil) != (tt.expect == nil) || (res.Personal != nil && *res.Personal != *tt.expect) {
+			t.Errorf("%q: personal namespace %+v, expected %+v", tt.line, res.Personal, tt.expect)
+		}
+	}
+}
+
+func TestQualifiedFolder(t *testing.T) {
+	setupTest(t)
+	namespaces.nmap["dovecot"] = Namespace{Prefix: "INBOX.", Delimiter: "."}
+	tests := []struct {
+		imap   string
+		folder string
+		expect string
+	}{
+		{"dovecot", "Archive", "INBOX.Archive"},
+		{"dovecot", "inbox", "inbox"},
+		{"dovecot", "INBOX.Archive", "INBOX.Archive"},
+		{"dovecot", "inbox.Archive", "inbox.Archive"},
+		{"other", "Archive", "Archive"},
+	}
+	for _, tt := range tests {
+		if got := qualifiedFolder(tt.imap, tt.folder); got != tt.expect {
+			t.Errorf("qualifiedFolder(%s, %s)=%s, expected %s", tt.imap, tt.folder, got, tt.expect)
+		}
+	}
+}
+
+func TestNamespaceFolders(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	ts.Namespace.Set("INBOX.")
+	ts.mailbox(t, "INBOX.Archive")
+	c := ts.connect(t)
+	if prefix := namespacePrefix(testServerName); prefix != "INBOX." {
+		t.Fatalf("namespace prefix '%s' is not queried at connect", prefix)
+	}
+	tests := []struct {
+		folder string
+		expect string
+	}{
+		{"Archive", "INBOX.Archive"},
+		{"archive", "INBOX.Archive"},
+		{"INBOX.Archive", "INBOX.Archive"},
+		{"inbox", "INBOX"},
+	}
+	for _, tt := range tests {
+		got, err := findImapFolder(testServerName, tt.folder)
+		if err != nil || got != tt.expect {
+			t.Errorf("findImapFolder(%s)=%s (error %v), expected %s", tt.folder, got, err, tt.expect)
+		}
+	}
+	// new folders are created within personal namespace
+	folder, err := ensureImapFolder(c, testServerName, "Projects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder != "INBOX.Projects" {
+		t.Errorf("created folder %s, expected INBOX.Projects", folder)
+	}
+	if _, err := ts.User.GetMailbox("INBOX.Projects"); err != nil {
+		t.Errorf("folder is not created on IMAP server: %v", err)
+	}
+}
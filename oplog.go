@@ -0,0 +1,124 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// oplog module for goimapsync, it records IMAP operations in operations
+// table of DB before their execution, e.g. move of the message which is
+// copy to target folder followed by expunge from source one. If goimapsync
+// crashes in the middle of operation the next run completes it or rolls
+// it back, see recoverOperations.
+//
+
+import (
+	"fmt"
+	"log"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// helper function to record move of given message, it returns id of the
+// operation which should be passed to completeOperation
+func recordMove(imapName string, msg Message, source, target string) (int64, error) {
+	seen := false
+	for _, f := range msg.Flags {
+		if f == imap.SeenFlag {
+			seen = true
+		}
+	}
+	o := Operation{Imap: imapName, Op: "move", MessageId: msg.MessageId, Source: source, Target: target, Seen: seen}
+	return insertOperation(o)
+}
+
+// helper function to remove record of completed operation
+func completeOperation(oid int64) {
+	if oid == 0 {
+		return
+	}
+	if err := deleteOperation(oid); err != nil {
+		log.Printf("unable to remove record of operation %d, error: %v\n", oid, err)
+	}
+}
+
+// helper function to complete or roll back recorded operations of given
+// IMAP server interrupted by crash of previous run, records of operations
+// which fail to recover are kept for the next run
+func recoverOperations(c *client.Client, imapName string) error {
+	ops, err := getOperations(imapName)
+	if err != nil {
+		return err
+	}
+	for _, o := range ops {
+		var err error
+		switch o.Op {
+		case "move":
+			err = recoverMove(c, o)
+		default:
+			err = fmt.Errorf("unsupported operation '%s'", o.Op)
+		}
+		if err != nil {
+			log.Printf("unable to recover %s of %s on '%s', error: %v\n", o.Op, o.MessageId, imapName, err)
+			continue
+		}
+		completeOperation(o.Id)
+	}
+	return nil
+}
+
+// helper function to recover interrupted move of the message: if message
+// is already copied to target folder it is expunged from source one,
+// otherwise the \Seen flag set by MoveMessage is removed
+func recoverMove(c *client.Client, o Operation) error {
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", o.MessageId)
+	if _, err := c.Select(o.Target, true); err != nil {
+		return err
+	}
+	copied, err := c.UidSearch(criteria)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Select(o.Source, false); err != nil {
+		return err
+	}
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return err
+	}
+	if len(uids) == 0 {
+		log.Printf("move of %s to '%s' on %s is already completed\n", o.MessageId, o.Target, o.Imap)
+		return nil
+	}
+	if len(copied) == 0 {
+		log.Printf("roll back interrupted move of %s to '%s' on %s\n", o.MessageId, o.Target, o.Imap)
+		if o.Seen {
+			return nil
+		}
+		item := imap.FormatFlagsOp(imap.RemoveFlags, true)
+		return c.UidStore(uidSet(uids), item, []interface{}{imap.SeenFlag}, nil)
+	}
+	if Config.SafeMode {
+		logSafeMode(o.Imap, fmt.Sprintf("removal of %s from '%s'", o.MessageId, o.Source))
+		return nil
+	}
+	log.Printf("complete interrupted move of %s to '%s' on %s\n", o.MessageId, o.Target, o.Imap)
+	// other messages flagged as \Deleted, e.g. within grace period, are kept
+	deleted, err := c.UidSearch(&imap.SearchCriteria{WithFlags: []string{imap.DeletedFlag}})
+	if err != nil {
+		return err
+	}
+	target := make(map[uint32]bool)
+	for _, uid := range uids {
+		target[uid] = true
+	}
+	var keep []uint32
+	for _, uid := range deleted {
+		if !target[uid] {
+			keep = append(keep, uid)
+		}
+	}
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.UidStore(uidSet(uids), item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+	return expungeUids(c, uids, keep)
+}
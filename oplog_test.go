@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// helper function to record move of given message and copy it to given
+// folder without expunge from INBOX, i.e. as MoveMessage does before crash
+// in the middle of the move
+func interruptedMove(c *client.Client, m testMessage, folder string, copied bool) error {
+	if _, err := c.Select("INBOX", false); err != nil {
+		return err
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", m.MessageId)
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return err
+	}
+	if len(uids) != 1 {
+		return fmt.Errorf("found %d message(s) %s in INBOX instead of 1", len(uids), m.MessageId)
+	}
+	msg := Message{MessageId: m.MessageId, Flags: m.Flags}
+	if _, err := recordMove(testServerName, msg, "INBOX", folder); err != nil {
+		return err
+	}
+	// MoveMessage marks message as seen before its copy
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.UidStore(uidSet(uids), item, []interface{}{imap.SeenFlag}, nil); err != nil {
+		return err
+	}
+	if !copied {
+		return nil
+	}
+	return c.UidCopy(uidSet(uids), folder)
+}
+
+func TestRecoverOperations(t *testing.T) {
+	tests := []struct {
+		name     string
+		flags    []string
+		copied   bool
+		safeMode bool
+		inbox    uint32 // messages left in INBOX
+		archive  uint32 // messages in Archive
+		flagsOut string // flags of message left in INBOX
+	}{
+		{name: "copied", copied: true, inbox: 0, archive: 1},
+		{name: "not copied", inbox: 1, archive: 0, flagsOut: ""},
+		{name: "not copied seen", flags: []string{imap.SeenFlag}, inbox: 1, archive: 0, flagsOut: imap.SeenFlag},
+		{name: "safe mode", copied: true, safeMode: true, inbox: 1, archive: 1, flagsOut: imap.SeenFlag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			Config.SafeMode = tt.safeMode
+			ts := startTestServer(t)
+			ts.mailbox(t, "Archive")
+			m := testMessage{MessageId: "<oplog-1@localhost>", Subject: "Interrupted move", Flags: tt.flags}
+			ts.add(t, "INBOX", m)
+			c := ts.connect(t)
+			if err := interruptedMove(c, m, "Archive", tt.copied); err != nil {
+				t.Fatal(err)
+			}
+			if err := recoverOperations(c, testServerName); err != nil {
+				t.Fatal(err)
+			}
+			// in-memory backend has one more message in INBOX
+			if n := ts.size(t, "INBOX") - 1; n != tt.inbox {
+				t.Errorf("%s: INBOX has %d message(s) after recovery, expected %d", tt.name, n, tt.inbox)
+			}
+			if n := ts.size(t, "Archive"); n != tt.archive {
+				t.Errorf("%s: Archive has %d message(s) after recovery, expected %d", tt.name, n, tt.archive)
+			}
+			if flags, ok := ts.flags(t, "INBOX")[m.MessageId]; ok && strings.Join(flags, " ") != tt.flagsOut {
+				t.Errorf("%s: message left in INBOX has flags %v, expected '%s'", tt.name, flags, tt.flagsOut)
+			}
+			if ops, err := getOperations(testServerName); err != nil {
+				t.Fatal(err)
+			} else if len(ops) != 0 {
+				t.Errorf("%s: %d operation(s) are left in DB after recovery", tt.name, len(ops))
+			}
+		})
+	}
+}
+
+func TestRecoverCompletedMove(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	ts.mailbox(t, "Archive")
+	m := testMessage{MessageId: "<oplog-2@localhost>", Subject: "Completed move"}
+	ts.add(t, "INBOX", m)
+	c := ts.connect(t)
+	if err := Move(currentClient(testServerName, c), testServerName, m.MessageId, "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	// the operation of successful move is removed
+	if ops, err := getOperations(testServerName); err != nil {
+		t.Fatal(err)
+	} else if len(ops) != 0 {
+		t.Fatalf("%d operation(s) are left in DB after move", len(ops))
+	}
+	// move recorded by crashed run which completed it before its record
+	// removal is only forgotten
+	if _, err := recordMove(testServerName, Message{MessageId: m.MessageId}, "INBOX", "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	if err := recoverOperations(c, testServerName); err != nil {
+		t.Fatal(err)
+	}
+	if n := ts.size(t, "Archive"); n != 1 {
+		t.Errorf("Archive has %d message(s) after recovery instead of 1", n)
+	}
+	if ops, err := getOperations(testServerName); err != nil {
+		t.Fatal(err)
+	} else if len(ops) != 0 {
+		t.Errorf("%d operation(s) are left in DB after recovery", len(ops))
+	}
+}
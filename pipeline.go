@@ -0,0 +1,170 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// pipeline module for goimapsync, it overlaps network and disk work of
+// folder fetch using two connections to the same mailbox: one fetches
+// envelopes and flags of the next chunk while the other one fetches bodies
+// of the current chunk for writeMail workers. Both connections operate on
+// UIDs of single SEARCH of readImap and bodies are fetched only for
+// messages which are not yet stored locally.
+//
+
+import (
+	"errors"
+	"sync"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// MetaChunk represents envelopes and flags of chunk of folder messages
+type MetaChunk struct {
+	Messages []*imap.Message // messages without bodies
+	Error    error           // fetch error of the chunk
+}
+
+// helper function to check if body of given message should be fetched
+func needsBody(msg *imap.Message, mdict map[string]string) bool {
+	hid := md5hash(msg.Envelope.MessageId)
+	if msg.Envelope.MessageId == "" {
+		// let processMessage report message without message id
+		return false
+	}
+	if entry, err := findMessage(hid); err == nil && entry.HashId == hid {
+		return false
+	}
+	if ignoredBy(msg.Envelope) != nil {
+		return false
+	}
+	return !isMailWritten(mdict, Message{HashId: hid})
+}
+
+// helper function to fetch given UIDs of selected folder in pipelined mode,
+// the meta connection should have folder selected, the body connection
+// selects it on its own
+func readImapPipelined(meta, body *client.Client, imapName, folder string, uids []uint32, batch int, section *imap.BodySectionName, newMessages bool, mdict map[string]string, wg *sync.WaitGroup) ([]Message, error) {
+	nmsg := uint32(len(uids))
+	_, err := withReconnect(body, imapName, "", func(c *client.Client) error {
+		_, err := c.Select(folder, false)
+		return err
+	})
+	if err != nil {
+		return []Message{}, err
+	}
+
+	// fetch envelopes and flags one chunk ahead of bodies
+	chunks := make(chan MetaChunk, 1)
+	go func() {
+		defer close(chunks)
+		items := []imap.FetchItem{imap.FetchFlags, imap.FetchEnvelope, imap.FetchUid}
+		if Config.ArchiveMode {
+			items = append(items, imap.FetchInternalDate)
+		}
+		for start := 0; start < len(uids); start += batch {
+			end := start + batch
+			if end > len(uids) {
+				end = len(uids)
+			}
+			var out []*imap.Message
+			_, err := withReconnect(meta, imapName, folder, func(c *client.Client) error {
+				out = nil
+				messages := make(chan *imap.Message, fetchChannelSize)
+				done := fetchMessages(c, uidSet(uids[start:end]), items, messages, true)
+				for msg := range messages {
+					out = append(out, msg)
+				}
+				return <-done
+			})
+			chunks <- MetaChunk{Messages: out, Error: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	// on error we drain remaining chunks to let meta fetch quit
+	defer func() {
+		for range chunks {
+		}
+	}()
+
+	var msgs []Message
+	process := func(msg *imap.Message) {
+		m, err := processMessage(imapName, folder, msg, section, msg.SeqNum, nmsg, newMessages, mdict, wg)
+		if errors.Is(err, errIgnored) {
+			return
+		}
+		if err != nil {
+			RunSummary.AddError(MessageError{Imap: imapName, Folder: folder, Uid: msg.Uid, MessageId: msg.Envelope.MessageId, Error: err})
+			return
+		}
+		addProcessed(imapName, 1)
+		msgs = append(msgs, m)
+	}
+	items := []imap.FetchItem{section.FetchItem(), imap.FetchUid}
+	for chunk := range chunks {
+		if chunk.Error != nil {
+			return msgs, chunk.Error
+		}
+		if interrupted() {
+			return msgs, errInterrupted
+		}
+		// messages which are already stored do not need their bodies
+		metas := make(map[uint32]*imap.Message)
+		var need []uint32
+		for _, msg := range chunk.Messages {
+			if msg == nil || msg.Envelope == nil {
+				e := MessageError{Imap: imapName, Folder: folder, Error: errors.New("message without envelope")}
+				if msg != nil {
+					e.Uid = msg.Uid
+				}
+				RunSummary.AddError(e)
+				continue
+			}
+			if needsBody(msg, mdict) {
+				metas[msg.Uid] = msg
+				need = append(need, msg.Uid)
+				continue
+			}
+			process(msg)
+		}
+		processed := make(map[uint32]bool)
+		body, err = withReconnect(body, imapName, folder, func(c *client.Client) error {
+			// on retry after reconnect we resume with UIDs which were not
+			// processed before connection dropped
+			var uids []uint32
+			for _, uid := range need {
+				if !processed[uid] {
+					uids = append(uids, uid)
+				}
+			}
+			if len(uids) == 0 {
+				return nil
+			}
+			messages := make(chan *imap.Message, fetchChannelSize)
+			done := fetchMessages(c, uidSet(uids), items, messages, true)
+			for bmsg := range messages {
+				if bmsg == nil {
+					continue
+				}
+				msg, ok := metas[bmsg.Uid]
+				if !ok || processed[bmsg.Uid] {
+					continue
+				}
+				processed[bmsg.Uid] = true
+				msg.Body = bmsg.Body
+				process(msg)
+			}
+			return <-done
+		})
+		if err != nil {
+			return msgs, err
+		}
+		// the message could be expunged after SEARCH
+		for _, uid := range need {
+			if !processed[uid] {
+				RunSummary.AddError(MessageError{Imap: imapName, Folder: folder, Uid: uid, MessageId: metas[uid].Envelope.MessageId, Error: errors.New("message without body")})
+			}
+		}
+	}
+	return msgs, nil
+}
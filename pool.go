@@ -0,0 +1,266 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// pool module for goimapsync, it keeps pool of connections per IMAP server
+// such that folders of the server can be fetched in parallel, the pool is
+// limited by maxConnections server option and it starts with primary
+// connection of the server. IMAP servers of the config with the same URI and
+// username are logins to the same account, they share the limit, i.e. the
+// smallest maxConnections of them, since providers cap simultaneous logins
+// per account rather than per connection.
+//
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// Pool represents pool of connections to IMAP server
+type Pool struct {
+	sync.Mutex
+	cond *sync.Cond       // signals returned connections
+	Name string           // name of IMAP server
+	Max  int              // maximum number of connections
+	Open int              // number of open connections
+	Idle []*client.Client // connections which are not borrowed
+}
+
+// errPoolShrunk reports that pool shrunk since IMAP server refused new connection
+var errPoolShrunk = errors.New("connection pool shrunk")
+
+// pools keeps connection pools of IMAP servers
+var pools = struct {
+	sync.Mutex
+	pmap map[string]*Pool
+}{pmap: make(map[string]*Pool)}
+
+// logins keeps number of open connections per account and its peak value
+var logins = struct {
+	sync.Mutex
+	open map[string]int
+	peak map[string]int
+}{open: make(map[string]int), peak: make(map[string]int)}
+
+// helper function to return account key of given IMAP server
+func accountKey(imapName string) string {
+	for _, s := range Config.Servers {
+		if s.Name == imapName {
+			return fmt.Sprintf("%s@%s", strings.ToLower(s.Username), strings.ToLower(s.Uri))
+		}
+	}
+	return imapName
+}
+
+// helper function to return maximum number of connections to the account of
+// given IMAP server, i.e. the smallest maxConnections of servers sharing it
+func accountLimit(imapName string) int {
+	key := accountKey(imapName)
+	max := 0
+	for _, s := range Config.Servers {
+		if s.MaxConnections > 0 && accountKey(s.Name) == key && (max == 0 || s.MaxConnections < max) {
+			max = s.MaxConnections
+		}
+	}
+	if max == 0 {
+		max = 1
+	}
+	return max
+}
+
+// helper function to account new connection to the account of given IMAP
+// server, the connection is refused if force is not set and the account
+// reached its limit, the primary connections are always accounted
+func reserveLogin(imapName string, force bool) bool {
+	key := accountKey(imapName)
+	logins.Lock()
+	defer logins.Unlock()
+	if !force && logins.open[key] >= accountLimit(imapName) {
+		return false
+	}
+	logins.open[key] += 1
+	if logins.open[key] > logins.peak[key] {
+		logins.peak[key] = logins.open[key]
+	}
+	return true
+}
+
+// helper function to release connection to the account of given IMAP server
+func releaseLogin(imapName string) {
+	key := accountKey(imapName)
+	logins.Lock()
+	defer logins.Unlock()
+	if logins.open[key] > 0 {
+		logins.open[key] -= 1
+	}
+}
+
+// helper function to return peak number of connections to the account of
+// given IMAP server
+func peakLogins(imapName string) int {
+	logins.Lock()
+	defer logins.Unlock()
+	return logins.peak[accountKey(imapName)]
+}
+
+// helper function to return connection pool of given IMAP server, the pool
+// is created with given primary connection of the server
+func connPool(imapName string, c *client.Client) *Pool {
+	pools.Lock()
+	defer pools.Unlock()
+	if p, ok := pools.pmap[imapName]; ok {
+		return p
+	}
+	p := &Pool{Name: imapName, Max: accountLimit(imapName), Open: 1, Idle: []*client.Client{currentClient(imapName, c)}}
+	p.cond = sync.NewCond(p)
+	pools.pmap[imapName] = p
+	return p
+}
+
+// helper function to check if given error reports that IMAP server does not
+// accept more connections, e.g. Gmail "Too many simultaneous connections" or
+// LIMIT response code, see https://tools.ietf.org/html/rfc5530
+func isConnLimitError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, pat := range []string{"too many simultaneous connections", "too many connections", "maximum number of connections", "[limit]"} {
+		if strings.Contains(msg, pat) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get borrows connection from the pool, it dials and logins new connection
+// if there is no idle one and the pool did not reach its maximum, otherwise
+// it waits until connection is returned. If IMAP server refuses connection
+// because of connection limit, or connections of other servers of the same
+// account hold the rest of its logins, the pool shrinks to its current size.
+func (p *Pool) Get() (*client.Client, error) {
+	p.Lock()
+	for len(p.Idle) == 0 && p.Open >= p.Max {
+		p.cond.Wait()
+	}
+	if n := len(p.Idle); n > 0 {
+		c := p.Idle[n-1]
+		p.Idle = p.Idle[:n-1]
+		p.Unlock()
+		return c, nil
+	}
+	if !reserveLogin(p.Name, false) {
+		if p.Open == 0 {
+			p.Unlock()
+			return nil, fmt.Errorf("connections to account of %s reached its limit", p.Name)
+		}
+		if verboseLevel(p.Name) > 0 {
+			log.Printf("account of %s reached its connection limit, shrink pool to %d connection(s)\n", p.Name, p.Open)
+		}
+		p.Max = p.Open
+		p.Unlock()
+		return p.Get()
+	}
+	p.Open += 1
+	p.Unlock()
+	c, err := p.dial()
+	if err == errPoolShrunk {
+		return p.Get()
+	}
+	return c, err
+}
+
+// TryGet borrows connection other than given one without waiting, it
+// returns nil if the pool has no such connection and can't open new one
+func (p *Pool) TryGet(other *client.Client) *client.Client {
+	p.Lock()
+	other = currentClient(p.Name, other)
+	for i, c := range p.Idle {
+		if c != other {
+			p.Idle = append(p.Idle[:i], p.Idle[i+1:]...)
+			p.Unlock()
+			return c
+		}
+	}
+	if p.Open >= p.Max || !reserveLogin(p.Name, false) {
+		p.Unlock()
+		return nil
+	}
+	p.Open += 1
+	p.Unlock()
+	c, err := p.dial()
+	if err != nil {
+		if verboseLevel(p.Name) > 0 {
+			log.Println(err)
+		}
+		return nil
+	}
+	return c
+}
+
+// helper function to dial new connection of the pool, the caller should
+// account it in p.Open and reserve its login beforehand, if IMAP server refuses connection
+// because of connection limit the pool shrinks to its current size and
+// errPoolShrunk is returned
+func (p *Pool) dial() (*client.Client, error) {
+	var srv Server
+	for _, s := range Config.Servers {
+		if s.Name == p.Name {
+			srv = s
+		}
+	}
+	c, err := dial(srv)
+	if err == nil {
+		return c, nil
+	}
+	releaseLogin(p.Name)
+	p.Lock()
+	defer p.Unlock()
+	p.Open -= 1
+	if isConnLimitError(err) && p.Open > 0 {
+		log.Printf("%s refused new connection, shrink pool to %d connection(s), error: %v\n", p.Name, p.Open, err)
+		p.Max = p.Open
+		return nil, errPoolShrunk
+	}
+	return nil, fmt.Errorf("unable to open connection to %s: %w", p.Name, err)
+}
+
+// Put returns borrowed connection to the pool, the connection which
+// replaced it after reconnect is returned if connection dropped
+func (p *Pool) Put(c *client.Client) {
+	p.Lock()
+	defer p.Unlock()
+	p.Idle = append(p.Idle, currentClient(p.Name, c))
+	p.cond.Signal()
+}
+
+// helper function to logout from pooled connections of all IMAP servers,
+// the primary connections are logged out by logout function
+func drainPools() {
+	pools.Lock()
+	defer pools.Unlock()
+	for name, p := range pools.pmap {
+		p.Lock()
+		primary := currentClient(name, nil)
+		for _, c := range p.Idle {
+			if c != primary {
+				c.Logout()
+			}
+		}
+		if p.Open > 1 && verboseLevel(name) > 0 {
+			log.Printf("closed %d pooled connection(s) to %s\n", p.Open-1, name)
+		}
+		// login of primary connection is released by logout
+		for i := 1; i < p.Open; i++ {
+			releaseLogin(name)
+		}
+		p.Idle = nil
+		p.Open = 0
+		p.Unlock()
+	}
+	pools.pmap = make(map[string]*Pool)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/emersion/go-imap/client"
+)
+
+func TestAccountLimit(t *testing.T) {
+	keepConfig(t)
+	tests := []struct {
+		name    string
+		servers []Server
+		expect  map[string]int
+	}{
+		{"default", []Server{{Name: "a", Uri: "a.org:993", Username: "u"}}, map[string]int{"a": 1, "unknown": 1}},
+		{"separate accounts", []Server{
+			{Name: "a", Uri: "a.org:993", Username: "u", MaxConnections: 3},
+			{Name: "b", Uri: "a.org:993", Username: "v", MaxConnections: 2},
+		}, map[string]int{"a": 3, "b": 2}},
+		{"shared account", []Server{
+			{Name: "a", Uri: "a.org:993", Username: "u", MaxConnections: 3},
+			{Name: "b", Uri: "A.org:993", Username: "U", MaxConnections: 2},
+			{Name: "c", Uri: "a.org:993", Username: "u"},
+		}, map[string]int{"a": 2, "b": 2, "c": 2}},
+	}
+	for _, tt := range tests {
+		Config = Configuration{Servers: tt.servers}
+		for name, expect := range tt.expect {
+			if got := accountLimit(name); got != expect {
+				t.Errorf("%s: accountLimit(%s)=%d, expected %d", tt.name, name, got, expect)
+			}
+		}
+	}
+}
+
+func TestIsConnLimitError(t *testing.T) {
+	tests := []struct {
+		err    error
+		expect bool
+	}{
+		{nil, false},
+		{errors.New("[ALERT] Too many simultaneous connections. (Failure)"), true},
+		{errors.New("[LIMIT] maximum number of connections reached"), true},
+		{errors.New("Too many connections from your IP"), true},
+		{errors.New("invalid credentials"), false},
+	}
+	for _, tt := range tests {
+		if got := isConnLimitError(tt.err); got != tt.expect {
+			t.Errorf("isConnLimitError(%v)=%v, expected %v", tt.err, got, tt.expect)
+		}
+	}
+}
+
+func TestBackupMaxConnections(t *testing.T) {
+	for _, max := range []int{1, 2} {
+		t.Run(fmt.Sprintf("max %d", max), func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			ts.Server.MaxConnections = max
+			for _, name := range []string{"A", "B", "C", "D"} {
+				ts.add(t, name, testMessage{MessageId: "<pool-" + name + "@localhost>", Subject: "Pool"})
+			}
+			c := ts.connect(t)
+			// backup fetches folders in parallel over connection pool which
+			// never exceeds maxConnections of the server
+			ts.Listener.Reset()
+			if err := Backup(currentClient(testServerName, c), testServerName, false); err != nil {
+				t.Fatal(err)
+			}
+			if peak := ts.Listener.Reset(); peak != max {
+				t.Errorf("backup opened %d connection(s) with maxConnections %d", peak, max)
+			}
+			if peak := peakLogins(testServerName); peak != max {
+				t.Errorf("%d login(s) are accounted with maxConnections %d", peak, max)
+			}
+		})
+	}
+}
+
+func TestBackupSharedAccount(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	ts.Server.MaxConnections = 2
+	for _, name := range []string{"A", "B", "C", "D"} {
+		ts.add(t, name, testMessage{MessageId: "<pool-" + name + "@localhost>", Subject: "Pool"})
+	}
+	c := ts.connect(t)
+	// the other server of the same account shares its limit, i.e. its
+	// primary connection leaves no room for pooled ones
+	alias := Server{Name: testServerName + "-alias", Uri: ts.Server.Uri, Username: ts.Server.Username, Password: ts.Server.Password, MaxConnections: 3}
+	Config.Servers = append(Config.Servers, alias)
+	ca, err := dial(alias)
+	if err != nil {
+		t.Fatalf("unable to login to test IMAP server: %v", err)
+	}
+	registerClient(alias.Name, ca)
+	defer logout(map[string]*client.Client{alias.Name: ca})
+	ts.Listener.Reset()
+	if err := Backup(currentClient(testServerName, c), testServerName, false); err != nil {
+		t.Fatal(err)
+	}
+	if peak := ts.Listener.Reset(); peak > ts.Server.MaxConnections {
+		t.Errorf("%d connection(s) are opened to account with maxConnections %d", peak, ts.Server.MaxConnections)
+	}
+	if peak := peakLogins(testServerName); peak != ts.Server.MaxConnections {
+		t.Errorf("%d login(s) are accounted to account with maxConnections %d", peak, ts.Server.MaxConnections)
+	}
+	for _, name := range []string{"A", "B", "C", "D"} {
+		if files := readMaildir(testServerName, name); len(files) != 1 {
+			t.Errorf("backup wrote %d local mail file(s) of folder %s instead of 1", len(files), name)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// preview module for goimapsync, it fetches only first portion of the
+// message, e.g. BODY.PEEK[]<0.4096>, without downloading large attachments
+//
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Preview writes first size bytes of given message from IMAP server(s)
+func Preview(cmap map[string]*client.Client, match string, size int, w io.Writer) error {
+	if match == "" {
+		return errors.New("Preview operation requires message id")
+	}
+	if size <= 0 {
+		return fmt.Errorf("invalid preview size %d", size)
+	}
+	defer timing("Preview", time.Now())
+	defer profiler("Preview")()
+	for name, c := range cmap {
+		found, err := previewImap(c, name, match, size, w)
+		if err != nil {
+			log.Printf("unable to preview '%s' from '%s', error: %v\n", match, name, err)
+			continue
+		}
+		if found {
+			return nil
+		}
+	}
+	return fmt.Errorf("message '%s' is not found", match)
+}
+
+// helper function to write first size bytes of given message from IMAP server
+func previewImap(c *client.Client, imapName, mid string, size int, w io.Writer) (bool, error) {
+	// use peek section to not mark the message as seen and partial
+	// offsets to fetch only requested byte range of the message
+	section := &imap.BodySectionName{Peek: true, Partial: []int{0, size}}
+	if verboseLevel(imapName) > 1 {
+		log.Println("IMAP", section.FetchItem())
+	}
+	return fetchSection(c, imapName, mid, section, w)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/emersion/go-imap/client"
+)
+
+func TestPreview(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	m := testMessage{MessageId: "<preview-1@localhost>", Subject: "Message to preview", Date: testRawDate}
+	ts.add(t, "INBOX", m)
+	c := ts.connect(t)
+	cmap := map[string]*client.Client{testServerName: c}
+	body := m.body()
+	tests := []struct {
+		mid    string
+		size   int
+		expect []byte
+		fail   bool
+	}{
+		{m.MessageId, 10, body[:10], false},
+		{m.MessageId, 100, body[:100], false},
+		{m.MessageId, len(body) + 100, body, false},
+		{m.MessageId, 0, nil, true},
+		{"", 10, nil, true},
+		{"<preview-unknown@localhost>", 10, nil, true},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		err := Preview(cmap, tt.mid, tt.size, &buf)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("preview of %s with size %d succeeded", tt.mid, tt.size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), tt.expect) {
+			t.Errorf("preview of %d bytes is %q instead of %q", tt.size, buf.String(), tt.expect)
+		}
+	}
+	// peek does not mark the message as seen
+	if flags := ts.flags(t, "INBOX")[m.MessageId]; len(flags) != 0 {
+		t.Errorf("preview changed flags of the message to %v", flags)
+	}
+}
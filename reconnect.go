@@ -0,0 +1,230 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// reconnect module for goimapsync, it provides transparent reconnection
+// to IMAP servers when connection drops in the middle of the operation
+//
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// connections keeps current primary connections to IMAP servers, and the
+// replaced map links dropped connections to ones which replaced them
+var connections = struct {
+	sync.Mutex
+	cmap     map[string]*client.Client
+	replaced map[*client.Client]*client.Client
+}{cmap: make(map[string]*client.Client), replaced: make(map[*client.Client]*client.Client)}
+
+// helper function to dial and login to given IMAP server
+func dial(s Server) (*client.Client, error) {
+	var c *client.Client
+	var err error
+	if s.Password, err = serverPassword(s); err != nil {
+		return nil, err
+	}
+	dialer := &Dialer{Timeout: time.Duration(s.DialTimeout) * time.Second, PreferIPv4: s.PreferIPv4}
+	if s.UseTls {
+		cfg, e := tlsConfig(s)
+		if e != nil {
+			return nil, e
+		}
+		c, err = client.DialWithDialerTLS(dialer, s.Uri, cfg)
+	} else {
+		c, err = client.DialWithDialer(dialer, s.Uri)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := authenticate(c, s); err != nil {
+		c.Logout()
+		return nil, err
+	}
+	// some providers log and rate-limit clients by their identification
+	if err := sendClientId(c, s.Name); err != nil {
+		log.Printf("unable to send ID to %s, error: %v", s.Name, err)
+	}
+	// mailbox names are exchanged as UTF-8 if server supports it
+	if err := enableUTF8(c, s.Name); err != nil {
+		log.Printf("unable to enable UTF8=ACCEPT on %s, error: %v", s.Name, err)
+	}
+	// personal namespace is used to resolve user-friendly folder names
+	if err := queryNamespace(c, s.Name); err != nil {
+		log.Printf("unable to query NAMESPACE of %s, error: %v", s.Name, err)
+	}
+	if verboseLevel(s.Name) > 0 {
+		log.Printf("Logged into %s (%s, %s)", s.Uri, dialer, tlsState(s.Name))
+	}
+	setState(s.Name, "connected")
+	return c, nil
+}
+
+// helper function to register connection to IMAP server
+func registerClient(imapName string, c *client.Client) {
+	connections.Lock()
+	defer connections.Unlock()
+	// primary connection is accounted in logins of its account once, its
+	// replacements after reconnect keep the same login
+	if _, ok := connections.cmap[imapName]; !ok {
+		reserveLogin(imapName, true)
+	}
+	connections.cmap[imapName] = c
+}
+
+// helper function to return current connection which replaced given one
+// after reconnect(s), the given client is returned if it was never replaced
+// and primary connection of the server is returned if it is nil
+func currentClient(imapName string, c *client.Client) *client.Client {
+	connections.Lock()
+	defer connections.Unlock()
+	if c == nil {
+		return connections.cmap[imapName]
+	}
+	for {
+		next, ok := connections.replaced[c]
+		if !ok {
+			return c
+		}
+		c = next
+	}
+}
+
+// helper function to check if given error is a connection level error
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrShortWrite) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, client.ErrNotLoggedIn) {
+		return true
+	}
+	// go-imap reports closed connection with unexported error
+	msg := strings.ToLower(err.Error())
+	for _, pat := range []string{"short write", "connection reset", "broken pipe", "use of closed network connection", "i/o timeout", "imap: connection closed"} {
+		if strings.Contains(msg, pat) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to re-dial and re-login to given IMAP server,
+// new connection replaces the old one in connections
+func reconnect(imapName string, old *client.Client) (*client.Client, error) {
+	var srv *Server
+	for _, s := range Config.Servers {
+		if s.Name == imapName {
+			srv = &s
+			break
+		}
+	}
+	if srv == nil {
+		return nil, fmt.Errorf("unknown IMAP server '%s'", imapName)
+	}
+	if old != nil {
+		old.Terminate()
+	}
+	log.Printf("reconnect to %s", imapName)
+	RunSummary.AddReconnect(imapName)
+	addReconnect(imapName)
+	setState(imapName, "reconnecting")
+	c, err := dial(*srv)
+	if err != nil {
+		return nil, err
+	}
+	connections.Lock()
+	if connections.cmap[imapName] == old {
+		connections.cmap[imapName] = c
+	}
+	if old != nil {
+		connections.replaced[old] = c
+	}
+	connections.Unlock()
+	return c, nil
+}
+
+// timeout of NOOP health check of idle connection
+const healthCheckTimeout = 30 * time.Second
+
+// helper function to check health of idle connection to given IMAP server
+// with NOOP command, the dead connection is replaced by new one
+func checkClient(imapName string, c *client.Client) (*client.Client, error) {
+	c = currentClient(imapName, c)
+	if c.State() != imap.LogoutState {
+		// the deadline of health check closes stalled connection, the
+		// client timeout is shared with concurrent commands and is not
+		// modified
+		timer := time.AfterFunc(healthCheckTimeout, func() { c.Terminate() })
+		err := c.Noop()
+		expired := !timer.Stop()
+		if expired && err != nil {
+			err = fmt.Errorf("health check exceeded deadline of %v: %w", healthCheckTimeout, err)
+		}
+		if !expired && !isConnError(err) {
+			return c, err
+		}
+		log.Printf("connection to %s is dead, error: %v", imapName, err)
+	}
+	nc, err := reconnect(imapName, c)
+	if err != nil {
+		return c, err
+	}
+	return nc, nil
+}
+
+// helper function to execute given function on IMAP server, if connection
+// drops the function is executed again on new connection with re-selected
+// folder until reconnect retry budget is exhausted. The function should be
+// idempotent, e.g. operate on UIDs. It returns the client used at last.
+func withReconnect(c *client.Client, imapName, folder string, fn func(c *client.Client) error) (*client.Client, error) {
+	retries := Config.ReconnectRetries
+	if retries == 0 {
+		retries = 3
+	}
+	c = currentClient(imapName, c)
+	err := fn(c)
+	for i := 0; i < retries && isConnError(err); i++ {
+		log.Printf("connection to %s dropped, error: %v", imapName, err)
+		// failed re-dial keeps the dropped client such that the next retry
+		// replaces it and callers never get nil client
+		nc, e := reconnect(imapName, c)
+		if e != nil {
+			log.Printf("unable to reconnect to %s, error: %v", imapName, e)
+			continue
+		}
+		c = nc
+		if folder != "" {
+			if _, e = c.Select(folder, false); e != nil {
+				err = e
+				continue
+			}
+		}
+		err = fn(c)
+	}
+	return c, err
+}
+
+// helper function to make UID set from given list of UIDs
+func uidSet(uids []uint32) *imap.SeqSet {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	return seqset
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// helper function to return number of reconnects of given IMAP server
+func reconnects(imapName string) int {
+	statusRegistry.Lock()
+	defer statusRegistry.Unlock()
+	if s, ok := statusRegistry.servers[imapName]; ok {
+		return s.Reconnects
+	}
+	return 0
+}
+
+func TestCheckClient(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	c := ts.connect(t)
+	start := reconnects(testServerName)
+	// every daemon tick checks connection kept since previous tick
+	tests := []struct {
+		name       string
+		drop       bool
+		reconnects int
+	}{
+		{"first tick", false, 0},
+		{"second tick", false, 0},
+		{"dropped connection", true, 1},
+		{"tick after reconnect", false, 1},
+	}
+	prev := c
+	for _, tt := range tests {
+		if tt.drop {
+			ts.Listener.DropAll()
+		}
+		nc, err := checkClient(testServerName, prev)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if (nc != prev) != tt.drop {
+			t.Errorf("%s: connection is replaced %v, expected %v", tt.name, nc != prev, tt.drop)
+		}
+		if currentClient(testServerName, c) != nc {
+			t.Errorf("%s: checked connection is not registered", tt.name)
+		}
+		if n := reconnects(testServerName) - start; n != tt.reconnects {
+			t.Errorf("%s: %d reconnect(s), expected %d", tt.name, n, tt.reconnects)
+		}
+		if err := nc.Noop(); err != nil {
+			t.Errorf("%s: checked connection is not usable: %v", tt.name, err)
+		}
+		prev = nc
+	}
+}
+
+func TestWithReconnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		refuse  int  // number of failed re-dials
+		fail    bool // retry budget is exhausted
+		calls   int  // calls of the function
+		replace bool // dropped client is replaced
+	}{
+		{name: "re-dial", calls: 2, replace: true},
+		{name: "failed re-dial", refuse: 1, calls: 2, replace: true},
+		{name: "failed re-dials", refuse: 3, fail: true, calls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			c := ts.connect(t)
+			Config.ReconnectRetries = 3
+			ts.Listener.RefuseNext(tt.refuse)
+			ts.Listener.DropAll()
+			calls := 0
+			nc, err := withReconnect(c, testServerName, "INBOX", func(c *client.Client) error {
+				calls += 1
+				_, err := c.Select("INBOX", false)
+				return err
+			})
+			if (err != nil) != tt.fail {
+				t.Errorf("withReconnect error %v, expected failure %v", err, tt.fail)
+			}
+			if calls != tt.calls {
+				t.Errorf("function is called %d time(s), expected %d", calls, tt.calls)
+			}
+			if nc == nil {
+				t.Fatal("withReconnect returned nil client")
+			}
+			if (nc != c) != tt.replace {
+				t.Errorf("client is replaced %v, expected %v", nc != c, tt.replace)
+			}
+			// the new connection is registered as primary one
+			if currentClient(testServerName, c) != nc || currentClient(testServerName, nil) != nc {
+				t.Errorf("returned client is not registered")
+			}
+			if tt.replace {
+				if err := nc.Noop(); err != nil {
+					t.Errorf("new client is not usable: %v", err)
+				}
+			}
+		})
+	}
+}
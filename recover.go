@@ -0,0 +1,123 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// recover module for goimapsync, it recovers writes of mail files which
+// were interrupted by crash, see writeMail for order of write steps
+//
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maximum age of files in maildir tmp area, see https://cr.yp.to/proto/maildir.html
+const maxTmpAge = 36 * time.Hour
+
+// helper function to return pattern of names of mail files written by
+// goimapsync on this host, i.e. tstamp.hid.hostname with optional flags
+func commitPattern() *regexp.Regexp {
+	return regexp.MustCompile(`^\d+\.[0-9a-f]{32}\.` + regexp.QuoteMeta(hostname) + `(:2,.*)?$`)
+}
+
+// helper function to confirm message file written to given path
+func confirmMessageFile(hid, fpath string) error {
+	sum, err := fileChecksum(fpath)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return err
+	}
+	return confirmMessage(hid, sum, info.Size(), info.ModTime().Unix())
+}
+
+// helper function to recover pending messages of interrupted writes:
+// - the file in its place is confirmed (crash after rename)
+// - the file in tmp area is moved into its place (crash before rename)
+// - otherwise the DB record is removed
+// and tmp files of goimapsync without DB records are removed, i.e. ones of
+// commits interrupted before their DB records were written and stale ones
+func reindexPending() error {
+	defer timing("reindexPending", time.Now())
+	if err := acquireRunLock(); err != nil {
+		return err
+	}
+	defer releaseRunLock()
+
+	pending, err := getPendingMessages()
+	if err != nil {
+		return err
+	}
+	tmps := make(map[string]bool)
+	var confirmed, moved, removed int
+	for _, p := range pending {
+		tmps[p.Tmp] = true
+		if _, err := os.Stat(p.Path); err == nil {
+			os.Remove(p.Tmp)
+			if err := confirmMessageFile(p.HashId, p.Path); err != nil {
+				log.Printf("unable to confirm %s, error: %v\n", p.Path, err)
+				continue
+			}
+			confirmed += 1
+		} else if _, err := os.Stat(p.Tmp); err == nil {
+			if err := os.Rename(p.Tmp, p.Path); err != nil {
+				log.Printf("unable to move %s, error: %v\n", p.Tmp, err)
+				continue
+			}
+			if err := confirmMessageFile(p.HashId, p.Path); err != nil {
+				log.Printf("unable to confirm %s, error: %v\n", p.Path, err)
+				continue
+			}
+			moved += 1
+		} else {
+			if err := deleteMessage(p.HashId); err != nil {
+				log.Printf("unable to delete %s from DB, error: %v\n", p.HashId, err)
+				continue
+			}
+			removed += 1
+		}
+	}
+
+	// the files written by goimapsync into tmp area before they were
+	// recorded in DB are never moved into their place
+	var stale int
+	pattern := commitPattern()
+	err = filepath.Walk(Config.Maildir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		// do not descend into cur and new areas of large folders
+		if info.Name() == "cur" || info.Name() == "new" {
+			return filepath.SkipDir
+		}
+		if info.Name() != "tmp" {
+			return nil
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil
+		}
+		for _, e := range entries {
+			fname := filepath.Join(path, e.Name())
+			if e.IsDir() || tmps[fname] || !strings.Contains(e.Name(), "."+hostname) {
+				continue
+			}
+			if pattern.MatchString(e.Name()) || time.Since(e.ModTime()) > maxTmpAge {
+				if err := os.Remove(fname); err == nil {
+					stale += 1
+				}
+			}
+		}
+		return filepath.SkipDir
+	})
+	if confirmed+moved+removed+stale > 0 {
+		log.Printf("recovered interrupted writes: confirmed %d, moved %d, removed %d message(s), removed %d orphan tmp file(s)\n", confirmed, moved, removed, stale)
+	}
+	return err
+}
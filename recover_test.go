@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReindexPending(t *testing.T) {
+	setupTest(t)
+	createLocalFolder("a", "INBOX")
+	tests := []struct {
+		name    string
+		tmp     bool // file is written into tmp area
+		pending bool // pending DB record is inserted
+		renamed bool // file is moved into its place
+		file    bool // file is in its place after recovery
+		record  bool // DB record is kept after recovery
+	}{
+		{"crash before DB record", true, false, false, false, false},
+		{"crash before rename", true, true, false, true, true},
+		{"crash before confirm", true, true, true, true, true},
+		{"lost tmp file", false, true, false, false, false},
+	}
+	type state struct {
+		msg Message
+		tmp string
+	}
+	var states []state
+	for i, tt := range tests {
+		mid := fmt.Sprintf("<recover-%d@localhost>", i)
+		m := Message{MessageId: mid, HashId: md5hash(mid), Imap: "a"}
+		fname := fmt.Sprintf("%d.%s.%s:2,", time.Now().Unix(), m.HashId, hostname)
+		m.Path = filepath.Join(localPath("a", "INBOX", "cur"), fname)
+		tmp := filepath.Join(localPath("a", "INBOX", "tmp"), fname)
+		if tt.tmp {
+			if err := ioutil.WriteFile(tmp, testMessage{MessageId: mid}.body(), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.pending {
+			if err := insertPendingMessage(m, tmp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.renamed {
+			if err := os.Rename(tmp, m.Path); err != nil {
+				t.Fatal(err)
+			}
+		}
+		states = append(states, state{m, tmp})
+	}
+	// tmp files of other hosts and MUAs are never touched
+	foreign := filepath.Join(localPath("a", "INBOX", "tmp"), "1700000000.M1P2.otherhost")
+	if err := ioutil.WriteFile(foreign, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reindexPending(); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := getPendingMessages(); err != nil || len(pending) != 0 {
+		t.Errorf("pending messages after recovery %v, error %v", pending, err)
+	}
+	files, err := getMessageFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := make(map[string]MessageFile)
+	for _, f := range files {
+		records[f.HashId] = f
+	}
+	for i, tt := range tests {
+		s := states[i]
+		if _, err := os.Stat(s.tmp); err == nil {
+			t.Errorf("%s: tmp file is not removed", tt.name)
+		}
+		_, err := os.Stat(s.msg.Path)
+		if got := err == nil; got != tt.file {
+			t.Errorf("%s: file in its place %v, expected %v", tt.name, got, tt.file)
+		}
+		r, ok := records[s.msg.HashId]
+		if ok != tt.record {
+			t.Errorf("%s: DB record kept %v, expected %v", tt.name, ok, tt.record)
+		}
+		// confirmed records carry checksum of their files
+		if ok && (r.Sha256 == "" || r.Size == 0 || r.Path != s.msg.Path) {
+			t.Errorf("%s: recovered DB record %+v", tt.name, r)
+		}
+	}
+	if _, err := os.Stat(foreign); err != nil {
+		t.Errorf("tmp file of other host is removed")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// repair module for goimapsync, it repairs encoding of flags in names of
+// local mail files, i.e. the info part <name>:2,<flags> should contain
+// flag letters in ASCII order without duplicates, see
+// https://cr.yp.to/proto/maildir.html. Old goimapsync versions used A
+// letter for answered mails which is R in maildir spec.
+//
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// helper function to return canonical form of flags of maildir info part
+func canonicalFlags(flags string) string {
+	seen := make(map[rune]bool)
+	var symbols []string
+	for _, r := range flags {
+		switch r {
+		case 'A':
+			// old goimapsync versions used A symbol for answered mails
+			r = 'R'
+		case 'N':
+			// mails in cur area are not new
+			continue
+		}
+		if seen[r] {
+			continue
+		}
+		seen[r] = true
+		symbols = append(symbols, string(r))
+	}
+	sort.Strings(symbols)
+	return strings.Join(symbols, "")
+}
+
+// helper function to return path of given mail file with canonical flags,
+// the path is the same if flags are already canonical
+func canonicalPath(fname string) string {
+	base := filepath.Base(fname)
+	arr := strings.Split(base, ":2,")
+	if len(arr) != 2 {
+		return fname
+	}
+	return filepath.Join(filepath.Dir(fname), fmt.Sprintf("%s:2,%s", arr[0], canonicalFlags(arr[1])))
+}
+
+// helper function to check if two files have identical content
+func sameContent(fname1, fname2 string) bool {
+	data1, err := ioutil.ReadFile(fname1)
+	if err != nil {
+		return false
+	}
+	data2, err := ioutil.ReadFile(fname2)
+	if err != nil {
+		return false
+	}
+	return string(data1) == string(data2)
+}
+
+// helper function to rename given mail file to its canonical path, if
+// another file already has this path the duplicate with identical content
+// is removed, otherwise unique suffix is added to the file name. It returns
+// new path of the mail file.
+func repairFlags(fname string, dryRun bool) (string, error) {
+	fpath := canonicalPath(fname)
+	if fpath == fname {
+		return fname, nil
+	}
+	if _, err := os.Stat(fpath); err == nil {
+		if sameContent(fname, fpath) {
+			if dryRun {
+				return fpath, nil
+			}
+			return fpath, os.Remove(fname)
+		}
+		arr := strings.Split(filepath.Base(fpath), ":2,")
+		for i := 1; ; i++ {
+			fpath = filepath.Join(filepath.Dir(fname), fmt.Sprintf("%s_%d:2,%s", arr[0], i, arr[1]))
+			if _, err := os.Stat(fpath); os.IsNotExist(err) {
+				break
+			}
+		}
+	}
+	if dryRun {
+		return fpath, nil
+	}
+	return fpath, os.Rename(fname, fpath)
+}
+
+// RepairFlags walks over cur areas of local maildir and renames mail files
+// whose flags are not in canonical form, the paths of renamed files are
+// updated in DB, with dryRun it only reports files to rename
+func RepairFlags(dryRun bool) error {
+	if !dryRun {
+		if err := acquireRunLock(); err != nil {
+			return err
+		}
+		defer releaseRunLock()
+	}
+	var nfiles, nrepaired int
+	err := filepath.Walk(Config.Maildir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// skip backup snapshots, see BackupMaildir
+			if info.Name() == ".snapshots" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Base(filepath.Dir(path)) != "cur" {
+			return nil
+		}
+		nfiles += 1
+		fpath, err := repairFlags(path, dryRun)
+		if err != nil {
+			log.Printf("unable to repair flags of %s, error: %v\n", path, err)
+			return nil
+		}
+		if fpath == path {
+			return nil
+		}
+		nrepaired += 1
+		if dryRun {
+			log.Printf("dry-run rename %s -> %s\n", path, fpath)
+			return nil
+		}
+		log.Printf("rename %s -> %s\n", path, fpath)
+		if arr := strings.Split(filepath.Base(path), "."); len(arr) > 1 {
+			if entry, err := findMessage(arr[1]); err == nil && entry.Path == path {
+				if err := updateMessagePath(arr[1], fpath); err != nil {
+					log.Printf("unable to update path of %s in DB, error: %v\n", fpath, err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("repaired flags of %d out of %d local mail file(s)\n", nrepaired, nfiles)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCanonicalFlags(t *testing.T) {
+	tests := []struct {
+		flags, expect string
+	}{
+		{"", ""},
+		{"FS", "FS"},
+		{"SF", "FS"},
+		{"SSR", "RS"},
+		{"AS", "RS"},
+		{"ARS", "RS"},
+		{"NS", "S"},
+		{"TDFS", "DFST"},
+	}
+	for _, tt := range tests {
+		if got := canonicalFlags(tt.flags); got != tt.expect {
+			t.Errorf("canonicalFlags(%q)=%q, expected %q", tt.flags, got, tt.expect)
+		}
+	}
+}
+
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		fname, expect string
+	}{
+		{"/mail/cur/1.hid.host:2,FS", "/mail/cur/1.hid.host:2,FS"},
+		{"/mail/cur/1.hid.host:2,SAF", "/mail/cur/1.hid.host:2,FRS"},
+		{"/mail/cur/1.hid.host:2,", "/mail/cur/1.hid.host:2,"},
+		{"/mail/new/1.hid.host", "/mail/new/1.hid.host"},
+	}
+	for _, tt := range tests {
+		if got := canonicalPath(tt.fname); got != tt.expect {
+			t.Errorf("canonicalPath(%q)=%q, expected %q", tt.fname, got, tt.expect)
+		}
+	}
+}
+
+func TestRepairFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string // content of file at canonical path, if any
+		dryRun   bool
+		expect   string // base name of repaired file
+	}{
+		{name: "rename", expect: "1.hid.host:2,RS"},
+		{name: "dry-run", dryRun: true, expect: "1.hid.host:2,RS"},
+		{name: "duplicate", existing: "content", expect: "1.hid.host:2,RS"},
+		{name: "collision", existing: "other content", expect: "1.hid.host_1:2,RS"},
+		{name: "dry-run collision", existing: "other content", dryRun: true, expect: "1.hid.host_1:2,RS"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		fname := filepath.Join(dir, "1.hid.host:2,SA")
+		if err := ioutil.WriteFile(fname, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tt.existing != "" {
+			if err := ioutil.WriteFile(filepath.Join(dir, "1.hid.host:2,RS"), []byte(tt.existing), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fpath, err := repairFlags(fname, tt.dryRun)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if filepath.Base(fpath) != tt.expect {
+			t.Errorf("%s: repaired file %s, expected %s", tt.name, filepath.Base(fpath), tt.expect)
+		}
+		_, err = os.Stat(fname)
+		if tt.dryRun && err != nil {
+			t.Errorf("%s: dry-run touched mis-encoded file, error: %v", tt.name, err)
+		}
+		if tt.dryRun {
+			continue
+		}
+		if !os.IsNotExist(err) {
+			t.Errorf("%s: mis-encoded file is kept", tt.name)
+		}
+		data, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(data) != "content" {
+			t.Errorf("%s: repaired file has content %q", tt.name, data)
+		}
+		if tt.existing != "" {
+			// the file at canonical path is never overwritten
+			data, _ := ioutil.ReadFile(filepath.Join(dir, "1.hid.host:2,RS"))
+			if string(data) != tt.existing {
+				t.Errorf("%s: file at canonical path has content %q, expected %q", tt.name, data, tt.existing)
+			}
+		}
+	}
+}
+
+func TestRepairFlagsUpdatesDB(t *testing.T) {
+	setupTest(t)
+	dir := filepath.Join(Config.Maildir, testServerName, "INBOX", "cur")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mid := "<repair-1@localhost>"
+	hid := md5hash(mid)
+	fname := filepath.Join(dir, "1."+hid+".host:2,SA")
+	if err := ioutil.WriteFile(fname, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertMessage(Message{MessageId: mid, HashId: hid, Path: fname, Imap: testServerName}); err != nil {
+		t.Fatal(err)
+	}
+	// the file in new area has no info part and is left as is
+	ndir := filepath.Join(Config.Maildir, testServerName, "INBOX", "new")
+	os.MkdirAll(ndir, 0755)
+	nname := filepath.Join(ndir, "2.nid.host")
+	ioutil.WriteFile(nname, []byte("new"), 0644)
+
+	if err := RepairFlags(false); err != nil {
+		t.Fatal(err)
+	}
+	expect := filepath.Join(dir, "1."+hid+".host:2,RS")
+	if _, err := os.Stat(expect); err != nil {
+		t.Errorf("mis-encoded file is not repaired, error: %v", err)
+	}
+	if _, err := os.Stat(nname); err != nil {
+		t.Errorf("file in new area is touched, error: %v", err)
+	}
+	entry, err := findMessage(hid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Path != expect {
+		t.Errorf("DB path %s, expected %s", entry.Path, expect)
+	}
+}
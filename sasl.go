@@ -0,0 +1,69 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// sasl module for goimapsync, it provides authentication mechanisms
+// of IMAP servers, see Server.AuthMechanism
+//
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+)
+
+// CramMD5Client implements sasl.Client interface for CRAM-MD5 mechanism,
+// see https://tools.ietf.org/html/rfc2195
+type CramMD5Client struct {
+	Username string // user name
+	Password string // user password
+}
+
+// Start implements sasl.Client interface
+func (a *CramMD5Client) Start() (string, []byte, error) {
+	return "CRAM-MD5", nil, nil
+}
+
+// Next implements sasl.Client interface
+func (a *CramMD5Client) Next(challenge []byte) ([]byte, error) {
+	h := hmac.New(md5.New, []byte(a.Password))
+	h.Write(challenge)
+	resp := fmt.Sprintf("%s %s", a.Username, hex.EncodeToString(h.Sum(nil)))
+	return []byte(resp), nil
+}
+
+// helper function to return SASL client for given server authentication
+// mechanism, the LOGIN mechanism uses IMAP LOGIN command and has no client
+func saslClient(s Server) (sasl.Client, error) {
+	switch strings.ToUpper(s.AuthMechanism) {
+	case "", "LOGIN":
+		return nil, nil
+	case "PLAIN":
+		return sasl.NewPlainClient("", s.Username, s.Password), nil
+	case "CRAM-MD5":
+		return &CramMD5Client{Username: s.Username, Password: s.Password}, nil
+	}
+	return nil, fmt.Errorf("unsupported authMechanism '%s' of '%s', please use LOGIN, PLAIN or CRAM-MD5", s.AuthMechanism, s.Name)
+}
+
+// helper function to authenticate to IMAP server using its mechanism
+func authenticate(c *client.Client, s Server) error {
+	auth, err := saslClient(s)
+	if err != nil {
+		return err
+	}
+	if auth == nil {
+		return c.Login(s.Username, s.Password)
+	}
+	mech, _, _ := auth.Start()
+	if ok, err := c.SupportAuth(mech); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("IMAP server '%s' does not support AUTH=%s", s.Name, mech)
+	}
+	return c.Authenticate(auth)
+}
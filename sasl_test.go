@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCramMD5Client(t *testing.T) {
+	// example of RFC 2195
+	auth := &CramMD5Client{Username: "tim", Password: "tanstaaftanstaaf"}
+	if mech, ir, err := auth.Start(); mech != "CRAM-MD5" || ir != nil || err != nil {
+		t.Errorf("start of CRAM-MD5 %q %q %v", mech, ir, err)
+	}
+	resp, err := auth.Next([]byte("<1896.697170952@postoffice.reston.mci.net>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := "tim b913a602c7eda7a495b4e6e7334d3890"; string(resp) != expect {
+		t.Errorf("CRAM-MD5 response %q, expected %q", resp, expect)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		mechanism string
+		password  string
+		expect    []string
+		fail      string
+	}{
+		{"", "password", nil, ""},
+		{"login", "password", nil, ""},
+		{"PLAIN", "password", []string{"PLAIN"}, ""},
+		{"cram-md5", "password", []string{"CRAM-MD5"}, ""},
+		{"CRAM-MD5", "wrong", []string{"CRAM-MD5"}, "invalid CRAM-MD5 digest"},
+		{"XOAUTH2", "password", nil, "unsupported authMechanism 'XOAUTH2'"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q %s", tt.mechanism, tt.password), func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			s := ts.Server
+			s.AuthMechanism = tt.mechanism
+			s.Password = tt.password
+			c, err := dial(s)
+			if tt.fail != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.fail) {
+					t.Errorf("%q: expected error with %q, got %v", tt.mechanism, tt.fail, err)
+				}
+			} else if err != nil {
+				t.Errorf("%q: %v", tt.mechanism, err)
+			} else {
+				c.Logout()
+			}
+			if got := ts.Auth.Get(); strings.Join(got, ",") != strings.Join(tt.expect, ",") {
+				t.Errorf("%q: used mechanisms %v, expected %v", tt.mechanism, got, tt.expect)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// search module for goimapsync, it searches messages of IMAP folder on the
+// server side via UID SEARCH, the query is a list of terms, e.g.
+//    FROM boss SINCE 1-Jun-2024 SUBJECT "review" UNSEEN
+// the terms are combined with AND, values with spaces should be quoted
+//
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// helper function to split search query into terms, double quoted values
+// are kept as single term
+func splitQuery(query string) ([]string, error) {
+	var terms []string
+	var term strings.Builder
+	quoted, inTerm := false, false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inTerm = true
+		case r == ' ' && !quoted:
+			if inTerm {
+				terms = append(terms, term.String())
+				term.Reset()
+				inTerm = false
+			}
+		default:
+			term.WriteRune(r)
+			inTerm = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unbalanced quotes in query '%s'", query)
+	}
+	if inTerm {
+		terms = append(terms, term.String())
+	}
+	return terms, nil
+}
+
+// helper function to parse search query into IMAP search criteria, it
+// supports FROM, TO, SUBJECT, TEXT, SINCE, BEFORE, UNSEEN and FLAGGED terms
+func parseQuery(query string) (*imap.SearchCriteria, error) {
+	terms, err := splitQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("empty search query")
+	}
+	criteria := imap.NewSearchCriteria()
+	for i := 0; i < len(terms); i++ {
+		key := strings.ToUpper(terms[i])
+		switch key {
+		case "UNSEEN":
+			criteria.WithoutFlags = append(criteria.WithoutFlags, imap.SeenFlag)
+			continue
+		case "FLAGGED":
+			criteria.WithFlags = append(criteria.WithFlags, imap.FlaggedFlag)
+			continue
+		case "FROM", "TO", "SUBJECT", "TEXT", "SINCE", "BEFORE":
+		default:
+			return nil, fmt.Errorf("unsupported search term '%s'", terms[i])
+		}
+		if i+1 >= len(terms) {
+			return nil, fmt.Errorf("search term %s requires value", key)
+		}
+		i++
+		value := terms[i]
+		switch key {
+		case "FROM", "TO", "SUBJECT":
+			criteria.Header.Add(key, value)
+		case "TEXT":
+			criteria.Text = append(criteria.Text, value)
+		case "SINCE", "BEFORE":
+			t, err := parseDate(value)
+			if err != nil {
+				return nil, err
+			}
+			if key == "SINCE" {
+				criteria.Since = searchSince(t)
+			} else {
+				criteria.Before = searchBefore(t)
+			}
+		}
+	}
+	return criteria, nil
+}
+
+// RemoteSearch searches messages of given IMAP folder via UID SEARCH and
+// returns envelopes of matching messages fetched in single batch, the found
+// UIDs are recorded in DB such that they can be used by -uid option
+func RemoteSearch(c *client.Client, imapName, folder, query string) ([]MessageInfo, error) {
+	defer timing("RemoteSearch", time.Now())
+	defer profiler("RemoteSearch")()
+	var out []MessageInfo
+	criteria, err := parseQuery(query)
+	if err != nil {
+		return out, err
+	}
+	setOperation(imapName, "search", folder)
+	name := imapFolder(imapName, folder)
+	var uids []uint32
+	c, err = withReconnect(c, imapName, "", func(c *client.Client) error {
+		if _, err := c.Select(name, true); err != nil {
+			return err
+		}
+		if verboseLevel(imapName) > 1 {
+			log.Println("IMAP search", criteria.Format())
+		}
+		var err error
+		uids, err = c.UidSearch(criteria)
+		return err
+	})
+	if err != nil {
+		if isConnError(err) {
+			return out, err
+		}
+		// the server rejected the search, e.g. it does not support the
+		// charset of the query
+		return out, fmt.Errorf("IMAP server %s is unable to perform search '%s': %w", imapName, query, err)
+	}
+	if len(uids) == 0 {
+		return out, nil
+	}
+
+	var msgs []Message
+	_, err = withReconnect(c, imapName, name, func(c *client.Client) error {
+		out, msgs = nil, nil
+		messages := make(chan *imap.Message, 10)
+		items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags, imap.FetchUid}
+		done := fetchMessages(c, uidSet(uids), items, messages, true)
+		for msg := range messages {
+			if msg == nil || msg.Envelope == nil {
+				continue
+			}
+			out = append(out, MessageInfo{
+				Imap:      imapName,
+				Folder:    folder,
+				SeqNumber: msg.SeqNum,
+				Uid:       msg.Uid,
+				Date:      msg.Envelope.Date,
+				From:      formatAddresses(msg.Envelope.From),
+				Subject:   msg.Envelope.Subject,
+				Flags:     msg.Flags,
+				MessageId: msg.Envelope.MessageId,
+			})
+			msgs = append(msgs, Message{Uid: msg.Uid, HashId: md5hash(msg.Envelope.MessageId)})
+		}
+		return <-done
+	})
+	if err != nil {
+		return out, err
+	}
+	if err := recordPresence(time.Now().Unix(), imapName, name, msgs); err != nil {
+		log.Printf("unable to record found UIDs of '%s' on '%s', error: %v\n", folder, imapName, err)
+	}
+	return out, nil
+}
+
+// helper function to print UIDs of found messages as comma separated list
+// suitable for -uid option
+func printUids(mlist []MessageInfo) {
+	var uids []string
+	for _, m := range mlist {
+		uids = append(uids, fmt.Sprintf("%d", m.Uid))
+	}
+	fmt.Println(strings.Join(uids, ","))
+}
@@ -0,0 +1,875 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// selftest module for goimapsync, it runs goimapsync end-to-end against
+// in-memory IMAP server of go-imap library preloaded with messages, such
+// that fetch and move code paths are exercised over real IMAP protocol
+// without external servers. It provides test server and setup of temporary
+// maildir and DB shared by other tests.
+//
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
+)
+
+// name of IMAP server used by self-test
+const testServerName = "selftest"
+
+// hostname used in names of local mail files written by self-test
+const testHostname = "selftest.localhost"
+
+// testMessage represents message preloaded into self-test IMAP server
+type testMessage struct {
+	MessageId string    // message id
+	Subject   string    // message subject
+	InReplyTo string    // message id of parent message
+	Flags     []string  // message flags
+	Date      time.Time // message date and internal date (default current time)
+}
+
+// testMessages lists messages preloaded into INBOX of self-test IMAP
+// server, in-memory backend already has one seen message in INBOX
+var testMessages = []testMessage{
+	{MessageId: "<selftest-1@localhost>", Subject: "Self-test message"},
+	{MessageId: "<selftest-2@localhost>", Subject: "Re: Self-test message", InReplyTo: "<selftest-1@localhost>", Flags: []string{imap.SeenFlag}},
+	{MessageId: "<selftest-3@localhost>", Subject: "Self-test message to move", Flags: []string{imap.FlaggedFlag}},
+}
+
+// helper function to compose body of self-test message
+func (m testMessage) body() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("From: selftest@example.org\r\n")
+	buf.WriteString("To: selftest@example.org\r\n")
+	buf.WriteString(fmt.Sprintf("Subject: %s\r\n", m.Subject))
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	buf.WriteString(fmt.Sprintf("Date: %s\r\n", date.Format(time.RFC1123Z)))
+	buf.WriteString(fmt.Sprintf("Message-ID: %s\r\n", m.MessageId))
+	if m.InReplyTo != "" {
+		buf.WriteString(fmt.Sprintf("In-Reply-To: %s\r\n", m.InReplyTo))
+		buf.WriteString(fmt.Sprintf("References: %s\r\n", m.InReplyTo))
+	}
+	buf.WriteString("Content-Type: text/plain\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(fmt.Sprintf("Body of %s\r\n", m.MessageId))
+	return buf.Bytes()
+}
+
+// testListener represents listener of self-test IMAP server which counts
+// open connections and their peak number, it also counts FETCH responses
+// and may drop connection after given number of them or refuse new ones
+type testListener struct {
+	net.Listener
+	sync.Mutex
+	Open    int // number of open connections
+	Peak    int // peak number of open connections since last reset
+	Fetches int // number of FETCH responses sent to clients
+	drop    int // number of FETCH responses after which connection is dropped
+	refuse  int // number of new connections closed before the greeting
+
+	conns map[*testConn]bool // open connections
+}
+
+// testConn represents connection of self-test IMAP server
+type testConn struct {
+	net.Conn
+	once     sync.Once
+	listener *testListener
+}
+
+// Accept implements net.Listener interface
+func (l *testListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	l.Lock()
+	defer l.Unlock()
+	for l.refuse > 0 {
+		l.refuse -= 1
+		conn.Close()
+		l.Unlock()
+		conn, err = l.Listener.Accept()
+		l.Lock()
+		if err != nil {
+			return conn, err
+		}
+	}
+	l.Open += 1
+	if l.Open > l.Peak {
+		l.Peak = l.Open
+	}
+	tc := &testConn{Conn: conn, listener: l}
+	if l.conns == nil {
+		l.conns = make(map[*testConn]bool)
+	}
+	l.conns[tc] = true
+	return tc, nil
+}
+
+// DropAll drops all open connections of clients
+func (l *testListener) DropAll() {
+	l.Lock()
+	var conns []*testConn
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// Reset sets peak number of connections to current number of them and
+// returns previous peak
+func (l *testListener) Reset() int {
+	l.Lock()
+	defer l.Unlock()
+	peak := l.Peak
+	l.Peak = l.Open
+	return peak
+}
+
+// FetchCount returns number of FETCH responses sent to clients
+func (l *testListener) FetchCount() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.Fetches
+}
+
+// DropAfter sets number of FETCH responses, counted from now, after which
+// connection of the client is dropped once
+func (l *testListener) DropAfter(n int) {
+	l.Lock()
+	defer l.Unlock()
+	l.drop = l.Fetches + n
+}
+
+// RefuseNext sets number of new connections which are closed before the
+// greeting, i.e. their dial fails
+func (l *testListener) RefuseNext(n int) {
+	l.Lock()
+	defer l.Unlock()
+	l.refuse = n
+}
+
+// Write implements net.Conn interface
+func (c *testConn) Write(p []byte) (int, error) {
+	l := c.listener
+	l.Lock()
+	l.Fetches += bytes.Count(p, []byte(" FETCH ("))
+	drop := l.drop > 0 && l.Fetches >= l.drop
+	if drop {
+		l.drop = 0
+	}
+	l.Unlock()
+	n, err := c.Conn.Write(p)
+	if drop {
+		c.Close()
+	}
+	return n, err
+}
+
+// Close implements net.Conn interface
+func (c *testConn) Close() error {
+	c.once.Do(func() {
+		c.listener.Lock()
+		c.listener.Open -= 1
+		delete(c.listener.conns, c)
+		c.listener.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// testServer represents in-memory IMAP server of tests
+type testServer struct {
+	Server    Server                  // configuration of the server
+	Backend   *memory.Backend         // in-memory backend of the server
+	User      backend.User            // user of the backend
+	Listener  *testListener           // listener which counts connections
+	Id        *testIdExtension        // ID extension which keeps identification
+	Expunge   *testExpungeExtension   // extension which counts EXPUNGE commands
+	Auth      *testAuth               // SASL mechanisms used by clients
+	Enable    *testEnableExtension    // ENABLE extension which keeps capabilities
+	List      *testListExtension      // extension which fails or stalls LIST
+	Namespace *testNamespaceExtension // NAMESPACE extension with personal prefix
+}
+
+// helper function to start in-memory IMAP server for tests, the server has
+// only INBOX with one seen message of in-memory backend and it is closed
+// once the test is done
+func startTestServer(t *testing.T) *testServer {
+	t.Helper()
+	be := memory.New()
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{
+		Server:    Server{Name: testServerName, Uri: ln.Addr().String(), Username: "username", Password: "password"},
+		Backend:   be,
+		User:      user,
+		Listener:  &testListener{Listener: ln},
+		Id:        &testIdExtension{},
+		Expunge:   &testExpungeExtension{},
+		Auth:      &testAuth{},
+		Enable:    &testEnableExtension{},
+		List:      &testListExtension{release: make(chan struct{})},
+		Namespace: &testNamespaceExtension{},
+	}
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	s.Addr = ts.Server.Uri
+	s.Enable(ts.Id)
+	s.Enable(ts.Expunge)
+	s.Enable(ts.Enable)
+	s.Enable(ts.List)
+	s.Enable(ts.Namespace)
+	s.EnableAuth(sasl.Plain, ts.Auth.plain(be))
+	s.EnableAuth("CRAM-MD5", ts.Auth.cramMD5(be))
+	go s.Serve(ts.Listener)
+	t.Cleanup(func() {
+		close(ts.List.release)
+		s.Close()
+	})
+	return ts
+}
+
+// helper function to return mailbox of test server, the mailbox is created
+// if it does not exist
+func (ts *testServer) mailbox(t *testing.T, name string) backend.Mailbox {
+	t.Helper()
+	mbox, err := ts.User.GetMailbox(name)
+	if err != nil {
+		if err := ts.User.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+		if mbox, err = ts.User.GetMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mbox
+}
+
+// helper function to remove all messages of given mailbox of test server,
+// e.g. seen message of in-memory backend in INBOX
+func (ts *testServer) empty(t *testing.T, name string) {
+	t.Helper()
+	mbox, ok := ts.mailbox(t, name).(*memory.Mailbox)
+	if !ok {
+		t.Fatalf("mailbox %s is not in-memory one", name)
+	}
+	mbox.Messages = nil
+}
+
+// helper function to add given messages to mailbox of test server
+func (ts *testServer) add(t *testing.T, name string, msgs ...testMessage) {
+	t.Helper()
+	mbox := ts.mailbox(t, name)
+	for _, m := range msgs {
+		date := m.Date
+		if date.IsZero() {
+			date = time.Now()
+		}
+		if err := mbox.CreateMessage(m.Flags, date, bytes.NewBuffer(m.body())); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// helper function to add raw message to mailbox of test server
+func (ts *testServer) addRaw(t *testing.T, name string, flags []string, data []byte) {
+	t.Helper()
+	if err := ts.mailbox(t, name).CreateMessage(flags, time.Now(), bytes.NewBuffer(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// helper function to count messages of given mailbox of test server
+func (ts *testServer) size(t *testing.T, name string) uint32 {
+	t.Helper()
+	status, err := ts.mailbox(t, name).Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status.Messages
+}
+
+// helper function to return flags of messages of given mailbox of test
+// server by their message ids
+func (ts *testServer) flags(t *testing.T, name string) map[string][]string {
+	t.Helper()
+	seqset, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 100)
+	if err := ts.mailbox(t, name).ListMessages(false, seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags}, ch); err != nil {
+		t.Fatal(err)
+	}
+	flags := make(map[string][]string)
+	for msg := range ch {
+		var out []string
+		for _, f := range msg.Flags {
+			if f != imap.RecentFlag {
+				out = append(out, f)
+			}
+		}
+		sort.Strings(out)
+		flags[msg.Envelope.MessageId] = out
+	}
+	return flags
+}
+
+// helper function to login to test server, the connection is registered as
+// primary one of its server and folders of the server are listed
+func (ts *testServer) connect(t *testing.T) *client.Client {
+	t.Helper()
+	Config.Servers = append(Config.Servers, ts.Server)
+	c, err := dial(ts.Server)
+	if err != nil {
+		t.Fatalf("unable to login to test IMAP server: %v", err)
+	}
+	registerClient(ts.Server.Name, c)
+	t.Cleanup(func() { logout(map[string]*client.Client{ts.Server.Name: c}) })
+	ts.listFolders(t, c)
+	return c
+}
+
+// helper function to list folders of test server
+func (ts *testServer) listFolders(t *testing.T, c *client.Client) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(Config.ListTimeout)*time.Second)
+	defer cancel()
+	folders, err := getImapFolders(ctx, currentClient(ts.Server.Name, c), ts.Server.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imapFolders[ts.Server.Name] = folders
+}
+
+// helper function to set up configuration, maildir and DB of a test in its
+// temporary directory, the global state is reset once the test is done
+func setupTest(t testing.TB) {
+	t.Helper()
+	Config = Configuration{Maildir: filepath.Join(t.TempDir(), "maildir"), MaildirHostname: testHostname}
+	if err := os.MkdirAll(Config.Maildir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ParseConfig(nil, nil)
+	imapFolders = make(map[string][]string)
+	RunSummary = Summary{}
+	var err error
+	if hostname, err = maildirHostname(); err != nil {
+		t.Fatal(err)
+	}
+	if mdb, err = InitDB(false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mdb.Close()
+		resetTestState()
+	})
+}
+
+// helper function to reset registries of connections, pools and logins
+// along with run context
+func resetTestState() {
+	drainPools()
+	connections.Lock()
+	connections.cmap = make(map[string]*client.Client)
+	connections.replaced = make(map[*client.Client]*client.Client)
+	connections.Unlock()
+	logins.Lock()
+	logins.open = make(map[string]int)
+	logins.peak = make(map[string]int)
+	logins.Unlock()
+	pools.Lock()
+	pools.pmap = make(map[string]*Pool)
+	pools.Unlock()
+	namespaces.Lock()
+	namespaces.nmap = make(map[string]Namespace)
+	namespaces.Unlock()
+	runContext, cancelRun = context.WithCancel(context.Background())
+}
+
+// testIdExtension represents ID extension of self-test IMAP server, it
+// keeps identification fields of the last ID command
+type testIdExtension struct {
+	sync.Mutex
+	Fields map[string]string // identification fields sent by the client
+}
+
+// Get returns identification fields of the last ID command
+func (ext *testIdExtension) Get() map[string]string {
+	ext.Lock()
+	defer ext.Unlock()
+	return ext.Fields
+}
+
+// Capabilities implements server.Extension interface
+func (ext *testIdExtension) Capabilities(c server.Conn) []string {
+	return []string{"ID"}
+}
+
+// Command implements server.Extension interface
+func (ext *testIdExtension) Command(name string) server.HandlerFactory {
+	if name != "ID" {
+		return nil
+	}
+	return func() server.Handler {
+		return &testIdHandler{ext: ext}
+	}
+}
+
+// testIdHandler handles ID command of self-test IMAP server
+type testIdHandler struct {
+	ext    *testIdExtension  // extension which keeps identification
+	fields map[string]string // identification fields of the command
+}
+
+// Parse implements imap.Parser interface
+func (h *testIdHandler) Parse(fields []interface{}) error {
+	if len(fields) < 1 {
+		return errors.New("ID command needs 1 argument")
+	}
+	var err error
+	h.fields, err = parseIdFields(fields[0])
+	return err
+}
+
+// Handle implements server.Handler interface
+func (h *testIdHandler) Handle(conn server.Conn) error {
+	h.ext.Lock()
+	h.ext.Fields = h.fields
+	h.ext.Unlock()
+	fields := idFields(map[string]string{"name": "selftest"})
+	return conn.WriteResp(&imap.DataResp{Fields: []interface{}{imap.RawString("ID"), fields}})
+}
+
+// testExpungeExtension represents extension of self-test IMAP server
+// which counts EXPUNGE commands
+type testExpungeExtension struct {
+	sync.Mutex
+	Count int    // number of EXPUNGE commands
+	wait  func() // function called before EXPUNGE is executed
+	err   error  // error returned by EXPUNGE instead of its execution
+}
+
+// SetWait sets function which is called before EXPUNGE is executed
+func (ext *testExpungeExtension) SetWait(wait func()) {
+	ext.Lock()
+	defer ext.Unlock()
+	ext.wait = wait
+}
+
+// SetError sets error which EXPUNGE returns instead of its execution
+func (ext *testExpungeExtension) SetError(err error) {
+	ext.Lock()
+	defer ext.Unlock()
+	ext.err = err
+}
+
+// Get returns number of EXPUNGE commands
+func (ext *testExpungeExtension) Get() int {
+	ext.Lock()
+	defer ext.Unlock()
+	return ext.Count
+}
+
+// Capabilities implements server.Extension interface
+func (ext *testExpungeExtension) Capabilities(c server.Conn) []string {
+	return nil
+}
+
+// Command implements server.Extension interface, it overrides builtin
+// EXPUNGE command
+func (ext *testExpungeExtension) Command(name string) server.HandlerFactory {
+	if name != "EXPUNGE" {
+		return nil
+	}
+	return func() server.Handler {
+		return &testExpungeHandler{ext: ext}
+	}
+}
+
+// testExpungeHandler handles EXPUNGE command of self-test IMAP server
+type testExpungeHandler struct {
+	server.Expunge
+	ext *testExpungeExtension // extension which counts commands
+}
+
+// Handle implements server.Handler interface
+func (h *testExpungeHandler) Handle(conn server.Conn) error {
+	h.ext.Lock()
+	h.ext.Count += 1
+	wait, err := h.ext.wait, h.ext.err
+	h.ext.Unlock()
+	if wait != nil {
+		wait()
+	}
+	if err != nil {
+		return err
+	}
+	return h.Expunge.Handle(conn)
+}
+
+// testEnableExtension represents ENABLE extension of self-test IMAP server,
+// it keeps capabilities enabled by the client
+type testEnableExtension struct {
+	sync.Mutex
+	Advertise bool     // advertise UTF8=ACCEPT capability (default false)
+	Enabled   []string // capabilities enabled by the client
+}
+
+// Get returns capabilities enabled by the client
+func (ext *testEnableExtension) Get() []string {
+	ext.Lock()
+	defer ext.Unlock()
+	return append([]string{}, ext.Enabled...)
+}
+
+// AdvertiseUTF8 sets server to advertise UTF8=ACCEPT capability
+func (ext *testEnableExtension) AdvertiseUTF8() {
+	ext.Lock()
+	defer ext.Unlock()
+	ext.Advertise = true
+}
+
+// Capabilities implements server.Extension interface
+func (ext *testEnableExtension) Capabilities(c server.Conn) []string {
+	ext.Lock()
+	defer ext.Unlock()
+	if !ext.Advertise {
+		return []string{"ENABLE"}
+	}
+	return []string{"ENABLE", "UTF8=ACCEPT"}
+}
+
+// Command implements server.Extension interface
+func (ext *testEnableExtension) Command(name string) server.HandlerFactory {
+	if name != "ENABLE" {
+		return nil
+	}
+	return func() server.Handler {
+		return &testEnableHandler{ext: ext}
+	}
+}
+
+// testEnableHandler handles ENABLE command of self-test IMAP server
+type testEnableHandler struct {
+	commands.Enable
+	ext *testEnableExtension // extension which keeps enabled capabilities
+}
+
+// Handle implements server.Handler interface
+func (h *testEnableHandler) Handle(conn server.Conn) error {
+	h.ext.Lock()
+	h.ext.Enabled = append(h.ext.Enabled, h.Caps...)
+	h.ext.Unlock()
+	fields := []interface{}{imap.RawString("ENABLED")}
+	for _, c := range h.Caps {
+		fields = append(fields, imap.RawString(c))
+	}
+	return conn.WriteResp(&imap.DataResp{Fields: fields})
+}
+
+// testListExtension represents extension of self-test IMAP server which
+// overrides builtin LIST command to fail or stall it
+type testListExtension struct {
+	sync.Mutex
+	Mode    string        // fail, stall or empty for builtin LIST
+	release chan struct{} // closed when stalled LIST commands should finish
+}
+
+// Set sets mode of LIST command
+func (ext *testListExtension) Set(mode string) {
+	ext.Lock()
+	defer ext.Unlock()
+	ext.Mode = mode
+}
+
+// Capabilities implements server.Extension interface
+func (ext *testListExtension) Capabilities(c server.Conn) []string {
+	return nil
+}
+
+// Command implements server.Extension interface
+func (ext *testListExtension) Command(name string) server.HandlerFactory {
+	if name != "LIST" {
+		return nil
+	}
+	return func() server.Handler {
+		return &testListHandler{ext: ext}
+	}
+}
+
+// testListHandler handles LIST command of self-test IMAP server
+type testListHandler struct {
+	server.List
+	ext *testListExtension // extension which keeps mode of the command
+}
+
+// Handle implements server.Handler interface
+func (h *testListHandler) Handle(conn server.Conn) error {
+	h.ext.Lock()
+	mode := h.ext.Mode
+	h.ext.Unlock()
+	switch mode {
+	case "fail":
+		return errors.New("list is not permitted")
+	case "stall":
+		<-h.ext.release
+		return errors.New("list is stalled")
+	}
+	return h.List.Handle(conn)
+}
+
+// testNamespaceExtension represents NAMESPACE extension of self-test IMAP
+// server, it reports personal namespace with given prefix
+type testNamespaceExtension struct {
+	sync.Mutex
+	Prefix string // prefix of personal namespace, empty disables extension
+}
+
+// Set sets prefix of personal namespace
+func (ext *testNamespaceExtension) Set(prefix string) {
+	ext.Lock()
+	defer ext.Unlock()
+	ext.Prefix = prefix
+}
+
+// Get returns prefix of personal namespace
+func (ext *testNamespaceExtension) Get() string {
+	ext.Lock()
+	defer ext.Unlock()
+	return ext.Prefix
+}
+
+// Capabilities implements server.Extension interface
+func (ext *testNamespaceExtension) Capabilities(c server.Conn) []string {
+	if ext.Get() == "" {
+		return nil
+	}
+	return []string{"NAMESPACE"}
+}
+
+// Command implements server.Extension interface
+func (ext *testNamespaceExtension) Command(name string) server.HandlerFactory {
+	if name != "NAMESPACE" {
+		return nil
+	}
+	return func() server.Handler {
+		return &testNamespaceHandler{ext: ext}
+	}
+}
+
+// testNamespaceHandler handles NAMESPACE command of self-test IMAP server
+type testNamespaceHandler struct {
+	ext *testNamespaceExtension // extension which keeps namespace prefix
+}
+
+// Parse implements imap.Parser interface
+func (h *testNamespaceHandler) Parse(fields []interface{}) error {
+	return nil
+}
+
+// Handle implements server.Handler interface
+func (h *testNamespaceHandler) Handle(conn server.Conn) error {
+	personal := []interface{}{[]interface{}{h.ext.Get(), "."}}
+	fields := []interface{}{imap.RawString("NAMESPACE"), personal, nil, nil}
+	return conn.WriteResp(&imap.DataResp{Fields: fields})
+}
+
+// testAuth keeps SASL mechanisms used by clients of self-test IMAP server,
+// the LOGIN command is not recorded
+type testAuth struct {
+	sync.Mutex
+	Mechanisms []string // used SASL mechanisms
+}
+
+// Get returns SASL mechanisms used by clients
+func (a *testAuth) Get() []string {
+	a.Lock()
+	defer a.Unlock()
+	return append([]string{}, a.Mechanisms...)
+}
+
+// testAuthServer wraps sasl.Server to record its mechanism once the client
+// starts authentication, the server creates SASL servers of all mechanisms
+// on every AUTHENTICATE command
+type testAuthServer struct {
+	sasl.Server
+	auth    *testAuth // recorder of used mechanisms
+	mech    string    // SASL mechanism
+	started bool      // true if client started authentication
+}
+
+// Next implements sasl.Server interface
+func (a *testAuthServer) Next(response []byte) ([]byte, bool, error) {
+	if !a.started {
+		a.started = true
+		a.auth.Lock()
+		a.auth.Mechanisms = append(a.auth.Mechanisms, a.mech)
+		a.auth.Unlock()
+	}
+	return a.Server.Next(response)
+}
+
+// helper function to log in user of the backend
+func testLogin(conn server.Conn, be backend.Backend, username, password string) error {
+	user, err := be.Login(conn.Info(), username, password)
+	if err != nil {
+		return err
+	}
+	ctx := conn.Context()
+	ctx.State = imap.AuthenticatedState
+	ctx.User = user
+	return nil
+}
+
+// helper function to return PLAIN mechanism of self-test IMAP server
+func (a *testAuth) plain(be backend.Backend) server.SASLServerFactory {
+	return func(conn server.Conn) sasl.Server {
+		return &testAuthServer{Server: sasl.NewPlainServer(func(identity, username, password string) error {
+			return testLogin(conn, be, username, password)
+		}), auth: a, mech: sasl.Plain}
+	}
+}
+
+// helper function to return CRAM-MD5 mechanism of self-test IMAP server,
+// the digest is verified against password of the test user
+func (a *testAuth) cramMD5(be backend.Backend) server.SASLServerFactory {
+	return func(conn server.Conn) sasl.Server {
+		return &testAuthServer{Server: &testCramMD5Server{login: func(username, password string) error {
+			return testLogin(conn, be, username, password)
+		}}, auth: a, mech: "CRAM-MD5"}
+	}
+}
+
+// testCramMD5Server implements sasl.Server interface for CRAM-MD5 mechanism
+type testCramMD5Server struct {
+	challenge []byte                                // challenge sent to the client
+	login     func(username, password string) error // login of the user
+}
+
+// Next implements sasl.Server interface
+func (a *testCramMD5Server) Next(response []byte) ([]byte, bool, error) {
+	if a.challenge == nil {
+		a.challenge = []byte("<1896.697170952@selftest.localhost>")
+		return a.challenge, false, nil
+	}
+	parts := strings.SplitN(string(response), " ", 2)
+	if len(parts) != 2 {
+		return nil, true, errors.New("malformed CRAM-MD5 response")
+	}
+	digest, err := (&CramMD5Client{Username: parts[0], Password: "password"}).Next(a.challenge)
+	if err != nil {
+		return nil, true, err
+	}
+	if string(digest) != string(response) {
+		return nil, true, errors.New("invalid CRAM-MD5 digest")
+	}
+	return nil, true, a.login(parts[0], "password")
+}
+
+// TestSelfTest runs goimapsync end-to-end against in-memory IMAP server: it
+// fetches INBOX, verifies local mail files and DB records, re-fetches INBOX
+// to verify that nothing is written twice and moves one message to Archive
+// folder
+func TestSelfTest(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	for _, name := range []string{"Archive", "Empty"} {
+		ts.mailbox(t, name)
+	}
+	ts.add(t, "INBOX", testMessages...)
+	c := ts.connect(t)
+
+	// fetch INBOX and verify local copies of preloaded messages
+	nmsg := ts.size(t, "INBOX")
+	msgs, err := Fetch(c, testServerName, "INBOX", false, FlagFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint32(len(msgs)) != nmsg {
+		t.Fatalf("fetched %d message(s) out of %d", len(msgs), nmsg)
+	}
+	for _, m := range testMessages {
+		if err := verifySelfTestMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Logf("fetched and verified %d message(s)", len(msgs))
+
+	// second fetch should not write any new files
+	files := len(readMaildir(testServerName, "INBOX"))
+	if _, err := Fetch(c, testServerName, "INBOX", false, FlagFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(readMaildir(testServerName, "INBOX")); n != files {
+		t.Fatalf("re-fetch changed number of local INBOX files from %d to %d", files, n)
+	}
+	t.Log("re-fetch did not write duplicates")
+
+	// move message to Archive folder
+	m := testMessages[2]
+	if err := Move(currentClient(testServerName, c), testServerName, m.MessageId, "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	if n := ts.size(t, "Archive"); n != 1 {
+		t.Fatalf("Archive folder has %d message(s) after move instead of 1", n)
+	}
+	if n := ts.size(t, "INBOX"); n != nmsg-1 {
+		t.Fatalf("INBOX folder has %d message(s) after move instead of %d", n, nmsg-1)
+	}
+	t.Log("moved message to Archive folder")
+}
+
+// helper function to verify local mail file and DB record of given
+// self-test message
+func verifySelfTestMessage(m testMessage) error {
+	hid := md5hash(m.MessageId)
+	entry, err := findMessage(hid)
+	if err != nil || entry.HashId != hid {
+		return fmt.Errorf("message %s is not recorded in DB", m.MessageId)
+	}
+	fname := findLocalMail(testServerName, "INBOX", hid)
+	if fname == "" {
+		return fmt.Errorf("message %s is not written into local maildir", m.MessageId)
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(data, []byte(fmt.Sprintf("Body of %s", m.MessageId))) {
+		return fmt.Errorf("local copy %s of message %s has wrong body", fname, m.MessageId)
+	}
+	if entry.Path != fname {
+		return fmt.Errorf("DB path %s of message %s differs from local file %s", entry.Path, m.MessageId, fname)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// sidecar module for goimapsync, in archive mode (Config.ArchiveMode) the
+// mail is written exactly as BODY[] returns it, i.e. with original line
+// endings and order of headers, and its IMAP metadata (UID, UIDVALIDITY,
+// flags, internal date) is kept in JSON sidecar file
+//    <maildir folder>/.meta/<hid>.json
+// outside of cur, new and tmp areas such that MUAs never see it.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// name of directory of sidecar files within local maildir folder
+const sidecarDir = ".meta"
+
+// MessageMeta represents sidecar metadata of mail written in archive mode
+type MessageMeta struct {
+	Imap         string    `json:"imap"`         // name of IMAP server
+	Folder       string    `json:"folder"`       // name of IMAP folder
+	Uid          uint32    `json:"uid"`          // message UID
+	UidValidity  uint32    `json:"uidvalidity"`  // UIDVALIDITY of IMAP folder
+	Flags        []string  `json:"flags"`        // message flags on IMAP server
+	InternalDate time.Time `json:"internaldate"` // internal date of message on IMAP server
+	MessageId    string    `json:"mid"`          // message id
+	HashId       string    `json:"hid"`          // message id hash
+	Size         int64     `json:"size"`         // size of mail file
+	Sha256       string    `json:"sha256"`       // checksum of mail file
+}
+
+// helper function to return path of sidecar file of given message
+func sidecarPath(imapName, folder, hid string) string {
+	return filepath.Join(localPath(imapName, folder, sidecarDir), fmt.Sprintf("%s.json", hid))
+}
+
+// helper function to write sidecar file of given message, the file is
+// written into temporary file first and renamed into its place
+func writeSidecar(imapName, folder string, m Message, size int64, sha string) error {
+	meta := MessageMeta{
+		Imap:         imapName,
+		Folder:       folder,
+		Uid:          m.Uid,
+		UidValidity:  folderUidValidity(imapName, folder),
+		Flags:        m.Flags,
+		InternalDate: m.InternalDate,
+		MessageId:    m.MessageId,
+		HashId:       m.HashId,
+		Size:         size,
+		Sha256:       sha,
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	fpath := sidecarPath(imapName, folder, m.HashId)
+	if err := os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+		return err
+	}
+	tpath := fpath + ".tmp"
+	if err := ioutil.WriteFile(tpath, data, 0644); err != nil {
+		os.Remove(tpath)
+		return err
+	}
+	return os.Rename(tpath, fpath)
+}
+
+// helper function to remove sidecar file of given message if it exists
+func removeSidecar(imapName, folder, hid string) {
+	os.Remove(sidecarPath(imapName, folder, hid))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+)
+
+// testRawMessage is fetched in archive mode, its headers are not in
+// canonical form and order
+var testRawMessage = []byte("message-id: <selftest-raw@localhost>\r\n" +
+	"Subject: Self-test  raw message\r\n" +
+	"X-Custom: first\r\n" +
+	"From: selftest@example.org\r\n" +
+	"X-Custom: second\r\n" +
+	"Date: Sat, 01 Jun 2024 10:00:00 +0200\r\n" +
+	"\r\n" +
+	"Raw body line\r\n" +
+	"line with LF only\n")
+
+// internal date of raw test message
+var testRawDate = time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+
+func TestArchiveMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive bool
+		flags   []string
+	}{
+		{"filtered write", false, []string{imap.SeenFlag}},
+		{"archive seen", true, []string{imap.SeenFlag}},
+		{"archive flagged", true, []string{imap.FlaggedFlag, imap.SeenFlag}},
+	}
+	mid := "<selftest-raw@localhost>"
+	hid := md5hash(mid)
+	h := sha256.Sum256(testRawMessage)
+	sum := hex.EncodeToString(h[:])
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			Config.ArchiveMode = tt.archive
+			ts := startTestServer(t)
+			if err := ts.mailbox(t, "Raw").CreateMessage(tt.flags, testRawDate, bytes.NewBuffer(testRawMessage)); err != nil {
+				t.Fatal(err)
+			}
+			c := ts.connect(t)
+			if _, err := Fetch(c, testServerName, "Raw", false, FlagFilter{}); err != nil {
+				t.Fatal(err)
+			}
+			fname := findLocalMail(testServerName, "Raw", hid)
+			if fname == "" {
+				t.Fatalf("%s: message %s is not written into local maildir", tt.name, mid)
+			}
+			data, err := ioutil.ReadFile(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := bytes.Equal(data, testRawMessage); got != tt.archive {
+				t.Errorf("%s: local copy is identical to raw source %v, expected %v", tt.name, got, tt.archive)
+			}
+			data, err = ioutil.ReadFile(sidecarPath(testServerName, "Raw", hid))
+			if !tt.archive {
+				if !os.IsNotExist(err) {
+					t.Errorf("%s: sidecar is written, error: %v", tt.name, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var meta MessageMeta
+			if err := json.Unmarshal(data, &meta); err != nil {
+				t.Fatal(err)
+			}
+			flags := strings.Join(meta.Flags, " ")
+			switch {
+			case meta.Imap != testServerName || meta.Folder != "Raw":
+				t.Errorf("%s: sidecar has location %s/%s", tt.name, meta.Imap, meta.Folder)
+			case meta.MessageId != mid || meta.HashId != hid:
+				t.Errorf("%s: sidecar has message id %s and hash %s", tt.name, meta.MessageId, meta.HashId)
+			case meta.Uid == 0 || meta.UidValidity == 0:
+				t.Errorf("%s: sidecar has UID %d and UIDVALIDITY %d", tt.name, meta.Uid, meta.UidValidity)
+			case !meta.InternalDate.Equal(testRawDate):
+				t.Errorf("%s: sidecar has internal date %s, expected %s", tt.name, meta.InternalDate, testRawDate)
+			case flags != strings.Join(tt.flags, " "):
+				t.Errorf("%s: sidecar has flags '%s', expected %v", tt.name, flags, tt.flags)
+			case meta.Size != int64(len(testRawMessage)) || meta.Sha256 != sum:
+				t.Errorf("%s: sidecar has size %d and checksum %s", tt.name, meta.Size, meta.Sha256)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// stats module for goimapsync, it collects statistics of local maildir
+// recorded in DB, i.e. number of messages, folders, ignored messages and
+// pending operations per IMAP server along with the last completed run, and
+// prints them in text, JSON or prometheus format. The latter one is suitable
+// for textfile collector of node_exporter, e.g.
+//    goimapsync -op=stats -format=prometheus > /var/lib/node_exporter/goimapsync.prom.$$
+//    mv /var/lib/node_exporter/goimapsync.prom.$$ /var/lib/node_exporter/goimapsync.prom
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ServerStats represents statistics of IMAP server
+type ServerStats struct {
+	Imap       string `json:"imap"`       // name of IMAP server
+	Messages   int    `json:"messages"`   // number of messages recorded in DB
+	Folders    int    `json:"folders"`    // number of cached IMAP folders
+	Ignored    int    `json:"ignored"`    // number of messages skipped by ignore rules
+	Operations int    `json:"operations"` // number of pending interrupted operations
+}
+
+// RunStats represents statistics of completed run
+type RunStats struct {
+	Op       string    `json:"op"`       // operation
+	Start    time.Time `json:"start"`    // start time of the run
+	End      time.Time `json:"end"`      // end time of the run
+	Fetched  int       `json:"fetched"`  // number of fetched messages
+	Uploaded int       `json:"uploaded"` // number of uploaded messages
+	Deleted  int       `json:"deleted"`  // number of deleted messages
+	Errors   int       `json:"errors"`   // number of errors
+	Status   string    `json:"status"`   // exit status of the run
+}
+
+// Stats represents statistics of goimapsync
+type Stats struct {
+	Servers     []ServerStats `json:"servers"`      // statistics of IMAP servers
+	LastRun     *RunStats     `json:"last_run"`     // the last completed run
+	LastSuccess time.Time     `json:"last_success"` // end time of the last successful run
+}
+
+// number of recent runs searched for the last completed and successful ones
+const statsRuns = 100
+
+// helper function to count rows of given DB table of IMAP server, the tables
+// created by migrations after given schema version are counted as empty
+func countRows(table, imapName string, since, version int) (int, error) {
+	if version < since {
+		return 0, nil
+	}
+	var count int
+	stmt := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE imap=?", table)
+	err := mdb.QueryRow(stmt, imapName).Scan(&count)
+	return count, err
+}
+
+// CollectStats collects statistics of IMAP servers of the config from DB
+func CollectStats() (Stats, error) {
+	var stats Stats
+	version, err := schemaVersion(mdb)
+	if err != nil {
+		return stats, err
+	}
+	for _, s := range Config.Servers {
+		st := ServerStats{Imap: s.Name}
+		if st.Messages, err = countRows("messages", s.Name, 1, version); err != nil {
+			return stats, err
+		}
+		if st.Folders, err = countRows("folders", s.Name, 4, version); err != nil {
+			return stats, err
+		}
+		if st.Ignored, err = countRows("ignored", s.Name, 13, version); err != nil {
+			return stats, err
+		}
+		if st.Operations, err = countRows("operations", s.Name, 12, version); err != nil {
+			return stats, err
+		}
+		stats.Servers = append(stats.Servers, st)
+	}
+	if version < 3 {
+		return stats, nil
+	}
+	runs, err := getRuns(statsRuns)
+	if err != nil {
+		return stats, err
+	}
+	for _, r := range runs {
+		if r.Status == "running" {
+			continue
+		}
+		if stats.LastRun == nil {
+			stats.LastRun = &RunStats{Op: r.Op, Start: r.Start, End: r.End, Fetched: r.Fetched, Uploaded: r.Uploaded, Deleted: r.Deleted, Errors: r.Errors, Status: r.Status}
+		}
+		if r.Status == "ok" {
+			stats.LastSuccess = r.End
+			break
+		}
+	}
+	return stats, nil
+}
+
+// helper function to escape label value of prometheus metric
+func promLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// helper function to print statistics in given format: text (default), json
+// or prometheus (text exposition format)
+func printStats(w io.Writer, stats Stats, format string) error {
+	switch format {
+	case "", "text":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "IMAP\tMESSAGES\tFOLDERS\tIGNORED\tOPERATIONS")
+		for _, s := range stats.Servers {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", s.Imap, s.Messages, s.Folders, s.Ignored, s.Operations)
+		}
+		tw.Flush()
+		if r := stats.LastRun; r != nil {
+			fmt.Fprintf(w, "last run: %s at %s, duration %s, fetched %d, uploaded %d, deleted %d, errors %d, status %s\n", r.Op, r.Start.Format(time.RFC3339), r.End.Sub(r.Start), r.Fetched, r.Uploaded, r.Deleted, r.Errors, r.Status)
+		}
+		if !stats.LastSuccess.IsZero() {
+			fmt.Fprintf(w, "last success: %s\n", stats.LastSuccess.Format(time.RFC3339))
+		}
+	case "json":
+		data, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+	case "prometheus":
+		metric := func(name, help string) {
+			fmt.Fprintf(w, "# HELP goimapsync_%s %s\n# TYPE goimapsync_%s gauge\n", name, help, name)
+		}
+		servers := []struct {
+			name, help string
+			value      func(s ServerStats) int
+		}{
+			{"messages", "Number of messages recorded in DB.", func(s ServerStats) int { return s.Messages }},
+			{"folders", "Number of cached IMAP folders.", func(s ServerStats) int { return s.Folders }},
+			{"ignored_messages", "Number of messages skipped by ignore rules.", func(s ServerStats) int { return s.Ignored }},
+			{"pending_operations", "Number of pending interrupted operations.", func(s ServerStats) int { return s.Operations }},
+		}
+		for _, m := range servers {
+			metric(m.name, m.help)
+			for _, s := range stats.Servers {
+				fmt.Fprintf(w, "goimapsync_%s{imap=\"%s\"} %d\n", m.name, promLabel(s.Imap), m.value(s))
+			}
+		}
+		if r := stats.LastRun; r != nil {
+			runs := []struct {
+				name, help string
+				value      float64
+			}{
+				{"last_run_timestamp_seconds", "End time of the last completed run.", float64(r.End.Unix())},
+				{"last_run_duration_seconds", "Duration of the last completed run.", r.End.Sub(r.Start).Seconds()},
+				{"last_run_fetched", "Number of messages fetched by the last completed run.", float64(r.Fetched)},
+				{"last_run_uploaded", "Number of messages uploaded by the last completed run.", float64(r.Uploaded)},
+				{"last_run_deleted", "Number of messages deleted by the last completed run.", float64(r.Deleted)},
+				{"last_run_errors", "Number of errors of the last completed run.", float64(r.Errors)},
+			}
+			for _, m := range runs {
+				metric(m.name, m.help)
+				fmt.Fprintf(w, "goimapsync_%s{op=\"%s\"} %s\n", m.name, promLabel(r.Op), strconv.FormatFloat(m.value, 'f', -1, 64))
+			}
+		}
+		if !stats.LastSuccess.IsZero() {
+			metric("last_success_timestamp_seconds", "End time of the last successful run.")
+			fmt.Fprintf(w, "goimapsync_last_success_timestamp_seconds %d\n", stats.LastSuccess.Unix())
+		}
+	default:
+		return fmt.Errorf("unsupported format '%s', please use text, json or prometheus", format)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPromLine matches sample line of prometheus text format
+var testPromLine = regexp.MustCompile(`^goimapsync_[a-z_]+(\{[a-z]+="([^"\\]|\\.)*"\})? [0-9.]+$`)
+
+// start time of the last run of sample stats
+var testStatsStart = time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+
+// testStats represents sample stats printed in all formats
+var testStats = Stats{
+	Servers:     []ServerStats{{Imap: `self"test`, Messages: 3, Folders: 2, Ignored: 1}},
+	LastRun:     &RunStats{Op: "sync", Start: testStatsStart, End: testStatsStart.Add(90 * time.Second), Fetched: 2, Errors: 1, Status: "error"},
+	LastSuccess: testStatsStart.Add(-time.Hour),
+}
+
+func TestPromLabel(t *testing.T) {
+	tests := []struct {
+		value, expect string
+	}{
+		{"selftest", "selftest"},
+		{`self"test`, `self\"test`},
+		{`a\b`, `a\\b`},
+		{"a\nb", `a\nb`},
+	}
+	for _, tt := range tests {
+		if got := promLabel(tt.value); got != tt.expect {
+			t.Errorf("promLabel(%q)=%q, expected %q", tt.value, got, tt.expect)
+		}
+	}
+}
+
+func TestPrintStatsText(t *testing.T) {
+	tests := []struct {
+		format string
+		stats  Stats
+		expect []string
+	}{
+		{"", Stats{Servers: []ServerStats{{Imap: "a", Messages: 1}}}, []string{"IMAP MESSAGES FOLDERS IGNORED OPERATIONS", "a 1 0 0 0"}},
+		{"text", testStats, []string{
+			"IMAP MESSAGES FOLDERS IGNORED OPERATIONS",
+			`self"test 3 2 1 0`,
+			"last run: sync at 2024-06-01T10:00:00Z, duration 1m30s, fetched 2, uploaded 0, deleted 0, errors 1, status error",
+			"last success: 2024-06-01T09:00:00Z",
+		}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := printStats(&buf, tt.stats, tt.format); err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			// columns of the table are aligned by spaces
+			lines = append(lines, strings.Join(strings.Fields(line), " "))
+		}
+		if strings.Join(lines, "\n") != strings.Join(tt.expect, "\n") {
+			t.Errorf("format %q: text stats\n%s\nexpected\n%s", tt.format, strings.Join(lines, "\n"), strings.Join(tt.expect, "\n"))
+		}
+	}
+}
+
+func TestPrintStatsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printStats(&buf, testStats, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Stats
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("unable to decode JSON stats: %v", err)
+	}
+	if len(decoded.Servers) != 1 || decoded.Servers[0] != testStats.Servers[0] || decoded.LastRun == nil ||
+		*decoded.LastRun != *testStats.LastRun || !decoded.LastSuccess.Equal(testStats.LastSuccess) {
+		t.Errorf("unexpected JSON stats:\n%s", buf.String())
+	}
+	for _, key := range []string{`"servers"`, `"last_run"`, `"last_success"`} {
+		if !strings.Contains(buf.String(), key) {
+			t.Errorf("JSON stats have no %s key:\n%s", key, buf.String())
+		}
+	}
+}
+
+func TestPrintStatsPrometheus(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printStats(&buf, testStats, "prometheus"); err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.HasPrefix(line, "# HELP goimapsync_") || (strings.HasPrefix(line, "# TYPE goimapsync_") && strings.HasSuffix(line, " gauge")) {
+			continue
+		}
+		if !testPromLine.MatchString(line) {
+			t.Errorf("invalid prometheus line '%s'", line)
+			continue
+		}
+		idx := strings.LastIndex(line, " ")
+		metrics[line[:idx]] = line[idx+1:]
+	}
+	tests := []struct {
+		name, value string
+	}{
+		{`goimapsync_messages{imap="self\"test"}`, "3"},
+		{`goimapsync_folders{imap="self\"test"}`, "2"},
+		{`goimapsync_ignored_messages{imap="self\"test"}`, "1"},
+		{`goimapsync_pending_operations{imap="self\"test"}`, "0"},
+		{`goimapsync_last_run_duration_seconds{op="sync"}`, "90"},
+		{`goimapsync_last_run_timestamp_seconds{op="sync"}`, fmt.Sprintf("%d", testStats.LastRun.End.Unix())},
+		{`goimapsync_last_run_fetched{op="sync"}`, "2"},
+		{`goimapsync_last_run_errors{op="sync"}`, "1"},
+		{"goimapsync_last_success_timestamp_seconds", fmt.Sprintf("%d", testStats.LastSuccess.Unix())},
+	}
+	for _, tt := range tests {
+		if metrics[tt.name] != tt.value {
+			t.Errorf("prometheus metric %s is '%s', expected '%s'", tt.name, metrics[tt.name], tt.value)
+		}
+	}
+	// stats without runs have no run metrics
+	buf.Reset()
+	if err := printStats(&buf, Stats{Servers: testStats.Servers}, "prometheus"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "last_run") || strings.Contains(buf.String(), "last_success") {
+		t.Errorf("prometheus stats without runs have run metrics:\n%s", buf.String())
+	}
+}
+
+func TestPrintStatsFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printStats(&buf, testStats, "xml"); err == nil || !strings.Contains(err.Error(), "unsupported format 'xml'") {
+		t.Errorf("unsupported stats format, error: %v", err)
+	}
+}
+
+func TestCollectStats(t *testing.T) {
+	setupTest(t)
+	Config.Servers = []Server{{Name: "a"}, {Name: "b"}}
+	for _, mid := range []string{"<stats-1@localhost>", "<stats-2@localhost>"} {
+		if err := insertMessage(Message{MessageId: mid, HashId: md5hash(mid), Imap: "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := saveCachedFolders("a", []string{"INBOX", "Work", "Spam"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertIgnored(IgnoredMessage{Imap: "a", Folder: "Spam", Uid: 1, HashId: "hid"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insertOperation(Operation{Imap: "b", Op: "move", MessageId: "<stats-3@localhost>"}); err != nil {
+		t.Fatal(err)
+	}
+	// the last completed run is reported along with the last successful one
+	// while running runs are skipped
+	for _, status := range []string{"ok", "error", "running"} {
+		rid, err := startRun("sync")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status == "running" {
+			continue
+		}
+		if err := finishRun(Run{Id: rid, Fetched: 2, Status: status}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := CollectStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []ServerStats{{Imap: "a", Messages: 2, Folders: 3, Ignored: 1}, {Imap: "b", Operations: 1}}
+	if fmt.Sprintf("%+v", stats.Servers) != fmt.Sprintf("%+v", expect) {
+		t.Errorf("server stats %+v, expected %+v", stats.Servers, expect)
+	}
+	if r := stats.LastRun; r == nil || r.Status != "error" || r.Fetched != 2 {
+		t.Errorf("last run %+v, expected failed sync", r)
+	}
+	if stats.LastSuccess.IsZero() {
+		t.Errorf("stats have no last success")
+	}
+}
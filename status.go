@@ -0,0 +1,115 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// status module for goimapsync, it keeps status of IMAP servers which is
+// updated at phase boundaries of operations and dumped upon SIGUSR1 signal
+//
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerStatus represents current status of IMAP server
+type ServerStatus struct {
+	Name       string    // name of IMAP server
+	State      string    // connection state
+	Operation  string    // current operation
+	Folder     string    // current folder
+	Processed  int       // number of messages processed in current run
+	Pending    int       // number of local changes awaiting push to IMAP server
+	LastSync   time.Time // time of last successful sync
+	NextRun    time.Time // time of next scheduled sync in daemon mode
+	Reconnects int       // number of reconnects since start of goimapsync
+}
+
+// String function dumps ServerStatus info
+func (s *ServerStatus) String() string {
+	lastSync := "never"
+	if !s.LastSync.IsZero() {
+		lastSync = s.LastSync.Format(time.RFC3339)
+	}
+	out := fmt.Sprintf("<Imap:%s State:%s Operation:%s Folder:%s Processed:%d Pending:%d Reconnects:%d LastSync:%s", s.Name, s.State, s.Operation, s.Folder, s.Processed, s.Pending, s.Reconnects, lastSync)
+	if !s.NextRun.IsZero() {
+		out = fmt.Sprintf("%s NextRun:%s", out, s.NextRun.Format(time.RFC3339))
+	}
+	return out + ">"
+}
+
+// status registry of IMAP servers
+var statusRegistry = struct {
+	sync.Mutex
+	servers map[string]*ServerStatus
+}{servers: make(map[string]*ServerStatus)}
+
+// helper function to update status of given IMAP server
+func updateStatus(imapName string, update func(s *ServerStatus)) {
+	statusRegistry.Lock()
+	defer statusRegistry.Unlock()
+	s, ok := statusRegistry.servers[imapName]
+	if !ok {
+		s = &ServerStatus{Name: imapName}
+		statusRegistry.servers[imapName] = s
+	}
+	update(s)
+}
+
+// helper function to set connection state of given IMAP server
+func setState(imapName, state string) {
+	updateStatus(imapName, func(s *ServerStatus) { s.State = state })
+}
+
+// helper function to set current operation and folder of given IMAP server
+func setOperation(imapName, op, folder string) {
+	updateStatus(imapName, func(s *ServerStatus) {
+		s.Operation = op
+		s.Folder = folder
+	})
+}
+
+// helper function to increment number of processed message of given IMAP server
+func addProcessed(imapName string, n int) {
+	updateStatus(imapName, func(s *ServerStatus) { s.Processed += n })
+}
+
+// helper function to count reconnect to given IMAP server
+func addReconnect(imapName string) {
+	updateStatus(imapName, func(s *ServerStatus) { s.Reconnects += 1 })
+}
+
+// helper function to set number of pending changes of given IMAP server
+func setPending(imapName string, n int) {
+	updateStatus(imapName, func(s *ServerStatus) { s.Pending = n })
+}
+
+// helper function to record successful sync of given IMAP server
+func setLastSync(imapName string) {
+	updateStatus(imapName, func(s *ServerStatus) { s.LastSync = time.Now() })
+}
+
+// helper function to format current status of all IMAP servers,
+// it never touches IMAP connections and only reads status registry
+func statusDump() string {
+	statusRegistry.Lock()
+	defer statusRegistry.Unlock()
+	var names []string
+	for name := range statusRegistry.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{fmt.Sprintf("### status: goroutines %d", runtime.NumGoroutine())}
+	for _, name := range names {
+		lines = append(lines, statusRegistry.servers[name].String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// helper function to log current status
+func logStatus() {
+	log.Println(statusDump())
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// status signal handler for unix systems
+//
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// helper function to dump status upon SIGUSR1 signal
+func initStatusSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			logStatus()
+		}
+	}()
+}
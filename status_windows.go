@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// status signal handler for windows, where SIGUSR1 is not available
+//
+
+// helper function to dump status upon SIGUSR1 signal
+func initStatusSignal() {}
@@ -0,0 +1,197 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// summary module for goimapsync, it collects information about the run
+//
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MessageError represents error which happened during processing of the message
+type MessageError struct {
+	Imap      string // name of imap server
+	Folder    string // name of imap folder
+	Uid       uint32 // message UID
+	MessageId string // message id
+	Error     error  // error
+}
+
+// String function dumps MessageError info
+func (e *MessageError) String() string {
+	return fmt.Sprintf("<Imap:%s Folder:%s Uid:%d MessageId:%s Error:%v>", e.Imap, e.Folder, e.Uid, e.MessageId, e.Error)
+}
+
+// Summary represents summary of goimapsync run
+type Summary struct {
+	sync.Mutex
+	Errors     []MessageError  // list of per-message errors
+	Reconnects map[string]int  // number of reconnects per IMAP server
+	Fetched    int             // number of fetched messages
+	Uploaded   int             // number of uploaded messages
+	Deleted    int             // number of deleted messages
+	Servers    map[string]bool // touched IMAP servers
+	Folders    map[string]bool // touched folders
+	Vanished   []string        // mirrored folders vanished from IMAP servers along with actions taken
+	Unchanged  int             // number of folders skipped as unchanged since the last fetch
+	Indexed    int             // number of messages indexed without bodies
+	Failed     int             // number of messages which could not be written into local maildir
+}
+
+// RunSummary keeps summary of current run
+var RunSummary Summary
+
+// AddError adds message error to the summary
+func (s *Summary) AddError(e MessageError) {
+	s.Lock()
+	defer s.Unlock()
+	log.Printf("ERROR: %s", e.String())
+	s.Errors = append(s.Errors, e)
+	fields := Event{"server": e.Imap, "folder": e.Folder, "uid": e.Uid, "message_id": e.MessageId}
+	if e.Error != nil {
+		fields["error"] = e.Error.Error()
+	}
+	emitEvent("error", fields)
+}
+
+// AddFailed adds error of message which could not be written into local
+// maildir even after retry
+func (s *Summary) AddFailed(e MessageError) {
+	s.AddError(e)
+	s.Lock()
+	defer s.Unlock()
+	s.Failed += 1
+}
+
+// AddReconnect records reconnect to given IMAP server
+func (s *Summary) AddReconnect(imapName string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.Reconnects == nil {
+		s.Reconnects = make(map[string]int)
+	}
+	s.Reconnects[imapName] += 1
+}
+
+// AddVanished records mirrored folder vanished from IMAP server and action
+// taken on its local folder
+func (s *Summary) AddVanished(imapName, folder, action string) {
+	s.Lock()
+	defer s.Unlock()
+	log.Printf("folder '%s' vanished from %s: %s\n", folder, imapName, action)
+	s.Vanished = append(s.Vanished, fmt.Sprintf("'%s' on %s: %s", folder, imapName, action))
+	emitEvent("folder_vanished", Event{"server": imapName, "folder": folder, "action": action})
+}
+
+// AddUnchanged records IMAP folder skipped as unchanged since the last fetch
+func (s *Summary) AddUnchanged(imapName, folder string) {
+	s.Lock()
+	defer s.Unlock()
+	s.Unchanged += 1
+	emitEvent("folder_unchanged", Event{"server": imapName, "folder": folder})
+}
+
+// Touch records IMAP server and folder touched by the run
+func (s *Summary) Touch(imapName, folder string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.Servers == nil {
+		s.Servers = make(map[string]bool)
+		s.Folders = make(map[string]bool)
+	}
+	s.Servers[imapName] = true
+	if folder != "" {
+		s.Folders[folder] = true
+	}
+}
+
+// AddFetched increments number of fetched messages
+func (s *Summary) AddFetched(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.Fetched += n
+}
+
+// AddIndexed increments number of messages indexed without bodies
+func (s *Summary) AddIndexed(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.Indexed += n
+}
+
+// AddUploaded increments number of uploaded messages
+func (s *Summary) AddUploaded(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.Uploaded += n
+}
+
+// AddDeleted increments number of deleted messages
+func (s *Summary) AddDeleted(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.Deleted += n
+}
+
+// Run returns run record of the summary
+func (s *Summary) Run(rid int64) Run {
+	s.Lock()
+	defer s.Unlock()
+	keys := func(m map[string]bool) string {
+		var out []string
+		for k := range m {
+			out = append(out, k)
+		}
+		sort.Strings(out)
+		return strings.Join(out, ",")
+	}
+	status := "ok"
+	if len(s.Errors) > 0 {
+		status = "error"
+	}
+	if interrupted() {
+		status = "interrupted"
+	}
+	return Run{
+		Id:       rid,
+		Servers:  keys(s.Servers),
+		Folders:  keys(s.Folders),
+		Fetched:  s.Fetched,
+		Uploaded: s.Uploaded,
+		Deleted:  s.Deleted,
+		Errors:   len(s.Errors),
+		Status:   status,
+	}
+}
+
+// Print prints summary of the run
+func (s *Summary) Print() {
+	s.Lock()
+	defer s.Unlock()
+	for name, n := range s.Reconnects {
+		log.Printf("### summary: %d reconnect(s) to %s", n, name)
+	}
+	for _, v := range s.Vanished {
+		log.Printf("### summary: vanished folder %s", v)
+	}
+	if s.Unchanged > 0 {
+		log.Printf("### summary: %d folder(s) skipped as unchanged", s.Unchanged)
+	}
+	if s.Indexed > 0 {
+		log.Printf("### summary: %d message(s) indexed with pending bodies, use fetch-bodies to download them", s.Indexed)
+	}
+	if s.Failed > 0 {
+		log.Printf("### summary: %d message(s) could not be written into local maildir, see failed_messages table", s.Failed)
+	}
+	if len(s.Errors) == 0 {
+		return
+	}
+	log.Printf("### summary: %d message(s) failed", len(s.Errors))
+	for _, e := range s.Errors {
+		log.Println(e.String())
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSummaryRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		fill    func(s *Summary)
+		servers string
+		folders string
+		errors  int
+		status  string
+	}{
+		{"empty", func(s *Summary) {}, "", "", 0, "ok"},
+		{"touched", func(s *Summary) {
+			s.Touch("b", "INBOX")
+			s.Touch("a", "")
+			s.Touch("a", "Archive")
+			s.AddFetched(2)
+		}, "a,b", "Archive,INBOX", 0, "ok"},
+		{"errors", func(s *Summary) {
+			s.Touch("a", "INBOX")
+			s.AddError(MessageError{Imap: "a", Folder: "INBOX", Uid: 1, Error: errors.New("message without message id")})
+			s.AddError(MessageError{Imap: "a", Folder: "INBOX", Uid: 2, Error: errors.New("message without body")})
+		}, "a", "INBOX", 2, "error"},
+	}
+	for _, tt := range tests {
+		var s Summary
+		tt.fill(&s)
+		run := s.Run(1)
+		if run.Servers != tt.servers || run.Folders != tt.folders || run.Errors != tt.errors || run.Status != tt.status {
+			t.Errorf("%s: run %+v, expected servers %q folders %q errors %d status %s", tt.name, run, tt.servers, tt.folders, tt.errors, tt.status)
+		}
+	}
+}
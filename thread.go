@@ -0,0 +1,168 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// thread module for goimapsync, it implements IMAP THREAD extension
+// see https://tools.ietf.org/html/rfc5256
+//
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// Thread represents node of IMAP thread tree, the node with zero Uid
+// represents missing parent of its children
+type Thread struct {
+	Uid      uint32    // message UID
+	Children []*Thread // children threads
+}
+
+// ThreadCommand represents IMAP THREAD command
+type ThreadCommand struct {
+	Algorithm string               // thread algorithm, e.g. REFERENCES or ORDEREDSUBJECT
+	Charset   string               // search charset
+	Criteria  *imap.SearchCriteria // search criteria
+}
+
+// Command implements imap.Commander interface
+func (cmd *ThreadCommand) Command() *imap.Command {
+	args := []interface{}{imap.RawString(cmd.Algorithm), imap.RawString(cmd.Charset)}
+	criteria := cmd.Criteria.Format()
+	if len(criteria) == 0 {
+		criteria = []interface{}{imap.RawString("ALL")}
+	}
+	args = append(args, criteria...)
+	return &imap.Command{Name: "THREAD", Arguments: args}
+}
+
+// ThreadResponse represents IMAP THREAD response
+type ThreadResponse struct {
+	Threads []*Thread // list of threads
+}
+
+// Handle implements responses.Handler interface
+func (r *ThreadResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "THREAD" {
+		return responses.ErrUnhandled
+	}
+	for _, f := range fields {
+		list, ok := f.([]interface{})
+		if !ok {
+			return errors.New("thread must be a list")
+		}
+		t, err := parseThread(list)
+		if err != nil {
+			return err
+		}
+		r.Threads = append(r.Threads, t)
+	}
+	return nil
+}
+
+// helper function to parse thread list, e.g. (3 6 (4 23)(44 7 96)) where
+// sequence of numbers represents parent-child chain and nested lists
+// represent branches of the last node
+func parseThread(fields []interface{}) (*Thread, error) {
+	var root, cur *Thread
+	for _, f := range fields {
+		if list, ok := f.([]interface{}); ok {
+			child, err := parseThread(list)
+			if err != nil {
+				return nil, err
+			}
+			if cur == nil {
+				cur = &Thread{}
+				root = cur
+			}
+			cur.Children = append(cur.Children, child)
+			continue
+		}
+		uid, err := imap.ParseNumber(f)
+		if err != nil {
+			return nil, err
+		}
+		node := &Thread{Uid: uid}
+		if cur == nil {
+			root = node
+		} else {
+			cur.Children = append(cur.Children, node)
+		}
+		cur = node
+	}
+	if root == nil {
+		return nil, errors.New("empty thread")
+	}
+	return root, nil
+}
+
+// Threads returns thread structure of given IMAP folder
+func Threads(c *client.Client, imapName, folder, algorithm string) ([]*Thread, error) {
+	defer timing("Threads", time.Now())
+	defer profiler("Threads")()
+	algorithm = strings.ToUpper(algorithm)
+	if ok, err := c.Support("THREAD=" + algorithm); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("IMAP server '%s' does not support THREAD=%s", imapName, algorithm)
+	}
+	if _, err := c.Select(imapFolder(imapName, folder), true); err != nil {
+		return nil, err
+	}
+	cmd := &commands.Uid{Cmd: &ThreadCommand{Algorithm: algorithm, Charset: "UTF-8", Criteria: imap.NewSearchCriteria()}}
+	res := &ThreadResponse{}
+	status, err := c.Execute(cmd, res)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+	return res.Threads, nil
+}
+
+// helper function to print thread tree of given IMAP folder using message
+// ids of given UIDs
+func printThreads(c *client.Client, imapName, folder string, threads []*Thread) {
+	// fetch envelopes of all messages in a folder to resolve message ids
+	mids := make(map[uint32]string)
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+	_, err := withReconnect(c, imapName, imapFolder(imapName, folder), func(c *client.Client) error {
+		messages := make(chan *imap.Message, 10)
+		done := fetchMessages(c, seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}, messages, true)
+		for msg := range messages {
+			if msg != nil && msg.Envelope != nil {
+				mids[msg.Uid] = msg.Envelope.MessageId
+			}
+		}
+		return <-done
+	})
+	if err != nil {
+		log.Printf("unable to fetch envelopes on '%s', error: %v\n", imapName, err)
+	}
+	var walk func(t *Thread, depth int)
+	walk = func(t *Thread, depth int) {
+		indent := strings.Repeat("  ", depth)
+		if t.Uid == 0 {
+			fmt.Printf("%s- (missing parent)\n", indent)
+		} else {
+			fmt.Printf("%s- %d %s\n", indent, t.Uid, mids[t.Uid])
+		}
+		for _, child := range t.Children {
+			walk(child, depth+1)
+		}
+	}
+	fmt.Printf("### %s\n", imapName)
+	for _, t := range threads {
+		walk(t, 0)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+
+	imap "github.com/emersion/go-imap"
+)
+
+// helper function to format thread tree, e.g. 3(6(4(23) 44(7(96)))), where
+// missing parent has zero UID
+func formatThread(t *Thread) string {
+	s := fmt.Sprintf("%d", t.Uid)
+	if len(t.Children) == 0 {
+		return s
+	}
+	var children []string
+	for _, c := range t.Children {
+		children = append(children, formatThread(c))
+	}
+	return fmt.Sprintf("%s(%s)", s, strings.Join(children, " "))
+}
+
+func TestThreadResponse(t *testing.T) {
+	tests := []struct {
+		line   string
+		expect []string
+		fail   bool
+	}{
+		{"* THREAD\r\n", nil, false},
+		{"* THREAD (2)(3 6 (4 23)(44 7 96))\r\n", []string{"2", "3(6(4(23) 44(7(96))))"}, false},
+		{"* THREAD ((3)(5))\r\n", []string{"0(3 5)"}, false},
+		{"* THREAD (1 2 3)\r\n", []string{"1(2(3))"}, false},
+		{"* THREAD (1 x)\r\n", nil, true},
+		{"* THREAD 1\r\n", nil, true},
+		{"* THREAD ()\r\n", nil, true},
+	}
+	for _, tt := range tests {
+		r := imap.NewReader(bufio.NewReader(strings.NewReader(tt.line)))
+		resp, err := imap.ReadResp(r)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.line, err)
+		}
+		res := &ThreadResponse{}
+		err = res.Handle(resp)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%q: invalid thread response is accepted", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		var threads []string
+		for _, th := range res.Threads {
+			threads = append(threads, formatThread(th))
+		}
+		if strings.Join(threads, ",") != strings.Join(tt.expect, ",") {
+			t.Errorf("%q: threads %v, expected %v", tt.line, threads, tt.expect)
+		}
+	}
+}
+
+func TestThreadCommand(t *testing.T) {
+	since := imap.NewSearchCriteria()
+	since.WithoutFlags = []string{imap.SeenFlag}
+	tests := []struct {
+		cmd    *ThreadCommand
+		expect string
+	}{
+		{&ThreadCommand{Algorithm: "REFERENCES", Charset: "UTF-8", Criteria: imap.NewSearchCriteria()}, "THREAD REFERENCES UTF-8 ALL"},
+		{&ThreadCommand{Algorithm: "ORDEREDSUBJECT", Charset: "UTF-8", Criteria: since}, "THREAD ORDEREDSUBJECT UTF-8 UNSEEN"},
+	}
+	for _, tt := range tests {
+		cmd := tt.cmd.Command()
+		var args []string
+		for _, a := range cmd.Arguments {
+			args = append(args, fmt.Sprintf("%v", a))
+		}
+		if got := strings.Join(append([]string{cmd.Name}, args...), " "); got != tt.expect {
+			t.Errorf("command %q, expected %q", got, tt.expect)
+		}
+	}
+}
+
+func TestThreadsUnsupported(t *testing.T) {
+	setupTest(t)
+	ts := startTestServer(t)
+	c := ts.connect(t)
+	// in-memory IMAP server does not support THREAD extension
+	if _, err := Threads(c, testServerName, "INBOX", "references"); err == nil || !strings.Contains(err.Error(), "THREAD=REFERENCES") {
+		t.Errorf("threads of server without THREAD extension, error: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// tls module for goimapsync, it applies TLS policy (versions and cipher
+// suites) and pins TLS certificates of IMAP servers, i.e. the connection
+// fails if server presents certificate (or public key) different from
+// pinned one even if it is signed by trusted CA
+//
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsVersions maps TLS version names to their values
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// helper function to return name of given TLS version
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return "TLS " + name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// helper function to make TLS config of given TLS policy, the empty
+// values keep Go defaults
+func tlsPolicy(minVersion, maxVersion string, ciphers []string) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	for _, v := range []struct {
+		name  string
+		value *uint16
+	}{{minVersion, &cfg.MinVersion}, {maxVersion, &cfg.MaxVersion}} {
+		if v.name == "" {
+			continue
+		}
+		version, ok := tlsVersions[strings.TrimSpace(strings.TrimPrefix(strings.ToUpper(v.name), "TLS"))]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version '%s', please use 1.0, 1.1, 1.2 or 1.3", v.name)
+		}
+		*v.value = version
+	}
+	if cfg.MinVersion != 0 && cfg.MaxVersion != 0 && cfg.MinVersion > cfg.MaxVersion {
+		return nil, fmt.Errorf("minimal TLS version %s is greater than maximal %s", minVersion, maxVersion)
+	}
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	for _, name := range ciphers {
+		found := false
+		for _, cs := range suites {
+			if cs.Name == name {
+				cfg.CipherSuites = append(cfg.CipherSuites, cs.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unsupported cipher suite '%s'", name)
+		}
+	}
+	return cfg, nil
+}
+
+// tlsStates keeps negotiated TLS versions and cipher suites of IMAP servers
+var tlsStates = struct {
+	sync.Mutex
+	smap map[string]tls.ConnectionState
+}{smap: make(map[string]tls.ConnectionState)}
+
+// helper function to describe negotiated TLS connection of given IMAP server
+func tlsState(imapName string) string {
+	tlsStates.Lock()
+	defer tlsStates.Unlock()
+	state, ok := tlsStates.smap[imapName]
+	if !ok {
+		return "no TLS"
+	}
+	return fmt.Sprintf("%s, %s", tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+}
+
+// helper function to normalize fingerprint, e.g. AB:CD:... -> abcd...
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.Replace(fp, ":", "", -1))
+}
+
+// helper function to compute fingerprints of given certificate and its public key
+func fingerprints(cert *x509.Certificate) (string, string) {
+	certSum := sha256.Sum256(cert.Raw)
+	keySum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(certSum[:]), hex.EncodeToString(keySum[:])
+}
+
+// helper function to make TLS config of given IMAP server, the pinned
+// fingerprints are verified against leaf certificate during handshake,
+// i.e. before we send any credentials, and negotiated TLS version and
+// cipher suite are recorded in tlsStates
+func tlsConfig(s Server) (*tls.Config, error) {
+	cfg, err := tlsPolicy(s.MinTLSVersion, s.MaxTLSVersion, s.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	cfg.VerifyConnection = func(state tls.ConnectionState) error {
+		tlsStates.Lock()
+		tlsStates.smap[s.Name] = state
+		tlsStates.Unlock()
+		return nil
+	}
+	if s.PinnedCertSHA256 == "" && s.PinnedPubKeySHA256 == "" {
+		return cfg, nil
+	}
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		certSum, keySum := fingerprints(cert)
+		if s.PinnedCertSHA256 != "" && normalizeFingerprint(s.PinnedCertSHA256) != certSum {
+			return fmt.Errorf("certificate of '%s' does not match pinned one, expected %s, observed %s", s.Name, normalizeFingerprint(s.PinnedCertSHA256), certSum)
+		}
+		if s.PinnedPubKeySHA256 != "" && normalizeFingerprint(s.PinnedPubKeySHA256) != keySum {
+			return fmt.Errorf("public key of '%s' does not match pinned one, expected %s, observed %s", s.Name, normalizeFingerprint(s.PinnedPubKeySHA256), keySum)
+		}
+		return nil
+	}
+	return cfg, nil
+}
+
+// Pin connects to given IMAP server, prints fingerprints of its certificate
+// and optionally writes certificate fingerprint into given config file
+func Pin(s Server, configFile string) error {
+	if !s.UseTls {
+		return fmt.Errorf("IMAP server '%s' does not use TLS", s.Name)
+	}
+	// use TLS policy of the server to verify it is in effect
+	cfg, err := tlsPolicy(s.MinTLSVersion, s.MaxTLSVersion, s.CipherSuites)
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", s.Uri, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("IMAP server '%s' presented no certificate", s.Name)
+	}
+	certSum, keySum := fingerprints(certs[0])
+	fmt.Printf("server: %s\ntls: %s\nsubject: %s\nissuer: %s\nexpires: %s\npinnedCertSHA256: %s\npinnedPubKeySHA256: %s\n",
+		s.Name, fmt.Sprintf("%s, %s", tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)),
+		certs[0].Subject, certs[0].Issuer, certs[0].NotAfter.Format(time.RFC3339), certSum, keySum)
+	if configFile == "" {
+		return nil
+	}
+	return savePin(configFile, s.Name, certSum)
+}
+
+// helper function to write pinned certificate fingerprint of given server
+// into config file, the server should be defined in this file
+func savePin(configFile, name, fingerprint string) error {
+	return updateConfigFile(configFile, func(rec map[string]interface{}) error {
+		servers, _ := rec["servers"].([]interface{})
+		for _, srv := range servers {
+			if m, ok := srv.(map[string]interface{}); ok && m["name"] == name {
+				m["pinnedCertSHA256"] = fingerprint
+				return nil
+			}
+		}
+		return fmt.Errorf("IMAP server '%s' is not defined in %s", name, configFile)
+	})
+}
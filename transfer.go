@@ -0,0 +1,137 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// transfer module for goimapsync, it migrates messages of IMAP folder from
+// one IMAP server to another, e.g. when switching mail provider
+//
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Migrate appends messages of given folder from src IMAP server to dst one
+// preserving their flags and internal date, the messages already present on
+// dst IMAP server (by their HashId) are skipped
+func Migrate(src, dst *ServerClient, folder string) error {
+	defer timing("Migrate", time.Now())
+	defer profiler("Migrate")()
+	if src.Name == dst.Name {
+		return errors.New("source and destination IMAP servers should be different")
+	}
+	setOperation(src.Name, "migrate", folder)
+	setOperation(dst.Name, "migrate", folder)
+	RunSummary.Touch(src.Name, folder)
+	RunSummary.Touch(dst.Name, folder)
+
+	srcFolder, err := findImapFolder(src.Name, folder)
+	if err != nil {
+		return err
+	}
+	dstFolder, err := ensureImapFolder(dst.Client, dst.Name, folder)
+	if err != nil {
+		return err
+	}
+
+	// hash ids of messages which are already on destination IMAP server
+	hids := make(map[string]bool)
+	_, err = withReconnect(dst.Client, dst.Name, "", func(c *client.Client) error {
+		mids, e := imapMessageIds(c, dstFolder)
+		for mid := range mids {
+			hids[md5hash(mid)] = true
+		}
+		return e
+	})
+	if err != nil {
+		return err
+	}
+
+	// get UIDs of all messages of source folder
+	var uids []uint32
+	_, err = withReconnect(src.Client, src.Name, "", func(c *client.Client) error {
+		if _, err := c.Select(srcFolder, true); err != nil {
+			return err
+		}
+		var e error
+		uids, e = c.UidSearch(imap.NewSearchCriteria())
+		return e
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("### migrate %d message(s) of '%s' from '%s' to '%s'\n", len(uids), folder, src.Name, dst.Name)
+
+	// use peek section to not mark messages as seen on source IMAP server
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{section.FetchItem(), imap.FetchFlags, imap.FetchEnvelope, imap.FetchInternalDate, imap.FetchUid}
+	batch := Config.FetchBatchSize
+	if batch <= 0 {
+		batch = 500
+	}
+	var uploaded, skipped int
+	for start := 0; start < len(uids); start += batch {
+		end := start + batch
+		if end > len(uids) {
+			end = len(uids)
+		}
+		// the fetch can be repeated after reconnect since appended
+		// messages are recorded in hids and skipped
+		_, err = withReconnect(src.Client, src.Name, srcFolder, func(c *client.Client) error {
+			messages := make(chan *imap.Message, 10)
+			done := fetchMessages(c, uidSet(uids[start:end]), items, messages, true)
+			for msg := range messages {
+				if msg == nil || msg.Envelope == nil {
+					continue
+				}
+				mid := msg.Envelope.MessageId
+				hid := md5hash(mid)
+				if mid != "" && hids[hid] {
+					skipped += 1
+					continue
+				}
+				body := msg.GetBody(section)
+				if body == nil {
+					RunSummary.AddError(MessageError{Imap: src.Name, Folder: folder, Uid: msg.Uid, MessageId: mid, Error: errors.New("message without body")})
+					continue
+				}
+				data, e := ioutil.ReadAll(body)
+				if e != nil {
+					RunSummary.AddError(MessageError{Imap: src.Name, Folder: folder, Uid: msg.Uid, MessageId: mid, Error: e})
+					continue
+				}
+				// the \Recent flag is maintained by IMAP server only
+				var flags []string
+				for _, f := range msg.Flags {
+					if f != imap.RecentFlag {
+						flags = append(flags, f)
+					}
+				}
+				_, e = withReconnect(dst.Client, dst.Name, "", func(c *client.Client) error {
+					return c.Append(dstFolder, flags, msg.InternalDate, bytes.NewReader(data))
+				})
+				if e != nil {
+					RunSummary.AddError(MessageError{Imap: dst.Name, Folder: folder, Uid: msg.Uid, MessageId: mid, Error: e})
+					continue
+				}
+				if mid != "" {
+					hids[hid] = true
+				}
+				uploaded += 1
+				RunSummary.AddUploaded(1)
+			}
+			return <-done
+		})
+		if err != nil {
+			return fmt.Errorf("unable to fetch '%s' from '%s': %w", folder, src.Name, err)
+		}
+	}
+	log.Printf("migrated '%s' from '%s' to '%s': uploaded %d, skipped %d out of %d message(s)\n", folder, src.Name, dst.Name, uploaded, skipped, len(uids))
+	return nil
+}
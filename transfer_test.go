@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+)
+
+func TestMigrate(t *testing.T) {
+	setupTest(t)
+	date := time.Date(2024, 3, 3, 10, 0, 0, 0, time.UTC)
+	msgs := []testMessage{
+		{MessageId: "<migrate-1@localhost>", Subject: "First", Date: date},
+		{MessageId: "<migrate-2@localhost>", Subject: "Second", Flags: []string{imap.SeenFlag, imap.FlaggedFlag}, Date: date.Add(time.Hour)},
+		{MessageId: "<migrate-3@localhost>", Subject: "Third", Flags: []string{imap.AnsweredFlag}, Date: date.Add(2 * time.Hour)},
+	}
+	src := startTestServer(t)
+	src.Server.Name = "old"
+	src.add(t, "Work", msgs...)
+	dst := startTestServer(t)
+	dst.Server.Name = "new"
+	// destination already has the second message without flags
+	dst.add(t, "Work", testMessage{MessageId: msgs[1].MessageId, Subject: "Second"})
+	srcClient := &ServerClient{Name: "old", Client: src.connect(t)}
+	dstClient := &ServerClient{Name: "new", Client: dst.connect(t)}
+
+	if err := Migrate(srcClient, srcClient, "Work"); err == nil {
+		t.Errorf("migrate to the same IMAP server is allowed")
+	}
+	// the second run finds all messages on destination and skips them
+	for i := 0; i < 2; i++ {
+		if err := Migrate(srcClient, dstClient, "Work"); err != nil {
+			t.Fatal(err)
+		}
+		if n := dst.size(t, "Work"); n != uint32(len(msgs)) {
+			t.Fatalf("run %d: destination has %d message(s) instead of %d", i, n, len(msgs))
+		}
+	}
+	expect := map[string]string{
+		msgs[0].MessageId: "",
+		// flags of skipped message are not changed
+		msgs[1].MessageId: "",
+		msgs[2].MessageId: imap.AnsweredFlag,
+	}
+	for mid, flags := range dst.flags(t, "Work") {
+		if got := strings.Join(flags, " "); got != expect[mid] {
+			t.Errorf("migrated message %s has flags %q, expected %q", mid, got, expect[mid])
+		}
+	}
+	// internal dates of migrated messages are preserved
+	seqset, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	if err := dst.mailbox(t, "Work").ListMessages(false, seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchInternalDate}, ch); err != nil {
+		t.Fatal(err)
+	}
+	var dates []string
+	for msg := range ch {
+		if msg.Envelope.MessageId != msgs[1].MessageId {
+			dates = append(dates, msg.InternalDate.UTC().Format(time.RFC3339))
+		}
+	}
+	sort.Strings(dates)
+	if got := strings.Join(dates, " "); got != "2024-03-03T10:00:00Z 2024-03-03T12:00:00Z" {
+		t.Errorf("internal dates of migrated messages %s", got)
+	}
+	// source messages are not marked as seen
+	if flags := src.flags(t, "Work"); len(flags[msgs[0].MessageId]) != 0 {
+		t.Errorf("migrated message has flags %v on source", flags[msgs[0].MessageId])
+	}
+}
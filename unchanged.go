@@ -0,0 +1,96 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// unchanged module for goimapsync, it skips fetch of IMAP folders which did
+// not change since the last complete fetch. The STATUS of the folder
+// (MESSAGES, UIDNEXT, UIDVALIDITY and UNSEEN) is recorded in DB after every
+// complete fetch, i.e. fetch of all messages without flag filter or query,
+// and the folder is neither selected nor scanned by subsequent fetches as
+// long as its STATUS and ignore rules of the config stay the same.
+// The sync always reads complete snapshot of the folder since local changes
+// are merged against it.
+//
+
+import (
+	"log"
+	"strings"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// FolderState represents STATUS of IMAP folder recorded by the last complete
+// fetch
+type FolderState struct {
+	Messages    uint32 // number of messages
+	UidNext     uint32 // next UID
+	UidValidity uint32 // UIDVALIDITY of the folder
+	Unseen      uint32 // number of unseen messages
+	Rules       string // ignore rules of the fetch
+}
+
+// status items which identify state of IMAP folder
+var folderStateItems = []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity, imap.StatusUnseen}
+
+// helper function to return key of ignore rules of the config, the ignored
+// messages may be fetched if rules change
+func ignoreRulesKey() string {
+	var rules []string
+	for _, m := range ignoreMatchers {
+		rules = append(rules, m.Rule.String())
+	}
+	return strings.Join(rules, ",")
+}
+
+// helper function to check if fetch uses flag filter or query, i.e. it does
+// not read all messages of the folder
+func isFiltered(filter FlagFilter) bool {
+	return len(filter.With) > 0 || len(filter.Without) > 0 || filter.Query != nil
+}
+
+// helper function to get state of given IMAP folder via STATUS, it returns
+// nil state if STATUS fails, e.g. the folder does not exist
+func folderStatus(c *client.Client, imapName, folder string) (*client.Client, *FolderState) {
+	var state *FolderState
+	c, err := withReconnect(c, imapName, "", func(c *client.Client) error {
+		status, err := c.Status(folder, folderStateItems)
+		if err != nil {
+			return err
+		}
+		state = &FolderState{
+			Messages:    status.Messages,
+			UidNext:     status.UidNext,
+			UidValidity: status.UidValidity,
+			Unseen:      status.Unseen,
+			Rules:       ignoreRulesKey(),
+		}
+		return nil
+	})
+	if err != nil && verboseLevel(imapName) > 0 {
+		log.Printf("unable to get status of '%s' on %s, error: %v\n", folder, imapName, err)
+	}
+	return c, state
+}
+
+// helper function to check if given IMAP folder did not change since the
+// last complete fetch, it returns current state of the folder which should
+// be recorded once the folder is completely fetched
+func unchangedFolder(c *client.Client, imapName, folder string, filter FlagFilter) (*client.Client, *FolderState, bool) {
+	c, state := folderStatus(c, imapName, folder)
+	// UIDNEXT is optional in STATUS response of some servers
+	if state == nil || state.UidNext == 0 || isFiltered(filter) {
+		return c, state, false
+	}
+	last, err := getFolderState(imapName, folder)
+	if err != nil || last == nil || *last != *state {
+		return c, state, false
+	}
+	// messages which could not be written are fetched again
+	if n, err := countFailedMessages(imapName, folder); err != nil || n > 0 {
+		return c, state, false
+	}
+	// UIDVALIDITY is recorded as for selected folder, e.g. for removals
+	// and mirror of the folder
+	recordUidValidity(imapName, folder, state.UidValidity)
+	return c, state, true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	imap "github.com/emersion/go-imap"
+)
+
+func TestIsFiltered(t *testing.T) {
+	tests := []struct {
+		filter FlagFilter
+		expect bool
+	}{
+		{FlagFilter{}, false},
+		{FlagFilter{With: []string{imap.FlaggedFlag}}, true},
+		{FlagFilter{Without: []string{imap.SeenFlag}}, true},
+		{FlagFilter{Query: imap.NewSearchCriteria()}, true},
+	}
+	for _, tt := range tests {
+		if got := isFiltered(tt.filter); got != tt.expect {
+			t.Errorf("isFiltered(%+v)=%v, expected %v", tt.filter, got, tt.expect)
+		}
+	}
+}
+
+func TestFetchUnchanged(t *testing.T) {
+	tests := []struct {
+		name      string
+		first     FlagFilter // filter of the first fetch
+		newOnly   bool       // first fetch reads only new messages
+		change    func(t *testing.T, ts *testServer)
+		unchanged int // folders skipped as unchanged by the second fetch
+		fetched   int // messages fetched by the second fetch
+	}{
+		{name: "idle folder", unchanged: 1},
+		{name: "new message", change: func(t *testing.T, ts *testServer) {
+			ts.add(t, "Work", testMessage{MessageId: "<unchanged-2@localhost>", Subject: "New message"})
+		}, fetched: 1},
+		{name: "failed write", change: func(t *testing.T, ts *testServer) {
+			mid := "<unchanged-1@localhost>"
+			if err := insertFailedMessage(FailedMessage{Imap: testServerName, Folder: "Work", Uid: 1, HashId: md5hash(mid), MessageId: mid}); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "filtered fetch", first: FlagFilter{Without: []string{imap.SeenFlag}}},
+		{name: "new messages fetch", newOnly: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			ts.add(t, "Work", testMessage{MessageId: "<unchanged-1@localhost>", Subject: "Message"})
+			c := ts.connect(t)
+			if _, err := Fetch(c, testServerName, "Work", tt.newOnly, tt.first); err != nil {
+				t.Fatal(err)
+			}
+			if tt.change != nil {
+				tt.change(t, ts)
+			}
+			unchanged, fetched := RunSummary.Unchanged, RunSummary.Fetched
+			if _, err := Fetch(c, testServerName, "Work", false, FlagFilter{}); err != nil {
+				t.Fatal(err)
+			}
+			if n := RunSummary.Unchanged - unchanged; n != tt.unchanged {
+				t.Errorf("%d folder(s) are skipped as unchanged, expected %d", n, tt.unchanged)
+			}
+			if n := RunSummary.Fetched - fetched; n != tt.fetched {
+				t.Errorf("%d message(s) are fetched, expected %d", n, tt.fetched)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// utf8 module for goimapsync, it enables UTF8=ACCEPT extension of IMAP
+// servers, see https://tools.ietf.org/html/rfc6855, in this mode the
+// mailbox names are sent by server as UTF-8 instead of modified UTF-7.
+// Folder names given by user, e.g. via -folder option copied from MUA
+// config, may still be in modified UTF-7, e.g. Entw&APw-rfe, they are
+// decoded before comparison with folder names of IMAP server.
+//
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// utf8Servers keeps IMAP servers which enabled UTF8=ACCEPT
+var utf8Servers = struct {
+	sync.Mutex
+	smap map[string]bool
+}{smap: make(map[string]bool)}
+
+// helper function to enable UTF8=ACCEPT on given IMAP server if it
+// advertises it, it should be called after login and before select
+func enableUTF8(c *client.Client, imapName string) error {
+	enabled := false
+	defer func() {
+		utf8Servers.Lock()
+		utf8Servers.smap[imapName] = enabled
+		utf8Servers.Unlock()
+	}()
+	if ok, err := c.Support("UTF8=ACCEPT"); err != nil || !ok {
+		return err
+	}
+	caps, err := c.Enable([]string{"UTF8=ACCEPT"})
+	if err != nil {
+		return err
+	}
+	for _, cap := range caps {
+		if cap == "UTF8=ACCEPT" {
+			enabled = true
+		}
+	}
+	if enabled && verboseLevel(imapName) > 0 {
+		log.Printf("enabled UTF8=ACCEPT on %s", imapName)
+	}
+	return nil
+}
+
+// helper function to check if given IMAP server enabled UTF8=ACCEPT
+func utf8Enabled(imapName string) bool {
+	utf8Servers.Lock()
+	defer utf8Servers.Unlock()
+	return utf8Servers.smap[imapName]
+}
+
+// UTF8ListResponse represents IMAP LIST response with UTF-8 mailbox names,
+// the standard one decodes names as modified UTF-7 and fails on them
+type UTF8ListResponse struct {
+	Mailboxes chan *imap.MailboxInfo // list of mailboxes
+}
+
+// Handle implements responses.Handler interface
+func (r *UTF8ListResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "LIST" {
+		return responses.ErrUnhandled
+	}
+	if len(fields) < 3 {
+		return errors.New("mailbox info needs at least 3 fields")
+	}
+	info := &imap.MailboxInfo{}
+	attrs, ok := fields[0].([]interface{})
+	if !ok {
+		return errors.New("mailbox attributes must be a list")
+	}
+	for _, a := range attrs {
+		if s, err := imap.ParseString(a); err == nil {
+			info.Attributes = append(info.Attributes, s)
+		}
+	}
+	if delim, ok := fields[1].(string); ok {
+		info.Delimiter = delim
+	}
+	mbox, err := imap.ParseString(fields[2])
+	if err != nil {
+		return err
+	}
+	if !utf8.ValidString(mbox) {
+		return errors.New("mailbox name is not valid UTF-8")
+	}
+	info.Name = imap.CanonicalMailboxName(mbox)
+	r.Mailboxes <- info
+	return nil
+}
+
+// helper function to list mailboxes of IMAP server which enabled UTF8=ACCEPT
+func listUTF8(c *client.Client, ch chan *imap.MailboxInfo) error {
+	defer close(ch)
+	cmd := &commands.List{Reference: "", Mailbox: "*"}
+	status, err := c.Execute(cmd, &UTF8ListResponse{Mailboxes: ch})
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// helper function to decode folder name given in modified UTF-7, the names
+// which are not valid modified UTF-7, e.g. UTF-8 ones, are returned as is
+func decodeFolderName(name string) string {
+	if !strings.Contains(name, "&") {
+		return name
+	}
+	decoded, err := utf7.Encoding.NewDecoder().String(name)
+	if err != nil {
+		return name
+	}
+	return decoded
+}
+
+// helper function to check if given folder names refer to the same folder,
+// the names are compared case-insensitively after modified UTF-7 decoding
+func sameFolder(a, b string) bool {
+	return strings.EqualFold(decodeFolderName(a), decodeFolderName(b))
+}
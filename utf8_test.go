@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+
+	imap "github.com/emersion/go-imap"
+)
+
+func TestEnableUTF8(t *testing.T) {
+	tests := []struct {
+		advertise bool
+		enabled   bool
+	}{
+		{false, false},
+		{true, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("advertise %v", tt.advertise), func(t *testing.T) {
+			setupTest(t)
+			ts := startTestServer(t)
+			ext := ts.Enable
+			if tt.advertise {
+				ext.AdvertiseUTF8()
+			}
+			c, err := dial(ts.Server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect := ""
+			if tt.advertise {
+				expect = "UTF8=ACCEPT"
+			}
+			if got := strings.Join(ext.Get(), " "); got != expect {
+				t.Errorf("advertise %v: client enabled %q, expected %q", tt.advertise, got, expect)
+			}
+			if got := utf8Enabled(testServerName); got != tt.enabled {
+				t.Errorf("advertise %v: utf8Enabled=%v, expected %v", tt.advertise, got, tt.enabled)
+			}
+			c.Logout()
+		})
+	}
+}
+
+func TestUTF8ListResponse(t *testing.T) {
+	tests := []struct {
+		line   string
+		expect string
+		fail   bool
+	}{
+		{"* LIST (\\HasNoChildren) \"/\" \"Entwürfe\"\r\n", "Entwürfe", false},
+		{"* LIST () \".\" \"Работа.Отчёты\"\r\n", "Работа.Отчёты", false},
+		{"* LIST (\\Noselect) \"/\" inbox\r\n", "INBOX", false},
+		{"* LIST \"/\" \"a\"\r\n", "", true},
+		{"* LIST x \"/\" \"a\"\r\n", "", true},
+	}
+	for _, tt := range tests {
+		r := imap.NewReader(bufio.NewReader(strings.NewReader(tt.line)))
+		resp, err := imap.ReadResp(r)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.line, err)
+		}
+		ch := make(chan *imap.MailboxInfo, 1)
+		err = (&UTF8ListResponse{Mailboxes: ch}).Handle(resp)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%q: invalid list response is accepted", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if info := <-ch; info.Name != tt.expect {
+			t.Errorf("%q: mailbox %q, expected %q", tt.line, info.Name, tt.expect)
+		}
+	}
+}
+
+func TestSameFolder(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		expect bool
+	}{
+		{"INBOX", "inbox", true},
+		{"Entw&APw-rfe", "Entwürfe", true},
+		{"entw&APw-rfe", "ENTWÜRFE", true},
+		{"Entw&APw-rfe", "Entwurfe", false},
+		// invalid modified UTF-7 is compared as is
+		{"A&B", "a&b", true},
+	}
+	for _, tt := range tests {
+		if got := sameFolder(tt.a, tt.b); got != tt.expect {
+			t.Errorf("sameFolder(%q, %q)=%v, expected %v", tt.a, tt.b, got, tt.expect)
+		}
+	}
+}
+
+func TestDecodeFolderName(t *testing.T) {
+	tests := []struct {
+		name, expect string
+	}{
+		{"INBOX", "INBOX"},
+		{"[Gmail]/All Mail", "[Gmail]/All Mail"},
+		{"Entw&APw-rfe", "Entwürfe"},
+		{"&BB4EQgQ,BEAEMAQyBDsENQQ9BD0ESwQ1-", "Отправленные"},
+		{"Tom &- Jerry", "Tom & Jerry"},
+		// names which are not modified UTF-7 are kept as is
+		{"Entwürfe", "Entwürfe"},
+		{"A&B", "A&B"},
+	}
+	for _, tt := range tests {
+		if got := decodeFolderName(tt.name); got != tt.expect {
+			t.Errorf("decodeFolderName(%q)=%q, expected %q", tt.name, got, tt.expect)
+		}
+	}
+}
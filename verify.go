@@ -0,0 +1,159 @@
+package main
+
+// Copyright (c) 2020 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+// verify module for goimapsync, it verifies integrity of local mail files
+// using checksums recorded in DB and optionally repairs corrupted ones
+//
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// helper function to compute checksum of given file
+func fileChecksum(fname string) (string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// helper function to find renamed mail file with given hash id in cur and
+// new areas next to given path, e.g. when another tool changed its flags
+func findRenamed(path, hid string) string {
+	dir := filepath.Dir(filepath.Dir(path))
+	for _, d := range []string{"cur", "new"} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, d))
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if arr := strings.Split(f.Name(), "."); len(arr) > 1 && arr[1] == hid {
+				return filepath.Join(dir, d, f.Name())
+			}
+		}
+	}
+	return ""
+}
+
+// helper function to re-fetch corrupted message from its IMAP server
+func repairMessage(cmap map[string]*client.Client, f MessageFile) error {
+	c, ok := cmap[f.Imap]
+	if !ok {
+		return fmt.Errorf("no connection to '%s'", f.Imap)
+	}
+	var buf bytes.Buffer
+	found, err := catImap(currentClient(f.Imap, c), f.Imap, f.MessageId, &buf)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("message is not found on '%s'", f.Imap)
+	}
+	if err := ioutil.WriteFile(f.Path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return updateMessageChecksum(f.HashId, hex.EncodeToString(sum[:]), info.Size(), info.ModTime().Unix())
+}
+
+// VerifyLocal verifies checksums of local mail files recorded in DB, the
+// files with unchanged size and modification time are skipped unless full
+// is set. With repair option corrupted messages are re-fetched from IMAP
+// server(s) given by cmap.
+func VerifyLocal(cmap map[string]*client.Client, full, repair bool) error {
+	defer timing("VerifyLocal", time.Now())
+	defer profiler("VerifyLocal")()
+	files, err := getMessageFiles()
+	if err != nil {
+		return err
+	}
+	var verified, skipped, recorded, renamed, repaired int
+	var corrupted, missing []MessageFile
+	for _, f := range files {
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			// the file may be renamed by another tool, e.g. flags change
+			fname := findRenamed(f.Path, f.HashId)
+			if fname == "" {
+				log.Printf("missing: %s\n", f.Path)
+				missing = append(missing, f)
+				continue
+			}
+			sum, err := fileChecksum(fname)
+			if err != nil {
+				return err
+			}
+			if f.Sha256 != "" && sum != f.Sha256 {
+				log.Printf("corrupted: %s\n", fname)
+				f.Path = fname
+				corrupted = append(corrupted, f)
+				continue
+			}
+			log.Printf("modified by another tool (flags rename only): %s -> %s\n", f.Path, fname)
+			renamed += 1
+			updateMessagePath(f.HashId, fname)
+			if finfo, err := os.Stat(fname); err == nil {
+				updateMessageChecksum(f.HashId, sum, finfo.Size(), finfo.ModTime().Unix())
+			}
+			continue
+		}
+		if !full && f.Sha256 != "" && info.Size() == f.Size && info.ModTime().Unix() == f.MTime {
+			skipped += 1
+			continue
+		}
+		sum, err := fileChecksum(f.Path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case f.Sha256 == "":
+			// file was written before checksums were introduced
+			recorded += 1
+		case sum != f.Sha256:
+			log.Printf("corrupted: %s\n", f.Path)
+			corrupted = append(corrupted, f)
+			continue
+		default:
+			verified += 1
+		}
+		updateMessageChecksum(f.HashId, sum, info.Size(), info.ModTime().Unix())
+	}
+	if repair {
+		for _, f := range corrupted {
+			if err := repairMessage(cmap, f); err != nil {
+				log.Printf("unable to repair %s, error: %v\n", f.Path, err)
+				continue
+			}
+			log.Printf("repaired: %s\n", f.Path)
+			repaired += 1
+		}
+	}
+	log.Printf("### verify-local: %d verified, %d skipped (unchanged), %d recorded (no checksum)\n", verified, skipped, recorded)
+	log.Printf("### verify-local: %d corrupted (%d repaired), %d missing, %d modified by another tool (flags rename only)\n", len(corrupted), repaired, len(missing), renamed)
+	if len(corrupted) > repaired || len(missing) > 0 {
+		return fmt.Errorf("%d corrupted and %d missing file(s)", len(corrupted)-repaired, len(missing))
+	}
+	return nil
+}